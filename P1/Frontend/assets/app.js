@@ -70,7 +70,7 @@
       const data = await r.json();
       const rows = data.resultados || [];
 
-      renderResultados(rows);
+      renderResultados(rows, data.consultaId);
       saveHistory({ input: payload, output: rows });
     } catch (err) {
       resultEl.innerHTML = error(err.message || String(err));
@@ -83,7 +83,7 @@
   }
 
   // === Render de resultados (tabla + gráfico) ===
-  function renderResultados(rows) {
+  function renderResultados(rows, consultaId) {
     if (!rows.length) {
       resultEl.innerHTML =
         `<p class="muted">Sin coincidencias con las reglas actuales.</p>`;
@@ -120,6 +120,19 @@
     }
     html += `</tbody></table>`;
 
+    // Descripción y consejos de autocuidado
+    for (const r of rows) {
+      const consejos = Array.isArray(r.consejos) ? r.consejos : [];
+      if (!r.descripcion && !consejos.length) continue;
+      const meta = [r.tipo, r.sistema].filter(Boolean).map(esc).join(" · ");
+      html += `
+        <div style="margin-top:10px;padding:8px 10px;border:1px solid #e5e7eb;border-radius:10px">
+          <strong>${esc(r.enfermedad)}</strong>${meta ? ` <span class="muted">(${meta})</span>` : ""}
+          ${r.descripcion ? `<p style="margin:6px 0">${esc(r.descripcion)}</p>` : ""}
+          ${consejos.length ? `<ul style="margin:6px 0 0 18px">${consejos.map(c => `<li>${esc(c)}</li>`).join("")}</ul>` : ""}
+        </div>`;
+    }
+
     // Gráfico de barras (SVG)
     html += `<div style="margin-top:14px">${renderAffinityChart(rows)}</div>`;
 
@@ -129,6 +142,7 @@
       <div id="report-meta" style="margin-top:14px;font-size:12px;color:#6b7280">
         <div><strong>Fecha:</strong> ${esc(meta.fecha)}</div>
         <div><strong>Fuente:</strong> MediLogic (herramienta de apoyo diagnóstico)</div>
+        ${consultaId ? `<div><strong>Consulta:</strong> ${esc(consultaId)}</div>` : ""}
         <div><strong>Nota:</strong> No sustituye consulta médica profesional.</div>
       </div>
       </section>
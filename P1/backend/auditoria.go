@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Auditoría de acciones administrativas ========
+//
+// Cada petición a un endpoint protegido por auth (y cada intento de login)
+// deja una entrada en storage/auditoria.jsonl: quién, qué ruta, sobre qué KB,
+// la versión de la KB antes y después, la IP, la fecha y el resultado. El
+// archivo sólo crece. Cada entrada guarda el hash de la anterior y el suyo
+// propio (HMAC-SHA256 de "<anterior>\n<entrada sin hash>"), así que borrar,
+// reordenar o editar una línea rompe la cadena desde ese punto. La clave del
+// HMAC es AUDIT_KEY o, sin ella, se deriva de AUTH_SECRET: no debe estar en
+// storage/ junto al registro, o quien pueda reescribirlo podría recalcular
+// toda la cadena. Del endpoint se guarda sólo la ruta, sin la query.
+//
+//   GET /admin/audit?desde=&hasta=&actor=&accion=&kb=&resultado=ok|denegado|rechazado|error&ip=&limite=500&formato=json|csv
+//   GET /admin/audit/verify   recorre la cadena y dice dónde se rompe
+//
+// Ambos son sólo para superadmin. Con limite se devuelven las últimas N
+// entradas que cumplen el filtro, en orden de escritura.
+
+var (
+	auditoriaPath = filepath.Join("storage", "auditoria.jsonl")
+	auditClave    []byte
+)
+
+const (
+	auditOK        = "ok"
+	auditDenegado  = "denegado"  // 401/403
+	auditRechazado = "rechazado" // otros 4xx
+	auditError     = "error"     // 5xx
+)
+
+type AuditEntrada struct {
+	Seq            int       `json:"seq"`
+	Fecha          time.Time `json:"fecha"`
+	Actor          string    `json:"actor"` // vacío: sin sesión válida
+	Rol            string    `json:"rol,omitempty"`
+	Accion         string    `json:"accion"` // método y patrón de la ruta
+	Endpoint       string    `json:"endpoint"`
+	KB             string    `json:"kb,omitempty"`
+	Borrador       string    `json:"borrador,omitempty"`
+	VersionAntes   string    `json:"versionAntes,omitempty"`
+	VersionDespues string    `json:"versionDespues,omitempty"`
+	IP             string    `json:"ip"`
+	Resultado      string    `json:"resultado"`
+	Estado         int       `json:"estado"`
+	Anterior       string    `json:"anterior"` // hash de la entrada anterior
+	Hash           string    `json:"hash"`
+}
+
+var (
+	auditMu     sync.Mutex
+	auditUltimo struct {
+		seq  int
+		hash string
+	}
+)
+
+// initAuditoria retoma la cadena donde quedó y avisa si está rota. Va
+// después de initCuentas, que carga la clave de firma de las sesiones.
+func initAuditoria() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	clave := os.Getenv("AUDIT_KEY")
+	if clave == "" {
+		if os.Getenv("AUTH_SECRET") == "" {
+			logp("Atención: sin AUDIT_KEY ni AUTH_SECRET la clave de la auditoría sale de %s, junto al registro; defina AUDIT_KEY", secretoPath)
+		}
+		clave = string(secretoFirma)
+	}
+	k := sha256.Sum256([]byte("auditoria:" + clave))
+	auditClave = k[:]
+
+	v, err := verificarAuditoria()
+	if err != nil {
+		logp("auditoría: %v", err)
+		return
+	}
+	if !v.OK && v.Rota == 1 && auditoriaSinClave() {
+		// registro de antes del HMAC: se archiva y se empieza otra cadena
+		viejo := auditoriaPath + "." + time.Now().UTC().Format("20060102T150405") + ".sha256"
+		if err := os.Rename(auditoriaPath, viejo); err != nil {
+			logp("auditoría: no se pudo archivar el registro sin clave: %v", err)
+			return
+		}
+		logp("auditoría: el registro anterior (hash sin clave) se archivó en %s", viejo)
+		v, _ = verificarAuditoria()
+	}
+	if !v.OK {
+		logp("Atención: la cadena de auditoría está rota en la entrada %d: %s", v.Rota, v.Motivo)
+	}
+}
+
+func hashAuditoria(e AuditEntrada) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	m := hmac.New(sha256.New, auditClave)
+	m.Write([]byte(e.Anterior + "\n"))
+	m.Write(b)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// auditoriaSinClave dice si el archivo entero es una cadena válida con el
+// SHA-256 sin clave de las versiones anteriores. Con auditMu tomado.
+func auditoriaSinClave() bool {
+	ok, n, anterior := true, 0, ""
+	err := leerAuditoria(func(e AuditEntrada, err error) {
+		n++
+		if err != nil || e.Anterior != anterior {
+			ok = false
+			return
+		}
+		h := e.Hash
+		e.Hash = ""
+		b, _ := json.Marshal(e)
+		s := sha256.Sum256(append([]byte(e.Anterior+"\n"), b...))
+		ok = ok && hex.EncodeToString(s[:]) == h
+		anterior = h
+	})
+	return err == nil && ok && n > 0
+}
+
+// registrarAuditoria encadena la entrada con la última y la añade al archivo.
+func registrarAuditoria(e AuditEntrada) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	e.Seq = auditUltimo.seq + 1
+	e.Anterior = auditUltimo.hash
+	e.Hash = hashAuditoria(e)
+	b, _ := json.Marshal(e)
+	f, err := os.OpenFile(auditoriaPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.Write(append(b, '\n'))
+		f.Close()
+	}
+	if err != nil {
+		logp("auditoría: no se pudo registrar %s %s: %v", e.Actor, e.Accion, err)
+		return
+	}
+	auditUltimo.seq, auditUltimo.hash = e.Seq, e.Hash
+}
+
+// leerAuditoria recorre las entradas en orden de escritura. Debe llamarse
+// con auditMu tomado.
+func leerAuditoria(fn func(AuditEntrada, error)) error {
+	f, err := os.Open(auditoriaPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var e AuditEntrada
+		fn(e, json.Unmarshal(sc.Bytes(), &e))
+	}
+	return sc.Err()
+}
+
+type auditVerificacion struct {
+	OK       bool   `json:"ok"`
+	Entradas int    `json:"entradas"`
+	Rota     int    `json:"rota,omitempty"` // nº de línea (desde 1) donde falla
+	Motivo   string `json:"motivo,omitempty"`
+}
+
+// verificarAuditoria comprueba la cadena y deja auditUltimo en la última
+// entrada legible. Debe llamarse con auditMu tomado.
+func verificarAuditoria() (auditVerificacion, error) {
+	v := auditVerificacion{OK: true}
+	auditUltimo.seq, auditUltimo.hash = 0, ""
+	err := leerAuditoria(func(e AuditEntrada, err error) {
+		v.Entradas++
+		fallo := ""
+		switch {
+		case err != nil:
+			fallo = "línea ilegible"
+		case e.Anterior != auditUltimo.hash:
+			fallo = "no enlaza con la entrada anterior"
+		case e.Seq != auditUltimo.seq+1:
+			fallo = "número de secuencia inesperado"
+		case hashAuditoria(e) != e.Hash:
+			fallo = "el contenido no coincide con su hash"
+		}
+		if fallo != "" && v.OK {
+			v.OK, v.Rota, v.Motivo = false, v.Entradas, fallo
+		}
+		if err == nil {
+			auditUltimo.seq, auditUltimo.hash = e.Seq, e.Hash
+		}
+	})
+	return v, err
+}
+
+//
+// ======== Middleware ========
+//
+
+type claveAudit struct{}
+
+// respuestaAuditada recuerda el código de estado de la respuesta.
+type respuestaAuditada struct {
+	http.ResponseWriter
+	estado int
+}
+
+func (w *respuestaAuditada) WriteHeader(c int) {
+	if w.estado == 0 {
+		w.estado = c
+	}
+	w.ResponseWriter.WriteHeader(c)
+}
+
+func (w *respuestaAuditada) Write(b []byte) (int, error) {
+	if w.estado == 0 {
+		w.estado = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditado registra la petición al terminar. Con conKB anota la versión de
+// la KB (o del borrador) antes y después. El actor lo pone autenticar.
+func auditado(conKB bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := &AuditEntrada{
+			Fecha:    time.Now().UTC(),
+			Accion:   accionDe(r),
+			Endpoint: r.URL.Path, // sin la query: puede llevar datos de pacientes
+			IP:       ipDe(r),
+		}
+		if conKB {
+			e.KB, e.Borrador = nombreKB(r), r.Header.Get(cabeceraBorrador)
+			e.VersionAntes = versionActual(e.KB, e.Borrador)
+		}
+		rw := &respuestaAuditada{ResponseWriter: w}
+		h(rw, r.WithContext(context.WithValue(r.Context(), claveAudit{}, e)))
+		if conKB {
+			e.VersionDespues = versionActual(e.KB, e.Borrador)
+		}
+		e.Estado = rw.estado
+		if e.Estado == 0 {
+			e.Estado = http.StatusOK
+		}
+		e.Resultado = resultadoDe(e.Estado)
+		registrarAuditoria(*e)
+	}
+}
+
+// anotarActor pone quién hace la petición en su entrada de auditoría.
+func anotarActor(r *http.Request, actor, rl string) {
+	if e, ok := r.Context().Value(claveAudit{}).(*AuditEntrada); ok {
+		e.Actor, e.Rol = actor, rl
+	}
+}
+
+// accionDe es el método y el patrón de la ruta, igual con o sin /kb/{kb}.
+func accionDe(r *http.Request) string {
+	p := r.Pattern
+	if p == "" {
+		p = r.URL.Path
+	}
+	return r.Method + " " + strings.TrimPrefix(p, "/kb/{kb}")
+}
+
+func ipDe(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
+
+func resultadoDe(estado int) string {
+	switch {
+	case estado == http.StatusUnauthorized || estado == http.StatusForbidden:
+		return auditDenegado
+	case estado >= 500:
+		return auditError
+	case estado >= 400:
+		return auditRechazado
+	}
+	return auditOK
+}
+
+//
+// ======== Endpoints /admin/audit ========
+//
+
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	desde, err := parseFecha(q.Get("desde"))
+	if err != nil {
+		http.Error(w, "desde: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	hasta, err := parseHasta(q.Get("hasta"))
+	if err != nil {
+		http.Error(w, "hasta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limite := 500
+	if v, err := strconv.Atoi(q.Get("limite")); err == nil && v > 0 {
+		limite = v
+	}
+	actor, accion, kb := q.Get("actor"), q.Get("accion"), q.Get("kb")
+	res, ip := q.Get("resultado"), q.Get("ip")
+
+	var out []AuditEntrada
+	auditMu.Lock()
+	err = leerAuditoria(func(e AuditEntrada, err error) {
+		switch {
+		case err != nil,
+			!desde.IsZero() && e.Fecha.Before(desde),
+			!hasta.IsZero() && !e.Fecha.Before(hasta),
+			actor != "" && e.Actor != actor,
+			accion != "" && !strings.Contains(e.Accion, accion),
+			kb != "" && e.KB != kb,
+			res != "" && e.Resultado != res,
+			ip != "" && e.IP != ip:
+			return
+		}
+		out = append(out, e)
+		if len(out) > limite {
+			out = out[1:]
+		}
+	})
+	auditMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if out == nil {
+		out = []AuditEntrada{}
+	}
+
+	formato := q.Get("formato")
+	if formato == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		formato = "csv"
+	}
+	if formato == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="auditoria.csv"`)
+		writeAuditCSV(w, out)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// celdaCSV antepone ' a un valor que una hoja de cálculo tomaría por fórmula
+// (empieza por = + - @, tabulador o retorno de carro). El usuario de un login
+// fallido, la ruta o el borrador los elige quien hace la petición, aunque no
+// tenga sesión.
+func celdaCSV(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func writeAuditCSV(w http.ResponseWriter, es []AuditEntrada) {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"seq", "fecha", "actor", "rol", "accion", "endpoint", "kb", "borrador", "version_antes", "version_despues", "ip", "resultado", "estado", "anterior", "hash"})
+	for _, e := range es {
+		fila := []string{
+			strconv.Itoa(e.Seq), e.Fecha.Format(time.RFC3339), e.Actor, e.Rol, e.Accion, e.Endpoint,
+			e.KB, e.Borrador, e.VersionAntes, e.VersionDespues, e.IP, e.Resultado,
+			strconv.Itoa(e.Estado), e.Anterior, e.Hash,
+		}
+		for i := range fila {
+			fila[i] = celdaCSV(fila[i])
+		}
+		_ = cw.Write(fila)
+	}
+	cw.Flush()
+}
+
+func handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	auditMu.Lock()
+	v, err := verificarAuditoria()
+	auditMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
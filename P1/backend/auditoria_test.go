@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usarAuditoria empieza una cadena vacía en un directorio temporal.
+func usarAuditoria(t *testing.T) {
+	t.Helper()
+	prevP, prevC, prevU := auditoriaPath, auditClave, auditUltimo
+	t.Cleanup(func() { auditoriaPath, auditClave, auditUltimo = prevP, prevC, prevU })
+	auditoriaPath = filepath.Join(t.TempDir(), "auditoria.jsonl")
+	auditClave = []byte("clave-de-auditoria")
+	auditUltimo.seq, auditUltimo.hash = 0, ""
+}
+
+func entradasAuditoria(t *testing.T) []AuditEntrada {
+	t.Helper()
+	var es []AuditEntrada
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := leerAuditoria(func(e AuditEntrada, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func TestVerificarAuditoriaManipulada(t *testing.T) {
+	usarAuditoria(t)
+	for _, actor := range []string{"root", "pub", "edi", "vic"} {
+		registrarAuditoria(AuditEntrada{Fecha: time.Now().UTC(), Actor: actor, Accion: "GET /admin/kb", Resultado: auditOK, Estado: 200})
+	}
+	b, err := os.ReadFile(auditoriaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineas := strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+	lineas[len(lineas)-1] += "\n"
+
+	verificar := func() auditVerificacion {
+		auditMu.Lock()
+		defer auditMu.Unlock()
+		v, err := verificarAuditoria()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := verificar(); !v.OK || v.Entradas != 4 {
+		t.Fatalf("cadena intacta: %+v", v)
+	}
+
+	// quien no tiene la clave no puede recalcular el hash de una línea editada
+	otraClave := func() string {
+		prev := auditClave
+		defer func() { auditClave = prev }()
+		auditClave = []byte("otra")
+		e := entradasAuditoria(t)[1]
+		e.Actor = "intruso"
+		e.Hash = hashAuditoria(e)
+		b, _ := json.Marshal(e)
+		return string(b) + "\n"
+	}()
+	casos := []struct {
+		nombre string
+		lineas []string
+		rota   int
+		motivo string
+	}{
+		{"editada", []string{lineas[0], strings.Replace(lineas[1], `"actor":"pub"`, `"actor":"otro"`, 1), lineas[2], lineas[3]}, 2, "hash"},
+		{"borrada", []string{lineas[0], lineas[2], lineas[3]}, 2, "no enlaza"},
+		{"reordenada", []string{lineas[0], lineas[2], lineas[1], lineas[3]}, 2, "no enlaza"},
+		{"primera borrada", []string{lineas[1], lineas[2], lineas[3]}, 1, "no enlaza"},
+		{"ilegible", []string{lineas[0], "{no es json\n", lineas[2], lineas[3]}, 2, "ilegible"},
+		{"firmada con otra clave", []string{lineas[0], otraClave, lineas[2], lineas[3]}, 2, "hash"},
+	}
+	for _, c := range casos {
+		if err := os.WriteFile(auditoriaPath, []byte(strings.Join(c.lineas, "")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		v := verificar()
+		if v.OK || v.Rota != c.rota || !strings.Contains(v.Motivo, c.motivo) {
+			t.Errorf("%s: %+v, se esperaba rota en %d (%s)", c.nombre, v, c.rota, c.motivo)
+		}
+	}
+}
+
+func TestAuditoriaUnaEntradaPorPeticion(t *testing.T) {
+	b := usarBases(t)
+	usarCuentas(t)
+	usarAuditoria(t)
+	antes := b.version
+
+	peticiones := []struct {
+		method, ruta, token, cuerpo string
+		actor, resultado            string
+		estado                      int
+	}{
+		{http.MethodGet, "/admin/kb?paciente=ana", tokenDe("vic"), "", "vic", auditOK, http.StatusOK},
+		{http.MethodPost, "/admin/symptoms", tokenDe("vic"), `{"name":"nausea"}`, "vic", auditDenegado, http.StatusForbidden},
+		{http.MethodPost, "/admin/symptoms", "", `{"name":"nausea"}`, "", auditDenegado, http.StatusUnauthorized},
+		{http.MethodPost, "/admin/symptoms", tokenDe("pub"), `{"name":"nausea"}`, "pub", auditOK, http.StatusCreated},
+		{http.MethodPost, "/admin/symptoms", tokenDe("pub"), `{"name":"nausea"}`, "pub", auditRechazado, http.StatusConflict},
+		{http.MethodGet, "/admin/users", tokenDe("root"), "", "root", auditOK, http.StatusOK},
+	}
+	for _, p := range peticiones {
+		if w := pedir(p.method, p.ruta, p.token, p.cuerpo, "If-Match", "*"); w.Code != p.estado {
+			t.Fatalf("%s %s: %d %s", p.method, p.ruta, w.Code, w.Body)
+		}
+	}
+	// las rutas sin auth no dejan entrada
+	pedir(http.MethodPost, "/analyze", "", `{"sintomas":[{"nombre":"fiebre","severidad":"leve"}]}`)
+	pedir(http.MethodGet, "/health", "", "")
+
+	es := entradasAuditoria(t)
+	if len(es) != len(peticiones) {
+		t.Fatalf("%d entradas para %d peticiones: %+v", len(es), len(peticiones), es)
+	}
+	for i, p := range peticiones {
+		e := es[i]
+		if e.Seq != i+1 || e.Actor != p.actor || e.Resultado != p.resultado || e.Estado != p.estado || strings.Contains(e.Endpoint, "?") {
+			t.Errorf("entrada %d: %+v", i+1, e)
+		}
+	}
+	if e := es[3]; e.KB != kbGeneral || e.VersionAntes != antes || e.VersionDespues != b.version || e.Accion != "POST /admin/symptoms" {
+		t.Errorf("entrada de la escritura: %+v", e)
+	}
+	if e := es[1]; e.VersionAntes != e.VersionDespues {
+		t.Errorf("la petición denegada cambió la versión: %+v", e)
+	}
+	if e := es[5]; e.KB != "" {
+		t.Errorf("/admin/users no es de una KB: %+v", e)
+	}
+
+	auditMu.Lock()
+	v, err := verificarAuditoria()
+	auditMu.Unlock()
+	if err != nil || !v.OK || v.Entradas != len(peticiones) {
+		t.Errorf("verificación: %+v, %v", v, err)
+	}
+}
+
+func TestAuditCSVSinFormulas(t *testing.T) {
+	es := []AuditEntrada{{
+		Seq:      1,
+		Actor:    `=HYPERLINK("http://x","y")`,
+		Accion:   "POST /auth/login",
+		Endpoint: "+cmd|' /C calc'!A0",
+		KB:       "-2+3",
+		Borrador: "@SUM(A1)",
+		IP:       "\t=1",
+		Rol:      "\r=1",
+		Estado:   401,
+	}}
+	w := httptest.NewRecorder()
+	writeAuditCSV(w, es)
+	filas, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filas) != 2 {
+		t.Fatalf("filas: %q", filas)
+	}
+	for i, celda := range filas[1] {
+		if celda != "" && strings.ContainsRune("=+-@\t\r", rune(celda[0])) {
+			t.Errorf("columna %s empieza por %q: %q", filas[0][i], celda[0], celda)
+		}
+	}
+	if filas[1][2] != `'=HYPERLINK("http://x","y")` || filas[1][4] != "POST /auth/login" {
+		t.Errorf("fila: %q", filas[1])
+	}
+}
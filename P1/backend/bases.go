@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	prolog "github.com/ichiban/prolog"
+)
+
+//
+// ======== Varias bases de conocimiento ========
+//
+// El servidor puede tener varias KB con nombre (p. ej. "general" y
+// "pediatria"), cada una con su .pl, su intérprete, su KB estructurada y sus
+// borradores. La KB de una petición se elige por la ruta /kb/{kb}/... o por
+// la cabecera X-KB; sin ninguna de las dos es "general", así que los clientes
+// de antes siguen funcionando igual:
+//
+//   POST /kb/pediatria/analyze              = POST /analyze con X-KB: pediatria
+//   GET  /kb/pediatria/admin/kb             = GET /admin/kb con X-KB: pediatria
+//
+// Todos los endpoints admin salvo /admin/kbs y /admin/outbox trabajan sobre
+// la KB elegida, y el historial, la vigilancia, el feedback, los informes
+// RPA, los trabajos RPA y los webhooks guardan a qué KB pertenecen y sólo se
+// listan desde ella.
+//
+// Además de las cuentas (cuentas.go), cada KB puede tener tokens de API
+// propios que sólo valen para ella, con un rol fijo (editor si no se indica;
+// nunca superadmin). Se envían como "Authorization: Bearer kb_..." y se
+// guarda su SHA-256; el token en claro se devuelve una sola vez al crearlo.
+//
+//   GET    /admin/kbs                           lista
+//   POST   /admin/kbs                           {nombre, descripcion, desde} crea (vacía o copia de desde)
+//   DELETE /admin/kbs/{nombre}                  elimina la KB y sus archivos (no "general")
+//   POST   /admin/kbs/{nombre}/tokens           {etiqueta, rol} -> {id, token}
+//   DELETE /admin/kbs/{nombre}/tokens/{id}
+//
+// Estos son sólo para superadmin. El registro está en storage/kbs.json; la
+// KB general usa prolog/medi_logic.pl, storage/kb.json y
+// storage/borradores.json como antes, y las demás prolog/<nombre>.pl y
+// storage/kbs/<nombre>/.
+
+const (
+	kbGeneral      = "general"
+	cabeceraKB     = "X-KB"
+	prefijoTokenKB = "kb_"
+)
+
+var (
+	kbsPath = filepath.Join("storage", "kbs.json")
+	bases   = map[string]*baseKB{} // protegido por mu
+)
+
+// TokenKB es un token de API limitado a una KB.
+type TokenKB struct {
+	ID       string    `json:"id"`
+	Etiqueta string    `json:"etiqueta,omitempty"`
+	Rol      string    `json:"rol,omitempty"`  // vacío: editor
+	Hash     string    `json:"hash,omitempty"` // SHA-256 del token; no se lista
+	Creado   time.Time `json:"creado"`
+}
+
+// KBInfo es la entrada del registro de KB.
+type KBInfo struct {
+	Nombre      string    `json:"nombre"`
+	Descripcion string    `json:"descripcion,omitempty"`
+	Creada      time.Time `json:"creada"`
+	Tokens      []TokenKB `json:"tokens,omitempty"`
+}
+
+// baseKB es una KB cargada. Todos los campos se protegen con mu.
+type baseKB struct {
+	KBInfo
+	plPath         string
+	kbPath         string // KB estructurada en JSON
+	borradoresPath string
+
+	kb         Knowledge
+	vm         *prolog.Interpreter
+	version    string // hash corto del .pl cargado en vm
+	borradores map[string]*Borrador
+}
+
+func nuevaBase(info KBInfo) *baseKB {
+	b := &baseKB{KBInfo: info, borradores: map[string]*Borrador{}}
+	if info.Nombre == kbGeneral {
+		b.plPath = plPath
+		b.kbPath = filepath.Join("storage", "kb.json")
+		b.borradoresPath = filepath.Join("storage", "borradores.json")
+	} else {
+		dir := filepath.Join("storage", "kbs", info.Nombre)
+		b.plPath = filepath.Join("prolog", info.Nombre+".pl")
+		b.kbPath = filepath.Join(dir, "kb.json")
+		b.borradoresPath = filepath.Join(dir, "borradores.json")
+	}
+	return b
+}
+
+// initBases carga el registro y cada KB. Si no hay registro se crea con la
+// KB general; sin storage/kb.json la general arranca con la KB por defecto.
+func initBases() {
+	var infos []KBInfo
+	if b, err := os.ReadFile(kbsPath); err == nil {
+		if err := json.Unmarshal(b, &infos); err != nil {
+			log.Fatalf("kbs.json inválido: %v", err)
+		}
+	}
+	hayGeneral := false
+	for _, in := range infos {
+		hayGeneral = hayGeneral || in.Nombre == kbGeneral
+	}
+	if !hayGeneral {
+		infos = append([]KBInfo{{Nombre: kbGeneral, Descripcion: "KB por defecto", Creada: time.Now().UTC()}}, infos...)
+	}
+	for _, in := range infos {
+		b := nuevaBase(in)
+		if err := b.cargar(); err != nil {
+			if in.Nombre == kbGeneral {
+				log.Fatalf("Error cargando Prolog: %v", err)
+			}
+			logp("KB %s no cargada: %v", in.Nombre, err)
+			continue
+		}
+		bases[in.Nombre] = b
+	}
+	if err := guardarRegistroKB(); err != nil {
+		log.Fatalf("No se pudo escribir %s: %v", kbsPath, err)
+	}
+	logp("%d KB cargadas: %s", len(bases), strings.Join(sortedKeys(bases), ", "))
+}
+
+// cargar lee la KB estructurada y el .pl y compila. Si el .pl guardado no
+// compila se regenera desde la KB estructurada.
+func (b *baseKB) cargar() error {
+	code := ""
+	data, err := os.ReadFile(b.kbPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &b.kb); err != nil {
+			return err
+		}
+		// el .pl puede no salir de la KB si se subió con /admin/upload-pl
+		if pl, err := os.ReadFile(b.plPath); err == nil {
+			code = string(pl)
+		}
+	case os.IsNotExist(err) && b.Nombre == kbGeneral:
+		b.kb = defaultKB()
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+	if code == "" {
+		code = buildPL(b.kb)
+	}
+	v, err := newVM(code)
+	if err != nil {
+		logp("KB %s: el .pl guardado no compila (%v); se regenera", b.Nombre, err)
+		code = buildPL(b.kb)
+		if v, err = newVM(code); err != nil {
+			return err
+		}
+	}
+	b.vm, b.version = v, versionOf(code)
+	if err := b.guardar(code); err != nil {
+		return err
+	}
+	b.cargarBorradores()
+	return nil
+}
+
+// guardar escribe el .pl y la KB estructurada (con mu tomado).
+func (b *baseKB) guardar(code string) error {
+	if err := os.MkdirAll(filepath.Dir(b.kbPath), 0755); err != nil {
+		return err
+	}
+	if err := b.guardarPL(code); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(b.kb, "", "  ")
+	tmp := b.kbPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.kbPath)
+}
+
+// guardarPL reemplaza el .pl de una vez, para que un corte a medias no deje
+// un archivo truncado que no arranque.
+func (b *baseKB) guardarPL(code string) error {
+	tmp := b.plPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(code), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.plPath)
+}
+
+// guardarRegistroKB escribe storage/kbs.json (con mu tomado o al arrancar).
+func guardarRegistroKB() error {
+	infos := make([]KBInfo, 0, len(bases))
+	for _, n := range sortedKeys(bases) {
+		infos = append(infos, bases[n].KBInfo)
+	}
+	data, _ := json.MarshalIndent(infos, "", "  ")
+	tmp := kbsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kbsPath)
+}
+
+// nombreKB es la KB que pide la petición: ruta /kb/{kb}/..., cabecera X-KB o
+// la general.
+func nombreKB(r *http.Request) string {
+	if n := r.PathValue("kb"); n != "" {
+		return n
+	}
+	if n := strings.TrimSpace(r.Header.Get(cabeceraKB)); n != "" {
+		return n
+	}
+	return kbGeneral
+}
+
+// buscarBase devuelve la KB con ese nombre (con mu tomado).
+func buscarBase(nombre string) (*baseKB, error) {
+	b, ok := bases[nombre]
+	if !ok {
+		return nil, errKBNoExiste(nombre)
+	}
+	return b, nil
+}
+
+func errKBNoExiste(nombre string) error {
+	return kbErr(http.StatusNotFound, "KB %s no encontrada", nombre)
+}
+
+// mismaKB compara el campo KB de un registro con una KB; los registros
+// anteriores a tener varias KB (campo vacío) son de la general.
+func mismaKB(registro, nombre string) bool {
+	if registro == "" {
+		registro = kbGeneral
+	}
+	return registro == nombre
+}
+
+// versionActual es la versión de la KB o de su borrador ("" si no existe).
+func versionActual(nombre, borrador string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	b, ok := bases[nombre]
+	switch {
+	case !ok:
+		return ""
+	case borrador == "":
+		return b.version
+	case b.borradores[borrador] != nil:
+		return b.borradores[borrador].Version
+	}
+	return ""
+}
+
+// rutaKB registra el patrón tal cual (KB por cabecera o la general) y bajo
+// /kb/{kb}.
+func rutaKB(patron string, h http.HandlerFunc) {
+	http.HandleFunc(patron, h)
+	http.HandleFunc("/kb/{kb}"+patron, h)
+}
+
+//
+// ======== Tokens por KB ========
+//
+
+func hashToken(tk string) string {
+	h := sha256.Sum256([]byte(tk))
+	return hex.EncodeToString(h[:])
+}
+
+// sesionTokenKB busca un token por KB entre todas las KB.
+func sesionTokenKB(tk string) (*sesion, error) {
+	h := hashToken(tk)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, b := range bases {
+		for _, t := range b.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(h)) != 1 {
+				continue
+			}
+			rl, err := parseRol(t.Rol)
+			if err != nil {
+				rl = rolEditor
+			}
+			quien := t.Etiqueta
+			if quien == "" {
+				quien = t.ID
+			}
+			return &sesion{Usuario: "token:" + quien, Rol: rl, KBs: []string{b.Nombre}}, nil
+		}
+	}
+	return nil, errTokenInvalido
+}
+
+func nuevoToken() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return prefijoTokenKB + hex.EncodeToString(b)
+}
+
+//
+// ======== Endpoints /admin/kbs ========
+//
+
+// kbResumen es lo que se lista de cada KB (los tokens sin hash).
+type kbResumen struct {
+	Nombre       string    `json:"nombre"`
+	Descripcion  string    `json:"descripcion,omitempty"`
+	Creada       time.Time `json:"creada"`
+	Version      string    `json:"version"`
+	Enfermedades int       `json:"enfermedades"`
+	Borradores   int       `json:"borradores"`
+	Tokens       []TokenKB `json:"tokens"`
+}
+
+func (b *baseKB) resumen() kbResumen {
+	out := kbResumen{
+		Nombre:       b.Nombre,
+		Descripcion:  b.Descripcion,
+		Creada:       b.Creada,
+		Version:      b.version,
+		Enfermedades: len(b.kb.Diseases),
+		Borradores:   len(b.borradores),
+		Tokens:       []TokenKB{},
+	}
+	for _, t := range b.Tokens {
+		t.Hash = ""
+		out.Tokens = append(out.Tokens, t)
+	}
+	return out
+}
+
+func handleKBs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mu.Lock()
+		out := []kbResumen{}
+		for _, n := range sortedKeys(bases) {
+			out = append(out, bases[n].resumen())
+		}
+		mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in struct {
+			Nombre      string `json:"nombre"`
+			Descripcion string `json:"descripcion"`
+			Desde       string `json:"desde"` // KB de la que se copia; vacío crea una KB vacía
+		}
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Nombre = strings.TrimSpace(in.Nombre)
+		if !borradorNomRe.MatchString(in.Nombre) {
+			http.Error(w, "nombre: minúsculas, dígitos, _ o -, hasta 40", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := bases[in.Nombre]; ok {
+			http.Error(w, "ya existe una KB con ese nombre", http.StatusConflict)
+			return
+		}
+		b := nuevaBase(KBInfo{Nombre: in.Nombre, Descripcion: strings.TrimSpace(in.Descripcion), Creada: time.Now().UTC()})
+		code := buildPL(b.kb)
+		if in.Desde != "" {
+			src, err := buscarBase(in.Desde)
+			if err != nil {
+				writeKBError(w, err)
+				return
+			}
+			b.kb = cloneKB(src.kb)
+			// se copia el .pl en vivo, que puede haberse subido a mano
+			if pl, err := os.ReadFile(src.plPath); err == nil {
+				code = string(pl)
+			}
+		}
+		v, err := compilarPL(code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		b.vm, b.version = v, versionOf(code)
+		if err := b.guardar(code); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bases[in.Nombre] = b
+		if err := guardarRegistroKB(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp("KB %s creada por %s", in.Nombre, autorDe(r))
+		w.Header().Set("ETag", etagKB(b.version))
+		writeJSON(w, http.StatusCreated, b.resumen())
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleKBItem elimina una KB con su .pl, su KB estructurada y sus
+// borradores. El historial, los informes y demás registros se conservan.
+func handleKBItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "solo DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	nombre := r.PathValue("nombre")
+	if nombre == kbGeneral {
+		http.Error(w, "la KB general no se puede eliminar", http.StatusConflict)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	b, err := buscarBase(nombre)
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	delete(bases, nombre)
+	if err := guardarRegistroKB(); err != nil {
+		bases[nombre] = b
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = os.Remove(b.plPath)
+	_ = os.RemoveAll(filepath.Dir(b.kbPath))
+	logp("KB %s eliminada por %s", nombre, autorDe(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleKBTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var in struct {
+		Etiqueta string `json:"etiqueta"`
+		Rol      string `json:"rol"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &in) {
+		return
+	}
+	if in.Rol == "" {
+		in.Rol = rolEditor.String()
+	}
+	if rl, err := parseRol(in.Rol); err != nil || rl == rolSuperadmin {
+		http.Error(w, "rol debe ser viewer, editor o publisher", http.StatusBadRequest)
+		return
+	}
+	tk := nuevoToken()
+	t := TokenKB{ID: nuevoID(), Etiqueta: strings.TrimSpace(in.Etiqueta), Rol: in.Rol, Hash: hashToken(tk), Creado: time.Now().UTC()}
+	mu.Lock()
+	defer mu.Unlock()
+	b, err := buscarBase(r.PathValue("nombre"))
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	b.Tokens = append(b.Tokens, t)
+	if err := guardarRegistroKB(); err != nil {
+		b.Tokens = b.Tokens[:len(b.Tokens)-1]
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":       t.ID,
+		"etiqueta": t.Etiqueta,
+		"rol":      t.Rol,
+		"kb":       b.Nombre,
+		"token":    tk, // no se vuelve a mostrar
+	})
+}
+
+func handleKBToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "solo DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	b, err := buscarBase(r.PathValue("nombre"))
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	id := r.PathValue("id")
+	for i, t := range b.Tokens {
+		if t.ID != id {
+			continue
+		}
+		b.Tokens = append(b.Tokens[:i:i], b.Tokens[i+1:]...)
+		if err := guardarRegistroKB(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "token no encontrado", http.StatusNotFound)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// usarBases ejecuta el test en un directorio temporal (storage/ y prolog/
+// vacíos) con sólo la KB general, cargada con la KB por defecto.
+func usarBases(t *testing.T) *baseKB {
+	t.Helper()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	prev := bases
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		mu.Lock()
+		bases = prev
+		mu.Unlock()
+	})
+	os.MkdirAll("storage", 0755)
+	os.MkdirAll("prolog", 0755)
+
+	b := nuevaBase(KBInfo{Nombre: kbGeneral})
+	if err := b.cargar(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	bases = map[string]*baseKB{kbGeneral: b}
+	mu.Unlock()
+	return b
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	prolog "github.com/ichiban/prolog"
+)
+
+//
+// ======== Borradores de la KB ========
+//
+// Un borrador es una copia con nombre de la KB en vivo donde se preparan
+// cambios sin que los vean los pacientes. Con la cabecera X-KB-Borrador:
+// <nombre>, POST /admin/kb, /admin/upload-pl, /admin/rpa/ingest, los recursos
+// /admin/diseases y afines, GET /admin/kb, /admin/export y POST /analyze
+// trabajan sobre el borrador en lugar de la KB en vivo.
+//
+//   GET    /admin/drafts                     lista (sin KB)
+//   POST   /admin/drafts                     {nombre, aprobacion} crea desde la KB en vivo
+//   GET    /admin/drafts/{nombre}            metadatos + KB
+//   DELETE /admin/drafts/{nombre}            descarta
+//   GET    /admin/drafts/{nombre}/diff       cambios respecto de la KB en vivo
+//   POST   /admin/drafts/{nombre}/approve    aprobación de otro administrador
+//   POST   /admin/drafts/{nombre}/publish    lo publica de una vez [?forzar=true]
+//
+// Publicar escribe el .pl del borrador, cambia la VM en vivo bajo el mismo
+// lock que cualquier otra escritura y elimina el borrador. Si la KB en vivo
+// cambió desde que se creó el borrador responde 409 (publicarlo desharía
+// esos cambios) salvo con ?forzar=true. Un borrador creado con aprobacion
+// (o cualquiera si KB_BORRADOR_APROBACION=true) sólo se publica cuando un
+// administrador que no lo editó aprueba su versión actual; editarlo después
+// invalida la aprobación.
+//
+// Cada KB (ver bases.go) tiene sus borradores; los de la general se guardan
+// en storage/borradores.json y los de las demás en storage/kbs/<kb>/.
+
+const cabeceraBorrador = "X-KB-Borrador"
+
+var borradorNomRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+type Aprobacion struct {
+	Autor   string    `json:"autor"`
+	Fecha   time.Time `json:"fecha"`
+	Version string    `json:"version"` // versión del borrador aprobada
+}
+
+// BorradorInfo son los metadatos que se listan.
+type BorradorInfo struct {
+	Nombre             string       `json:"nombre"`
+	Autor              string       `json:"autor"`
+	Creado             time.Time    `json:"creado"`
+	Modificado         time.Time    `json:"modificado"`
+	Editores           []string     `json:"editores"`
+	Base               string       `json:"base"` // versión en vivo de la que parte
+	Version            string       `json:"version"`
+	PLManual           bool         `json:"plManual,omitempty"` // .pl subido tal cual, no generado de la KB
+	RequiereAprobacion bool         `json:"requiereAprobacion"`
+	Aprobaciones       []Aprobacion `json:"aprobaciones,omitempty"`
+
+	// calculados al responder
+	Aprobado       bool `json:"aprobado"`
+	Desactualizado bool `json:"desactualizado"` // la KB en vivo ya no es Base
+}
+
+type Borrador struct {
+	BorradorInfo
+	KB Knowledge `json:"kb"`
+	PL string    `json:"pl"`
+
+	vm *prolog.Interpreter
+}
+
+func errBorradorNoExiste(nombre string) error {
+	return kbErr(http.StatusNotFound, "borrador %s no encontrado", nombre)
+}
+
+// cargarBorradores carga y compila los borradores guardados de la KB. Va
+// después de cargar la KB en vivo.
+func (kb *baseKB) cargarBorradores() {
+	b, err := os.ReadFile(kb.borradoresPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &kb.borradores)
+	}
+	if err != nil {
+		logp("No se pudieron cargar los borradores de %s: %v", kb.Nombre, err)
+		kb.borradores = map[string]*Borrador{}
+		return
+	}
+	for _, br := range kb.borradores {
+		if br.vm, err = compilarPL(br.PL); err != nil {
+			logp("borrador %s/%s no compila: %v", kb.Nombre, br.Nombre, err)
+		}
+	}
+	if len(kb.borradores) > 0 {
+		logp("%d borradores de la KB %s cargados", len(kb.borradores), kb.Nombre)
+	}
+}
+
+// guardarBorradores se llama con mu tomado.
+func (kb *baseKB) guardarBorradores() error {
+	b, _ := json.MarshalIndent(kb.borradores, "", "  ")
+	tmp := kb.borradoresPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kb.borradoresPath)
+}
+
+// borradorDe busca el borrador en la KB (con mu tomado).
+func borradorDe(kbNombre, nombre string) (*baseKB, *Borrador, error) {
+	kb, err := buscarBase(kbNombre)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, ok := kb.borradores[nombre]
+	if !ok {
+		return kb, nil, errBorradorNoExiste(nombre)
+	}
+	return kb, b, nil
+}
+
+// actualizar registra una escritura en el borrador.
+func (b *Borrador) actualizar(autor string, k Knowledge, pl, version string, v *prolog.Interpreter, manual bool) {
+	b.KB, b.PL, b.Version, b.vm, b.PLManual = k, pl, version, v, manual
+	b.Modificado = time.Now().UTC()
+	if !contains(b.Editores, autor) {
+		b.Editores = append(b.Editores, autor)
+	}
+}
+
+// info devuelve los metadatos con los campos calculados; enVivo es la
+// versión actual de su KB (con mu tomado).
+func (b *Borrador) info(enVivo string) BorradorInfo {
+	in := b.BorradorInfo
+	in.Aprobado = b.aprobado()
+	in.Desactualizado = b.Base != enVivo
+	return in
+}
+
+func (b *Borrador) aprobado() bool {
+	for _, a := range b.Aprobaciones {
+		if a.Version == b.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// subirPLBorrador es /admin/upload-pl sobre un borrador: el .pl debe compilar.
+func subirPLBorrador(e escritura, body []byte) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	kb, b, err := borradorDe(e.KB, e.Borrador)
+	if err != nil {
+		return "", err
+	}
+	if e.IfMatch != "" && !coincideETag(e.IfMatch, b.Version) {
+		return "", errVersion(b.Version)
+	}
+	v, err := compilarPL(string(body))
+	if err != nil {
+		return "", kbErr(http.StatusUnprocessableEntity, "el .pl no es válido: %v", err)
+	}
+	version := versionOf(string(body))
+	b.actualizar(e.Autor, b.KB, string(body), version, v, true)
+	return version, kb.guardarBorradores()
+}
+
+// publicarBorrador pasa el borrador a la KB en vivo y lo elimina.
+func publicarBorrador(kbNombre, nombre, autor, ifMatch string, forzar bool) (string, error) {
+	mu.Lock()
+	kb, b, err := borradorDe(kbNombre, nombre)
+	if err != nil {
+		mu.Unlock()
+		return "", err
+	}
+	if ifMatch != "" && !coincideETag(ifMatch, b.Version) {
+		mu.Unlock()
+		return "", errVersion(b.Version)
+	}
+	if b.Base != kb.version && !forzar {
+		mu.Unlock()
+		return "", kbErr(http.StatusConflict, "la KB en vivo cambió desde que se creó el borrador (base %s, en vivo %s); revise el diff o use ?forzar=true", b.Base, kb.version)
+	}
+	if b.RequiereAprobacion && !b.aprobado() {
+		mu.Unlock()
+		return "", kbErr(http.StatusConflict, "el borrador requiere la aprobación de otro administrador para la versión %s", b.Version)
+	}
+	if b.vm == nil {
+		mu.Unlock()
+		return "", kbErr(http.StatusUnprocessableEntity, "el borrador no compila")
+	}
+	antes, anterior := cloneKB(kb.kb), kb.version
+	if !b.PLManual {
+		kb.kb = b.KB
+	}
+	if err := kb.guardar(b.PL); err != nil {
+		kb.kb = antes
+		mu.Unlock()
+		return "", err
+	}
+	kb.vm, kb.version = b.vm, b.Version
+	delete(kb.borradores, nombre)
+	if err := kb.guardarBorradores(); err != nil {
+		logp("borradores: no se pudo guardar tras publicar %s: %v", nombre, err)
+	}
+	mu.Unlock()
+
+	var d *KBDiff
+	if !b.PLManual {
+		diff := diffKB(antes, b.KB)
+		d = &diff
+	}
+	notificarCambioKB(kb.Nombre, "borrador:"+nombre, autor, anterior, b.Version, d)
+	logp("borrador %s/%s publicado por %s (versión %s)", kb.Nombre, nombre, autor, b.Version)
+	return b.Version, nil
+}
+
+//
+// ======== Endpoints /admin/drafts ========
+//
+
+func handleDrafts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mu.Lock()
+		kb, err := buscarBase(nombreKB(r))
+		out := []BorradorInfo{}
+		if err == nil {
+			for _, n := range sortedKeys(kb.borradores) {
+				out = append(out, kb.borradores[n].info(kb.version))
+			}
+		}
+		mu.Unlock()
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in struct {
+			Nombre     string `json:"nombre"`
+			Aprobacion bool   `json:"aprobacion"`
+		}
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Nombre = strings.TrimSpace(in.Nombre)
+		if !borradorNomRe.MatchString(in.Nombre) {
+			http.Error(w, "nombre: minúsculas, dígitos, _ o -, hasta 40", http.StatusBadRequest)
+			return
+		}
+		autor, ahora := autorDe(r), time.Now().UTC()
+		mu.Lock()
+		kb, err := buscarBase(nombreKB(r))
+		if err != nil {
+			mu.Unlock()
+			writeKBError(w, err)
+			return
+		}
+		// el .pl en vivo puede no salir de kb si se subió con /admin/upload-pl
+		pl, err := os.ReadFile(kb.plPath)
+		if err != nil {
+			mu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, ok := kb.borradores[in.Nombre]; ok {
+			mu.Unlock()
+			http.Error(w, "ya existe un borrador con ese nombre", http.StatusConflict)
+			return
+		}
+		b := &Borrador{
+			BorradorInfo: BorradorInfo{
+				Nombre:             in.Nombre,
+				Autor:              autor,
+				Creado:             ahora,
+				Modificado:         ahora,
+				Editores:           []string{autor},
+				Base:               kb.version,
+				Version:            kb.version,
+				PLManual:           versionOf(buildPL(kb.kb)) != kb.version,
+				RequiereAprobacion: in.Aprobacion || getenv("KB_BORRADOR_APROBACION", "false") == "true",
+			},
+			KB: cloneKB(kb.kb),
+			PL: string(pl),
+			vm: kb.vm, // sólo se consulta; una escritura crea otro intérprete
+		}
+		kb.borradores[in.Nombre] = b
+		err = kb.guardarBorradores()
+		info := b.info(kb.version)
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", etagKB(info.Version))
+		writeJSON(w, http.StatusCreated, info)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleDraft(w http.ResponseWriter, r *http.Request) {
+	nombre := r.PathValue("nombre")
+	switch r.Method {
+	case http.MethodGet:
+		mu.Lock()
+		kb, b, err := borradorDe(nombreKB(r), nombre)
+		var info BorradorInfo
+		var k Knowledge
+		if err == nil {
+			info, k = b.info(kb.version), cloneKB(b.KB)
+		}
+		mu.Unlock()
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etagKB(info.Version))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"borrador": info, "kb": k})
+
+	case http.MethodDelete:
+		mu.Lock()
+		kb, _, err := borradorDe(nombreKB(r), nombre)
+		if err != nil {
+			mu.Unlock()
+			writeKBError(w, err)
+			return
+		}
+		delete(kb.borradores, nombre)
+		err = kb.guardarBorradores()
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp("borrador %s/%s descartado por %s", kb.Nombre, nombre, autorDe(r))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDraftDiff compara el borrador con la KB en vivo (JSON o, con
+// ?formato=texto o Accept: text/plain, el mismo texto que el dry run RPA).
+func handleDraftDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	nombre := r.PathValue("nombre")
+	mu.Lock()
+	kb, b, err := borradorDe(nombreKB(r), nombre)
+	var info BorradorInfo
+	var d KBDiff
+	var enVivo string
+	if err == nil {
+		enVivo = kb.version
+		info = b.info(enVivo)
+		d = diffKB(kb.kb, b.KB)
+	}
+	mu.Unlock()
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	if r.URL.Query().Get("formato") == "texto" || strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		t := "Borrador " + nombre + " (versión " + info.Version + ") frente a la KB en vivo (" + enVivo + ")\n"
+		if info.Desactualizado {
+			t += "Atención: la KB en vivo cambió desde que se creó el borrador (base " + info.Base + ")\n"
+		}
+		if info.PLManual {
+			t += "Atención: el .pl del borrador se subió directamente; el diff sólo cubre la KB estructurada\n"
+		}
+		w.Write([]byte(t + "\n" + formatKBDiff(d)))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"borrador": info,
+		"enVivo":   enVivo,
+		"diff":     d,
+	})
+}
+
+func handleDraftApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	nombre, autor := r.PathValue("nombre"), autorDe(r)
+	mu.Lock()
+	kb, b, err := borradorDe(nombreKB(r), nombre)
+	var info BorradorInfo
+	switch {
+	case err != nil:
+	case contains(b.Editores, autor):
+		err = kbErr(http.StatusForbidden, "%s editó el borrador; debe aprobarlo otro administrador", autor)
+	case r.Header.Get("If-Match") != "" && !coincideETag(r.Header.Get("If-Match"), b.Version):
+		err = errVersion(b.Version)
+	default:
+		if !b.aprobado() {
+			b.Aprobaciones = append(b.Aprobaciones, Aprobacion{Autor: autor, Fecha: time.Now().UTC(), Version: b.Version})
+			err = kb.guardarBorradores()
+		}
+		info = b.info(kb.version)
+	}
+	mu.Unlock()
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func handleDraftPublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	nombre := r.PathValue("nombre")
+	version, err := publicarBorrador(nombreKB(r), nombre, autorDe(r), r.Header.Get("If-Match"), r.URL.Query().Get("forzar") == "true")
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etagKB(version))
+	writeJSON(w, http.StatusOK, map[string]string{"publicado": nombre, "version": version})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ichiban/prolog"
+)
+
+//
+// ======== Códigos clínicos estándar ========
+//
+// Los nombres de la KB son átomos libres; para que otros sistemas (la
+// historia clínica, FHIR) sepan de qué se habla, cada elemento puede llevar
+// un código opcional:
+//
+//   enfermedades  icd10   CIE-10 (OMS o CM): letra, dos caracteres y subcategoría opcional (J11.1, G43.909)
+//   síntomas      snomed  SNOMED CT: identificador de concepto (6 a 18 dígitos, dígito de control Verhoeff)
+//                 icpc    ICPC-2: capítulo y rúbrica (R05, A03)
+//   medicamentos  atc     ATC nivel 5, el principio activo (N02BE01)
+//
+// Se guardan en mayúsculas y sin espacios; un código mal formado hace que
+// la escritura no se aplique (422), venga de la API, del CSV o de una
+// ingesta RPA (que lo descarta con un diagnóstico). Se compilan como
+// codigo(Elemento, Sistema, 'Codigo') y /analyze los devuelve con cada
+// resultado. No se comprueba que el código exista en la terminología, sólo
+// su forma.
+
+const (
+	codICD10  = "icd10"
+	codSNOMED = "snomed"
+	codICPC   = "icpc"
+	codATC    = "atc"
+)
+
+var formatosCodigo = map[string]*regexp.Regexp{
+	codICD10:  regexp.MustCompile(`^[A-Z][0-9][0-9A-Z](\.[0-9A-Z]{1,4})?$`),
+	codSNOMED: regexp.MustCompile(`^[1-9][0-9]{5,17}$`),
+	codICPC:   regexp.MustCompile(`^[ABDFHKLNPRSTUWXYZ][0-9]{2}$`),
+	codATC:    regexp.MustCompile(`^[ABCDGHJLMNPRSV][0-9]{2}[A-Z]{2}[0-9]{2}$`),
+}
+
+var ejemplosCodigo = map[string]string{codICD10: "J11.1", codSNOMED: "386661006", codICPC: "R05", codATC: "N02BE01"}
+
+// normalizarCodigo devuelve el código en su forma canónica o un error si no
+// tiene el formato del sistema. Un código vacío es válido (no hay código).
+func normalizarCodigo(sistema, c string) (string, error) {
+	c = strings.ToUpper(strings.Join(strings.Fields(c), ""))
+	if c == "" {
+		return "", nil
+	}
+	if !formatosCodigo[sistema].MatchString(c) {
+		return "", fmt.Errorf("%s %q no tiene un formato válido (p. ej. %s)", sistema, c, ejemplosCodigo[sistema])
+	}
+	if sistema == codSNOMED {
+		// los dos dígitos antes del de control son la partición: 00 o 10 para conceptos
+		if p := c[len(c)-3 : len(c)-1]; p != "00" && p != "10" {
+			return "", fmt.Errorf("snomed %q no es un identificador de concepto (partición %s)", c, p)
+		}
+		if !verhoeffValido(c) {
+			return "", fmt.Errorf("snomed %q tiene un dígito de control incorrecto", c)
+		}
+	}
+	return c, nil
+}
+
+var (
+	verhoeffD = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, {1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6}, {3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8}, {5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2}, {7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4}, {9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, {1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2}, {8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0}, {4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5}, {7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+)
+
+// verhoeffValido comprueba el último dígito de s (sólo dígitos) como control Verhoeff.
+func verhoeffValido(s string) bool {
+	c := 0
+	for i := 0; i < len(s); i++ {
+		c = verhoeffD[c][verhoeffP[i%8][s[len(s)-1-i]-'0']]
+	}
+	return c == 0
+}
+
+// validarCodigosKB normaliza todos los códigos de k y devuelve un 422 con
+// los que no tienen formato válido.
+func validarCodigosKB(k *Knowledge) error {
+	var malos []string
+	norm := func(elem, sistema string, c *string) {
+		v, err := normalizarCodigo(sistema, *c)
+		if err != nil {
+			malos = append(malos, atomize(elem)+": "+err.Error())
+			return
+		}
+		*c = v
+	}
+	for i := range k.Symptoms {
+		s := &k.Symptoms[i]
+		norm(s.Name, codSNOMED, &s.SNOMED)
+		norm(s.Name, codICPC, &s.ICPC)
+	}
+	for i := range k.Diseases {
+		norm(k.Diseases[i].Name, codICD10, &k.Diseases[i].ICD10)
+	}
+	for i := range k.Meds {
+		norm(k.Meds[i].Name, codATC, &k.Meds[i].ATC)
+	}
+	if len(malos) > 0 {
+		return kbErr(http.StatusUnprocessableEntity, "códigos inválidos: %s", strings.Join(malos, "; "))
+	}
+	return nil
+}
+
+// codigosDe lee codigo/3 del intérprete: elemento -> sistema -> código. Un
+// .pl subido a mano puede no tener el predicado; entonces no hay códigos.
+// El llamador sincroniza el acceso.
+func codigosDe(v *prolog.Interpreter) map[string]map[string]string {
+	out := map[string]map[string]string{}
+	sol, err := v.Query("codigo(E, S, C).")
+	if err != nil {
+		return out
+	}
+	defer sol.Close()
+	for sol.Next() {
+		var c struct{ E, S, C string }
+		if sol.Scan(&c) != nil {
+			continue
+		}
+		if out[c.E] == nil {
+			out[c.E] = map[string]string{}
+		}
+		out[c.E][c.S] = c.C
+	}
+	return out
+}
+
+// validarCodigo normaliza *c para los recursos de la KB; el error es un 422.
+func validarCodigo(sistema string, c *string) error {
+	v, err := normalizarCodigo(sistema, *c)
+	if err != nil {
+		return kbErr(http.StatusUnprocessableEntity, "%v", err)
+	}
+	*c = v
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ======== Expresiones cron ========
+//
+// Formato clásico de 5 campos: minuto hora día-del-mes mes día-de-la-semana
+// (0 = domingo, 7 también). Cada campo admite *, n, a-b, */n, a-b/n y listas
+// separadas por comas. Como en cron, si día-del-mes y día-de-la-semana están
+// restringidos a la vez basta con que coincida uno. También se aceptan
+// @hourly, @daily, @weekly y @monthly. Se evalúan en la hora local del servidor.
+
+type cronExpr struct {
+	min, hora, dia, mes, dow uint64 // bit i = valor i permitido
+	diaTodos, dowTodos       bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(s string) (cronExpr, error) {
+	var c cronExpr
+	s = strings.TrimSpace(s)
+	if m, ok := cronMacros[s]; ok {
+		s = m
+	}
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return c, fmt.Errorf("cron %q: se esperaban 5 campos, hay %d", s, len(f))
+	}
+	var err error
+	if c.min, err = cronCampo(f[0], 0, 59); err != nil {
+		return c, fmt.Errorf("cron minuto: %v", err)
+	}
+	if c.hora, err = cronCampo(f[1], 0, 23); err != nil {
+		return c, fmt.Errorf("cron hora: %v", err)
+	}
+	if c.dia, err = cronCampo(f[2], 1, 31); err != nil {
+		return c, fmt.Errorf("cron día del mes: %v", err)
+	}
+	if c.mes, err = cronCampo(f[3], 1, 12); err != nil {
+		return c, fmt.Errorf("cron mes: %v", err)
+	}
+	if c.dow, err = cronCampo(f[4], 0, 7); err != nil {
+		return c, fmt.Errorf("cron día de la semana: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 = domingo
+	}
+	c.diaTodos = strings.HasPrefix(f[2], "*")
+	c.dowTodos = strings.HasPrefix(f[4], "*")
+	return c, nil
+}
+
+func cronCampo(s string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, parte := range strings.Split(s, ",") {
+		rango, paso := parte, 1
+		if i := strings.Index(parte, "/"); i >= 0 {
+			n, err := strconv.Atoi(parte[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("paso inválido en %q", parte)
+			}
+			rango, paso = parte[:i], n
+		}
+		a, b := lo, hi
+		if rango != "*" {
+			var err error
+			if i := strings.Index(rango, "-"); i >= 0 {
+				if a, err = strconv.Atoi(rango[:i]); err == nil {
+					b, err = strconv.Atoi(rango[i+1:])
+				}
+			} else if a, err = strconv.Atoi(rango); err == nil {
+				b = a
+				if paso > 1 {
+					b = hi // "5/15" = desde 5 cada 15
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("valor inválido %q", parte)
+			}
+		}
+		if a < lo || b > hi || a > b {
+			return 0, fmt.Errorf("%q fuera de rango %d-%d", parte, lo, hi)
+		}
+		for v := a; v <= b; v += paso {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// coincide indica si la expresión se cumple en el minuto de t.
+func (c cronExpr) coincide(t time.Time) bool {
+	if c.min&(1<<uint(t.Minute())) == 0 || c.hora&(1<<uint(t.Hour())) == 0 || c.mes&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dia := c.dia&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.diaTodos || c.dowTodos {
+		return dia && dow
+	}
+	return dia || dow
+}
+
+// siguiente devuelve el primer minuto posterior a t que cumple la expresión
+// (tiempo cero si no hay ninguno en los próximos 5 años, p. ej. "0 0 31 2 *").
+func (c cronExpr) siguiente(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	fin := t.AddDate(5, 0, 0)
+	for t.Before(fin) {
+		switch {
+		case c.mes&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.coincide(time.Date(t.Year(), t.Month(), t.Day(), firstBit(c.hora), firstBit(c.min), 0, 0, t.Location())):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hora&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.min&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func firstBit(b uint64) int {
+	for i := 0; i < 64; i++ {
+		if b&(1<<uint(i)) != 0 {
+			return i
+		}
+	}
+	return 0
+}
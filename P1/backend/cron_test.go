@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func fecha(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCronCoincide(t *testing.T) {
+	casos := []struct {
+		expr, cuando string
+		quiere       bool
+	}{
+		{"*/15 * * * *", "2025-06-13 10:30", true},
+		{"*/15 * * * *", "2025-06-13 10:31", false},
+		{"5/20 * * * *", "2025-06-13 10:25", true}, // desde 5 cada 20: 5, 25, 45
+		{"5/20 * * * *", "2025-06-13 10:20", false},
+		{"0 9-17/2 * * 1-5", "2025-06-13 11:00", true}, // viernes
+		{"0 9-17/2 * * 1-5", "2025-06-13 12:00", false},
+		{"0 9-17/2 * * 1-5", "2025-06-14 11:00", false}, // sábado
+		{"0 0 1,15 * *", "2025-06-15 00:00", true},
+		{"0 0 1,15 * *", "2025-06-14 00:00", false},
+		{"0 0 * * 7", "2025-06-15 00:00", true}, // 7 también es domingo
+		{"0 0 * * 0", "2025-06-15 00:00", true},
+		{"@daily", "2025-06-13 00:00", true},
+		{"@daily", "2025-06-13 01:00", false},
+		{"@monthly", "2025-07-01 00:00", true},
+
+		// día del mes y día de la semana restringidos: basta con uno
+		{"0 0 13 * 5", "2025-06-13 00:00", true},  // viernes 13
+		{"0 0 13 * 5", "2025-06-20 00:00", true},  // viernes
+		{"0 0 13 * 5", "2025-07-13 00:00", true},  // 13 en domingo
+		{"0 0 13 * 5", "2025-06-14 00:00", false}, // ni uno ni otro
+		// con uno de los dos en * se exigen ambos (el * no restringe)
+		{"0 0 13 * *", "2025-06-20 00:00", false},
+		{"0 0 * * 5", "2025-06-14 00:00", false},
+		// "*/2" cuenta como *, igual que en cron: se exigen día impar y lunes
+		{"0 0 */2 * 1", "2025-06-16 00:00", false},
+		{"0 0 */2 * 1", "2025-06-23 00:00", true},
+	}
+	for _, c := range casos {
+		e, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if got := e.coincide(fecha(c.cuando)); got != c.quiere {
+			t.Errorf("%q en %s = %v, se esperaba %v", c.expr, c.cuando, got, c.quiere)
+		}
+	}
+}
+
+func TestCronErrores(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",       // 4 campos
+		"* * * * * *",   // 6 campos
+		"60 * * * *",    // minuto fuera de rango
+		"* 24 * * *",    // hora
+		"* * 0 * *",     // día del mes empieza en 1
+		"* * * 13 *",    // mes
+		"* * * * 8",     // día de la semana
+		"*/0 * * * *",   // paso nulo
+		"*/x * * * *",   // paso no numérico
+		"5-1 * * * *",   // rango al revés
+		"1-2-3 * * * *", // rango mal formado
+		"a * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: se esperaba error", expr)
+		}
+	}
+}
+
+func TestCronSiguiente(t *testing.T) {
+	casos := []struct {
+		expr, desde, quiere string
+	}{
+		{"0 6 * * 1", "2025-06-13 10:00", "2025-06-16 06:00"},
+		{"30 * * * *", "2025-06-13 10:30", "2025-06-13 11:30"}, // estrictamente después
+		{"*/15 9-10 * * *", "2025-06-13 10:50", "2025-06-14 09:00"},
+		{"0 0 13 * 5", "2025-06-13 00:00", "2025-06-20 00:00"},
+		{"0 0 29 2 *", "2025-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 1 */3 *", "2025-06-13 00:00", "2025-07-01 00:00"},
+	}
+	for _, c := range casos {
+		e, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if got := e.siguiente(fecha(c.desde)); !got.Equal(fecha(c.quiere)) {
+			t.Errorf("%q desde %s = %s, se esperaba %s", c.expr, c.desde, got.Format("2006-01-02 15:04"), c.quiere)
+		}
+	}
+
+	e, _ := parseCron("0 0 31 2 *")
+	if got := e.siguiente(fecha("2025-01-01 00:00")); !got.IsZero() {
+		t.Errorf("31 de febrero: se esperaba tiempo cero, hay %s", got)
+	}
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Cuentas de administración y roles ========
+//
+// Cada administrador tiene una cuenta con contraseña (PBKDF2-SHA256 con sal)
+// y un rol. POST /auth/login devuelve un token firmado con HMAC-SHA256 que
+// caduca a las AUTH_TOKEN_HORAS y se envía en "Authorization: Bearer
+// <token>". Ya no se acepta el token en la query: acababa en los logs de
+// acceso.
+//
+// Roles, de menos a más:
+//   viewer      lee la KB, los borradores, informes, historial y estadísticas
+//   editor      además crea y edita borradores y hace dry runs
+//   publisher   además escribe en la KB en vivo, aprueba y publica borradores
+//               y gestiona los trabajos RPA
+//   superadmin  además sube .pl, gestiona cuentas, KB, webhooks y correo,
+//               y descifra el historial
+//
+// Una cuenta puede limitarse a ciertas KB (ver bases.go); superadmin siempre
+// vale para todas. Los tokens por KB de /admin/kbs/{nombre}/tokens siguen
+// valiendo como Bearer con el rol con que se crearon.
+//
+//   POST   /auth/login                  {usuario, password} -> {token, expira, rol, kbs}
+//   GET    /auth/me                     la cuenta del token
+//   POST   /auth/password               {actual, nueva}
+//   GET    /admin/users                 lista (superadmin)
+//   POST   /admin/users                 {usuario, password, rol, kbs}
+//   GET    /admin/users/{usuario}
+//   PATCH  /admin/users/{usuario}       {password, rol, kbs, activa}
+//   DELETE /admin/users/{usuario}
+//
+// Las cuentas se guardan en storage/cuentas.json. Si no hay ninguna se crea
+// ADMIN_USER (default admin, superadmin) con ADMIN_PASSWORD (default
+// admin123). La clave de firma es AUTH_SECRET o, sin ella, una aleatoria que
+// se guarda en storage/auth_secret para que los tokens sobrevivan a un
+// reinicio.
+
+type rol int
+
+const (
+	rolViewer rol = iota + 1
+	rolEditor
+	rolPublisher
+	rolSuperadmin
+)
+
+var nombresRol = map[rol]string{
+	rolViewer:     "viewer",
+	rolEditor:     "editor",
+	rolPublisher:  "publisher",
+	rolSuperadmin: "superadmin",
+}
+
+func (r rol) String() string { return nombresRol[r] }
+
+func parseRol(s string) (rol, error) {
+	for r, n := range nombresRol {
+		if n == s {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("rol debe ser viewer, editor, publisher o superadmin")
+}
+
+const (
+	pbkdf2Iter   = 120000
+	tokenPrefijo = "ml1"
+)
+
+var (
+	cuentasPath = filepath.Join("storage", "cuentas.json")
+	secretoPath = filepath.Join("storage", "auth_secret")
+	usuarioRe   = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,39}$`)
+
+	cuentasMu     sync.Mutex
+	cuentas       = map[string]*Cuenta{}
+	secretoFirma  []byte
+	duracionToken = 8 * time.Hour
+)
+
+type Cuenta struct {
+	Usuario string    `json:"usuario"`
+	Hash    string    `json:"hash,omitempty"` // pbkdf2-sha256$iter$sal$clave
+	Rol     string    `json:"rol"`
+	KBs     []string  `json:"kbs,omitempty"` // vacío: todas
+	Activa  bool      `json:"activa"`
+	Creada  time.Time `json:"creada"`
+	// Gen se incrementa al cambiar la contraseña, el rol, las KB o el estado,
+	// y los tokens emitidos con otra Gen dejan de valer.
+	Gen int `json:"gen"`
+	// Sal es aleatoria por cuenta y va en los tokens: si se borra la cuenta y
+	// se vuelve a crear con el mismo usuario, Gen vuelve a 0 pero los tokens
+	// de la anterior no valen porque la sal es otra.
+	Sal string `json:"sal,omitempty"`
+}
+
+func nuevaSalCuenta() string {
+	return hex.EncodeToString(aleatorio(16))
+}
+
+func initCuentas() {
+	if h, err := strconv.Atoi(getenv("AUTH_TOKEN_HORAS", "8")); err == nil && h > 0 {
+		duracionToken = time.Duration(h) * time.Hour
+	}
+	if s := os.Getenv("AUTH_SECRET"); s != "" {
+		secretoFirma = []byte(s)
+	} else if b, err := os.ReadFile(secretoPath); err == nil && len(b) > 0 {
+		secretoFirma = b
+	} else {
+		secretoFirma = []byte(hex.EncodeToString(aleatorio(32)))
+		if err := os.WriteFile(secretoPath, secretoFirma, 0600); err != nil {
+			log.Fatalf("No se pudo escribir %s: %v", secretoPath, err)
+		}
+	}
+
+	if b, err := os.ReadFile(cuentasPath); err == nil {
+		var cs []*Cuenta
+		if err := json.Unmarshal(b, &cs); err != nil {
+			log.Fatalf("cuentas.json inválido: %v", err)
+		}
+		sinSal := false
+		for _, c := range cs {
+			if c.Sal == "" {
+				// de antes de la sal: sus tokens dejan de valer una vez
+				c.Sal, sinSal = nuevaSalCuenta(), true
+			}
+			cuentas[c.Usuario] = c
+		}
+		if sinSal {
+			if err := guardarCuentas(); err != nil {
+				log.Fatalf("No se pudo escribir %s: %v", cuentasPath, err)
+			}
+		}
+	}
+	if len(cuentas) > 0 {
+		return
+	}
+	usuario, pass := getenv("ADMIN_USER", "admin"), getenv("ADMIN_PASSWORD", "admin123")
+	if pass == "admin123" {
+		logp("Atención: se crea la cuenta %s con la contraseña por defecto; cámbiela (POST /auth/password) o defina ADMIN_PASSWORD", usuario)
+	}
+	cuentas[usuario] = &Cuenta{Usuario: usuario, Hash: hashPassword(pass), Rol: rolSuperadmin.String(), Activa: true, Creada: time.Now().UTC(), Sal: nuevaSalCuenta()}
+	if err := guardarCuentas(); err != nil {
+		log.Fatalf("No se pudo escribir %s: %v", cuentasPath, err)
+	}
+}
+
+// guardarCuentas se llama con cuentasMu tomado.
+func guardarCuentas() error {
+	cs := make([]*Cuenta, 0, len(cuentas))
+	for _, u := range sortedKeys(cuentas) {
+		cs = append(cs, cuentas[u])
+	}
+	b, _ := json.MarshalIndent(cs, "", "  ")
+	tmp := cuentasPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cuentasPath)
+}
+
+func aleatorio(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+//
+// ======== Contraseñas ========
+//
+
+// pbkdf2SHA256 es PBKDF2 (RFC 8018) con HMAC-SHA256.
+func pbkdf2SHA256(pass, sal []byte, iter, n int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	var out []byte
+	for bloque := uint32(1); len(out) < n; bloque++ {
+		prf.Reset()
+		prf.Write(sal)
+		prf.Write([]byte{byte(bloque >> 24), byte(bloque >> 16), byte(bloque >> 8), byte(bloque)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+func hashPassword(pass string) string {
+	sal := aleatorio(16)
+	k := pbkdf2SHA256([]byte(pass), sal, pbkdf2Iter, 32)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iter, b64.EncodeToString(sal), b64.EncodeToString(k))
+}
+
+func verificarPassword(hash, pass string) bool {
+	p := strings.Split(hash, "$")
+	if len(p) != 4 || p[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(p[1])
+	b64 := base64.RawStdEncoding
+	sal, err1 := b64.DecodeString(p[2])
+	k, err2 := b64.DecodeString(p[3])
+	if err != nil || err1 != nil || err2 != nil || iter < 1 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(pass), sal, iter, len(k)), k) == 1
+}
+
+// hashFicticio se compara cuando el usuario no existe, para que la respuesta
+// tarde lo mismo.
+var hashFicticio = hashPassword("-")
+
+func validarPassword(p string) error {
+	if len(p) < 8 {
+		return fmt.Errorf("la contraseña debe tener al menos 8 caracteres")
+	}
+	return nil
+}
+
+//
+// ======== Tokens firmados ========
+//
+
+type claimsToken struct {
+	Sub string `json:"sub"`
+	Gen int    `json:"gen"`
+	Sal string `json:"sal"`
+	Iat int64  `json:"iat"`
+	Exp int64  `json:"exp"`
+}
+
+func firmar(s string) string {
+	m := hmac.New(sha256.New, secretoFirma)
+	m.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// emitirToken devuelve ml1.<claims en base64url>.<HMAC>.
+func emitirToken(c *Cuenta, ahora time.Time) (string, time.Time) {
+	exp := ahora.Add(duracionToken)
+	b, _ := json.Marshal(claimsToken{Sub: c.Usuario, Gen: c.Gen, Sal: c.Sal, Iat: ahora.Unix(), Exp: exp.Unix()})
+	cuerpo := tokenPrefijo + "." + base64.RawURLEncoding.EncodeToString(b)
+	return cuerpo + "." + firmar(cuerpo), exp
+}
+
+var errTokenInvalido = errors.New("token inválido o caducado")
+
+func verificarToken(tk string, ahora time.Time) (claimsToken, error) {
+	var c claimsToken
+	p := strings.Split(tk, ".")
+	if len(p) != 3 || p[0] != tokenPrefijo {
+		return c, errTokenInvalido
+	}
+	if !hmac.Equal([]byte(firmar(p[0]+"."+p[1])), []byte(p[2])) {
+		return c, errTokenInvalido
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p[1])
+	if err != nil || json.Unmarshal(b, &c) != nil || ahora.Unix() >= c.Exp {
+		return c, errTokenInvalido
+	}
+	return c, nil
+}
+
+//
+// ======== Sesión y permisos ========
+//
+
+// sesion es quién hace una petición autenticada.
+type sesion struct {
+	Usuario string
+	Rol     rol
+	KBs     []string // vacío: todas
+	Cuenta  bool     // false para los tokens por KB
+}
+
+func (s *sesion) puedeKB(nombre string) bool {
+	return len(s.KBs) == 0 || contains(s.KBs, nombre)
+}
+
+type claveSesion struct{}
+
+// sesionDe valida la cabecera Authorization: un token de cuenta o uno por KB.
+func sesionDe(r *http.Request) (*sesion, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return nil, errTokenInvalido
+	}
+	tk := strings.TrimSpace(h[7:])
+	if strings.HasPrefix(tk, prefijoTokenKB) {
+		return sesionTokenKB(tk)
+	}
+	c, err := verificarToken(tk, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	cuentasMu.Lock()
+	defer cuentasMu.Unlock()
+	cu, ok := cuentas[c.Sub]
+	if !ok || !cu.Activa || cu.Gen != c.Gen || cu.Sal != c.Sal {
+		return nil, errTokenInvalido
+	}
+	rl, _ := parseRol(cu.Rol)
+	return &sesion{Usuario: cu.Usuario, Rol: rl, KBs: cu.KBs, Cuenta: true}, nil
+}
+
+// sesionDeCtx es la sesión que dejó auth en el contexto (nil sin auth).
+func sesionDeCtx(r *http.Request) *sesion {
+	s, _ := r.Context().Value(claveSesion{}).(*sesion)
+	return s
+}
+
+// auth exige una sesión con al menos el rol min y acceso a la KB de la
+// petición. Toda petición, autorizada o no, queda en la auditoría.
+func auth(min rol, h http.HandlerFunc) http.HandlerFunc {
+	return authSegun(func(*http.Request) rol { return min }, h)
+}
+
+// authSegun es auth con el rol mínimo según la petición (método, borrador...).
+func authSegun(rolPara func(*http.Request) rol, h http.HandlerFunc) http.HandlerFunc {
+	return auditado(true, func(w http.ResponseWriter, r *http.Request) {
+		s, ok := autenticar(w, r)
+		if !ok {
+			return
+		}
+		if !s.puedeKB(nombreKB(r)) {
+			http.Error(w, "la cuenta no tiene acceso a la KB "+nombreKB(r), http.StatusForbidden)
+			return
+		}
+		if min := rolPara(r); s.Rol < min {
+			http.Error(w, "requiere rol "+min.String(), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), claveSesion{}, s)))
+	})
+}
+
+// authCuenta es auth para lo que no depende de una KB (/auth/*, cuentas).
+func authCuenta(min rol, h http.HandlerFunc) http.HandlerFunc {
+	return auditado(false, func(w http.ResponseWriter, r *http.Request) {
+		s, ok := autenticar(w, r)
+		if !ok {
+			return
+		}
+		if s.Rol < min {
+			http.Error(w, "requiere rol "+min.String(), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), claveSesion{}, s)))
+	})
+}
+
+func autenticar(w http.ResponseWriter, r *http.Request) (*sesion, bool) {
+	s, err := sesionDe(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="medi-logic"`)
+		http.Error(w, "no autorizado", http.StatusUnauthorized)
+		return nil, false
+	}
+	anotarActor(r, s.Usuario, s.Rol.String())
+	return s, true
+}
+
+// rolEscritura: leer la KB es de viewer, escribir en un borrador de editor y
+// en la KB en vivo de publisher.
+func rolEscritura(r *http.Request) rol {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return rolViewer
+	case r.Header.Get(cabeceraBorrador) != "":
+		return rolEditor
+	}
+	return rolPublisher
+}
+
+// rolIngesta es rolEscritura, salvo el dry run que no escribe.
+func rolIngesta(r *http.Request) rol {
+	if r.URL.Query().Get("dry_run") == "true" {
+		return rolEditor
+	}
+	return rolEscritura(r)
+}
+
+// rolLectura deja leer a viewer y exige min para lo demás.
+func rolLectura(min rol) func(*http.Request) rol {
+	return func(r *http.Request) rol {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return rolViewer
+		}
+		return min
+	}
+}
+
+// autorDe identifica a quien hace un cambio desde la API admin.
+func autorDe(r *http.Request) string {
+	if s := sesionDeCtx(r); s != nil {
+		return s.Usuario
+	}
+	return "desconocido"
+}
+
+//
+// ======== Endpoints /auth ========
+//
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var in struct {
+		Usuario  string `json:"usuario"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	cuentasMu.Lock()
+	c, ok := cuentas[strings.TrimSpace(in.Usuario)]
+	var cu Cuenta
+	if ok {
+		cu = *c
+	}
+	cuentasMu.Unlock()
+	hash := hashFicticio
+	if ok {
+		hash = cu.Hash
+	}
+	anotarActor(r, strings.TrimSpace(in.Usuario), cu.Rol)
+	if !verificarPassword(hash, in.Password) || !ok || !cu.Activa {
+		logp("login fallido para %q desde %s", in.Usuario, r.RemoteAddr)
+		http.Error(w, "usuario o contraseña incorrectos", http.StatusUnauthorized)
+		return
+	}
+	tk, exp := emitirToken(&cu, time.Now())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":   tk,
+		"expira":  exp.UTC(),
+		"usuario": cu.Usuario,
+		"rol":     cu.Rol,
+		"kbs":     cu.KBs,
+	})
+}
+
+func handleYo(w http.ResponseWriter, r *http.Request) {
+	s := sesionDeCtx(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"usuario": s.Usuario, "rol": s.Rol.String(), "kbs": s.KBs})
+}
+
+// handlePassword cambia la contraseña propia; los tokens anteriores dejan de valer.
+func handlePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	s := sesionDeCtx(r)
+	if !s.Cuenta {
+		http.Error(w, "un token por KB no tiene contraseña", http.StatusForbidden)
+		return
+	}
+	var in struct {
+		Actual string `json:"actual"`
+		Nueva  string `json:"nueva"`
+	}
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if err := validarPassword(in.Nueva); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cuentasMu.Lock()
+	defer cuentasMu.Unlock()
+	c, ok := cuentas[s.Usuario]
+	if !ok || !verificarPassword(c.Hash, in.Actual) {
+		http.Error(w, "contraseña actual incorrecta", http.StatusForbidden)
+		return
+	}
+	c.Hash = hashPassword(in.Nueva)
+	c.Gen++
+	if err := guardarCuentas(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// ======== Endpoints /admin/users ========
+//
+
+// cuentaPatch son los campos de POST y PATCH; los nil no se tocan.
+type cuentaPatch struct {
+	Usuario  string    `json:"usuario"`
+	Password *string   `json:"password"`
+	Rol      *string   `json:"rol"`
+	KBs      *[]string `json:"kbs"`
+	Activa   *bool     `json:"activa"`
+}
+
+// aplicar valida y copia los campos en c (con cuentasMu tomado).
+func (p cuentaPatch) aplicar(c *Cuenta) error {
+	if p.Password != nil {
+		if err := validarPassword(*p.Password); err != nil {
+			return err
+		}
+		c.Hash = hashPassword(*p.Password)
+	}
+	if p.Rol != nil {
+		if _, err := parseRol(*p.Rol); err != nil {
+			return err
+		}
+		c.Rol = *p.Rol
+	}
+	if p.KBs != nil {
+		c.KBs = nil
+		for _, k := range *p.KBs {
+			if k = strings.TrimSpace(k); k != "" && !contains(c.KBs, k) {
+				c.KBs = append(c.KBs, k)
+			}
+		}
+	}
+	if p.Activa != nil {
+		c.Activa = *p.Activa
+	}
+	if c.Rol == rolSuperadmin.String() && len(c.KBs) > 0 {
+		return fmt.Errorf("un superadmin no puede limitarse a ciertas KB")
+	}
+	return nil
+}
+
+// quedaSuperadmin dice si hay otra cuenta superadmin activa además de usuario.
+func quedaSuperadmin(usuario string) bool {
+	for _, c := range cuentas {
+		if c.Usuario != usuario && c.Activa && c.Rol == rolSuperadmin.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cuentasMu.Lock()
+		out := []Cuenta{}
+		for _, u := range sortedKeys(cuentas) {
+			c := *cuentas[u]
+			c.Hash, c.Sal = "", ""
+			out = append(out, c)
+		}
+		cuentasMu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in cuentaPatch
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Usuario = strings.TrimSpace(in.Usuario)
+		if !usuarioRe.MatchString(in.Usuario) {
+			http.Error(w, "usuario: minúsculas, dígitos, . _ o -, de 2 a 40", http.StatusBadRequest)
+			return
+		}
+		if in.Password == nil || in.Rol == nil {
+			http.Error(w, "password y rol son obligatorios", http.StatusBadRequest)
+			return
+		}
+		c := &Cuenta{Usuario: in.Usuario, Activa: true, Creada: time.Now().UTC(), Sal: nuevaSalCuenta()}
+		if err := in.aplicar(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cuentasMu.Lock()
+		defer cuentasMu.Unlock()
+		if _, ok := cuentas[c.Usuario]; ok {
+			http.Error(w, "ya existe una cuenta con ese usuario", http.StatusConflict)
+			return
+		}
+		cuentas[c.Usuario] = c
+		if err := guardarCuentas(); err != nil {
+			delete(cuentas, c.Usuario)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp("cuenta %s (%s) creada por %s", c.Usuario, c.Rol, autorDe(r))
+		out := *c
+		out.Hash, out.Sal = "", ""
+		writeJSON(w, http.StatusCreated, out)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleUser(w http.ResponseWriter, r *http.Request) {
+	usuario := r.PathValue("usuario")
+	cuentasMu.Lock()
+	defer cuentasMu.Unlock()
+	c, ok := cuentas[usuario]
+	if !ok {
+		http.Error(w, "cuenta no encontrada", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		out := *c
+		out.Hash, out.Sal = "", ""
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPatch:
+		var in cuentaPatch
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		nueva := *c
+		if err := in.aplicar(&nueva); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.Rol == rolSuperadmin.String() && (nueva.Rol != c.Rol || !nueva.Activa) && !quedaSuperadmin(usuario) {
+			http.Error(w, "debe quedar al menos un superadmin activo", http.StatusConflict)
+			return
+		}
+		nueva.Gen++
+		*c = nueva
+		if err := guardarCuentas(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp("cuenta %s modificada por %s", usuario, autorDe(r))
+		out := *c
+		out.Hash, out.Sal = "", ""
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodDelete:
+		if c.Rol == rolSuperadmin.String() && !quedaSuperadmin(usuario) {
+			http.Error(w, "debe quedar al menos un superadmin activo", http.StatusConflict)
+			return
+		}
+		delete(cuentas, usuario)
+		if err := guardarCuentas(); err != nil {
+			cuentas[usuario] = c
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp("cuenta %s eliminada por %s", usuario, autorDe(r))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var rutasRegistradas sync.Once
+
+// pedir atiende la petición con las rutas de main (registrarRutas) y el token
+// dado ("" sin Authorization). cabeceras son pares nombre, valor.
+func pedir(method, ruta, token, cuerpo string, cabeceras ...string) *httptest.ResponseRecorder {
+	rutasRegistradas.Do(registrarRutas)
+	r := httptest.NewRequest(method, ruta, strings.NewReader(cuerpo))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(cabeceras); i += 2 {
+		r.Header.Set(cabeceras[i], cabeceras[i+1])
+	}
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+// usarCuentas deja una cuenta por rol (root superadmin, pub publisher, edi
+// editor y vic viewer) con una clave de firma de prueba.
+func usarCuentas(t *testing.T) {
+	t.Helper()
+	prevC, prevS, prevP := cuentas, secretoFirma, cuentasPath
+	t.Cleanup(func() { cuentas, secretoFirma, cuentasPath = prevC, prevS, prevP })
+	secretoFirma = []byte("clave-de-prueba")
+	cuentasPath = filepath.Join(t.TempDir(), "cuentas.json")
+	cuentas = map[string]*Cuenta{}
+	for u, rl := range map[string]rol{"root": rolSuperadmin, "pub": rolPublisher, "edi": rolEditor, "vic": rolViewer} {
+		cuentas[u] = &Cuenta{Usuario: u, Rol: rl.String(), Activa: true, Creada: time.Now().UTC(), Sal: nuevaSalCuenta()}
+	}
+}
+
+func tokenDe(usuario string) string {
+	tk, _ := emitirToken(cuentas[usuario], time.Now())
+	return tk
+}
+
+func TestTokenRechazado(t *testing.T) {
+	usarBases(t)
+	usarCuentas(t)
+
+	vic := tokenDe("vic")
+	if w := pedir(http.MethodGet, "/admin/symptoms", vic, ""); w.Code != http.StatusOK {
+		t.Fatalf("token válido: %d %s", w.Code, w.Body)
+	}
+
+	partes := strings.Split(vic, ".")
+	otraFirma := partes[2][:len(partes[2])-1] + "A"
+	if strings.HasSuffix(partes[2], "A") {
+		otraFirma = partes[2][:len(partes[2])-1] + "B"
+	}
+	deRoot := strings.Split(tokenDe("root"), ".")
+	caducado, _ := emitirToken(cuentas["vic"], time.Now().Add(-duracionToken-time.Minute))
+	secretoFirma = []byte("otra-clave")
+	otraClave := tokenDe("vic")
+	secretoFirma = []byte("clave-de-prueba")
+
+	casos := map[string]string{
+		"sin token":           "",
+		"mal formado":         "ml1.no-es-un-token",
+		"firma alterada":      partes[0] + "." + partes[1] + "." + otraFirma,
+		"claims de otra":      partes[0] + "." + deRoot[1] + "." + partes[2],
+		"caducado":            caducado,
+		"firmado con otra":    otraClave,
+		"token por KB ajeno":  prefijoTokenKB + "inventado",
+		"prefijo desconocido": "ml0." + partes[1] + "." + partes[2],
+		"usuario inexistente": func() string { tk, _ := emitirToken(&Cuenta{Usuario: "nadie"}, time.Now()); return tk }(),
+	}
+	for caso, tk := range casos {
+		w := pedir(http.MethodGet, "/admin/symptoms", tk, "")
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: %d", caso, w.Code)
+		}
+	}
+
+	// cambiar la cuenta (Gen) invalida los tokens emitidos antes
+	if w := pedir(http.MethodPatch, "/admin/users/vic", tokenDe("root"), `{"kbs":["general"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH cuenta: %d %s", w.Code, w.Body)
+	}
+	if w := pedir(http.MethodGet, "/admin/symptoms", vic, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("token con Gen anterior: %d", w.Code)
+	}
+	if w := pedir(http.MethodGet, "/admin/symptoms", tokenDe("vic"), ""); w.Code != http.StatusOK {
+		t.Errorf("token nuevo tras el cambio: %d %s", w.Code, w.Body)
+	}
+	// y una cuenta desactivada no entra ni con un token nuevo
+	cuentas["vic"].Activa = false
+	if w := pedir(http.MethodGet, "/admin/symptoms", tokenDe("vic"), ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("cuenta desactivada: %d", w.Code)
+	}
+}
+
+func TestRolPorRuta(t *testing.T) {
+	b := usarBases(t)
+	usarCuentas(t)
+	sintoma := `{"name":"nausea"}`
+
+	casos := []struct {
+		usuario, method, ruta, cuerpo string
+		quiere                        int
+	}{
+		{"vic", http.MethodGet, "/admin/symptoms", "", http.StatusOK},
+		{"vic", http.MethodPost, "/admin/symptoms", sintoma, http.StatusForbidden},
+		{"vic", http.MethodDelete, "/admin/diseases/migrana", "", http.StatusForbidden},
+		{"vic", http.MethodPost, "/admin/kb", "{}", http.StatusForbidden},
+		{"vic", http.MethodPost, "/admin/rpa/ingest?dry_run=true", "nombre: gripe\n", http.StatusForbidden},
+		{"vic", http.MethodPost, "/admin/drafts", `{"nombre":"b1"}`, http.StatusForbidden},
+		{"vic", http.MethodPost, "/admin/fit", "{}", http.StatusForbidden},
+		{"edi", http.MethodPost, "/admin/symptoms", sintoma, http.StatusForbidden}, // la KB en vivo es de publisher
+		{"edi", http.MethodPost, "/admin/rpa/jobs/run?id=x", "", http.StatusForbidden},
+		{"pub", http.MethodGet, "/admin/users", "", http.StatusForbidden},
+		{"pub", http.MethodPost, "/admin/symptoms", sintoma, http.StatusCreated},
+	}
+	for _, c := range casos {
+		w := pedir(c.method, c.ruta, tokenDe(c.usuario), c.cuerpo, "If-Match", "*")
+		if w.Code != c.quiere {
+			t.Errorf("%s %s %s: %d, se esperaba %d (%s)", c.usuario, c.method, c.ruta, w.Code, c.quiere, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	// una cuenta limitada a otra KB no entra en la general
+	cuentas["edi"].KBs = []string{"pediatria"}
+	if w := pedir(http.MethodGet, "/admin/symptoms", tokenDe("edi"), ""); w.Code != http.StatusForbidden {
+		t.Errorf("cuenta de otra KB: %d", w.Code)
+	}
+
+	// subir un .pl es sólo de superadmin
+	pl := buildPL(defaultKB())
+	for _, u := range []string{"vic", "edi", "pub"} {
+		if w := pedir(http.MethodPost, "/admin/upload-pl", tokenDe(u), pl, "If-Match", etagKB(b.version)); w.Code != http.StatusForbidden {
+			t.Errorf("upload-pl como %s: %d", u, w.Code)
+		}
+	}
+	if w := pedir(http.MethodPost, "/admin/upload-pl", tokenDe("root"), pl, "If-Match", etagKB(b.version)); w.Code != http.StatusNoContent {
+		t.Errorf("upload-pl como superadmin: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUltimoSuperadmin(t *testing.T) {
+	usarBases(t)
+	usarCuentas(t)
+	root := tokenDe("root")
+
+	for _, c := range []struct{ method, cuerpo string }{
+		{http.MethodPatch, `{"rol":"publisher"}`},
+		{http.MethodPatch, `{"activa":false}`},
+		{http.MethodDelete, ""},
+	} {
+		if w := pedir(c.method, "/admin/users/root", root, c.cuerpo); w.Code != http.StatusConflict {
+			t.Errorf("%s %s al único superadmin: %d %s", c.method, c.cuerpo, w.Code, w.Body)
+		}
+	}
+	if c := cuentas["root"]; c.Rol != rolSuperadmin.String() || !c.Activa || c.Gen != 0 {
+		t.Fatalf("la cuenta cambió: %+v", c)
+	}
+
+	// un superadmin desactivado no cuenta
+	if w := pedir(http.MethodPost, "/admin/users", root, `{"usuario":"root2","password":"clave-larga","rol":"superadmin"}`); w.Code != http.StatusCreated {
+		t.Fatalf("crear root2: %d %s", w.Code, w.Body)
+	}
+	cuentas["root2"].Activa = false
+	if w := pedir(http.MethodDelete, "/admin/users/root", root, ""); w.Code != http.StatusConflict {
+		t.Errorf("borrar root con root2 inactivo: %d", w.Code)
+	}
+
+	cuentas["root2"].Activa = true
+	if w := pedir(http.MethodPatch, "/admin/users/root", root, `{"rol":"publisher"}`); w.Code != http.StatusOK {
+		t.Fatalf("degradar root con otro superadmin: %d %s", w.Code, w.Body)
+	}
+	if w := pedir(http.MethodDelete, "/admin/users/root2", tokenDe("root2"), ""); w.Code != http.StatusConflict {
+		t.Errorf("borrar al nuevo único superadmin: %d %s", w.Code, w.Body)
+	}
+}
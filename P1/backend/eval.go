@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	prolog "github.com/ichiban/prolog"
+)
+
+//
+// ======== Evaluación con casos etiquetados ========
+//
+// Un archivo de casos es JSON:
+//
+//	{"casos":[{"id":"flu-1",
+//	           "sintomas":[{"nombre":"fiebre","severidad":"severo"}],
+//	           "alergias":[], "cronicos":[],
+//	           "esperado":{"enfermedad":"influenza","medicamento":"paracetamol",
+//	                       "urgencia":"Consulta médica inmediata sugerida"}}]}
+//
+// Sólo "esperado.enfermedad" es obligatorio; medicamento y urgencia se
+// comparan cuando vienen informados.
+
+type EvalEsperado struct {
+	Enfermedad  string `json:"enfermedad"`
+	Medicamento string `json:"medicamento,omitempty"`
+	Urgencia    string `json:"urgencia,omitempty"`
+}
+
+type EvalCase struct {
+	ID       string         `json:"id"`
+	Sintomas []SintomaInput `json:"sintomas"`
+	Alergias []string       `json:"alergias"`
+	Cronicos []string       `json:"cronicos"`
+	Esperado EvalEsperado   `json:"esperado"`
+}
+
+type EvalSuite struct {
+	Casos []EvalCase `json:"casos"`
+}
+
+type EvalFallo struct {
+	ID       string       `json:"id"`
+	Esperado EvalEsperado `json:"esperado"`
+	Obtenido EvalEsperado `json:"obtenido"`
+	Rango    int          `json:"rango"` // posición de la enfermedad esperada (0 = no aparece)
+	Motivos  []string     `json:"motivos"`
+}
+
+type EvalReport struct {
+	Total        int                       `json:"total"`
+	Top1         int                       `json:"top1"`
+	Top3         int                       `json:"top3"`
+	Top1Accuracy float64                   `json:"top1Accuracy"`
+	Top3Accuracy float64                   `json:"top3Accuracy"`
+	MRR          float64                   `json:"mrr"` // rango recíproco medio de la enfermedad esperada
+	MedAccuracy  float64                   `json:"medAccuracy"`
+	UrgAccuracy  float64                   `json:"urgAccuracy"`
+	Confusion    map[string]map[string]int `json:"confusion"` // esperado -> obtenido -> n
+	MedCasos     int                       `json:"medCasos"`
+	MedAciertos  int                       `json:"medAciertos"`
+	UrgCasos     int                       `json:"urgCasos"`
+	UrgAciertos  int                       `json:"urgAciertos"`
+	Fallos       []EvalFallo               `json:"fallos"`
+}
+
+// sinResultado marca en la matriz de confusión los casos sin ninguna coincidencia.
+const sinResultado = "(ninguna)"
+
+// evaluar corre todos los casos contra el intérprete dado. El llamador
+// sincroniza el acceso si se trata del intérprete global.
+func evaluar(v *prolog.Interpreter, s EvalSuite) (EvalReport, error) {
+	rep := EvalReport{Confusion: map[string]map[string]int{}}
+	for i, c := range s.Casos {
+		id := c.ID
+		if id == "" {
+			id = fmt.Sprintf("caso_%d", i+1)
+		}
+		res, err := consultar(v, AnalyzeReq{Sintomas: c.Sintomas, Alergias: c.Alergias, Cronicos: c.Cronicos})
+		if err != nil {
+			return rep, fmt.Errorf("caso %s: %v", id, err)
+		}
+		esp := EvalEsperado{
+			Enfermedad:  atomize(c.Esperado.Enfermedad),
+			Medicamento: c.Esperado.Medicamento,
+			Urgencia:    c.Esperado.Urgencia,
+		}
+		if esp.Medicamento != "" {
+			esp.Medicamento = atomize(esp.Medicamento)
+		}
+
+		obt := EvalEsperado{Enfermedad: sinResultado}
+		if len(res) > 0 {
+			obt = EvalEsperado{Enfermedad: res[0].Enf, Medicamento: res[0].Med, Urgencia: res[0].Urg}
+		}
+		rango := 0
+		for j, r := range res {
+			if r.Enf == esp.Enfermedad {
+				rango = j + 1
+				break
+			}
+		}
+
+		rep.Total++
+		if rep.Confusion[esp.Enfermedad] == nil {
+			rep.Confusion[esp.Enfermedad] = map[string]int{}
+		}
+		rep.Confusion[esp.Enfermedad][obt.Enfermedad]++
+
+		if rango > 0 {
+			rep.MRR += 1 / float64(rango)
+		}
+
+		var motivos []string
+		if rango == 1 {
+			rep.Top1++
+		} else {
+			motivos = append(motivos, fmt.Sprintf("enfermedad: esperada %s, obtenida %s", esp.Enfermedad, obt.Enfermedad))
+		}
+		if rango >= 1 && rango <= 3 {
+			rep.Top3++
+		}
+		if esp.Medicamento != "" {
+			rep.MedCasos++
+			if obt.Medicamento == esp.Medicamento {
+				rep.MedAciertos++
+			} else {
+				motivos = append(motivos, fmt.Sprintf("medicamento: esperado %s, obtenido %s", esp.Medicamento, obt.Medicamento))
+			}
+		}
+		if esp.Urgencia != "" {
+			rep.UrgCasos++
+			if obt.Urgencia == esp.Urgencia {
+				rep.UrgAciertos++
+			} else {
+				motivos = append(motivos, fmt.Sprintf("urgencia: esperada %q, obtenida %q", esp.Urgencia, obt.Urgencia))
+			}
+		}
+		if len(motivos) > 0 {
+			rep.Fallos = append(rep.Fallos, EvalFallo{ID: id, Esperado: esp, Obtenido: obt, Rango: rango, Motivos: motivos})
+		}
+	}
+	rep.Top1Accuracy = ratio(rep.Top1, rep.Total)
+	rep.Top3Accuracy = ratio(rep.Top3, rep.Total)
+	if rep.Total > 0 {
+		rep.MRR /= float64(rep.Total)
+	}
+	rep.MedAccuracy = ratio(rep.MedAciertos, rep.MedCasos)
+	rep.UrgAccuracy = ratio(rep.UrgAciertos, rep.UrgCasos)
+	return rep, nil
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func loadEvalSuite(r io.Reader) (EvalSuite, error) {
+	var s EvalSuite
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return s, fmt.Errorf("casos inválidos: %v", err)
+	}
+	return s, s.validar()
+}
+
+func (s EvalSuite) validar() error {
+	if len(s.Casos) == 0 {
+		return fmt.Errorf("no hay casos")
+	}
+	for i, c := range s.Casos {
+		if strings.TrimSpace(c.Esperado.Enfermedad) == "" {
+			return fmt.Errorf("caso %d: falta esperado.enfermedad", i+1)
+		}
+	}
+	return nil
+}
+
+// formatEvalReport produce el resumen legible que imprime `medi-logic eval`.
+func formatEvalReport(rep EvalReport) string {
+	var b strings.Builder
+	b.WriteString("MediLogic – Evaluación de casos\n")
+	b.WriteString(fmt.Sprintf("Casos: %d\n", rep.Total))
+	b.WriteString(fmt.Sprintf("Top-1: %d/%d (%.1f%%)\n", rep.Top1, rep.Total, rep.Top1Accuracy*100))
+	b.WriteString(fmt.Sprintf("Top-3: %d/%d (%.1f%%)\n", rep.Top3, rep.Total, rep.Top3Accuracy*100))
+	b.WriteString(fmt.Sprintf("MRR: %.3f\n", rep.MRR))
+	if rep.MedCasos > 0 {
+		b.WriteString(fmt.Sprintf("Medicamento: %d/%d (%.1f%%)\n", rep.MedAciertos, rep.MedCasos, rep.MedAccuracy*100))
+	}
+	if rep.UrgCasos > 0 {
+		b.WriteString(fmt.Sprintf("Urgencia: %d/%d (%.1f%%)\n", rep.UrgAciertos, rep.UrgCasos, rep.UrgAccuracy*100))
+	}
+
+	b.WriteString("\nMatriz de confusión (esperada -> obtenida: n)\n")
+	var esperadas []string
+	for e := range rep.Confusion {
+		esperadas = append(esperadas, e)
+	}
+	sort.Strings(esperadas)
+	for _, e := range esperadas {
+		var obt []string
+		for o := range rep.Confusion[e] {
+			obt = append(obt, o)
+		}
+		sort.Strings(obt)
+		var cols []string
+		for _, o := range obt {
+			cols = append(cols, fmt.Sprintf("%s:%d", o, rep.Confusion[e][o]))
+		}
+		b.WriteString(fmt.Sprintf("  %s -> %s\n", e, strings.Join(cols, ", ")))
+	}
+
+	if len(rep.Fallos) > 0 {
+		b.WriteString("\nFallos\n")
+		for _, f := range rep.Fallos {
+			b.WriteString(fmt.Sprintf("- %s (rango %d)\n", f.ID, f.Rango))
+			for _, m := range f.Motivos {
+				b.WriteString("    " + m + "\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+//
+// ======== Endpoint /admin/eval ========
+//
+
+// evalReq permite evaluar contra una KB candidata; si KB es nil se usa la activa.
+type evalReq struct {
+	Casos []EvalCase `json:"casos"`
+	KB    *Knowledge `json:"kb,omitempty"`
+}
+
+func handleEval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var in evalReq
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	suite := EvalSuite{Casos: in.Casos}
+	if err := suite.validar(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rep EvalReport
+		err error
+	)
+	if in.KB != nil {
+		cand, cerr := newVM(buildPL(*in.KB))
+		if cerr != nil {
+			http.Error(w, fmt.Sprintf("KB candidata no compila: %v", cerr), http.StatusBadRequest)
+			return
+		}
+		rep, err = evaluar(cand, suite)
+	} else {
+		mu.Lock()
+		var base *baseKB
+		if base, err = buscarBase(nombreKB(r)); err == nil {
+			rep, err = evaluar(base.vm, suite)
+		}
+		mu.Unlock()
+	}
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+//
+// ======== Comando `medi-logic eval` ========
+//
+
+func runEvalCmd(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	casos := fs.String("casos", "", "archivo JSON con los casos etiquetados")
+	kbFile := fs.String("kb", "", "KB candidata en JSON (por defecto se usa el .pl activo)")
+	plFile := fs.String("pl", plPath, "archivo .pl a evaluar cuando no se indica -kb")
+	asJSON := fs.Bool("json", false, "imprimir el informe en JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *casos == "" {
+		fmt.Fprintln(os.Stderr, "uso: medi-logic eval -casos casos.json [-kb kb.json | -pl archivo.pl] [-json]")
+		return 2
+	}
+
+	f, err := os.Open(*casos)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	suite, err := loadEvalSuite(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var code string
+	if *kbFile != "" {
+		b, err := os.ReadFile(*kbFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var k Knowledge
+		if err := json.Unmarshal(b, &k); err != nil {
+			fmt.Fprintf(os.Stderr, "KB inválida: %v\n", err)
+			return 1
+		}
+		code = buildPL(k)
+	} else {
+		b, err := os.ReadFile(*plFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		code = string(b)
+	}
+	v, err := newVM(code)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error cargando Prolog: %v\n", err)
+		return 1
+	}
+
+	rep, err := evaluar(v, suite)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	} else {
+		fmt.Print(formatEvalReport(rep))
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func casoEval(id, esperada string, sintomas ...string) EvalCase {
+	c := EvalCase{ID: id, Esperado: EvalEsperado{Enfermedad: esperada}}
+	for i := 0; i < len(sintomas); i += 2 {
+		c.Sintomas = append(c.Sintomas, SintomaInput{Nombre: sintomas[i], Severidad: sintomas[i+1]})
+	}
+	return c
+}
+
+func TestEvaluarDefaultKB(t *testing.T) {
+	v, err := compilarPL(buildPL(defaultKB()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	casos := []struct {
+		caso  EvalCase
+		rango int
+	}{
+		{casoEval("gripe", "influenza", "fiebre", "severo", "tos", "moderado", "fatiga", "moderado"), 1},
+		{casoEval("resfriado", "resfriado_comun", "tos", "moderado", "dolor_garganta", "moderado"), 1},
+		{casoEval("migrana", "migrana", "dolor_cabeza", "severo"), 1},
+		{casoEval("migrana-segunda", "migrana", "dolor_cabeza", "leve", "fiebre", "severo"), 2},
+		{casoEval("resfriado-tercero", "resfriado_comun", "dolor_cabeza", "leve", "fiebre", "severo"), 3},
+		{casoEval("resfriado-con-fiebre", "Resfriado común", "fiebre", "leve"), 2}, // se normaliza a átomo
+		{casoEval("sin-migrana", "migrana", "tos", "moderado", "dolor_garganta", "moderado"), 0},
+	}
+	var suite EvalSuite
+	top1, top3, mrr := 0, 0, 0.0
+	for _, c := range casos {
+		rep, err := evaluar(v, EvalSuite{Casos: []EvalCase{c.caso}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rango := 1
+		if len(rep.Fallos) > 0 {
+			rango = rep.Fallos[0].Rango
+		}
+		if rango != c.rango {
+			t.Errorf("%s: rango %d, se esperaba %d", c.caso.ID, rango, c.rango)
+		}
+		suite.Casos = append(suite.Casos, c.caso)
+		if c.rango == 1 {
+			top1++
+		}
+		if c.rango >= 1 && c.rango <= 3 {
+			top3++
+		}
+		if c.rango > 0 {
+			mrr += 1 / float64(c.rango)
+		}
+	}
+
+	rep, err := evaluar(v, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(casos)
+	if rep.Total != n || rep.Top1 != top1 || rep.Top3 != top3 {
+		t.Errorf("total %d, top1 %d, top3 %d; se esperaba %d, %d, %d", rep.Total, rep.Top1, rep.Top3, n, top1, top3)
+	}
+	if math.Abs(rep.Top1Accuracy-float64(top1)/float64(n)) > 1e-9 || math.Abs(rep.MRR-mrr/float64(n)) > 1e-9 {
+		t.Errorf("top1Accuracy %v, mrr %v; se esperaba %v, %v", rep.Top1Accuracy, rep.MRR, float64(top1)/float64(n), mrr/float64(n))
+	}
+	if rep.Confusion["migrana"]["influenza"] != 1 || rep.Confusion["migrana"]["resfriado_comun"] != 1 {
+		t.Errorf("confusión de migrana: %v", rep.Confusion["migrana"])
+	}
+}
+
+func TestEvaluarMedicamentoYUrgencia(t *testing.T) {
+	v, err := compilarPL(buildPL(defaultKB()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := casoEval("gripe", "influenza", "fiebre", "severo", "tos", "moderado")
+	c.Alergias = []string{"aines"}
+	c.Esperado.Medicamento, c.Esperado.Urgencia = "paracetamol", "Posible automanejo"
+	rep, err := evaluar(v, EvalSuite{Casos: []EvalCase{c}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Top1 != 1 || rep.MedAciertos != 1 || rep.UrgCasos != 1 || rep.UrgAciertos != 0 {
+		t.Fatalf("informe: %+v", rep)
+	}
+	if len(rep.Fallos) != 1 || len(rep.Fallos[0].Motivos) != 1 || !strings.HasPrefix(rep.Fallos[0].Motivos[0], "urgencia") {
+		t.Errorf("fallos: %+v", rep.Fallos)
+	}
+}
+
+func TestHandleEvalKBCandidata(t *testing.T) {
+	// la KB candidata sin la característica tos de resfriado_comun pierde
+	// el primer puesto en el caso de tos y garganta
+	k := defaultKB()
+	k.Diseases[0].Caracteristicas = k.Diseases[0].Caracteristicas[1:]
+	body, _ := json.Marshal(evalReq{
+		Casos: []EvalCase{casoEval("resfriado", "resfriado_comun", "tos", "severo")},
+		KB:    &k,
+	})
+	w := httptest.NewRecorder()
+	handleEval(w, httptest.NewRequest(http.MethodPost, "/admin/eval", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var rep EvalReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Total != 1 || rep.Top1 != 0 || rep.Fallos[0].Obtenido.Enfermedad != "influenza" {
+		t.Errorf("informe: %+v", rep)
+	}
+
+	for _, cuerpo := range []string{`{"casos":[]}`, `{"casos":[{"sintomas":[]}]}`, `no es json`} {
+		w := httptest.NewRecorder()
+		handleEval(w, httptest.NewRequest(http.MethodPost, "/admin/eval", strings.NewReader(cuerpo)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", cuerpo, w.Code)
+		}
+	}
+}
+
+func TestRunEvalCmd(t *testing.T) {
+	kb := filepath.Join(t.TempDir(), "kb.json")
+	b, _ := json.Marshal(defaultKB())
+	if err := os.WriteFile(kb, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := runEvalCmd([]string{"-casos", filepath.Join("casos", "basicos.json"), "-kb", kb, "-json"}); n != 0 {
+		t.Errorf("eval con casos/basicos.json: código %d", n)
+	}
+	if n := runEvalCmd(nil); n != 2 {
+		t.Errorf("sin -casos: código %d", n)
+	}
+	if n := runEvalCmd([]string{"-casos", "no_existe.json"}); n != 1 {
+		t.Errorf("casos inexistentes: código %d", n)
+	}
+}
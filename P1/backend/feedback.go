@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// ======== Retroalimentación clínica ========
+//
+// Cada /analyze devuelve un consultaId. El médico confirma después el
+// diagnóstico real con POST /feedback y el admin consulta las tasas de
+// acuerdo en GET /admin/feedback/report. El consultaId llega también a la
+// interfaz del paciente, así que /feedback exige una cuenta editor o superior
+// con acceso a la KB de la consulta, y se anota quién confirmó.
+//
+// Para poder cruzar la confirmación con lo sugerido se guarda un resumen de
+// cada consulta reciente (sólo síntomas y primer resultado, sin datos del
+// paciente) durante consultaTTL. Además de en memoria, cada resumen se añade
+// a storage/consultas.jsonl, que se relee al arrancar: un reinicio no deja
+// sin respuesta los /feedback pendientes. El archivo se compacta (sin las
+// vencidas) al cargar y cada consultaMaxMem altas. El informe de cada KB
+// (ver bases.go) sólo cuenta las consultas hechas contra ella.
+
+const (
+	consultaTTL    = 72 * time.Hour
+	consultaMaxMem = 10000
+)
+
+var (
+	feedbackPath  = filepath.Join("storage", "feedback.jsonl")
+	consultasPath = filepath.Join("storage", "consultas.jsonl")
+)
+
+type consultaResumen struct {
+	KB       string    `json:"kb,omitempty"`
+	Fecha    time.Time `json:"fecha"`
+	Sintomas []string  `json:"sintomas"`
+	Sugerida string    `json:"sugerida,omitempty"`
+	Med      string    `json:"med,omitempty"`
+	Urg      string    `json:"urg,omitempty"`
+}
+
+// consultaGuardada es una línea de consultas.jsonl.
+type consultaGuardada struct {
+	ID string `json:"id"`
+	consultaResumen
+}
+
+type FeedbackReq struct {
+	ConsultaID       string `json:"consultaId"`
+	Diagnostico      string `json:"diagnostico"`      // diagnóstico confirmado
+	Medicamento      string `json:"medicamento"`      // medicamento prescrito
+	UrgenciaAdecuada *bool  `json:"urgenciaAdecuada"` // ¿la urgencia sugerida fue apropiada?
+}
+
+type Feedback struct {
+	ConsultaID       string    `json:"consultaId"`
+	KB               string    `json:"kb,omitempty"` // vacío: la general
+	Fecha            time.Time `json:"fecha"`
+	Sintomas         []string  `json:"sintomas"`
+	Sugerida         string    `json:"sugerida"`
+	SugeridoMed      string    `json:"sugeridoMed"`
+	Urgencia         string    `json:"urgencia"`
+	Diagnostico      string    `json:"diagnostico"`
+	Medicamento      string    `json:"medicamento,omitempty"`
+	UrgenciaAdecuada *bool     `json:"urgenciaAdecuada,omitempty"`
+	Acierto          bool      `json:"acierto"`
+	Autor            string    `json:"autor,omitempty"` // cuenta que confirmó el diagnóstico
+}
+
+var (
+	fbMu       sync.Mutex
+	consultas  = map[string]consultaResumen{}
+	feedbacks  []Feedback
+	feedbackID = map[string]bool{}
+
+	consultasAltas int // líneas añadidas a consultas.jsonl desde la última compactación
+)
+
+func nuevoID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// registrarConsulta guarda el resumen de una consulta y devuelve su ID.
+func registrarConsulta(kbNombre string, req AnalyzeReq, res []resultado) string {
+	id := nuevoID()
+	c := consultaResumen{KB: kbNombre, Fecha: time.Now()}
+	for _, s := range req.Sintomas {
+		c.Sintomas = append(c.Sintomas, atomize(s.Nombre))
+	}
+	if len(res) > 0 {
+		c.Sugerida, c.Med, c.Urg = res[0].Enf, res[0].Med, res[0].Urg
+	}
+
+	fbMu.Lock()
+	defer fbMu.Unlock()
+	if len(consultas) >= consultaMaxMem {
+		podarConsultas()
+	}
+	consultas[id] = c
+	if err := appendConsulta(id, c); err != nil {
+		logp("consultas: %v", err)
+	}
+	return id
+}
+
+func appendConsulta(id string, c consultaResumen) error {
+	consultasAltas++
+	if consultasAltas >= consultaMaxMem {
+		podarConsultas()
+		return compactarConsultas()
+	}
+	f, err := os.OpenFile(consultasPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, _ := json.Marshal(consultaGuardada{ID: id, consultaResumen: c})
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// compactarConsultas reescribe consultas.jsonl con las consultas en memoria.
+// Debe llamarse con fbMu tomado.
+func compactarConsultas() error {
+	var buf []byte
+	for id, c := range consultas {
+		b, _ := json.Marshal(consultaGuardada{ID: id, consultaResumen: c})
+		buf = append(append(buf, b...), '\n')
+	}
+	tmp := consultasPath + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	consultasAltas = 0
+	return os.Rename(tmp, consultasPath)
+}
+
+// loadConsultas recupera las consultas aún no vencidas de consultas.jsonl.
+func loadConsultas() {
+	f, err := os.Open(consultasPath)
+	if err != nil {
+		return
+	}
+	limite := time.Now().Add(-consultaTTL)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var c consultaGuardada
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil || c.ID == "" || c.Fecha.Before(limite) {
+			continue
+		}
+		consultas[c.ID] = c.consultaResumen
+	}
+	f.Close()
+	for len(consultas) > consultaMaxMem {
+		podarConsultas()
+	}
+	if err := compactarConsultas(); err != nil {
+		logp("consultas: %v", err)
+	}
+}
+
+// podarConsultas descarta las consultas vencidas y, si aún no hay sitio, la más antigua.
+// Debe llamarse con fbMu tomado.
+func podarConsultas() {
+	limite := time.Now().Add(-consultaTTL)
+	var oldestID string
+	var oldest time.Time
+	for id, c := range consultas {
+		if c.Fecha.Before(limite) {
+			delete(consultas, id)
+			continue
+		}
+		if oldestID == "" || c.Fecha.Before(oldest) {
+			oldestID, oldest = id, c.Fecha
+		}
+	}
+	if len(consultas) >= consultaMaxMem && oldestID != "" {
+		delete(consultas, oldestID)
+	}
+}
+
+func loadFeedback() {
+	loadConsultas()
+	f, err := os.Open(feedbackPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var fb Feedback
+		if err := json.Unmarshal(sc.Bytes(), &fb); err != nil {
+			continue
+		}
+		feedbacks = append(feedbacks, fb)
+		feedbackID[fb.ConsultaID] = true
+	}
+}
+
+func appendFeedback(fb Feedback) error {
+	f, err := os.OpenFile(feedbackPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, _ := json.Marshal(fb)
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var in FeedbackReq
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if in.ConsultaID == "" || in.Diagnostico == "" {
+		http.Error(w, "consultaId y diagnostico son obligatorios", http.StatusBadRequest)
+		return
+	}
+
+	fbMu.Lock()
+	defer fbMu.Unlock()
+	c, ok := consultas[in.ConsultaID]
+	if !ok {
+		http.Error(w, "consulta desconocida o vencida", http.StatusNotFound)
+		return
+	}
+	kbConsulta := c.KB
+	if kbConsulta == "" {
+		kbConsulta = kbGeneral
+	}
+	if s := sesionDeCtx(r); s == nil || !s.puedeKB(kbConsulta) {
+		http.Error(w, "la cuenta no tiene acceso a la KB de la consulta", http.StatusForbidden)
+		return
+	}
+	if feedbackID[in.ConsultaID] {
+		http.Error(w, "la consulta ya tiene retroalimentación", http.StatusConflict)
+		return
+	}
+	fb := Feedback{
+		ConsultaID:       in.ConsultaID,
+		KB:               c.KB,
+		Fecha:            time.Now(),
+		Sintomas:         c.Sintomas,
+		Sugerida:         c.Sugerida,
+		SugeridoMed:      c.Med,
+		Urgencia:         c.Urg,
+		Diagnostico:      atomize(in.Diagnostico),
+		UrgenciaAdecuada: in.UrgenciaAdecuada,
+		Autor:            autorDe(r),
+	}
+	if in.Medicamento != "" {
+		fb.Medicamento = atomize(in.Medicamento)
+	}
+	fb.Acierto = fb.Sugerida == fb.Diagnostico
+	if err := appendFeedback(fb); err != nil {
+		http.Error(w, "no se pudo guardar la retroalimentación", http.StatusInternalServerError)
+		return
+	}
+	feedbacks = append(feedbacks, fb)
+	feedbackID[fb.ConsultaID] = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// ======== Informe de retroalimentación ========
+//
+
+type FeedbackEnfermedad struct {
+	Enfermedad    string   `json:"enfermedad"` // diagnóstico confirmado
+	Casos         int      `json:"casos"`
+	Acuerdos      int      `json:"acuerdos"` // la sugerencia top-1 coincidió
+	Tasa          float64  `json:"tasa"`
+	MedCasos      int      `json:"medCasos"`
+	MedAcuerdos   int      `json:"medAcuerdos"` // el medicamento sugerido fue el prescrito
+	UrgCasos      int      `json:"urgCasos"`
+	UrgAdecuadas  int      `json:"urgAdecuadas"`
+	ConfundidaCon []string `json:"confundidaCon,omitempty"` // sugerencias erróneas más frecuentes
+}
+
+type FeedbackSintoma struct {
+	Sintoma   string  `json:"sintoma"`
+	Casos     int     `json:"casos"`
+	Errores   int     `json:"errores"`
+	TasaError float64 `json:"tasaError"`
+}
+
+type FeedbackReport struct {
+	Total         int                  `json:"total"`
+	Acuerdos      int                  `json:"acuerdos"`
+	Tasa          float64              `json:"tasa"`
+	PorEnfermedad []FeedbackEnfermedad `json:"porEnfermedad"`
+	Sintomas      []FeedbackSintoma    `json:"sintomas"` // ordenados por errores
+}
+
+func buildFeedbackReport(list []Feedback) FeedbackReport {
+	rep := FeedbackReport{Total: len(list)}
+	porEnf := map[string]*FeedbackEnfermedad{}
+	confusion := map[string]map[string]int{}
+	porSint := map[string]*FeedbackSintoma{}
+
+	for _, fb := range list {
+		e := porEnf[fb.Diagnostico]
+		if e == nil {
+			e = &FeedbackEnfermedad{Enfermedad: fb.Diagnostico}
+			porEnf[fb.Diagnostico] = e
+		}
+		e.Casos++
+		if fb.Acierto {
+			e.Acuerdos++
+			rep.Acuerdos++
+		} else {
+			if confusion[fb.Diagnostico] == nil {
+				confusion[fb.Diagnostico] = map[string]int{}
+			}
+			sug := fb.Sugerida
+			if sug == "" {
+				sug = sinResultado
+			}
+			confusion[fb.Diagnostico][sug]++
+		}
+		if fb.Medicamento != "" {
+			e.MedCasos++
+			if fb.Medicamento == fb.SugeridoMed {
+				e.MedAcuerdos++
+			}
+		}
+		if fb.UrgenciaAdecuada != nil {
+			e.UrgCasos++
+			if *fb.UrgenciaAdecuada {
+				e.UrgAdecuadas++
+			}
+		}
+		for _, s := range fb.Sintomas {
+			ps := porSint[s]
+			if ps == nil {
+				ps = &FeedbackSintoma{Sintoma: s}
+				porSint[s] = ps
+			}
+			ps.Casos++
+			if !fb.Acierto {
+				ps.Errores++
+			}
+		}
+	}
+	rep.Tasa = ratio(rep.Acuerdos, rep.Total)
+
+	for name, e := range porEnf {
+		e.Tasa = ratio(e.Acuerdos, e.Casos)
+		e.ConfundidaCon = topClaves(confusion[name], 3)
+		rep.PorEnfermedad = append(rep.PorEnfermedad, *e)
+	}
+	sort.Slice(rep.PorEnfermedad, func(i, j int) bool {
+		return rep.PorEnfermedad[i].Enfermedad < rep.PorEnfermedad[j].Enfermedad
+	})
+
+	for _, s := range porSint {
+		s.TasaError = ratio(s.Errores, s.Casos)
+		rep.Sintomas = append(rep.Sintomas, *s)
+	}
+	sort.Slice(rep.Sintomas, func(i, j int) bool {
+		a, b := rep.Sintomas[i], rep.Sintomas[j]
+		if a.Errores != b.Errores {
+			return a.Errores > b.Errores
+		}
+		return a.Sintoma < b.Sintoma
+	})
+	return rep
+}
+
+// topClaves devuelve las n claves con mayor conteo (empates por nombre).
+func topClaves(m map[string]int, n int) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if m[ks[i]] != m[ks[j]] {
+			return m[ks[i]] > m[ks[j]]
+		}
+		return ks[i] < ks[j]
+	})
+	if len(ks) > n {
+		ks = ks[:n]
+	}
+	return ks
+}
+
+func handleFeedbackReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	kbNombre := nombreKB(r)
+	fbMu.Lock()
+	var list []Feedback
+	for _, fb := range feedbacks {
+		if mismaKB(fb.KB, kbNombre) {
+			list = append(list, fb)
+		}
+	}
+	fbMu.Unlock()
+	rep := buildFeedbackReport(list)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
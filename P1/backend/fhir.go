@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//
+// ======== Salida FHIR R4 de /analyze ========
+//
+// Con Accept: application/fhir+json (o ?_format=application/fhir+json)
+// /analyze devuelve un Bundle "collection" en lugar de AnalyzeResp:
+//
+//   RiskAssessment     uno por consulta; una prediction por enfermedad con
+//                      probabilityDecimal = afinidad/100 y la urgencia como rationale
+//   Condition          una candidata por enfermedad (verificationStatus provisional),
+//                      con los síntomas consultados como evidence
+//   MedicationRequest  el medicamento sugerido para cada una (status draft,
+//                      intent proposal), con reasonReference a su Condition
+//
+// Los códigos de codigos.go van como coding (CIE-10, SNOMED CT, ICPC-2, ATC)
+// y el nombre del elemento como text. El consultaId de /feedback es el
+// identifier del Bundle y del RiskAssessment. El paciente, si se envía, es
+// el identifier del subject; si no, el subject sólo lleva display.
+//
+// Antes de responder el Bundle se comprueba con validarBundleFHIR (campos
+// obligatorios, valores de los códigos de estado y referencias internas):
+// si no la pasa es un fallo del servidor (500), no del cliente.
+
+const (
+	mimeFHIRJSON = "application/fhir+json"
+
+	sistemaICD10  = "http://hl7.org/fhir/sid/icd-10"
+	sistemaSNOMED = "http://snomed.info/sct"
+	sistemaICPC   = "http://hl7.org/fhir/sid/icpc-2"
+	sistemaATC    = "http://www.whocc.no/atc"
+
+	sistemaConsulta = "urn:medi-logic:consulta"
+	sistemaPaciente = "urn:medi-logic:paciente"
+	sistemaVerif    = "http://terminology.hl7.org/CodeSystem/condition-ver-status"
+
+	sinMedicamento = "ninguno" // lo que pone consulta_item/7 si no hay uno seguro
+)
+
+var sistemasFHIR = map[string]string{
+	codICD10: sistemaICD10, codSNOMED: sistemaSNOMED, codICPC: sistemaICPC, codATC: sistemaATC,
+}
+
+type fhirCoding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirConcepto struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirIdentificador struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+type fhirReferencia struct {
+	Reference  string             `json:"reference,omitempty"`
+	Identifier *fhirIdentificador `json:"identifier,omitempty"`
+	Display    string             `json:"display,omitempty"`
+}
+
+type fhirNota struct {
+	Text string `json:"text"`
+}
+
+type BundleFHIR struct {
+	ResourceType string             `json:"resourceType"`
+	ID           string             `json:"id"`
+	Identifier   *fhirIdentificador `json:"identifier,omitempty"`
+	Type         string             `json:"type"`
+	Timestamp    string             `json:"timestamp"`
+	Entry        []fhirEntrada      `json:"entry"`
+}
+
+type fhirEntrada struct {
+	FullURL  string      `json:"fullUrl"`
+	Resource interface{} `json:"resource"`
+}
+
+type fhirRiskAssessment struct {
+	ResourceType       string              `json:"resourceType"`
+	ID                 string              `json:"id"`
+	Identifier         []fhirIdentificador `json:"identifier,omitempty"`
+	Status             string              `json:"status"`
+	Method             *fhirConcepto       `json:"method,omitempty"`
+	Subject            fhirReferencia      `json:"subject"`
+	OccurrenceDateTime string              `json:"occurrenceDateTime"`
+	Prediction         []fhirPrediccion    `json:"prediction,omitempty"`
+	Note               []fhirNota          `json:"note,omitempty"`
+}
+
+type fhirPrediccion struct {
+	Outcome            fhirConcepto `json:"outcome"`
+	ProbabilityDecimal float64      `json:"probabilityDecimal"`
+	Rationale          string       `json:"rationale,omitempty"`
+}
+
+type fhirCondition struct {
+	ResourceType       string          `json:"resourceType"`
+	ID                 string          `json:"id"`
+	VerificationStatus fhirConcepto    `json:"verificationStatus"`
+	Code               fhirConcepto    `json:"code"`
+	Subject            fhirReferencia  `json:"subject"`
+	RecordedDate       string          `json:"recordedDate"`
+	Evidence           []fhirEvidencia `json:"evidence,omitempty"`
+	Note               []fhirNota      `json:"note,omitempty"`
+}
+
+type fhirEvidencia struct {
+	Code []fhirConcepto `json:"code"`
+}
+
+type fhirMedicationRequest struct {
+	ResourceType              string           `json:"resourceType"`
+	ID                        string           `json:"id"`
+	Status                    string           `json:"status"`
+	Intent                    string           `json:"intent"`
+	MedicationCodeableConcept fhirConcepto     `json:"medicationCodeableConcept"`
+	Subject                   fhirReferencia   `json:"subject"`
+	AuthoredOn                string           `json:"authoredOn"`
+	ReasonReference           []fhirReferencia `json:"reasonReference,omitempty"`
+}
+
+// pideFHIR dice si la petición negocia FHIR. El error (406) es para quien
+// sólo acepta FHIR en XML, que no se genera.
+func pideFHIR(r *http.Request) (bool, error) {
+	if f := r.URL.Query().Get("_format"); f != "" {
+		switch f {
+		case mimeFHIRJSON, "fhir+json", "application/json+fhir":
+			return true, nil
+		case "xml", "application/fhir+xml", "fhir+xml":
+			return false, fmt.Errorf("sólo se genera FHIR en JSON (%s)", mimeFHIRJSON)
+		}
+		return false, nil
+	}
+	xml := false
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := mime.ParseMediaType(strings.TrimSpace(a))
+		switch mt {
+		case mimeFHIRJSON, "application/json+fhir":
+			return true, nil
+		case "application/fhir+xml", "application/xml+fhir":
+			xml = true
+		case "*/*", "application/json":
+			return false, nil
+		}
+	}
+	if xml {
+		return false, fmt.Errorf("sólo se genera FHIR en JSON (%s)", mimeFHIRJSON)
+	}
+	return false, nil
+}
+
+// uuidFHIR es un UUID v4 para ids y fullUrl urn:uuid.
+func uuidFHIR() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// conceptoFHIR arma el CodeableConcept de un elemento con sus códigos. El
+// nombre de la KB va en text: no es el display oficial del código.
+func conceptoFHIR(nombre string, cods map[string]string, sistemas ...string) fhirConcepto {
+	c := fhirConcepto{Text: nombre}
+	for _, s := range sistemas {
+		if v := cods[s]; v != "" {
+			c.Coding = append(c.Coding, fhirCoding{System: sistemasFHIR[s], Code: v})
+		}
+	}
+	return c
+}
+
+// bundleFHIR traduce una consulta ya resuelta a un Bundle R4.
+func bundleFHIR(resp AnalyzeResp, req AnalyzeReq, res []resultado, info map[string]infoEnf, cods map[string]map[string]string, ahora time.Time) BundleFHIR {
+	fecha := ahora.UTC().Format(time.RFC3339)
+	b := BundleFHIR{ResourceType: "Bundle", ID: uuidFHIR(), Type: "collection", Timestamp: fecha, Entry: []fhirEntrada{}}
+	add := func(id string, r interface{}) string {
+		url := "urn:uuid:" + id
+		b.Entry = append(b.Entry, fhirEntrada{FullURL: url, Resource: r})
+		return url
+	}
+
+	sujeto := fhirReferencia{Display: "Paciente de la consulta"}
+	if p := strings.TrimSpace(req.Paciente); p != "" {
+		sujeto = fhirReferencia{Identifier: &fhirIdentificador{System: sistemaPaciente, Value: p}}
+	}
+
+	ra := fhirRiskAssessment{
+		ResourceType:       "RiskAssessment",
+		ID:                 uuidFHIR(),
+		Status:             "preliminary",
+		Method:             &fhirConcepto{Text: "MediLogic: afinidad de los síntomas con cada enfermedad"},
+		Subject:            sujeto,
+		OccurrenceDateTime: fecha,
+	}
+	if resp.ConsultaID != "" {
+		id := fhirIdentificador{System: sistemaConsulta, Value: resp.ConsultaID}
+		b.Identifier = &id
+		ra.Identifier = []fhirIdentificador{id}
+	}
+	if resp.Borrador != "" {
+		ra.Note = []fhirNota{{Text: "Consulta de prueba contra el borrador " + resp.Borrador}}
+	}
+	add(ra.ID, &ra) // primero; las predicciones se van añadiendo al mismo valor
+
+	var evidencia []fhirConcepto
+	for _, s := range req.Sintomas {
+		n := atomize(s.Nombre)
+		evidencia = append(evidencia, conceptoFHIR(n, cods[n], codSNOMED, codICPC))
+	}
+
+	for _, row := range res {
+		enf := conceptoFHIR(row.Enf, cods[row.Enf], codICD10)
+		ra.Prediction = append(ra.Prediction, fhirPrediccion{
+			Outcome:            enf,
+			ProbabilityDecimal: float64(clamp(int(row.Afin), 0, 100)) / 100,
+			Rationale:          row.Urg,
+		})
+
+		cond := fhirCondition{
+			ResourceType: "Condition",
+			ID:           uuidFHIR(),
+			VerificationStatus: fhirConcepto{Coding: []fhirCoding{
+				{System: sistemaVerif, Code: "provisional", Display: "Provisional"},
+			}},
+			Code:         enf,
+			Subject:      sujeto,
+			RecordedDate: fecha,
+		}
+		if len(evidencia) > 0 {
+			cond.Evidence = []fhirEvidencia{{Code: evidencia}}
+		}
+		if d := info[row.Enf].D; d != "" {
+			cond.Note = []fhirNota{{Text: d}}
+		}
+		urlCond := add(cond.ID, &cond)
+
+		if row.Med == "" || row.Med == sinMedicamento {
+			continue
+		}
+		mr := fhirMedicationRequest{
+			ResourceType:              "MedicationRequest",
+			ID:                        uuidFHIR(),
+			Status:                    "draft",
+			Intent:                    "proposal",
+			MedicationCodeableConcept: conceptoFHIR(row.Med, cods[row.Med], codATC),
+			Subject:                   sujeto,
+			AuthoredOn:                fecha,
+			ReasonReference:           []fhirReferencia{{Reference: urlCond, Display: row.Enf}},
+		}
+		add(mr.ID, &mr)
+	}
+	return b
+}
+
+//
+// ======== Validación estructural ========
+//
+
+var (
+	estadosRiskAssessment = []string{"registered", "preliminary", "final", "amended", "corrected", "cancelled", "entered-in-error", "unknown"}
+	estadosMedRequest     = []string{"active", "on-hold", "cancelled", "completed", "entered-in-error", "stopped", "draft", "unknown"}
+	intentosMedRequest    = []string{"proposal", "plan", "order", "original-order", "reflex-order", "filler-order", "instance-order", "option"}
+	estadosVerificacion   = []string{"unconfirmed", "provisional", "differential", "confirmed", "refuted", "entered-in-error"}
+	tiposBundle           = []string{"document", "message", "transaction", "transaction-response", "batch", "batch-response", "history", "searchset", "collection"}
+)
+
+// validarBundleFHIR comprueba las cardinalidades mínimas y los códigos
+// obligatorios de R4 para los recursos que genera bundleFHIR, que las
+// referencias urn:uuid apunten a entradas del Bundle y que las
+// probabilidades estén entre 0 y 1. Devuelve todos los problemas.
+func validarBundleFHIR(b BundleFHIR) []string {
+	var errs []string
+	mal := func(format string, args ...interface{}) { errs = append(errs, fmt.Sprintf(format, args...)) }
+	fechaOK := func(campo, v string) {
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			mal("%s: fecha %q no es un dateTime", campo, v)
+		}
+	}
+	concepto := func(campo string, c fhirConcepto, obligatorio bool) {
+		if obligatorio && c.Text == "" && len(c.Coding) == 0 {
+			mal("%s es obligatorio", campo)
+		}
+		for _, cd := range c.Coding {
+			if cd.System == "" || cd.Code == "" {
+				mal("%s.coding necesita system y code", campo)
+			}
+		}
+	}
+	sujeto := func(campo string, r fhirReferencia) {
+		if r.Reference == "" && r.Identifier == nil && r.Display == "" {
+			mal("%s es obligatorio", campo)
+		}
+	}
+
+	if b.ResourceType != "Bundle" || b.ID == "" {
+		mal("Bundle: resourceType e id obligatorios")
+	}
+	if !contains(tiposBundle, b.Type) {
+		mal("Bundle.type %q no es válido", b.Type)
+	}
+	fechaOK("Bundle.timestamp", b.Timestamp)
+
+	urls := map[string]bool{}
+	for i, e := range b.Entry {
+		if !strings.HasPrefix(e.FullURL, "urn:uuid:") || urls[e.FullURL] {
+			mal("entry[%d].fullUrl %q no es un urn:uuid único", i, e.FullURL)
+		}
+		urls[e.FullURL] = true
+	}
+
+	n := 0
+	for i, e := range b.Entry {
+		campo := func(c string) string { return fmt.Sprintf("entry[%d].%s", i, c) }
+		switch r := e.Resource.(type) {
+		case *fhirRiskAssessment:
+			n++
+			if r.ID == "" || "urn:uuid:"+r.ID != e.FullURL {
+				mal("%s no coincide con fullUrl", campo("RiskAssessment.id"))
+			}
+			if !contains(estadosRiskAssessment, r.Status) {
+				mal("%s %q no es válido", campo("RiskAssessment.status"), r.Status)
+			}
+			sujeto(campo("RiskAssessment.subject"), r.Subject)
+			fechaOK(campo("RiskAssessment.occurrenceDateTime"), r.OccurrenceDateTime)
+			for j, p := range r.Prediction {
+				concepto(campo(fmt.Sprintf("RiskAssessment.prediction[%d].outcome", j)), p.Outcome, true)
+				if p.ProbabilityDecimal < 0 || p.ProbabilityDecimal > 1 || math.IsNaN(p.ProbabilityDecimal) {
+					mal("%s %v fuera de 0..1", campo(fmt.Sprintf("RiskAssessment.prediction[%d].probabilityDecimal", j)), p.ProbabilityDecimal)
+				}
+			}
+		case *fhirCondition:
+			if r.ID == "" || "urn:uuid:"+r.ID != e.FullURL {
+				mal("%s no coincide con fullUrl", campo("Condition.id"))
+			}
+			sujeto(campo("Condition.subject"), r.Subject)
+			concepto(campo("Condition.code"), r.Code, true)
+			if len(r.VerificationStatus.Coding) != 1 || r.VerificationStatus.Coding[0].System != sistemaVerif ||
+				!contains(estadosVerificacion, r.VerificationStatus.Coding[0].Code) {
+				mal("%s no es un código de %s", campo("Condition.verificationStatus"), sistemaVerif)
+			}
+			fechaOK(campo("Condition.recordedDate"), r.RecordedDate)
+			for j, ev := range r.Evidence {
+				for k, c := range ev.Code {
+					concepto(campo(fmt.Sprintf("Condition.evidence[%d].code[%d]", j, k)), c, true)
+				}
+			}
+		case *fhirMedicationRequest:
+			if r.ID == "" || "urn:uuid:"+r.ID != e.FullURL {
+				mal("%s no coincide con fullUrl", campo("MedicationRequest.id"))
+			}
+			if !contains(estadosMedRequest, r.Status) {
+				mal("%s %q no es válido", campo("MedicationRequest.status"), r.Status)
+			}
+			if !contains(intentosMedRequest, r.Intent) {
+				mal("%s %q no es válido", campo("MedicationRequest.intent"), r.Intent)
+			}
+			concepto(campo("MedicationRequest.medicationCodeableConcept"), r.MedicationCodeableConcept, true)
+			sujeto(campo("MedicationRequest.subject"), r.Subject)
+			fechaOK(campo("MedicationRequest.authoredOn"), r.AuthoredOn)
+			for _, rr := range r.ReasonReference {
+				if !urls[rr.Reference] {
+					mal("%s %q no está en el Bundle", campo("MedicationRequest.reasonReference"), rr.Reference)
+				}
+			}
+		default:
+			mal("%s: recurso inesperado %T", campo("resource"), e.Resource)
+		}
+	}
+	if n != 1 {
+		mal("el Bundle debe tener un RiskAssessment (tiene %d)", n)
+	}
+	return errs
+}
+
+// escribirFHIR valida el Bundle y lo envía como application/fhir+json.
+func escribirFHIR(w http.ResponseWriter, b BundleFHIR) {
+	if errs := validarBundleFHIR(b); len(errs) > 0 {
+		logp("FHIR: Bundle inválido: %s", strings.Join(errs, "; "))
+		http.Error(w, "no se pudo generar un Bundle FHIR válido", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mimeFHIRJSON+"; fhirVersion=4.0")
+	_ = json.NewEncoder(w).Encode(b)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var actualizar = flag.Bool("actualizar", false, "reescribe los archivos de testdata/")
+
+func TestPideFHIR(t *testing.T) {
+	casos := []struct {
+		accept, formato string
+		quiere, err     bool
+	}{
+		{"", "", false, false},
+		{"application/json", "", false, false},
+		{"application/fhir+json", "", true, false},
+		{"application/fhir+json; fhirVersion=4.0", "", true, false},
+		{"application/json+fhir", "", true, false}, // DSTU2, se acepta igual
+		{"application/fhir+xml", "", false, true},
+		{"application/xml+fhir", "", false, true},
+		{"*/*", "", false, false},
+		{"text/html", "", false, false},
+		// listas: gana el primero que decide
+		{"application/fhir+xml, application/fhir+json", "", true, false},
+		{"application/fhir+json;q=0.9, */*;q=0.1", "", true, false},
+		{"application/json, application/fhir+json", "", false, false},
+		{"*/*, application/fhir+json", "", false, false},
+		{"application/fhir+xml, */*", "", false, false},
+		{"application/fhir+xml, text/html", "", false, true},
+		// _format manda sobre Accept
+		{"application/json", "application/fhir+json", true, false},
+		{"application/fhir+json", "json", false, false},
+		{"", "fhir+json", true, false},
+		{"application/fhir+json", "xml", false, true},
+		{"", "application/fhir+xml", false, true},
+	}
+	for _, c := range casos {
+		u := "/analyze"
+		if c.formato != "" {
+			u += "?_format=" + strings.ReplaceAll(c.formato, "+", "%2B")
+		}
+		r := httptest.NewRequest("POST", u, nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		got, err := pideFHIR(r)
+		if got != c.quiere || (err != nil) != c.err {
+			t.Errorf("Accept %q, _format %q: %v, %v; se esperaba %v, error %v", c.accept, c.formato, got, err, c.quiere, c.err)
+		}
+	}
+}
+
+// bundleDefault resuelve una consulta fija contra defaultKB() como lo hace
+// handleAnalyze y devuelve el Bundle.
+func bundleDefault(t *testing.T) BundleFHIR {
+	t.Helper()
+	v, err := compilarPL(buildPL(defaultKB()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := AnalyzeReq{
+		Sintomas: []SintomaInput{{Nombre: "fiebre", Severidad: "severo"}, {Nombre: "tos", Severidad: "moderado"}},
+		Alergias: []string{"aines"},
+		Paciente: "P-0001",
+	}
+	res, err := consultar(v, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 {
+		t.Fatal("la consulta no devolvió resultados")
+	}
+	resp := AnalyzeResp{ConsultaID: "consulta-fija"}
+	ahora := time.Date(2025, 6, 13, 10, 30, 0, 0, time.UTC)
+	return bundleFHIR(resp, req, res, infoEnfermedades(v, res), codigosDe(v), ahora)
+}
+
+var uuidRe = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+
+// sinUUIDs cambia cada UUID por uuid-N en orden de aparición, para comparar
+// Bundles de ejecuciones distintas.
+func sinUUIDs(b []byte) []byte {
+	vistos := map[string]string{}
+	return uuidRe.ReplaceAllFunc(b, func(u []byte) []byte {
+		if _, ok := vistos[string(u)]; !ok {
+			vistos[string(u)] = fmt.Sprintf("uuid-%d", len(vistos)+1)
+		}
+		return []byte(vistos[string(u)])
+	})
+}
+
+func TestBundleFHIRGolden(t *testing.T) {
+	b, err := json.MarshalIndent(bundleDefault(t), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := append(sinUUIDs(b), '\n')
+	ruta := filepath.Join("testdata", "fhir_bundle_default.json")
+	if *actualizar {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(ruta, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quiere, err := os.ReadFile(ruta)
+	if err != nil {
+		t.Fatalf("%v (genérelo con go test -run TestBundleFHIRGolden -actualizar)", err)
+	}
+	if !bytes.Equal(got, quiere) {
+		t.Errorf("el Bundle no coincide con %s (si el cambio es intencionado, -actualizar):\n%s", ruta, got)
+	}
+}
+
+// TestBundleFHIRR4 lee el Bundle ya serializado, como lo haría un cliente,
+// y comprueba los campos obligatorios de R4 y los enlaces internos sin pasar
+// por validarBundleFHIR.
+func TestBundleFHIRR4(t *testing.T) {
+	b := bundleDefault(t)
+	if errs := validarBundleFHIR(b); len(errs) > 0 {
+		t.Fatalf("validarBundleFHIR: %v", errs)
+	}
+	data, _ := json.Marshal(b)
+	var bundle struct {
+		ResourceType string            `json:"resourceType"`
+		Type         string            `json:"type"`
+		Timestamp    string            `json:"timestamp"`
+		Identifier   map[string]string `json:"identifier"`
+		Entry        []struct {
+			FullURL  string                 `json:"fullUrl"`
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.ResourceType != "Bundle" || bundle.Type != "collection" || bundle.Timestamp == "" {
+		t.Fatalf("Bundle: resourceType %q, type %q, timestamp %q", bundle.ResourceType, bundle.Type, bundle.Timestamp)
+	}
+	if bundle.Identifier["system"] != sistemaConsulta || bundle.Identifier["value"] != "consulta-fija" {
+		t.Errorf("Bundle.identifier = %v", bundle.Identifier)
+	}
+
+	// campos 1..1 de R4 para cada recurso que se genera
+	obligatorios := map[string][]string{
+		"RiskAssessment":    {"id", "status", "subject"},
+		"Condition":         {"id", "subject", "code", "verificationStatus"},
+		"MedicationRequest": {"id", "status", "intent", "subject", "medicationCodeableConcept"},
+	}
+	recursos := map[string]map[string]interface{}{} // fullUrl -> recurso
+	cuenta := map[string]int{}
+	for i, e := range bundle.Entry {
+		tipo, _ := e.Resource["resourceType"].(string)
+		cuenta[tipo]++
+		campos, ok := obligatorios[tipo]
+		if !ok {
+			t.Errorf("entry[%d]: recurso inesperado %q", i, tipo)
+			continue
+		}
+		for _, c := range campos {
+			if v, ok := e.Resource[c]; !ok || v == "" || v == nil {
+				t.Errorf("entry[%d] %s: falta %s", i, tipo, c)
+			}
+		}
+		if e.FullURL != "urn:uuid:"+e.Resource["id"].(string) {
+			t.Errorf("entry[%d]: fullUrl %q no es urn:uuid:<id>", i, e.FullURL)
+		}
+		recursos[e.FullURL] = e.Resource
+	}
+	if cuenta["RiskAssessment"] != 1 || cuenta["Condition"] == 0 || cuenta["MedicationRequest"] == 0 {
+		t.Fatalf("recursos: %v", cuenta)
+	}
+
+	texto := func(r map[string]interface{}, campo string) string {
+		c, _ := r[campo].(map[string]interface{})
+		s, _ := c["text"].(string)
+		return s
+	}
+	predicciones := map[string]bool{}
+	for _, r := range recursos {
+		if r["resourceType"] != "RiskAssessment" {
+			continue
+		}
+		for _, p := range r["prediction"].([]interface{}) {
+			predicciones[texto(p.(map[string]interface{}), "outcome")] = true
+		}
+	}
+	condiciones := map[string]bool{}
+	for url, r := range recursos {
+		switch r["resourceType"] {
+		case "Condition":
+			condiciones[url] = true
+			if !predicciones[texto(r, "code")] {
+				t.Errorf("Condition %s no tiene prediction en el RiskAssessment", texto(r, "code"))
+			}
+		case "MedicationRequest":
+			refs, _ := r["reasonReference"].([]interface{})
+			if len(refs) != 1 {
+				t.Errorf("MedicationRequest %s: reasonReference = %v", texto(r, "medicationCodeableConcept"), refs)
+				continue
+			}
+			ref := refs[0].(map[string]interface{})
+			c, ok := recursos[ref["reference"].(string)]
+			if !ok || c["resourceType"] != "Condition" {
+				t.Errorf("MedicationRequest %s: reasonReference %v no lleva a una Condition del Bundle", texto(r, "medicationCodeableConcept"), ref["reference"])
+				continue
+			}
+			if texto(c, "code") != ref["display"] {
+				t.Errorf("reasonReference display %v, la Condition es %s", ref["display"], texto(c, "code"))
+			}
+			if texto(r, "medicationCodeableConcept") == "ibuprofeno" {
+				t.Error("se propuso ibuprofeno con alergia a aines")
+			}
+		}
+	}
+
+	// una referencia rota sí la detecta validarBundleFHIR
+	for _, e := range b.Entry {
+		if mr, ok := e.Resource.(*fhirMedicationRequest); ok {
+			mr.ReasonReference[0].Reference = "urn:uuid:no-existe"
+			break
+		}
+	}
+	if errs := validarBundleFHIR(b); len(errs) != 1 || !strings.Contains(errs[0], "reasonReference") {
+		t.Errorf("referencia rota: %v", errs)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+// ======== Ajuste de pesos de caracteriza/3 ========
+//
+// Objetivo de optimización (lexicográfico, de mayor a menor prioridad):
+//   1. maximizar los aciertos top-1 sobre los casos etiquetados;
+//   2. a igualdad, maximizar el rango recíproco medio (MRR) de la enfermedad esperada;
+//   3. a igualdad, minimizar el número de pesos distintos de la KB original.
+//
+// Se hace ascenso por coordenadas sobre los pesos enteros 1..3 (los mismos
+// límites que aplica clamp en buildPL). Sólo se ajustan pares enfermedad-síntoma
+// que ya existen; el ajuste nunca crea ni borra caracteriza/3.
+
+const fitObjetivo = "max top-1; desempate por MRR; luego mínimo de pesos modificados"
+
+// fitMaxPasadas limita las vueltas completas sobre todos los pesos.
+const fitMaxPasadas = 5
+
+// Cada evaluación compila la KB candidata y corre todos los casos, así que
+// /admin/fit limita los casos y el total de evaluaciones; al llegar al límite
+// devuelve la mejor candidata hasta ese punto con limitado=true. El comando
+// fit no tiene límite.
+const (
+	fitMaxCasos        = 200
+	fitMaxEvaluaciones = 600
+)
+
+type FitCambio struct {
+	Enfermedad string `json:"enfermedad"`
+	Sintoma    string `json:"sintoma"`
+	Antes      int    `json:"antes"`
+	Despues    int    `json:"despues"`
+}
+
+type FitResult struct {
+	Objetivo  string      `json:"objetivo"`
+	Pasadas   int         `json:"pasadas"`
+	Antes     EvalReport  `json:"antes"`
+	Despues   EvalReport  `json:"despues"`
+	Cambios   []FitCambio `json:"cambios"`
+	Limitado  bool        `json:"limitado,omitempty"` // se cortó en maxEval evaluaciones
+	Candidata Knowledge   `json:"candidata"`          // no se aplica: revisar y enviar a POST /admin/kb
+}
+
+// fitScore es el valor del objetivo para una KB concreta.
+type fitScore struct {
+	top1    int
+	mrr     float64
+	cambios int
+}
+
+func (a fitScore) mejorQue(b fitScore) bool {
+	if a.top1 != b.top1 {
+		return a.top1 > b.top1
+	}
+	// tolerancia para no oscilar por errores de redondeo
+	if d := a.mrr - b.mrr; d > 1e-9 || d < -1e-9 {
+		return a.mrr > b.mrr
+	}
+	return a.cambios < b.cambios
+}
+
+// evaluarKB compila la KB en un intérprete aislado y corre los casos.
+func evaluarKB(k Knowledge, s EvalSuite) (EvalReport, error) {
+	v, err := newVM(buildPL(k))
+	if err != nil {
+		return EvalReport{}, fmt.Errorf("KB no compila: %v", err)
+	}
+	return evaluar(v, s)
+}
+
+// ajustarPesos propone pesos nuevos para base según los casos, con a lo sumo
+// maxEval evaluaciones (0: sin límite). base no se modifica.
+func ajustarPesos(base Knowledge, s EvalSuite, maxEval int) (FitResult, error) {
+	antes, err := evaluarKB(base, s)
+	if err != nil {
+		return FitResult{}, err
+	}
+	cand := cloneKB(base)
+	for i := range cand.Diseases {
+		for j := range cand.Diseases[i].Caracteristicas {
+			c := &cand.Diseases[i].Caracteristicas[j]
+			c.Peso = clamp(c.Peso, 1, 3)
+		}
+	}
+
+	cambios := func() int {
+		n := 0
+		for i := range cand.Diseases {
+			for j, c := range cand.Diseases[i].Caracteristicas {
+				if c.Peso != clamp(base.Diseases[i].Caracteristicas[j].Peso, 1, 3) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	evaluaciones := 0
+	puntuar := func() (fitScore, EvalReport, error) {
+		evaluaciones++
+		rep, err := evaluarKB(cand, s)
+		if err != nil {
+			return fitScore{}, rep, err
+		}
+		return fitScore{top1: rep.Top1, mrr: rep.MRR, cambios: cambios()}, rep, nil
+	}
+
+	mejor, mejorRep, err := puntuar()
+	if err != nil {
+		return FitResult{}, err
+	}
+	pasadas, limitado := 0, false
+	for pasadas < fitMaxPasadas && !limitado {
+		pasadas++
+		mejoro := false
+		for i := range cand.Diseases {
+			for j := range cand.Diseases[i].Caracteristicas {
+				c := &cand.Diseases[i].Caracteristicas[j]
+				actual := c.Peso
+				elegido := actual
+				for w := 1; w <= 3 && !limitado; w++ {
+					if w == actual {
+						continue
+					}
+					if maxEval > 0 && evaluaciones >= maxEval {
+						limitado = true
+						break
+					}
+					c.Peso = w
+					sc, rep, err := puntuar()
+					if err != nil {
+						return FitResult{}, err
+					}
+					if sc.mejorQue(mejor) {
+						mejor, mejorRep, elegido = sc, rep, w
+					}
+				}
+				c.Peso = elegido
+				if elegido != actual {
+					mejoro = true
+				}
+			}
+		}
+		if !mejoro {
+			break
+		}
+	}
+
+	res := FitResult{
+		Objetivo:  fitObjetivo,
+		Pasadas:   pasadas,
+		Antes:     antes,
+		Despues:   mejorRep,
+		Candidata: cand,
+		Limitado:  limitado,
+	}
+	for i, d := range cand.Diseases {
+		for j, c := range d.Caracteristicas {
+			if old := base.Diseases[i].Caracteristicas[j].Peso; c.Peso != old {
+				res.Cambios = append(res.Cambios, FitCambio{Enfermedad: d.Name, Sintoma: c.Symptom, Antes: old, Despues: c.Peso})
+			}
+		}
+	}
+	return res, nil
+}
+
+func formatFitResult(r FitResult) string {
+	var b strings.Builder
+	b.WriteString("MediLogic – Ajuste de pesos\n")
+	b.WriteString("Objetivo: " + r.Objetivo + "\n")
+	b.WriteString(fmt.Sprintf("Pasadas: %d\n\n", r.Pasadas))
+	b.WriteString(fmt.Sprintf("            %-10s %-10s\n", "antes", "después"))
+	b.WriteString(fmt.Sprintf("Top-1       %-10s %-10s\n", pct(r.Antes.Top1Accuracy), pct(r.Despues.Top1Accuracy)))
+	b.WriteString(fmt.Sprintf("Top-3       %-10s %-10s\n", pct(r.Antes.Top3Accuracy), pct(r.Despues.Top3Accuracy)))
+	b.WriteString(fmt.Sprintf("MRR         %-10.3f %-10.3f\n", r.Antes.MRR, r.Despues.MRR))
+	b.WriteString("\nCambios propuestos\n")
+	if len(r.Cambios) == 0 {
+		b.WriteString("  (ninguno)\n")
+	}
+	for _, c := range r.Cambios {
+		b.WriteString(fmt.Sprintf("  caracteriza(%s, %s): %d -> %d\n", c.Enfermedad, c.Sintoma, c.Antes, c.Despues))
+	}
+	return b.String()
+}
+
+func pct(x float64) string {
+	return fmt.Sprintf("%.1f%%", x*100)
+}
+
+//
+// ======== Endpoint /admin/fit ========
+//
+
+// handleFit devuelve una KB candidata con la comparación antes/después.
+// Nunca modifica la KB activa: el admin la aplica con POST /admin/kb.
+func handleFit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var in evalReq
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	suite := EvalSuite{Casos: in.Casos}
+	if err := suite.validar(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(suite.Casos) > fitMaxCasos {
+		http.Error(w, fmt.Sprintf("como mucho %d casos (use el comando fit para más)", fitMaxCasos), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var base Knowledge
+	if in.KB != nil {
+		base = *in.KB
+	} else {
+		k, _, err := kbDe(r)
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		base = k
+	}
+	res, err := ajustarPesos(base, suite, fitMaxEvaluaciones)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+//
+// ======== Comando `medi-logic fit` ========
+//
+
+func runFitCmd(args []string) int {
+	fs := flag.NewFlagSet("fit", flag.ContinueOnError)
+	casos := fs.String("casos", "", "archivo JSON con los casos etiquetados")
+	kbFile := fs.String("kb", filepath.Join("storage", "kb.json"), "KB de partida en JSON")
+	out := fs.String("out", "", "archivo donde escribir la KB candidata (JSON)")
+	asJSON := fs.Bool("json", false, "imprimir el resultado completo en JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *casos == "" {
+		fmt.Fprintln(os.Stderr, "uso: medi-logic fit -casos casos.json [-kb kb.json] [-out candidata.json] [-json]")
+		return 2
+	}
+
+	f, err := os.Open(*casos)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	suite, err := loadEvalSuite(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	b, err := os.ReadFile(*kbFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var base Knowledge
+	if err := json.Unmarshal(b, &base); err != nil {
+		fmt.Fprintf(os.Stderr, "KB inválida: %v\n", err)
+		return 1
+	}
+
+	res, err := ajustarPesos(base, suite, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out != "" {
+		b, _ := json.MarshalIndent(res.Candidata, "", "  ")
+		if err := os.WriteFile(*out, b, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(res)
+	} else {
+		fmt.Print(formatFitResult(res))
+		if *out != "" {
+			fmt.Printf("\nKB candidata escrita en %s (no aplicada)\n", *out)
+		}
+	}
+	return 0
+}
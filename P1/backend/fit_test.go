@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAjustarPesosLimite(t *testing.T) {
+	suite := EvalSuite{Casos: []EvalCase{
+		casoEval("migrana-segunda", "migrana", "dolor_cabeza", "leve", "fiebre", "severo"),
+		casoEval("gripe", "influenza", "fiebre", "severo", "tos", "moderado"),
+	}}
+	res, err := ajustarPesos(defaultKB(), suite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Limitado || res.Despues.Top1 < res.Antes.Top1 {
+		t.Fatalf("sin límite: %+v", res)
+	}
+
+	res, err = ajustarPesos(defaultKB(), suite, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Limitado || res.Pasadas != 1 {
+		t.Errorf("con 3 evaluaciones: limitado %v, pasadas %d", res.Limitado, res.Pasadas)
+	}
+}
+
+func TestHandleFitMaxCasos(t *testing.T) {
+	casos := make([]EvalCase, fitMaxCasos+1)
+	for i := range casos {
+		casos[i] = casoEval("", "influenza", "fiebre", "severo")
+	}
+	body, _ := json.Marshal(evalReq{Casos: casos})
+	w := httptest.NewRecorder()
+	handleFit(w, httptest.NewRequest(http.MethodPost, "/admin/fit", strings.NewReader(string(body))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("%d casos: %d %s", len(casos), w.Code, w.Body)
+	}
+}
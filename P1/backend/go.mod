@@ -3,3 +3,8 @@ module medi-logic
 go 1.23.2
 
 require github.com/ichiban/prolog v1.2.2
+
+require (
+	github.com/kr/text v0.2.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+)
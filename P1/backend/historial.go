@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Historial de consultas (opcional) ========
+//
+// Se activa con HISTORIAL_KEY (variables de entorno):
+//   HISTORIAL_KEY             clave para cifrar en reposo y seudonimizar pacientes
+//   HISTORIAL_RETENCION_DIAS  días que se conservan los registros (default 90)
+//
+// Sin clave no se guarda nada. Los campos de texto libre e identificadores
+// (paciente, notas, alergias, crónicos) se cifran con AES-256-GCM; en claro
+// quedan sólo los datos necesarios para filtrar y agregar (fecha, síntomas,
+// resultados, versión de KB). El paciente se guarda como seudónimo HMAC-SHA256,
+// estable para la misma clave, de modo que se pueden agrupar sus consultas sin
+// conocer su identidad.
+
+var historialPath = filepath.Join("storage", "historial.jsonl")
+
+// estrategiaPuntaje identifica el cálculo de afinidad/4 que produce los resultados.
+const estrategiaPuntaje = "afinidad_ponderada" // suma(peso*severidad) / (9*N)
+
+type HistRecord struct {
+	ID         string         `json:"id"` // mismo valor que consultaId
+	Fecha      time.Time      `json:"fecha"`
+	Paciente   string         `json:"paciente,omitempty"` // seudónimo
+	KB         string         `json:"kb,omitempty"`       // vacío: la general
+	KBVersion  string         `json:"kbVersion"`
+	Estrategia string         `json:"estrategia"`
+	Sintomas   []SintomaInput `json:"sintomas"`
+	Resultados []resultado    `json:"resultados"`
+	Enfermedad string         `json:"enfermedad"` // primer resultado (o vacío)
+	Urgencia   string         `json:"urgencia"`
+	Cifrado    string         `json:"cifrado,omitempty"` // histPrivado cifrado (base64)
+	Privado    *histPrivado   `json:"privado,omitempty"` // sólo en respuestas con ?descifrar=true
+}
+
+// histPrivado son los campos que nunca se escriben en claro.
+type histPrivado struct {
+	Paciente string   `json:"paciente,omitempty"`
+	Notas    string   `json:"notas,omitempty"`
+	Alergias []string `json:"alergias,omitempty"`
+	Cronicos []string `json:"cronicos,omitempty"`
+}
+
+type historial struct {
+	mu        sync.Mutex
+	path      string
+	clave     []byte // AES-256
+	seudo     []byte // clave HMAC para seudónimos
+	retencion time.Duration
+}
+
+// hist es nil cuando el historial está desactivado.
+var hist *historial
+
+func initHistorial() {
+	k := os.Getenv("HISTORIAL_KEY")
+	if k == "" {
+		return
+	}
+	dias, err := strconv.Atoi(getenv("HISTORIAL_RETENCION_DIAS", "90"))
+	if err != nil || dias < 1 {
+		logp("HISTORIAL_RETENCION_DIAS inválido, se usan 90 días")
+		dias = 90
+	}
+	hist = newHistorial(historialPath, k, time.Duration(dias)*24*time.Hour)
+	if n, err := hist.podar(time.Now()); err != nil {
+		logp("historial: no se pudo aplicar la retención: %v", err)
+	} else if n > 0 {
+		logp("historial: %d registros vencidos eliminados", n)
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if _, err := hist.podar(time.Now()); err != nil {
+				logp("historial: no se pudo aplicar la retención: %v", err)
+			}
+		}
+	}()
+	logp("Historial de consultas activo (retención %d días)", dias)
+}
+
+func newHistorial(path, clave string, retencion time.Duration) *historial {
+	ck := sha256.Sum256([]byte("cifrado:" + clave))
+	sk := sha256.Sum256([]byte("seudonimo:" + clave))
+	return &historial{path: path, clave: ck[:], seudo: sk[:], retencion: retencion}
+}
+
+func (h *historial) seudonimo(paciente string) string {
+	m := hmac.New(sha256.New, h.seudo)
+	m.Write([]byte(strings.ToLower(strings.TrimSpace(paciente))))
+	return hex.EncodeToString(m.Sum(nil))[:24]
+}
+
+func (h *historial) cifrar(p histPrivado) (string, error) {
+	plain, _ := json.Marshal(p)
+	block, err := aes.NewCipher(h.clave)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (h *historial) descifrar(s string) (histPrivado, error) {
+	var p histPrivado
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return p, err
+	}
+	block, err := aes.NewCipher(h.clave)
+	if err != nil {
+		return p, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return p, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return p, fmt.Errorf("cifrado truncado")
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return p, err
+	}
+	return p, json.Unmarshal(plain, &p)
+}
+
+// guardar añade la consulta al historial.
+func (h *historial) guardar(id, kbNombre string, req AnalyzeReq, res []resultado, version string) error {
+	rec := HistRecord{
+		ID:         id,
+		Fecha:      time.Now().UTC(),
+		KB:         kbNombre,
+		KBVersion:  version,
+		Estrategia: estrategiaPuntaje,
+		Sintomas:   req.Sintomas,
+		Resultados: res,
+	}
+	if len(res) > 0 {
+		rec.Enfermedad, rec.Urgencia = res[0].Enf, res[0].Urg
+	}
+	if strings.TrimSpace(req.Paciente) != "" {
+		rec.Paciente = h.seudonimo(req.Paciente)
+	}
+	priv := histPrivado{Paciente: req.Paciente, Notas: req.Notas, Alergias: req.Alergias, Cronicos: req.Cronicos}
+	if priv.Paciente != "" || priv.Notas != "" || len(priv.Alergias) > 0 || len(priv.Cronicos) > 0 {
+		c, err := h.cifrar(priv)
+		if err != nil {
+			return err
+		}
+		rec.Cifrado = c
+	}
+
+	b, _ := json.Marshal(rec)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// leer recorre los registros en orden de escritura; fn devuelve false para cortar.
+// Debe llamarse con h.mu tomado.
+func (h *historial) leer(fn func(HistRecord) bool) error {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var rec HistRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !fn(rec) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+// podar reescribe el archivo sin los registros más antiguos que la retención.
+func (h *historial) podar(now time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limite := now.Add(-h.retencion)
+	var keep []HistRecord
+	borrados := 0
+	err := h.leer(func(rec HistRecord) bool {
+		if rec.Fecha.Before(limite) {
+			borrados++
+		} else {
+			keep = append(keep, rec)
+		}
+		return true
+	})
+	if err != nil || borrados == 0 {
+		return 0, err
+	}
+	var buf strings.Builder
+	for _, rec := range keep {
+		b, _ := json.Marshal(rec)
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0600); err != nil {
+		return 0, err
+	}
+	return borrados, os.Rename(tmp, h.path)
+}
+
+type histFiltro struct {
+	KB           string
+	Desde, Hasta time.Time // Hasta exclusivo; cero = sin límite
+	Enfermedad   string
+	Urgencia     string
+	Paciente     string // seudónimo
+	Limite       int
+}
+
+func (h *historial) buscar(f histFiltro) ([]HistRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []HistRecord
+	err := h.leer(func(rec HistRecord) bool {
+		if !mismaKB(rec.KB, f.KB) {
+			return true
+		}
+		if !f.Desde.IsZero() && rec.Fecha.Before(f.Desde) {
+			return true
+		}
+		if !f.Hasta.IsZero() && !rec.Fecha.Before(f.Hasta) {
+			return true
+		}
+		if f.Enfermedad != "" && rec.Enfermedad != f.Enfermedad {
+			return true
+		}
+		if f.Urgencia != "" && rec.Urgencia != f.Urgencia {
+			return true
+		}
+		if f.Paciente != "" && rec.Paciente != f.Paciente {
+			return true
+		}
+		out = append(out, rec)
+		return f.Limite <= 0 || len(out) < f.Limite
+	})
+	return out, err
+}
+
+//
+// ======== Endpoint /admin/historial ========
+//
+// GET /admin/historial?desde=2025-08-01&hasta=2025-08-31&enfermedad=influenza
+//                     &urgencia=...&paciente=<seudónimo>&limite=100&descifrar=true
+//
+// El identificador real del paciente va en la cabecera X-Paciente (se
+// seudonimiza aquí): en la URL acabaría en los logs de acceso y en la
+// auditoría, así que ?paciente= sólo acepta el seudónimo.
+
+const cabeceraPaciente = "X-Paciente"
+
+func handleHistorial(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if hist == nil {
+		http.Error(w, "historial desactivado (defina HISTORIAL_KEY)", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	descifrar := q.Get("descifrar") == "true"
+	if s := sesionDeCtx(r); descifrar && (s == nil || s.Rol < rolSuperadmin) {
+		http.Error(w, "descifrar requiere rol superadmin", http.StatusForbidden)
+		return
+	}
+	f := histFiltro{KB: nombreKB(r)}
+	var err error
+	if f.Desde, err = parseFecha(q.Get("desde")); err != nil {
+		http.Error(w, "desde: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Hasta, err = parseHasta(q.Get("hasta")); err != nil {
+		http.Error(w, "hasta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("enfermedad"); v != "" {
+		f.Enfermedad = atomize(v)
+	}
+	f.Urgencia = q.Get("urgencia")
+	id, seud := strings.TrimSpace(r.Header.Get(cabeceraPaciente)), q.Get("paciente")
+	switch {
+	case id != "" && seud != "":
+		http.Error(w, "use X-Paciente o ?paciente=, no ambos", http.StatusBadRequest)
+		return
+	case id != "":
+		f.Paciente = hist.seudonimo(id)
+	case seud != "":
+		if len(seud) != 24 || !isHex(seud) {
+			http.Error(w, "?paciente= sólo admite el seudónimo; envíe el identificador en la cabecera "+cabeceraPaciente, http.StatusBadRequest)
+			return
+		}
+		f.Paciente = seud
+	}
+	f.Limite, _ = strconv.Atoi(q.Get("limite"))
+
+	recs, err := hist.buscar(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range recs {
+		if descifrar && recs[i].Cifrado != "" {
+			p, err := hist.descifrar(recs[i].Cifrado)
+			if err != nil {
+				http.Error(w, "no se pudo descifrar "+recs[i].ID, http.StatusInternalServerError)
+				return
+			}
+			recs[i].Privado = &p
+		}
+		recs[i].Cifrado = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"total": len(recs), "registros": recs})
+}
+
+// parseFecha acepta RFC3339 o AAAA-MM-DD; vacío devuelve el tiempo cero.
+func parseFecha(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("fecha inválida %q (use AAAA-MM-DD o RFC3339)", s)
+	}
+	return t, nil
+}
+
+// parseHasta es parseFecha para el final de un rango, que es exclusivo: una
+// fecha AAAA-MM-DD incluye ese día entero (el límite pasa a las 00:00 del
+// siguiente); un instante RFC3339 se toma tal cual.
+func parseHasta(s string) (time.Time, error) {
+	t, err := parseFecha(s)
+	if err != nil || s == "" {
+		return t, err
+	}
+	if _, err := time.Parse(time.RFC3339, s); err != nil {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== RPA: bandeja de entrada vigilada (opcional) ========
+//
+// Se activa con RPA_INBOX_DIR (variables de entorno):
+//   RPA_INBOX_DIR        carpeta a vigilar
+//   RPA_INBOX_INTERVALO  segundos entre revisiones (default 10)
+//   RPA_INBOX_ESTRICTO   "false" aplica también archivos con errores de
+//                        validación, como el endpoint sin ?estricto (default true)
+//   RPA_INBOX_KB         KB sobre la que se aplica (default general, ver bases.go)
+//
+// Los archivos .txt, .json, .yaml/.yml y .csv pasan por el mismo pipeline que
+// POST /admin/rpa/ingest y luego se mueven a processed/ o failed/ dentro de la
+// carpeta, junto a un <archivo>.resultado.json. Cada ingesta correcta se anota
+// por hash SHA-256 del contenido en storage/rpa_inbox.jsonl, así que el mismo
+// contenido no se vuelve a aplicar aunque se reinicie el servidor o el archivo
+// llegue con otro nombre.
+
+var inboxLedgerPath = filepath.Join("storage", "rpa_inbox.jsonl")
+
+// inboxQuieto es el tiempo sin modificaciones antes de tomar un archivo, para
+// no leer uno que todavía se está copiando.
+const inboxQuieto = 2 * time.Second
+
+var inboxExts = map[string]string{
+	".txt":  rpaFmtTexto,
+	".json": rpaFmtJSON,
+	".yaml": rpaFmtYAML,
+	".yml":  rpaFmtYAML,
+	".csv":  rpaFmtCSV,
+}
+
+// inboxEntrada es una línea del registro de hashes ya ingeridos.
+type inboxEntrada struct {
+	Hash    string    `json:"hash"`
+	Archivo string    `json:"archivo"`
+	Fecha   time.Time `json:"fecha"`
+}
+
+// inboxResultado es el contenido del archivo .resultado.json.
+type inboxResultado struct {
+	Archivo      string    `json:"archivo"`
+	Hash         string    `json:"hash"`
+	Fecha        time.Time `json:"fecha"`
+	Estado       string    `json:"estado"` // aplicado | duplicado | fallido
+	Formato      string    `json:"formato,omitempty"`
+	Enfermedades int       `json:"enfermedades"`
+	Error        string    `json:"error,omitempty"`
+	Diagnosticos []rpaDiag `json:"diagnosticos,omitempty"`
+	Informe      string    `json:"informe,omitempty"`
+	Previo       string    `json:"previo,omitempty"` // archivo que ya traía este contenido
+}
+
+type inbox struct {
+	mu       sync.Mutex
+	dir      string
+	kb       string
+	estricto bool
+	ledger   string
+	vistos   map[string]inboxEntrada // hash -> primera ingesta
+}
+
+func initInbox() {
+	dir := os.Getenv("RPA_INBOX_DIR")
+	if dir == "" {
+		return
+	}
+	seg, err := strconv.Atoi(getenv("RPA_INBOX_INTERVALO", "10"))
+	if err != nil || seg < 1 {
+		logp("RPA_INBOX_INTERVALO inválido, se usan 10 segundos")
+		seg = 10
+	}
+	in, err := newInbox(dir, inboxLedgerPath, getenv("RPA_INBOX_ESTRICTO", "true") != "false")
+	if err != nil {
+		logp("bandeja RPA desactivada: %v", err)
+		return
+	}
+	in.kb = getenv("RPA_INBOX_KB", kbGeneral)
+	mu.Lock()
+	_, err = buscarBase(in.kb)
+	mu.Unlock()
+	if err != nil {
+		logp("bandeja RPA desactivada: %v", err)
+		return
+	}
+	go func() {
+		for {
+			in.revisar(time.Now())
+			time.Sleep(time.Duration(seg) * time.Second)
+		}
+	}()
+	logp("Bandeja RPA vigilando %s para la KB %s (cada %ds, %d archivos ya ingeridos)", dir, in.kb, seg, len(in.vistos))
+}
+
+func newInbox(dir, ledger string, estricto bool) (*inbox, error) {
+	for _, d := range []string{dir, filepath.Join(dir, "processed"), filepath.Join(dir, "failed")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	in := &inbox{dir: dir, estricto: estricto, ledger: ledger, vistos: map[string]inboxEntrada{}}
+	f, err := os.Open(ledger)
+	if os.IsNotExist(err) {
+		return in, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e inboxEntrada
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Hash == "" {
+			continue
+		}
+		if _, ok := in.vistos[e.Hash]; !ok {
+			in.vistos[e.Hash] = e
+		}
+	}
+	return in, sc.Err()
+}
+
+// revisar procesa los archivos listos de la carpeta, en orden alfabético.
+func (in *inbox) revisar(now time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ents, err := os.ReadDir(in.dir)
+	if err != nil {
+		logp("bandeja RPA: %v", err)
+		return
+	}
+	for _, e := range ents {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, ok := inboxExts[strings.ToLower(filepath.Ext(e.Name()))]; !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || now.Sub(fi.ModTime()) < inboxQuieto {
+			continue
+		}
+		in.procesar(e.Name())
+	}
+}
+
+func (in *inbox) procesar(nombre string) {
+	ruta := filepath.Join(in.dir, nombre)
+	body, err := os.ReadFile(ruta)
+	if err != nil {
+		logp("bandeja RPA: no se pudo leer %s: %v", nombre, err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	res := inboxResultado{Archivo: nombre, Hash: hex.EncodeToString(sum[:]), Fecha: time.Now().UTC()}
+
+	if prev, ok := in.vistos[res.Hash]; ok {
+		res.Estado = "duplicado"
+		res.Previo = prev.Archivo
+		in.mover(ruta, "processed", res)
+		logp("bandeja RPA: %s ya se ingirió como %s, no se aplica", nombre, prev.Archivo)
+		return
+	}
+
+	parsed, formato, err := parseRPA(body, inboxExts[strings.ToLower(filepath.Ext(nombre))])
+	res.Formato = formato
+	res.Enfermedades = len(parsed.Items)
+	res.Diagnosticos = parsed.Diagnosticos
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case in.estricto && parsed.errores() > 0:
+		res.Error = fmt.Sprintf("%d errores de validación, no se aplicó nada", parsed.errores())
+	case len(parsed.Items) == 0:
+		res.Error = "el archivo no contiene enfermedades"
+	}
+	if res.Error == "" {
+		if inf, err := aplicarRPA(formato, parsed, escritura{Origen: "rpa_bandeja", Autor: "bandeja:" + nombre, KB: in.kb}); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Informe = inf.Texto()
+		}
+	}
+	if res.Error != "" {
+		res.Estado = "fallido"
+		in.mover(ruta, "failed", res)
+		logp("bandeja RPA: %s fallido: %s", nombre, res.Error)
+		return
+	}
+
+	res.Estado = "aplicado"
+	if err := in.anotar(inboxEntrada{Hash: res.Hash, Archivo: nombre, Fecha: res.Fecha}); err != nil {
+		logp("bandeja RPA: no se pudo anotar %s: %v", nombre, err)
+	}
+	in.mover(ruta, "processed", res)
+	logp("bandeja RPA: %s aplicado (%d enfermedades)", nombre, res.Enfermedades)
+}
+
+func (in *inbox) anotar(e inboxEntrada) error {
+	in.vistos[e.Hash] = e
+	b, _ := json.Marshal(e)
+	f, err := os.OpenFile(in.ledger, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// mover deja el archivo en processed/ o failed/ con su .resultado.json. Si ya
+// existe uno con el mismo nombre se antepone la fecha para no pisarlo.
+func (in *inbox) mover(ruta, sub string, res inboxResultado) {
+	destino := filepath.Join(in.dir, sub, res.Archivo)
+	if _, err := os.Stat(destino); err == nil {
+		destino = filepath.Join(in.dir, sub, res.Fecha.Format("20060102_150405")+"_"+res.Archivo)
+	}
+	if err := os.Rename(ruta, destino); err != nil {
+		// sin mover, el archivo se volvería a procesar en la siguiente revisión
+		logp("bandeja RPA: no se pudo mover %s: %v", res.Archivo, err)
+		return
+	}
+	b, _ := json.MarshalIndent(res, "", "  ")
+	_ = os.WriteFile(destino+".resultado.json", b, 0644)
+}
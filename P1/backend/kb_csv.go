@@ -0,0 +1,537 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// ======== KB como hojas de cálculo (CSV en un .zip) ========
+//
+// GET /admin/kb/csv descarga la KB (o el borrador de X-KB-Borrador) como un
+// .zip con un CSV por tabla, y POST /admin/kb/csv la reemplaza por la del .zip
+// (exige If-Match como POST /admin/kb; ?dry_run=true sólo valida y devuelve
+// el diff). Las columnas de cada archivo (la primera fila es la cabecera, en
+// cualquier orden; las columnas desconocidas se ignoran con un aviso):
+//
+//   sintomas.csv           nombre, [snomed], [icpc]
+//   enfermedades.csv       nombre, tipo, sistema, [descripcion], [icd10]
+//   consejos.csv           enfermedad, consejo (una fila por consejo, en orden)
+//   caracteristicas.csv    enfermedad, sintoma, peso (1..3)
+//   medicamentos.csv       nombre, [atc]
+//   trata.csv              medicamento, enfermedad
+//   contraindicaciones.csv medicamento, tipo (alergia|cronico), valor
+//
+// Las columnas entre corchetes pueden faltar, y también consejos.csv. Los
+// .zip de versiones anteriores traían los consejos en la columna consejos de
+// enfermedades.csv separados por ';'; se siguen leyendo (con un aviso) si la
+// enfermedad no tiene filas en consejos.csv. Los nombres se normalizan a
+// átomo como en el resto de la API y los códigos clínicos se validan como en
+// codigos.go. Si alguna fila tiene un error no se aplica nada: la respuesta
+// (422) lista cada problema con su archivo, fila y columna. Se escriben en
+// UTF-8 con BOM para que Excel los abra bien; al importar el BOM es opcional.
+// Cada archivo puede ocupar hasta maxZipCSV sin comprimir.
+
+type tablaCSV struct {
+	Archivo      string
+	Columnas     []string
+	Obligatorias int      // las primeras N columnas
+	Opcional     bool     // el archivo puede faltar
+	Obsoletas    []string // se leen pero ya no se exportan
+}
+
+var (
+	csvSintomas           = tablaCSV{"sintomas.csv", []string{"nombre", codSNOMED, codICPC}, 1, false, nil}
+	csvEnfermedades       = tablaCSV{"enfermedades.csv", []string{"nombre", "tipo", "sistema", "descripcion", codICD10}, 3, false, []string{"consejos"}}
+	csvConsejos           = tablaCSV{"consejos.csv", []string{"enfermedad", "consejo"}, 2, true, nil}
+	csvCaracteristicas    = tablaCSV{"caracteristicas.csv", []string{"enfermedad", "sintoma", "peso"}, 3, false, nil}
+	csvMedicamentos       = tablaCSV{"medicamentos.csv", []string{"nombre", codATC}, 1, false, nil}
+	csvTrata              = tablaCSV{"trata.csv", []string{"medicamento", "enfermedad"}, 2, false, nil}
+	csvContraindicaciones = tablaCSV{"contraindicaciones.csv", []string{"medicamento", "tipo", "valor"}, 3, false, nil}
+
+	// en el orden en que se importan (cada una puede referirse a las anteriores)
+	tablasCSV = []tablaCSV{csvSintomas, csvEnfermedades, csvConsejos, csvCaracteristicas, csvMedicamentos, csvTrata, csvContraindicaciones}
+)
+
+const maxZipCSV = 20 << 20
+
+// diagCSV es un problema de una celda o fila del .zip.
+type diagCSV struct {
+	Archivo   string `json:"archivo"`
+	Fila      int    `json:"fila"`    // línea del archivo (1 = cabecera); 0 si afecta al archivo
+	Columna   string `json:"columna"` // vacío si afecta a la fila
+	Severidad string `json:"severidad"`
+	Mensaje   string `json:"mensaje"`
+}
+
+//
+// ======== Exportar ========
+//
+
+func exportarKBCSV(k Knowledge) ([]byte, error) {
+	filas := map[string][][]string{}
+	for _, s := range k.Symptoms {
+		filas[csvSintomas.Archivo] = append(filas[csvSintomas.Archivo], []string{s.Name, s.SNOMED, s.ICPC})
+	}
+	for _, d := range k.Diseases {
+		filas[csvEnfermedades.Archivo] = append(filas[csvEnfermedades.Archivo],
+			[]string{d.Name, d.Tipo, d.Sistema, d.Descripcion, d.ICD10})
+		for _, c := range d.Consejos {
+			filas[csvConsejos.Archivo] = append(filas[csvConsejos.Archivo], []string{d.Name, c})
+		}
+		for _, c := range d.Caracteristicas {
+			filas[csvCaracteristicas.Archivo] = append(filas[csvCaracteristicas.Archivo],
+				[]string{d.Name, c.Symptom, strconv.Itoa(c.Peso)})
+		}
+	}
+	for _, m := range k.Meds {
+		filas[csvMedicamentos.Archivo] = append(filas[csvMedicamentos.Archivo], []string{m.Name, m.ATC})
+		for _, d := range m.Treats {
+			filas[csvTrata.Archivo] = append(filas[csvTrata.Archivo], []string{m.Name, d})
+		}
+	}
+	for _, c := range contraindicaciones(&k) {
+		filas[csvContraindicaciones.Archivo] = append(filas[csvContraindicaciones.Archivo], []string{c.Med, c.Tipo, c.Valor})
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, t := range tablasCSV {
+		f, err := zw.Create(t.Archivo)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(f, "\uFEFF")
+		cw := csv.NewWriter(f)
+		_ = cw.Write(t.Columnas)
+		_ = cw.WriteAll(filas[t.Archivo])
+		if err := cw.Error(); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//
+// ======== Importar ========
+//
+
+// filaCSV es una fila leída con acceso a sus celdas por columna.
+type filaCSV struct {
+	linea  int
+	celdas map[string]string
+}
+
+func (f filaCSV) get(col string) string { return f.celdas[col] }
+
+// importacionCSV acumula la KB leída y los diagnósticos.
+type importacionCSV struct {
+	k     Knowledge
+	diags []diagCSV
+}
+
+// codigo valida la celda col con el sistema de codigos.go; vacía es sin
+// código. Si no es válida anota el error y el elemento se lee sin código,
+// para no arrastrar errores a las tablas que lo referencian.
+func (im *importacionCSV) codigo(archivo string, f filaCSV, col string) string {
+	c, err := normalizarCodigo(col, f.get(col))
+	if err != nil {
+		im.diag(archivo, f.linea, col, sevError, "%v", err)
+	}
+	return c
+}
+
+func (im *importacionCSV) diag(archivo string, fila int, col, sev, format string, args ...interface{}) {
+	im.diags = append(im.diags, diagCSV{Archivo: archivo, Fila: fila, Columna: col, Severidad: sev, Mensaje: fmt.Sprintf(format, args...)})
+}
+
+// leerTablaCSV lee un archivo del .zip comprobando la cabecera.
+func (im *importacionCSV) leerTablaCSV(zf *zip.File, t tablaCSV) []filaCSV {
+	rc, err := zf.Open()
+	if err != nil {
+		im.diag(t.Archivo, 0, "", sevError, "no se pudo leer: %v", err)
+		return nil
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(io.LimitReader(rc, maxZipCSV+1))
+	if err != nil {
+		im.diag(t.Archivo, 0, "", sevError, "no se pudo leer: %v", err)
+		return nil
+	}
+	if len(body) > maxZipCSV {
+		im.diag(t.Archivo, 0, "", sevError, "el archivo supera %d MB", maxZipCSV>>20)
+		return nil
+	}
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\uFEFF"))))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	cab, err := cr.Read()
+	if err == io.EOF {
+		im.diag(t.Archivo, 0, "", sevError, "archivo vacío (falta la cabecera %s)", strings.Join(t.Columnas, ","))
+		return nil
+	}
+	if err != nil {
+		im.diag(t.Archivo, 1, "", sevError, "CSV inválido: %v", err)
+		return nil
+	}
+	idx := map[string]int{}
+	for i, h := range cab {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if !contains(t.Columnas, h) && !contains(t.Obsoletas, h) {
+			im.diag(t.Archivo, 1, h, sevAviso, "columna desconocida ignorada")
+			continue
+		}
+		idx[h] = i
+	}
+	for _, c := range t.Columnas[:t.Obligatorias] {
+		if _, ok := idx[c]; !ok {
+			im.diag(t.Archivo, 1, c, sevError, "falta la columna")
+			return nil
+		}
+	}
+
+	var out []filaCSV
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			linea := 0
+			if pe, ok := err.(*csv.ParseError); ok {
+				linea = pe.Line
+			}
+			im.diag(t.Archivo, linea, "", sevError, "CSV inválido: %v", err)
+			return out
+		}
+		f := filaCSV{celdas: map[string]string{}}
+		f.linea, _ = cr.FieldPos(0)
+		vacia := true
+		for c, i := range idx {
+			if i < len(row) {
+				f.celdas[c] = strings.TrimSpace(row[i])
+				vacia = vacia && f.celdas[c] == ""
+			}
+		}
+		if !vacia { // las filas en blanco de las hojas de cálculo se saltan
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// importarKBCSV lee el .zip y construye la KB. Con errores la KB no es válida.
+func importarKBCSV(data []byte) (Knowledge, []diagCSV) {
+	im := &importacionCSV{k: Knowledge{
+		Symptoms: []Symptom{}, Diseases: []Disease{}, Meds: []Medication{},
+		ContraAlergias: []ContraAlergia{}, ContraCronicos: []ContraCronico{},
+	}}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		im.diag("", 0, "", sevError, "no es un .zip válido: %v", err)
+		return im.k, im.diags
+	}
+	archivos := map[string]*zip.File{}
+	for _, f := range zr.File {
+		nombre := strings.ToLower(f.Name[strings.LastIndex(f.Name, "/")+1:])
+		if f.FileInfo().IsDir() || nombre == "" || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		archivos[nombre] = f
+	}
+	tablas := map[string][]filaCSV{}
+	for _, t := range tablasCSV {
+		zf, ok := archivos[t.Archivo]
+		if !ok {
+			if !t.Opcional {
+				im.diag(t.Archivo, 0, "", sevError, "falta el archivo")
+			}
+			continue
+		}
+		tablas[t.Archivo] = im.leerTablaCSV(zf, t)
+		delete(archivos, t.Archivo)
+	}
+	for _, n := range sortedKeys(archivos) {
+		im.diag(n, 0, "", sevAviso, "archivo desconocido ignorado")
+	}
+
+	sintomas := map[string]bool{}
+	for _, f := range tablas[csvSintomas.Archivo] {
+		n := f.get("nombre")
+		switch {
+		case n == "":
+			im.diag(csvSintomas.Archivo, f.linea, "nombre", sevError, "nombre vacío")
+		case sintomas[atomize(n)]:
+			im.diag(csvSintomas.Archivo, f.linea, "nombre", sevError, "síntoma %s repetido", atomize(n))
+		default:
+			sintomas[atomize(n)] = true
+			im.k.Symptoms = append(im.k.Symptoms, Symptom{
+				Name:   atomize(n),
+				SNOMED: im.codigo(csvSintomas.Archivo, f, codSNOMED),
+				ICPC:   im.codigo(csvSintomas.Archivo, f, codICPC),
+			})
+		}
+	}
+
+	enfermedades := map[string]int{} // nombre -> índice
+	var obsoletos []filaCSV          // filas con la columna consejos
+	for _, f := range tablas[csvEnfermedades.Archivo] {
+		n := f.get("nombre")
+		switch {
+		case n == "":
+			im.diag(csvEnfermedades.Archivo, f.linea, "nombre", sevError, "nombre vacío")
+			continue
+		case enfermedades[atomize(n)] > 0:
+			im.diag(csvEnfermedades.Archivo, f.linea, "nombre", sevError, "enfermedad %s repetida", atomize(n))
+			continue
+		}
+		// como validarEnfermedad (kb_recursos.go): tipo y sistema son obligatorios
+		for _, col := range []string{"tipo", "sistema"} {
+			if f.get(col) == "" {
+				im.diag(csvEnfermedades.Archivo, f.linea, col, sevError, "%s vacío", col)
+			}
+		}
+		im.k.Diseases = append(im.k.Diseases, Disease{
+			Name:            atomize(n),
+			Tipo:            atomizeOpt(f.get("tipo")),
+			Sistema:         atomizeOpt(f.get("sistema")),
+			Descripcion:     f.get("descripcion"),
+			Caracteristicas: []Caract{},
+			ICD10:           im.codigo(csvEnfermedades.Archivo, f, codICD10),
+		})
+		enfermedades[atomize(n)] = len(im.k.Diseases) // +1: 0 es "no existe"
+		if f.get("consejos") != "" {
+			obsoletos = append(obsoletos, f)
+		}
+	}
+
+	for _, f := range tablas[csvConsejos.Archivo] {
+		a := csvConsejos.Archivo
+		e, c := atomize(f.get("enfermedad")), f.get("consejo")
+		i := enfermedades[e]
+		switch {
+		case i == 0:
+			im.diag(a, f.linea, "enfermedad", sevError, "la enfermedad %s no está en enfermedades.csv", e)
+		case c == "":
+			im.diag(a, f.linea, "consejo", sevError, "consejo vacío")
+		default:
+			im.k.Diseases[i-1].Consejos = append(im.k.Diseases[i-1].Consejos, c)
+		}
+	}
+	for _, f := range obsoletos {
+		d := &im.k.Diseases[enfermedades[atomize(f.get("nombre"))]-1]
+		if len(d.Consejos) > 0 {
+			im.diag(csvEnfermedades.Archivo, f.linea, "consejos", sevAviso, "columna ignorada: %s tiene consejos en consejos.csv", d.Name)
+			continue
+		}
+		d.Consejos = splitConsejos(f.get("consejos"))
+		im.diag(csvEnfermedades.Archivo, f.linea, "consejos", sevAviso, "columna obsoleta separada por ';'; use consejos.csv")
+	}
+
+	vistos := map[string]bool{}
+	for _, f := range tablas[csvCaracteristicas.Archivo] {
+		a := csvCaracteristicas.Archivo
+		e, s := atomize(f.get("enfermedad")), atomize(f.get("sintoma"))
+		i := enfermedades[e]
+		ok := true
+		if i == 0 {
+			im.diag(a, f.linea, "enfermedad", sevError, "la enfermedad %s no está en enfermedades.csv", e)
+			ok = false
+		}
+		if !sintomas[s] {
+			im.diag(a, f.linea, "sintoma", sevError, "el síntoma %s no está en sintomas.csv", s)
+			ok = false
+		}
+		peso, err := strconv.Atoi(f.get("peso"))
+		if err != nil || peso < 1 || peso > 3 {
+			im.diag(a, f.linea, "peso", sevError, "peso %q debe ser 1, 2 o 3", f.get("peso"))
+			ok = false
+		}
+		if ok && vistos[e+"|"+s] {
+			im.diag(a, f.linea, "", sevError, "%s ya tiene el síntoma %s", e, s)
+			ok = false
+		}
+		if ok {
+			vistos[e+"|"+s] = true
+			d := &im.k.Diseases[i-1]
+			d.Caracteristicas = append(d.Caracteristicas, Caract{Symptom: s, Peso: peso})
+		}
+	}
+
+	meds := map[string]int{}
+	for _, f := range tablas[csvMedicamentos.Archivo] {
+		n := f.get("nombre")
+		switch {
+		case n == "":
+			im.diag(csvMedicamentos.Archivo, f.linea, "nombre", sevError, "nombre vacío")
+		case meds[atomize(n)] > 0:
+			im.diag(csvMedicamentos.Archivo, f.linea, "nombre", sevError, "medicamento %s repetido", atomize(n))
+		default:
+			im.k.Meds = append(im.k.Meds, Medication{Name: atomize(n), Treats: []string{}, ATC: im.codigo(csvMedicamentos.Archivo, f, codATC)})
+			meds[atomize(n)] = len(im.k.Meds)
+		}
+	}
+
+	vistos = map[string]bool{}
+	for _, f := range tablas[csvTrata.Archivo] {
+		a := csvTrata.Archivo
+		m, e := atomize(f.get("medicamento")), atomize(f.get("enfermedad"))
+		i := meds[m]
+		ok := true
+		if i == 0 {
+			im.diag(a, f.linea, "medicamento", sevError, "el medicamento %s no está en medicamentos.csv", m)
+			ok = false
+		}
+		if enfermedades[e] == 0 {
+			im.diag(a, f.linea, "enfermedad", sevError, "la enfermedad %s no está en enfermedades.csv", e)
+			ok = false
+		}
+		if ok && vistos[m+"|"+e] {
+			im.diag(a, f.linea, "", sevAviso, "fila repetida ignorada")
+			ok = false
+		}
+		if ok {
+			vistos[m+"|"+e] = true
+			im.k.Meds[i-1].Treats = append(im.k.Meds[i-1].Treats, e)
+		}
+	}
+
+	vistos = map[string]bool{}
+	for _, f := range tablas[csvContraindicaciones.Archivo] {
+		a := csvContraindicaciones.Archivo
+		m, tipo, v := atomize(f.get("medicamento")), strings.ToLower(f.get("tipo")), f.get("valor")
+		ok := true
+		if meds[m] == 0 {
+			im.diag(a, f.linea, "medicamento", sevError, "el medicamento %s no está en medicamentos.csv", m)
+			ok = false
+		}
+		if tipo != contraAlergia && tipo != contraCronico {
+			im.diag(a, f.linea, "tipo", sevError, "tipo %q debe ser alergia o cronico", f.get("tipo"))
+			ok = false
+		}
+		if v == "" {
+			im.diag(a, f.linea, "valor", sevError, "valor vacío")
+			ok = false
+		}
+		clave := m + "|" + tipo + "|" + atomize(v)
+		if ok && vistos[clave] {
+			im.diag(a, f.linea, "", sevAviso, "fila repetida ignorada")
+			ok = false
+		}
+		if !ok {
+			continue
+		}
+		vistos[clave] = true
+		if tipo == contraAlergia {
+			im.k.ContraAlergias = append(im.k.ContraAlergias, ContraAlergia{Med: m, Alergia: atomize(v)})
+		} else {
+			im.k.ContraCronicos = append(im.k.ContraCronicos, ContraCronico{Med: m, Cronico: atomize(v)})
+		}
+	}
+	return im.k, im.diags
+}
+
+//
+// ======== Endpoint /admin/kb/csv ========
+//
+
+// resultadoImportCSV es la respuesta de POST /admin/kb/csv.
+type resultadoImportCSV struct {
+	DryRun       bool           `json:"dryRun,omitempty"`
+	Aplicado     bool           `json:"aplicado"`
+	Version      string         `json:"version,omitempty"`
+	Cambios      map[string]int `json:"cambios,omitempty"`
+	Diff         *KBDiff        `json:"diff,omitempty"` // sólo dry_run
+	Diagnosticos []diagCSV      `json:"diagnosticos"`
+}
+
+func handleKBCSV(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		k, version, err := kbDe(r)
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		b, err := exportarKBCSV(k)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nombre := nombreKB(r)
+		if n := r.Header.Get(cabeceraBorrador); n != "" {
+			nombre += "_" + n
+		}
+		w.Header().Set("ETag", etagKB(version))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kb_%s_%s.zip"`, nombre, version))
+		w.Write(b)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxZipCSV+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxZipCSV {
+			http.Error(w, "el .zip supera 20 MB", http.StatusRequestEntityTooLarge)
+			return
+		}
+		nueva, diags := importarKBCSV(data)
+		res := resultadoImportCSV{Diagnosticos: diags}
+		if res.Diagnosticos == nil {
+			res.Diagnosticos = []diagCSV{}
+		}
+		for _, d := range diags {
+			if d.Severidad == sevError {
+				writeJSON(w, http.StatusUnprocessableEntity, res)
+				return
+			}
+		}
+
+		if r.URL.Query().Get("dry_run") == "true" {
+			actual, version, err := kbDe(r)
+			if err != nil {
+				writeKBError(w, err)
+				return
+			}
+			if _, err := compilarPL(buildPL(nueva)); err != nil {
+				http.Error(w, "la KB resultante no es válida: "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			d := diffKB(actual, nueva)
+			res.DryRun, res.Version, res.Diff, res.Cambios = true, version, &d, resumenDiff(d)
+			writeJSON(w, http.StatusOK, res)
+			return
+		}
+
+		if r.Header.Get("If-Match") == "" {
+			http.Error(w, "falta If-Match con la ETag de GET /admin/kb (o * para sobrescribir sin comprobar)", http.StatusPreconditionRequired)
+			return
+		}
+		c, err := mutarKB(escrituraDe(r, "csv"), func(k *Knowledge) error {
+			*k = nueva
+			return nil
+		})
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		res.Aplicado, res.Version, res.Cambios = true, c.Version, resumenDiff(diffKB(c.Antes, c.Despues))
+		w.Header().Set("ETag", etagKB(c.Version))
+		writeJSON(w, http.StatusOK, res)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
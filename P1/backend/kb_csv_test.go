@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// zipCSV arma un .zip con los archivos dados (nombre -> contenido).
+func zipCSV(t *testing.T, archivos map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, n := range sortedKeys(archivos) {
+		f, err := zw.Create(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(archivos[n]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hojasValidas es una KB mínima correcta en CSV.
+func hojasValidas() map[string]string {
+	return map[string]string{
+		"sintomas.csv":           "nombre,snomed,icpc\nfiebre,386661006,A03\ntos,,\n",
+		"enfermedades.csv":       "nombre,tipo,sistema,descripcion,icd10\ngripe,viral,respiratorio,,J11.1\n",
+		"consejos.csv":           "enfermedad,consejo\ngripe,Reposo\n",
+		"caracteristicas.csv":    "enfermedad,sintoma,peso\ngripe,fiebre,3\ngripe,tos,2\n",
+		"medicamentos.csv":       "nombre,atc\nparacetamol,N02BE01\n",
+		"trata.csv":              "medicamento,enfermedad\nparacetamol,gripe\n",
+		"contraindicaciones.csv": "medicamento,tipo,valor\nparacetamol,cronico,hepatopatia\n",
+	}
+}
+
+func TestKBCSVIdaYVuelta(t *testing.T) {
+	k := defaultKB()
+	k.Diseases[0].Descripcion = `Con "comillas", comas y ; punto y coma`
+	k.Diseases[0].Consejos = append(k.Diseases[0].Consejos, "Un consejo, con coma")
+	data, err := exportarKBCSV(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nueva, diags := importarKBCSV(data)
+	if len(diags) != 0 {
+		t.Fatalf("diagnósticos: %+v", diags)
+	}
+	a, _ := json.Marshal(k)
+	b, _ := json.Marshal(nueva)
+	if !bytes.Equal(a, b) {
+		t.Errorf("la KB no vuelve igual:\n%s\n%s", a, b)
+	}
+	if versionOf(buildPL(nueva)) != versionOf(buildPL(k)) {
+		t.Error("la KB importada compila a otra versión")
+	}
+}
+
+func TestKBCSVDiagnosticos(t *testing.T) {
+	if _, diags := importarKBCSV(zipCSV(t, hojasValidas())); len(diags) != 0 {
+		t.Fatalf("hojas válidas: %+v", diags)
+	}
+
+	casos := []struct {
+		nombre, archivo, contenido string
+		quiere                     diagCSV // Mensaje: subcadena
+	}{
+		{"falta archivo", "trata.csv", "", diagCSV{Archivo: "trata.csv", Fila: 0, Severidad: sevError, Mensaje: "falta el archivo"}},
+		{"falta columna", "caracteristicas.csv", "enfermedad,sintoma\ngripe,fiebre\n", diagCSV{Archivo: "caracteristicas.csv", Fila: 1, Columna: "peso", Severidad: sevError, Mensaje: "falta la columna"}},
+		{"columna desconocida", "medicamentos.csv", "nombre,atc,precio\nparacetamol,N02BE01,3\n", diagCSV{Archivo: "medicamentos.csv", Fila: 1, Columna: "precio", Severidad: sevAviso, Mensaje: "desconocida"}},
+		{"peso fuera de rango", "caracteristicas.csv", "enfermedad,sintoma,peso\ngripe,fiebre,3\ngripe,tos,4\n", diagCSV{Archivo: "caracteristicas.csv", Fila: 3, Columna: "peso", Severidad: sevError, Mensaje: "1, 2 o 3"}},
+		{"síntoma inexistente", "caracteristicas.csv", "enfermedad,sintoma,peso\ngripe,nausea,2\n", diagCSV{Archivo: "caracteristicas.csv", Fila: 2, Columna: "sintoma", Severidad: sevError, Mensaje: "nausea"}},
+		{"columnas en otro orden", "caracteristicas.csv", "peso,sintoma,enfermedad\n2,tos,otitis\n", diagCSV{Archivo: "caracteristicas.csv", Fila: 2, Columna: "enfermedad", Severidad: sevError, Mensaje: "otitis"}},
+		{"tipo vacío", "enfermedades.csv", "nombre,tipo,sistema\ngripe,,respiratorio\n", diagCSV{Archivo: "enfermedades.csv", Fila: 2, Columna: "tipo", Severidad: sevError, Mensaje: "tipo vacío"}},
+		{"sistema vacío", "enfermedades.csv", "\uFEFFnombre,tipo,sistema\n\ngripe,viral,\n", diagCSV{Archivo: "enfermedades.csv", Fila: 3, Columna: "sistema", Severidad: sevError, Mensaje: "sistema vacío"}},
+		{"sin columna sistema", "enfermedades.csv", "nombre,tipo\ngripe,viral\n", diagCSV{Archivo: "enfermedades.csv", Fila: 1, Columna: "sistema", Severidad: sevError, Mensaje: "falta la columna"}},
+		{"código inválido", "sintomas.csv", "nombre,snomed\nfiebre,abc\ntos,\n", diagCSV{Archivo: "sintomas.csv", Fila: 2, Columna: codSNOMED, Severidad: sevError}},
+		{"tipo de contraindicación", "contraindicaciones.csv", "medicamento,tipo,valor\nparacetamol,edad,anciano\n", diagCSV{Archivo: "contraindicaciones.csv", Fila: 2, Columna: "tipo", Severidad: sevError, Mensaje: "alergia o cronico"}},
+		{"demasiado grande", "consejos.csv", "enfermedad,consejo\n" + strings.Repeat(" ", maxZipCSV), diagCSV{Archivo: "consejos.csv", Fila: 0, Severidad: sevError, Mensaje: "supera 20 MB"}},
+	}
+	for _, c := range casos {
+		hojas := hojasValidas()
+		if c.contenido == "" {
+			delete(hojas, c.archivo)
+		} else {
+			hojas[c.archivo] = c.contenido
+		}
+		_, diags := importarKBCSV(zipCSV(t, hojas))
+		encontrado := false
+		for _, d := range diags {
+			q := c.quiere
+			if d.Archivo == q.Archivo && d.Fila == q.Fila && d.Columna == q.Columna && d.Severidad == q.Severidad && strings.Contains(d.Mensaje, q.Mensaje) {
+				encontrado = true
+			}
+		}
+		if !encontrado {
+			t.Errorf("%s: no está %+v en %+v", c.nombre, c.quiere, diags)
+		}
+	}
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//
+// ======== Recursos de la KB (/admin/symptoms, /admin/diseases, ...) ========
+//
+// Edición granular sin reenviar la KB completa a POST /admin/kb:
+//
+//   GET  /admin/symptoms              POST  crea {name, snomed, icpc}
+//   GET|PUT|PATCH|DELETE /admin/symptoms/{name}
+//   GET  /admin/diseases              POST  crea una Disease
+//   GET|PUT|PATCH|DELETE /admin/diseases/{name}
+//   GET  /admin/meds                  POST  crea una Medication
+//   GET|PUT|PATCH|DELETE /admin/meds/{name}
+//   GET|POST|PUT|DELETE  /admin/contraindications
+//
+// Los nombres se comparan ya convertidos a átomo ("Dolor de cabeza" y
+// "dolor_de_cabeza" son el mismo síntoma) y se guardan como átomo. PUT
+// reemplaza (o crea) el recurso, PATCH sólo cambia los campos enviados y
+// admite "name" para renombrar, arrastrando las referencias. DELETE responde
+// 409 con las referencias si el recurso está en uso; con ?cascada=true las
+// elimina también (caracteriza/3 de un síntoma, trata/2 de una enfermedad,
+// contraindicaciones de un medicamento).
+//
+// Cada escritura pasa por mutarKB: si la KB resultante no compila no se
+// aplica (422). Como POST /admin/kb, las escrituras exigen If-Match con la
+// ETag de la KB (412 si cambió); los GET devuelven esa ETag. Con
+// X-KB-Borrador todo se hace sobre el borrador (ver borradores.go).
+//
+// Los códigos clínicos (snomed e icpc del síntoma, icd10 de la enfermedad,
+// atc del medicamento) se normalizan y un formato inválido es un 422 (ver
+// codigos.go).
+
+const origenCRUD = "crud"
+
+func mismoNombre(a, b string) bool { return atomize(a) == atomize(b) }
+
+func indiceSintoma(k *Knowledge, name string) int {
+	for i, s := range k.Symptoms {
+		if mismoNombre(s.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func indiceEnfermedad(k *Knowledge, name string) int {
+	for i, d := range k.Diseases {
+		if mismoNombre(d.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func indiceMed(k *Knowledge, name string) int {
+	for i, m := range k.Meds {
+		if mismoNombre(m.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// referenciasSintoma lista las enfermedades que usan el síntoma.
+func referenciasSintoma(k *Knowledge, name string) []string {
+	var out []string
+	for _, d := range k.Diseases {
+		for _, c := range d.Caracteristicas {
+			if mismoNombre(c.Symptom, name) {
+				out = append(out, d.Name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// referenciasEnfermedad lista los medicamentos que la tratan.
+func referenciasEnfermedad(k *Knowledge, name string) []string {
+	var out []string
+	for _, m := range k.Meds {
+		for _, t := range m.Treats {
+			if mismoNombre(t, name) {
+				out = append(out, m.Name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// referenciasMed devuelve las contraindicaciones del medicamento.
+func referenciasMed(k *Knowledge, name string) []Contraindicacion {
+	var out []Contraindicacion
+	for _, c := range contraindicaciones(k) {
+		if mismoNombre(c.Med, name) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// validarSintoma normaliza el nombre y los códigos de s.
+func validarSintoma(s *Symptom) error {
+	s.Name = atomize(s.Name)
+	if err := validarCodigo(codSNOMED, &s.SNOMED); err != nil {
+		return err
+	}
+	return validarCodigo(codICPC, &s.ICPC)
+}
+
+// validarEnfermedad normaliza d y comprueba que sus síntomas existan.
+func validarEnfermedad(k *Knowledge, d *Disease) error {
+	d.Name = atomize(d.Name)
+	if err := validarCodigo(codICD10, &d.ICD10); err != nil {
+		return err
+	}
+	if strings.TrimSpace(d.Tipo) == "" || strings.TrimSpace(d.Sistema) == "" {
+		return kbErr(http.StatusUnprocessableEntity, "tipo y sistema son obligatorios")
+	}
+	d.Tipo, d.Sistema = atomize(d.Tipo), atomize(d.Sistema)
+	vistos := map[string]bool{}
+	for i := range d.Caracteristicas {
+		c := &d.Caracteristicas[i]
+		c.Symptom = atomize(c.Symptom)
+		if c.Peso < 1 || c.Peso > 3 {
+			return kbErr(http.StatusUnprocessableEntity, "peso de %s debe estar entre 1 y 3", c.Symptom)
+		}
+		if vistos[c.Symptom] {
+			return kbErr(http.StatusUnprocessableEntity, "síntoma %s repetido", c.Symptom)
+		}
+		vistos[c.Symptom] = true
+		if indiceSintoma(k, c.Symptom) < 0 {
+			return kbErr(http.StatusUnprocessableEntity, "síntoma %s no existe (créelo en /admin/symptoms)", c.Symptom)
+		}
+	}
+	var cs []string
+	for _, c := range d.Consejos {
+		if c = strings.TrimSpace(c); c != "" {
+			cs = append(cs, c)
+		}
+	}
+	d.Consejos = cs
+	return nil
+}
+
+// validarMed normaliza m y comprueba que las enfermedades tratadas existan.
+func validarMed(k *Knowledge, m *Medication) error {
+	m.Name = atomize(m.Name)
+	if err := validarCodigo(codATC, &m.ATC); err != nil {
+		return err
+	}
+	ts := []string{}
+	for _, t := range m.Treats {
+		t = atomize(t)
+		if indiceEnfermedad(k, t) < 0 {
+			return kbErr(http.StatusUnprocessableEntity, "enfermedad %s no existe", t)
+		}
+		if !contains(ts, t) {
+			ts = append(ts, t)
+		}
+	}
+	m.Treats = ts
+	return nil
+}
+
+// escribirKB aplica fn con mutarKB comprobando el If-Match de la petición.
+// Si falla responde con el error y devuelve false; si no, deja la ETag de la
+// nueva versión para la respuesta.
+func escribirKB(w http.ResponseWriter, r *http.Request, fn func(k *Knowledge) error) bool {
+	c, err := mutarKB(escrituraDe(r, origenCRUD), fn)
+	if err != nil {
+		writeKBError(w, err)
+		return false
+	}
+	w.Header().Set("ETag", etagKB(c.Version))
+	return true
+}
+
+// leerKB devuelve la KB que lee la petición (en vivo o borrador) y deja su
+// ETag en la respuesta. Si falla ya respondió con el error.
+func leerKB(w http.ResponseWriter, r *http.Request) (Knowledge, bool) {
+	k, version, err := kbDe(r)
+	if err != nil {
+		writeKBError(w, err)
+		return k, false
+	}
+	w.Header().Set("ETag", etagKB(version))
+	return k, true
+}
+
+// decodeJSON lee el cuerpo y responde 400 si no es JSON válido.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+//
+// ======== Síntomas ========
+//
+
+type sintomaDetalle struct {
+	Name         string   `json:"name"`
+	SNOMED       string   `json:"snomed,omitempty"`
+	ICPC         string   `json:"icpc,omitempty"`
+	Enfermedades []string `json:"enfermedades"`
+}
+
+// symptomPatch tiene punteros para distinguir campos ausentes de vacíos.
+type symptomPatch struct {
+	Name   *string `json:"name"`
+	SNOMED *string `json:"snomed"`
+	ICPC   *string `json:"icpc"`
+}
+
+func handleSymptoms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		out := append([]Symptom{}, k.Symptoms...)
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in Symptom
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		if strings.TrimSpace(in.Name) == "" {
+			http.Error(w, "name requerido", http.StatusBadRequest)
+			return
+		}
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if err := validarSintoma(&in); err != nil {
+				return err
+			}
+			if indiceSintoma(k, in.Name) >= 0 {
+				return kbErr(http.StatusConflict, "síntoma %s ya existe", in.Name)
+			}
+			k.Symptoms = append(k.Symptoms, in)
+			return nil
+		}) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, in)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSymptom(w http.ResponseWriter, r *http.Request) {
+	name := atomize(r.PathValue("name"))
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		i := indiceSintoma(&k, name)
+		if i < 0 {
+			http.Error(w, "síntoma no encontrado", http.StatusNotFound)
+			return
+		}
+		s := k.Symptoms[i]
+		out := sintomaDetalle{Name: s.Name, SNOMED: s.SNOMED, ICPC: s.ICPC, Enfermedades: referenciasSintoma(&k, name)}
+		if out.Enfermedades == nil {
+			out.Enfermedades = []string{}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPut, http.MethodPatch:
+		// PUT crea si no existe y reemplaza los códigos; PATCH sólo cambia los
+		// campos enviados. Ambos renombran con "name".
+		var p symptomPatch
+		if r.ContentLength != 0 && !decodeJSON(w, r, &p) {
+			return
+		}
+		var out Symptom
+		creado := false
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceSintoma(k, name)
+			s := Symptom{Name: name}
+			if i >= 0 {
+				s = k.Symptoms[i]
+			} else if r.Method == http.MethodPatch {
+				return kbErr(http.StatusNotFound, "síntoma no encontrado")
+			}
+			if r.Method == http.MethodPut {
+				s.SNOMED, s.ICPC = "", ""
+			}
+			if p.Name != nil && strings.TrimSpace(*p.Name) != "" {
+				s.Name = *p.Name
+			}
+			if p.SNOMED != nil {
+				s.SNOMED = *p.SNOMED
+			}
+			if p.ICPC != nil {
+				s.ICPC = *p.ICPC
+			}
+			if err := validarSintoma(&s); err != nil {
+				return err
+			}
+			if (i < 0 || !mismoNombre(s.Name, name)) && indiceSintoma(k, s.Name) >= 0 {
+				return kbErr(http.StatusConflict, "síntoma %s ya existe", s.Name)
+			}
+			out = s
+			if i < 0 {
+				k.Symptoms = append(k.Symptoms, s)
+				creado = true
+				return nil
+			}
+			k.Symptoms[i] = s
+			for di := range k.Diseases {
+				for ci := range k.Diseases[di].Caracteristicas {
+					if c := &k.Diseases[di].Caracteristicas[ci]; mismoNombre(c.Symptom, name) {
+						c.Symptom = s.Name
+					}
+				}
+			}
+			return nil
+		}) {
+			return
+		}
+		status := http.StatusOK
+		if creado {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, out)
+
+	case http.MethodDelete:
+		cascada := r.URL.Query().Get("cascada") == "true"
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceSintoma(k, name)
+			if i < 0 {
+				return kbErr(http.StatusNotFound, "síntoma no encontrado")
+			}
+			if refs := referenciasSintoma(k, name); len(refs) > 0 {
+				if !cascada {
+					return kbErr(http.StatusConflict, "síntoma usado por %s (use ?cascada=true para quitarlo de ellas)", strings.Join(refs, ", "))
+				}
+				for di := range k.Diseases {
+					d := &k.Diseases[di]
+					cs := d.Caracteristicas[:0]
+					for _, c := range d.Caracteristicas {
+						if !mismoNombre(c.Symptom, name) {
+							cs = append(cs, c)
+						}
+					}
+					d.Caracteristicas = cs
+				}
+			}
+			k.Symptoms = append(k.Symptoms[:i], k.Symptoms[i+1:]...)
+			return nil
+		}) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+//
+// ======== Enfermedades ========
+//
+
+// diseasePatch tiene punteros para distinguir campos ausentes de vacíos.
+type diseasePatch struct {
+	Name            *string   `json:"name"`
+	Tipo            *string   `json:"tipo"`
+	Sistema         *string   `json:"sistema"`
+	Descripcion     *string   `json:"descripcion"`
+	Consejos        *[]string `json:"consejos"`
+	Caracteristicas *[]Caract `json:"caracteristicas"`
+	ICD10           *string   `json:"icd10"`
+}
+
+func handleDiseases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		out := k.Diseases
+		if out == nil {
+			out = []Disease{}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in Disease
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		if strings.TrimSpace(in.Name) == "" {
+			http.Error(w, "name requerido", http.StatusBadRequest)
+			return
+		}
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if err := validarEnfermedad(k, &in); err != nil {
+				return err
+			}
+			if indiceEnfermedad(k, in.Name) >= 0 {
+				return kbErr(http.StatusConflict, "enfermedad %s ya existe", in.Name)
+			}
+			k.Diseases = append(k.Diseases, in)
+			return nil
+		}) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, in)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleDisease(w http.ResponseWriter, r *http.Request) {
+	name := atomize(r.PathValue("name"))
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		i := indiceEnfermedad(&k, name)
+		if i < 0 {
+			http.Error(w, "enfermedad no encontrada", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, k.Diseases[i])
+
+	case http.MethodPut:
+		var in Disease
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Name = name // PUT no renombra; para eso PATCH {"name": ...}
+		creado := false
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if err := validarEnfermedad(k, &in); err != nil {
+				return err
+			}
+			if i := indiceEnfermedad(k, name); i >= 0 {
+				k.Diseases[i] = in
+			} else {
+				k.Diseases = append(k.Diseases, in)
+				creado = true
+			}
+			return nil
+		}) {
+			return
+		}
+		status := http.StatusOK
+		if creado {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, in)
+
+	case http.MethodPatch:
+		var p diseasePatch
+		if !decodeJSON(w, r, &p) {
+			return
+		}
+		var out Disease
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceEnfermedad(k, name)
+			if i < 0 {
+				return kbErr(http.StatusNotFound, "enfermedad no encontrada")
+			}
+			d := k.Diseases[i]
+			if p.Name != nil {
+				d.Name = *p.Name
+			}
+			if p.Tipo != nil {
+				d.Tipo = *p.Tipo
+			}
+			if p.Sistema != nil {
+				d.Sistema = *p.Sistema
+			}
+			if p.Descripcion != nil {
+				d.Descripcion = *p.Descripcion
+			}
+			if p.Consejos != nil {
+				d.Consejos = *p.Consejos
+			}
+			if p.Caracteristicas != nil {
+				d.Caracteristicas = *p.Caracteristicas
+			}
+			if p.ICD10 != nil {
+				d.ICD10 = *p.ICD10
+			}
+			if err := validarEnfermedad(k, &d); err != nil {
+				return err
+			}
+			if !mismoNombre(d.Name, name) {
+				if indiceEnfermedad(k, d.Name) >= 0 {
+					return kbErr(http.StatusConflict, "enfermedad %s ya existe", d.Name)
+				}
+				for mi := range k.Meds {
+					for ti, t := range k.Meds[mi].Treats {
+						if mismoNombre(t, name) {
+							k.Meds[mi].Treats[ti] = d.Name
+						}
+					}
+				}
+			}
+			k.Diseases[i] = d
+			out = d
+			return nil
+		}) {
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodDelete:
+		cascada := r.URL.Query().Get("cascada") == "true"
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceEnfermedad(k, name)
+			if i < 0 {
+				return kbErr(http.StatusNotFound, "enfermedad no encontrada")
+			}
+			if refs := referenciasEnfermedad(k, name); len(refs) > 0 {
+				if !cascada {
+					return kbErr(http.StatusConflict, "enfermedad tratada por %s (use ?cascada=true para quitarla de ellos)", strings.Join(refs, ", "))
+				}
+				for mi := range k.Meds {
+					m := &k.Meds[mi]
+					ts := []string{}
+					for _, t := range m.Treats {
+						if !mismoNombre(t, name) {
+							ts = append(ts, t)
+						}
+					}
+					m.Treats = ts
+				}
+			}
+			k.Diseases = append(k.Diseases[:i], k.Diseases[i+1:]...)
+			return nil
+		}) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+//
+// ======== Medicamentos ========
+//
+
+type medPatch struct {
+	Name   *string   `json:"name"`
+	Treats *[]string `json:"treats"`
+	ATC    *string   `json:"atc"`
+}
+
+func handleMeds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		out := k.Meds
+		if out == nil {
+			out = []Medication{}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in Medication
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		if strings.TrimSpace(in.Name) == "" {
+			http.Error(w, "name requerido", http.StatusBadRequest)
+			return
+		}
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if err := validarMed(k, &in); err != nil {
+				return err
+			}
+			if indiceMed(k, in.Name) >= 0 {
+				return kbErr(http.StatusConflict, "medicamento %s ya existe", in.Name)
+			}
+			k.Meds = append(k.Meds, in)
+			return nil
+		}) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, in)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleMed(w http.ResponseWriter, r *http.Request) {
+	name := atomize(r.PathValue("name"))
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		i := indiceMed(&k, name)
+		if i < 0 {
+			http.Error(w, "medicamento no encontrado", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, k.Meds[i])
+
+	case http.MethodPut:
+		var in Medication
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		in.Name = name
+		creado := false
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if err := validarMed(k, &in); err != nil {
+				return err
+			}
+			if i := indiceMed(k, name); i >= 0 {
+				k.Meds[i] = in
+			} else {
+				k.Meds = append(k.Meds, in)
+				creado = true
+			}
+			return nil
+		}) {
+			return
+		}
+		status := http.StatusOK
+		if creado {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, in)
+
+	case http.MethodPatch:
+		var p medPatch
+		if !decodeJSON(w, r, &p) {
+			return
+		}
+		var out Medication
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceMed(k, name)
+			if i < 0 {
+				return kbErr(http.StatusNotFound, "medicamento no encontrado")
+			}
+			m := k.Meds[i]
+			if p.Name != nil {
+				m.Name = *p.Name
+			}
+			if p.Treats != nil {
+				m.Treats = *p.Treats
+			}
+			if p.ATC != nil {
+				m.ATC = *p.ATC
+			}
+			if err := validarMed(k, &m); err != nil {
+				return err
+			}
+			if !mismoNombre(m.Name, name) {
+				if indiceMed(k, m.Name) >= 0 {
+					return kbErr(http.StatusConflict, "medicamento %s ya existe", m.Name)
+				}
+				for ci := range k.ContraAlergias {
+					if mismoNombre(k.ContraAlergias[ci].Med, name) {
+						k.ContraAlergias[ci].Med = m.Name
+					}
+				}
+				for ci := range k.ContraCronicos {
+					if mismoNombre(k.ContraCronicos[ci].Med, name) {
+						k.ContraCronicos[ci].Med = m.Name
+					}
+				}
+			}
+			k.Meds[i] = m
+			out = m
+			return nil
+		}) {
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodDelete:
+		cascada := r.URL.Query().Get("cascada") == "true"
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			i := indiceMed(k, name)
+			if i < 0 {
+				return kbErr(http.StatusNotFound, "medicamento no encontrado")
+			}
+			if refs := referenciasMed(k, name); len(refs) > 0 {
+				if !cascada {
+					return kbErr(http.StatusConflict, "medicamento con %d contraindicaciones (use ?cascada=true para borrarlas)", len(refs))
+				}
+				quitarContraindicaciones(k, func(c Contraindicacion) bool { return mismoNombre(c.Med, name) })
+			}
+			k.Meds = append(k.Meds[:i], k.Meds[i+1:]...)
+			return nil
+		}) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+//
+// ======== Contraindicaciones ========
+//
+// Vista unificada de ContraAlergias y ContraCronicos:
+//   GET    ?med=&tipo=             lista filtrada
+//   POST   {med, tipo, valor}      añade una
+//   PUT    ?med=  [{tipo, valor}]  reemplaza todas las del medicamento
+//   DELETE ?med=&tipo=&valor=      borra una
+
+const (
+	contraAlergia = "alergia"
+	contraCronico = "cronico"
+)
+
+type Contraindicacion struct {
+	Med   string `json:"med"`
+	Tipo  string `json:"tipo"` // alergia | cronico
+	Valor string `json:"valor"`
+}
+
+func contraindicaciones(k *Knowledge) []Contraindicacion {
+	out := []Contraindicacion{}
+	for _, c := range k.ContraAlergias {
+		out = append(out, Contraindicacion{Med: c.Med, Tipo: contraAlergia, Valor: c.Alergia})
+	}
+	for _, c := range k.ContraCronicos {
+		out = append(out, Contraindicacion{Med: c.Med, Tipo: contraCronico, Valor: c.Cronico})
+	}
+	return out
+}
+
+func (c Contraindicacion) igual(o Contraindicacion) bool {
+	return mismoNombre(c.Med, o.Med) && c.Tipo == o.Tipo && mismoNombre(c.Valor, o.Valor)
+}
+
+// quitarContraindicaciones borra las que cumplan fn y devuelve cuántas.
+func quitarContraindicaciones(k *Knowledge, fn func(Contraindicacion) bool) int {
+	n := 0
+	as := []ContraAlergia{}
+	for _, c := range k.ContraAlergias {
+		if fn(Contraindicacion{Med: c.Med, Tipo: contraAlergia, Valor: c.Alergia}) {
+			n++
+			continue
+		}
+		as = append(as, c)
+	}
+	cs := []ContraCronico{}
+	for _, c := range k.ContraCronicos {
+		if fn(Contraindicacion{Med: c.Med, Tipo: contraCronico, Valor: c.Cronico}) {
+			n++
+			continue
+		}
+		cs = append(cs, c)
+	}
+	k.ContraAlergias, k.ContraCronicos = as, cs
+	return n
+}
+
+// agregarContraindicacion valida c y la añade si no existe ya.
+func agregarContraindicacion(k *Knowledge, c Contraindicacion) error {
+	if indiceMed(k, c.Med) < 0 {
+		return kbErr(http.StatusUnprocessableEntity, "medicamento %s no existe", c.Med)
+	}
+	if strings.TrimSpace(c.Valor) == "" {
+		return kbErr(http.StatusUnprocessableEntity, "valor requerido")
+	}
+	for _, o := range contraindicaciones(k) {
+		if o.igual(c) {
+			return kbErr(http.StatusConflict, "la contraindicación ya existe")
+		}
+	}
+	med, valor := atomize(c.Med), atomize(c.Valor)
+	switch c.Tipo {
+	case contraAlergia:
+		k.ContraAlergias = append(k.ContraAlergias, ContraAlergia{Med: med, Alergia: valor})
+	case contraCronico:
+		k.ContraCronicos = append(k.ContraCronicos, ContraCronico{Med: med, Cronico: valor})
+	default:
+		return kbErr(http.StatusUnprocessableEntity, "tipo debe ser alergia o cronico")
+	}
+	return nil
+}
+
+func handleContraindicaciones(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		k, ok := leerKB(w, r)
+		if !ok {
+			return
+		}
+		out := []Contraindicacion{}
+		for _, c := range contraindicaciones(&k) {
+			if v := q.Get("med"); v != "" && !mismoNombre(c.Med, v) {
+				continue
+			}
+			if v := q.Get("tipo"); v != "" && c.Tipo != v {
+				continue
+			}
+			out = append(out, c)
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var in Contraindicacion
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			return agregarContraindicacion(k, in)
+		}) {
+			return
+		}
+		in.Med, in.Valor = atomize(in.Med), atomize(in.Valor)
+		writeJSON(w, http.StatusCreated, in)
+
+	case http.MethodPut:
+		med := q.Get("med")
+		if med == "" {
+			http.Error(w, "?med= requerido", http.StatusBadRequest)
+			return
+		}
+		var in []Contraindicacion
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		var out []Contraindicacion
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			quitarContraindicaciones(k, func(c Contraindicacion) bool { return mismoNombre(c.Med, med) })
+			for _, c := range in {
+				c.Med = med
+				if err := agregarContraindicacion(k, c); err != nil {
+					return err
+				}
+			}
+			out = referenciasMed(k, med)
+			return nil
+		}) {
+			return
+		}
+		if out == nil {
+			out = []Contraindicacion{}
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodDelete:
+		c := Contraindicacion{Med: q.Get("med"), Tipo: q.Get("tipo"), Valor: q.Get("valor")}
+		if c.Med == "" || c.Tipo == "" || c.Valor == "" {
+			http.Error(w, "?med=, ?tipo= y ?valor= requeridos", http.StatusBadRequest)
+			return
+		}
+		if !escribirKB(w, r, func(k *Knowledge) error {
+			if quitarContraindicaciones(k, c.igual) == 0 {
+				return kbErr(http.StatusNotFound, "contraindicación no encontrada")
+			}
+			return nil
+		}) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
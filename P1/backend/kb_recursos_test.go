@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recursos atiende las rutas de kb_recursos.go como en main.go (sin auth).
+func recursos() *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/admin/symptoms", exigeIfMatch(handleSymptoms))
+	m.HandleFunc("/admin/symptoms/{name}", exigeIfMatch(handleSymptom))
+	m.HandleFunc("/admin/diseases", exigeIfMatch(handleDiseases))
+	m.HandleFunc("/admin/diseases/{name}", exigeIfMatch(handleDisease))
+	m.HandleFunc("/admin/meds", exigeIfMatch(handleMeds))
+	m.HandleFunc("/admin/meds/{name}", exigeIfMatch(handleMed))
+	return m
+}
+
+// pedirRecurso hace la petición con If-Match (si no es "") y devuelve la respuesta.
+func pedirRecurso(method, ruta, ifMatch, cuerpo string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, ruta, strings.NewReader(cuerpo))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	recursos().ServeHTTP(w, r)
+	return w
+}
+
+func TestBorrarRecursoCascada(t *testing.T) {
+	b := usarBases(t)
+
+	w := pedirRecurso(http.MethodDelete, "/admin/symptoms/fatiga", etagKB(b.version), "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "influenza") || !strings.Contains(w.Body.String(), "migrana") {
+		t.Fatalf("borrar un síntoma en uso: %d %s", w.Code, w.Body)
+	}
+	if indiceSintoma(&b.kb, "fatiga") < 0 {
+		t.Fatal("el 409 borró el síntoma")
+	}
+
+	w = pedirRecurso(http.MethodDelete, "/admin/symptoms/Fatiga?cascada=true", etagKB(b.version), "")
+	if w.Code != http.StatusNoContent || w.Header().Get("ETag") != etagKB(b.version) {
+		t.Fatalf("borrar en cascada: %d %s (ETag %s, versión %s)", w.Code, w.Body, w.Header().Get("ETag"), b.version)
+	}
+	if len(referenciasSintoma(&b.kb, "fatiga")) != 0 || indiceSintoma(&b.kb, "fatiga") >= 0 {
+		t.Errorf("fatiga sigue en la KB: %+v", b.kb.Diseases)
+	}
+
+	w = pedirRecurso(http.MethodDelete, "/admin/diseases/migrana", etagKB(b.version), "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "paracetamol") {
+		t.Fatalf("borrar una enfermedad tratada: %d %s", w.Code, w.Body)
+	}
+	w = pedirRecurso(http.MethodDelete, "/admin/diseases/migrana?cascada=true", etagKB(b.version), "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("borrar una enfermedad en cascada: %d %s", w.Code, w.Body)
+	}
+	if len(referenciasEnfermedad(&b.kb, "migrana")) != 0 || indiceEnfermedad(&b.kb, "migrana") >= 0 {
+		t.Errorf("migrana sigue en la KB: %+v", b.kb.Meds)
+	}
+
+	if w := pedirRecurso(http.MethodDelete, "/admin/symptoms/fatiga", etagKB(b.version), ""); w.Code != http.StatusNotFound {
+		t.Errorf("borrar un síntoma inexistente: %d", w.Code)
+	}
+}
+
+func TestRenombrarRecurso(t *testing.T) {
+	b := usarBases(t)
+
+	w := pedirRecurso(http.MethodPatch, "/admin/symptoms/tos", etagKB(b.version), `{"name":"Tos seca"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("renombrar síntoma: %d %s", w.Code, w.Body)
+	}
+	if s := b.kb.Symptoms[indiceSintoma(&b.kb, "tos_seca")]; s.SNOMED != "49727002" {
+		t.Errorf("el renombrado perdió los códigos: %+v", s)
+	}
+	if refs := referenciasSintoma(&b.kb, "tos_seca"); len(refs) != 2 || len(referenciasSintoma(&b.kb, "tos")) != 0 {
+		t.Errorf("las características no siguen al síntoma: %v", refs)
+	}
+
+	w = pedirRecurso(http.MethodPatch, "/admin/diseases/influenza", etagKB(b.version), `{"name":"gripe"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("renombrar enfermedad: %d %s", w.Code, w.Body)
+	}
+	if d := b.kb.Diseases[indiceEnfermedad(&b.kb, "gripe")]; d.ICD10 != "J11.1" || len(d.Caracteristicas) != 3 {
+		t.Errorf("el renombrado cambió la enfermedad: %+v", d)
+	}
+	if refs := referenciasEnfermedad(&b.kb, "gripe"); len(refs) != 2 || len(referenciasEnfermedad(&b.kb, "influenza")) != 0 {
+		t.Errorf("los tratamientos no siguen a la enfermedad: %v", refs)
+	}
+
+	if w := pedirRecurso(http.MethodPatch, "/admin/diseases/gripe", etagKB(b.version), `{"name":"migrana"}`); w.Code != http.StatusConflict {
+		t.Errorf("renombrar a un nombre existente: %d %s", w.Code, w.Body)
+	}
+	if w := pedirRecurso(http.MethodPatch, "/admin/symptoms/no_existe", etagKB(b.version), `{"name":"otro"}`); w.Code != http.StatusNotFound {
+		t.Errorf("renombrar un síntoma inexistente: %d", w.Code)
+	}
+}
+
+func TestRecursoInvalidoYVersion(t *testing.T) {
+	b := usarBases(t)
+	version := b.version
+
+	for _, c := range []struct{ method, ruta, cuerpo string }{
+		{http.MethodPost, "/admin/diseases", `{"name":"otitis","tipo":"bacteriano","sistema":"auditivo","caracteristicas":[{"symptom":"fiebre","peso":4}]}`},
+		{http.MethodPost, "/admin/diseases", `{"name":"otitis","tipo":"bacteriano","sistema":"auditivo","caracteristicas":[{"symptom":"dolor_oido","peso":2}]}`},
+		{http.MethodPost, "/admin/diseases", `{"name":"otitis","caracteristicas":[{"symptom":"fiebre","peso":2}]}`},
+		{http.MethodPatch, "/admin/diseases/migrana", `{"caracteristicas":[{"symptom":"fatiga","peso":1},{"symptom":"Fatiga","peso":2}]}`},
+		{http.MethodPatch, "/admin/symptoms/tos", `{"snomed":"no-es-un-codigo"}`},
+		{http.MethodPost, "/admin/meds", `{"name":"amoxicilina","treats":["otitis"]}`},
+	} {
+		if w := pedirRecurso(c.method, c.ruta, etagKB(b.version), c.cuerpo); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s %s: %d %s", c.method, c.ruta, c.cuerpo, w.Code, w.Body)
+		}
+	}
+	if b.version != version {
+		t.Fatal("una escritura rechazada cambió la KB")
+	}
+
+	if w := pedirRecurso(http.MethodPatch, "/admin/symptoms/tos", "", `{"icpc":"R05"}`); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("sin If-Match: %d", w.Code)
+	}
+	if w := pedirRecurso(http.MethodPatch, "/admin/symptoms/tos", etagKB(version), `{"name":"tos_seca"}`); w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	// otra pestaña con la ETag anterior no pisa el cambio
+	w := pedirRecurso(http.MethodDelete, "/admin/symptoms/fiebre?cascada=true", etagKB(version), "")
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != etagKB(b.version) {
+		t.Errorf("If-Match vieja: %d, ETag %q (actual %q)", w.Code, w.Header().Get("ETag"), etagKB(b.version))
+	}
+	if indiceSintoma(&b.kb, "fiebre") < 0 {
+		t.Error("el 412 borró el síntoma")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// ======== Diferencias semánticas entre dos KB ========
+//
+// Se comparan por nombre atomizado, así que "Dolor Cabeza" y "dolor_cabeza"
+// cuentan como el mismo síntoma, igual que en el .pl generado.
+
+type CampoCambio struct {
+	Campo   string `json:"campo"`
+	Antes   string `json:"antes"`
+	Despues string `json:"despues"`
+}
+
+// PesoCambio es un cambio en caracteriza/3; 0 significa que el par no existe.
+type PesoCambio struct {
+	Sintoma string `json:"sintoma"`
+	Antes   int    `json:"antes"`
+	Despues int    `json:"despues"`
+}
+
+type EnfermedadCambio struct {
+	Nombre string        `json:"nombre"`
+	Campos []CampoCambio `json:"campos,omitempty"`
+	Pesos  []PesoCambio  `json:"pesos,omitempty"`
+}
+
+// CodigoCambio es un código clínico añadido, cambiado o quitado (vacío).
+type CodigoCambio struct {
+	Elemento string `json:"elemento"`
+	Sistema  string `json:"sistema"` // icd10, snomed, icpc o atc
+	Antes    string `json:"antes"`
+	Despues  string `json:"despues"`
+}
+
+// Vinculo es un par medicamento-valor (enfermedad tratada, alergia o crónico).
+type Vinculo struct {
+	Med   string `json:"med"`
+	Valor string `json:"valor"`
+}
+
+type KBDiff struct {
+	EnfermedadesNuevas      []string           `json:"enfermedadesNuevas,omitempty"`
+	EnfermedadesModificadas []EnfermedadCambio `json:"enfermedadesModificadas,omitempty"`
+	EnfermedadesSinCambios  []string           `json:"enfermedadesSinCambios,omitempty"`
+	EnfermedadesEliminadas  []string           `json:"enfermedadesEliminadas,omitempty"`
+	SintomasNuevos          []string           `json:"sintomasNuevos,omitempty"`
+	SintomasEliminados      []string           `json:"sintomasEliminados,omitempty"`
+	MedicamentosNuevos      []string           `json:"medicamentosNuevos,omitempty"`
+	MedicamentosEliminados  []string           `json:"medicamentosEliminados,omitempty"`
+	TratamientosNuevos      []Vinculo          `json:"tratamientosNuevos,omitempty"`
+	TratamientosEliminados  []Vinculo          `json:"tratamientosEliminados,omitempty"`
+	AlergiasNuevas          []Vinculo          `json:"contraAlergiasNuevas,omitempty"`
+	AlergiasEliminadas      []Vinculo          `json:"contraAlergiasEliminadas,omitempty"`
+	CronicosNuevos          []Vinculo          `json:"contraCronicosNuevas,omitempty"`
+	CronicosEliminados      []Vinculo          `json:"contraCronicosEliminadas,omitempty"`
+	Codigos                 []CodigoCambio     `json:"codigos,omitempty"`
+}
+
+// Vacio indica que ambas KB generan los mismos hechos.
+func (d KBDiff) Vacio() bool {
+	return len(d.EnfermedadesNuevas)+len(d.EnfermedadesModificadas)+len(d.EnfermedadesEliminadas)+
+		len(d.SintomasNuevos)+len(d.SintomasEliminados)+
+		len(d.MedicamentosNuevos)+len(d.MedicamentosEliminados)+
+		len(d.TratamientosNuevos)+len(d.TratamientosEliminados)+
+		len(d.AlergiasNuevas)+len(d.AlergiasEliminadas)+
+		len(d.CronicosNuevos)+len(d.CronicosEliminados)+len(d.Codigos) == 0
+}
+
+func diffKB(antes, despues Knowledge) KBDiff {
+	var d KBDiff
+
+	// Enfermedades
+	ea := diseaseIndex(antes)
+	ed := diseaseIndex(despues)
+	for _, name := range sortedKeys(ed) {
+		nueva := ed[name]
+		vieja, ok := ea[name]
+		if !ok {
+			d.EnfermedadesNuevas = append(d.EnfermedadesNuevas, name)
+			continue
+		}
+		c := EnfermedadCambio{Nombre: name}
+		for _, f := range [][3]string{
+			{"tipo", atomize(vieja.Tipo), atomize(nueva.Tipo)},
+			{"sistema", atomize(vieja.Sistema), atomize(nueva.Sistema)},
+			{"descripcion", vieja.Descripcion, nueva.Descripcion},
+			{"consejos", strings.Join(vieja.Consejos, "; "), strings.Join(nueva.Consejos, "; ")},
+		} {
+			if f[1] != f[2] {
+				c.Campos = append(c.Campos, CampoCambio{Campo: f[0], Antes: f[1], Despues: f[2]})
+			}
+		}
+		pa, pd := pesos(vieja), pesos(nueva)
+		for _, s := range sortedKeys(unionKeys(pa, pd)) {
+			if pa[s] != pd[s] {
+				c.Pesos = append(c.Pesos, PesoCambio{Sintoma: s, Antes: pa[s], Despues: pd[s]})
+			}
+		}
+		if len(c.Campos) > 0 || len(c.Pesos) > 0 {
+			d.EnfermedadesModificadas = append(d.EnfermedadesModificadas, c)
+		} else {
+			d.EnfermedadesSinCambios = append(d.EnfermedadesSinCambios, name)
+		}
+	}
+	for _, name := range sortedKeys(ea) {
+		if _, ok := ed[name]; !ok {
+			d.EnfermedadesEliminadas = append(d.EnfermedadesEliminadas, name)
+		}
+	}
+
+	// Síntomas y medicamentos
+	d.SintomasNuevos, d.SintomasEliminados = setDiff(symptomSet(antes), symptomSet(despues))
+	d.MedicamentosNuevos, d.MedicamentosEliminados = setDiff(medSet(antes), medSet(despues))
+
+	// Vínculos
+	d.TratamientosNuevos, d.TratamientosEliminados = vinculoDiff(treatSet(antes), treatSet(despues))
+	d.AlergiasNuevas, d.AlergiasEliminadas = vinculoDiff(alergiaSet(antes), alergiaSet(despues))
+	d.CronicosNuevos, d.CronicosEliminados = vinculoDiff(cronicoSet(antes), cronicoSet(despues))
+
+	// Códigos clínicos (los de elementos nuevos o eliminados también cuentan)
+	ca, cd := codigoMap(antes), codigoMap(despues)
+	for _, clave := range sortedKeys(unionKeysStr(ca, cd)) {
+		if ca[clave] != cd[clave] {
+			el, sis, _ := strings.Cut(clave, "|")
+			d.Codigos = append(d.Codigos, CodigoCambio{Elemento: el, Sistema: sis, Antes: ca[clave], Despues: cd[clave]})
+		}
+	}
+	return d
+}
+
+// codigoMap indexa los códigos por "elemento|sistema".
+func codigoMap(k Knowledge) map[string]string {
+	m := map[string]string{}
+	put := func(el, sis, c string) {
+		if c != "" {
+			m[atomize(el)+"|"+sis] = c
+		}
+	}
+	for _, s := range k.Symptoms {
+		put(s.Name, codSNOMED, s.SNOMED)
+		put(s.Name, codICPC, s.ICPC)
+	}
+	for _, x := range k.Diseases {
+		put(x.Name, codICD10, x.ICD10)
+	}
+	for _, x := range k.Meds {
+		put(x.Name, codATC, x.ATC)
+	}
+	return m
+}
+
+func diseaseIndex(k Knowledge) map[string]Disease {
+	m := map[string]Disease{}
+	for _, d := range k.Diseases {
+		m[atomize(d.Name)] = d
+	}
+	return m
+}
+
+func pesos(d Disease) map[string]int {
+	m := map[string]int{}
+	for _, c := range d.Caracteristicas {
+		m[atomize(c.Symptom)] = clamp(c.Peso, 1, 3)
+	}
+	return m
+}
+
+func symptomSet(k Knowledge) map[string]bool {
+	m := map[string]bool{}
+	for _, s := range k.Symptoms {
+		m[atomize(s.Name)] = true
+	}
+	return m
+}
+
+func medSet(k Knowledge) map[string]bool {
+	m := map[string]bool{}
+	for _, x := range k.Meds {
+		m[atomize(x.Name)] = true
+	}
+	return m
+}
+
+func treatSet(k Knowledge) map[Vinculo]bool {
+	m := map[Vinculo]bool{}
+	for _, x := range k.Meds {
+		for _, t := range x.Treats {
+			m[Vinculo{atomize(x.Name), atomize(t)}] = true
+		}
+	}
+	return m
+}
+
+func alergiaSet(k Knowledge) map[Vinculo]bool {
+	m := map[Vinculo]bool{}
+	for _, c := range k.ContraAlergias {
+		m[Vinculo{atomize(c.Med), atomize(c.Alergia)}] = true
+	}
+	return m
+}
+
+func cronicoSet(k Knowledge) map[Vinculo]bool {
+	m := map[Vinculo]bool{}
+	for _, c := range k.ContraCronicos {
+		m[Vinculo{atomize(c.Med), atomize(c.Cronico)}] = true
+	}
+	return m
+}
+
+func setDiff(a, b map[string]bool) (nuevos, eliminados []string) {
+	for _, k := range sortedKeys(b) {
+		if !a[k] {
+			nuevos = append(nuevos, k)
+		}
+	}
+	for _, k := range sortedKeys(a) {
+		if !b[k] {
+			eliminados = append(eliminados, k)
+		}
+	}
+	return
+}
+
+func vinculoDiff(a, b map[Vinculo]bool) (nuevos, eliminados []Vinculo) {
+	for v := range b {
+		if !a[v] {
+			nuevos = append(nuevos, v)
+		}
+	}
+	for v := range a {
+		if !b[v] {
+			eliminados = append(eliminados, v)
+		}
+	}
+	sortVinculos(nuevos)
+	sortVinculos(eliminados)
+	return
+}
+
+func sortVinculos(vs []Vinculo) {
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].Med != vs[j].Med {
+			return vs[i].Med < vs[j].Med
+		}
+		return vs[i].Valor < vs[j].Valor
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func unionKeys(a, b map[string]int) map[string]int {
+	m := map[string]int{}
+	for k := range a {
+		m[k] = 1
+	}
+	for k := range b {
+		m[k] = 1
+	}
+	return m
+}
+
+func unionKeysStr(a, b map[string]string) map[string]bool {
+	m := map[string]bool{}
+	for k := range a {
+		m[k] = true
+	}
+	for k := range b {
+		m[k] = true
+	}
+	return m
+}
+
+// formatPeso muestra 0 como "-" (par inexistente).
+func formatPeso(p int) string {
+	if p == 0 {
+		return "-"
+	}
+	return fmt.Sprint(p)
+}
+
+// formatCodigo muestra "" como "-" (sin código).
+func formatCodigo(c string) string {
+	if c == "" {
+		return "-"
+	}
+	return c
+}
+
+func formatVinculos(vs []Vinculo) string {
+	var out []string
+	for _, v := range vs {
+		out = append(out, v.Med+"→"+v.Valor)
+	}
+	return strings.Join(out, ", ")
+}
+
+// formatKBDiff resume el diff en texto plano.
+func formatKBDiff(d KBDiff) string {
+	if d.Vacio() {
+		return "Sin cambios en la KB.\n"
+	}
+	var b strings.Builder
+	linea := func(titulo string, xs []string) {
+		if len(xs) > 0 {
+			b.WriteString(fmt.Sprintf("%s: %s\n", titulo, strings.Join(xs, ", ")))
+		}
+	}
+	linea("Enfermedades nuevas", d.EnfermedadesNuevas)
+	for _, c := range d.EnfermedadesModificadas {
+		b.WriteString("Enfermedad modificada: " + c.Nombre + "\n")
+		for _, f := range c.Campos {
+			b.WriteString(fmt.Sprintf("  %s: %q → %q\n", f.Campo, f.Antes, f.Despues))
+		}
+		for _, p := range c.Pesos {
+			b.WriteString(fmt.Sprintf("  %s: %s → %s\n", p.Sintoma, formatPeso(p.Antes), formatPeso(p.Despues)))
+		}
+	}
+	linea("Enfermedades eliminadas", d.EnfermedadesEliminadas)
+	linea("Síntomas nuevos", d.SintomasNuevos)
+	linea("Síntomas eliminados", d.SintomasEliminados)
+	linea("Medicamentos nuevos", d.MedicamentosNuevos)
+	linea("Medicamentos eliminados", d.MedicamentosEliminados)
+	if len(d.TratamientosNuevos) > 0 {
+		b.WriteString("Tratamientos nuevos: " + formatVinculos(d.TratamientosNuevos) + "\n")
+	}
+	if len(d.TratamientosEliminados) > 0 {
+		b.WriteString("Tratamientos eliminados: " + formatVinculos(d.TratamientosEliminados) + "\n")
+	}
+	if len(d.AlergiasNuevas) > 0 {
+		b.WriteString("Contraindicaciones por alergia nuevas: " + formatVinculos(d.AlergiasNuevas) + "\n")
+	}
+	if len(d.AlergiasEliminadas) > 0 {
+		b.WriteString("Contraindicaciones por alergia eliminadas: " + formatVinculos(d.AlergiasEliminadas) + "\n")
+	}
+	if len(d.CronicosNuevos) > 0 {
+		b.WriteString("Contraindicaciones por crónico nuevas: " + formatVinculos(d.CronicosNuevos) + "\n")
+	}
+	if len(d.CronicosEliminados) > 0 {
+		b.WriteString("Contraindicaciones por crónico eliminadas: " + formatVinculos(d.CronicosEliminados) + "\n")
+	}
+	for _, c := range d.Codigos {
+		b.WriteString(fmt.Sprintf("Código %s de %s: %s → %s\n", c.Sistema, c.Elemento, formatCodigo(c.Antes), formatCodigo(c.Despues)))
+	}
+	return b.String()
+}
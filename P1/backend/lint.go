@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//
+// ======== Lint de la KB ========
+//
+// Además de la integridad referencial (que ya comprueban los recursos y el
+// compilador), la KB puede tener problemas lógicos que no impiden cargarla:
+//
+//   sin_alternativa_alergia    (aviso) ningún medicamento que trata la enfermedad es seguro con esa alergia
+//   sin_tratamiento            (aviso) ningún medicamento trata la enfermedad
+//   enfermedad_sin_sintomas    (error) sin caracteriza/3 nunca puede sugerirse
+//   perfil_identico            (error) dos enfermedades con los mismos síntomas y pesos: nunca se distinguen
+//   sintoma_sin_uso            (aviso) ningún caracteriza/3 lo usa
+//   medicamento_sin_uso        (aviso) no trata ninguna enfermedad de la KB
+//   contraindicacion_duplicada (aviso) la misma contraindicación más de una vez
+//   contraindicacion_contradictoria (error) contraindicado por la misma condición que trata
+//   contraindicacion_sin_valor (info)  alergia "desconocida" (de una ingesta RPA); no la declara ningún paciente
+//
+// Las alergias que se comprueban son las que aparecen en contraindicado_por_alergia/2
+// (salvo "desconocida"), o las que se indiquen con -alergias / ?alergias=.
+//
+//   medi-logic lint [-kb storage/kb.json] [-alergias aines,penicilina] [-estricto] [-json]
+//   GET /admin/kb/lint[?alergias=&formato=texto]   (con X-KB-Borrador, el borrador)
+//
+// El comando termina con código 1 si hay errores (o avisos, con -estricto).
+
+const sevInfo = "info"
+
+const alergiaDesconocida = "desconocida" // la que pone applyParsedToKB
+
+type HallazgoLint struct {
+	Regla      string   `json:"regla"`
+	Severidad  string   `json:"severidad"`
+	Elementos  []string `json:"elementos"` // nombres implicados
+	Mensaje    string   `json:"mensaje"`
+	Sugerencia string   `json:"sugerencia"`
+}
+
+type InformeLint struct {
+	Version   string         `json:"version,omitempty"`
+	Alergias  []string       `json:"alergias"` // las comprobadas
+	Resumen   map[string]int `json:"resumen"`  // por severidad
+	Hallazgos []HallazgoLint `json:"hallazgos"`
+}
+
+var ordenSeveridad = map[string]int{sevError: 0, sevAviso: 1, sevInfo: 2}
+
+// lintKB revisa k. alergias vacío usa las de la propia KB.
+func lintKB(k Knowledge, alergias []string) InformeLint {
+	inf := InformeLint{Resumen: map[string]int{sevError: 0, sevAviso: 0, sevInfo: 0}, Hallazgos: []HallazgoLint{}}
+	add := func(regla, sev, msg, sug string, elems ...string) {
+		inf.Hallazgos = append(inf.Hallazgos, HallazgoLint{Regla: regla, Severidad: sev, Elementos: elems, Mensaje: msg, Sugerencia: sug})
+		inf.Resumen[sev]++
+	}
+
+	// alergias a comprobar
+	if len(alergias) == 0 {
+		for _, c := range k.ContraAlergias {
+			if a := atomize(c.Alergia); a != alergiaDesconocida && !contains(alergias, a) {
+				alergias = append(alergias, a)
+			}
+		}
+	} else {
+		for i := range alergias {
+			alergias[i] = atomize(alergias[i])
+		}
+	}
+	sort.Strings(alergias)
+	inf.Alergias = alergias
+
+	contraPor := map[string]map[string]bool{} // med -> alergias
+	for _, c := range k.ContraAlergias {
+		m := atomize(c.Med)
+		if contraPor[m] == nil {
+			contraPor[m] = map[string]bool{}
+		}
+		contraPor[m][atomize(c.Alergia)] = true
+	}
+	tratan := map[string][]string{} // enfermedad -> medicamentos
+	for _, m := range k.Meds {
+		for _, d := range m.Treats {
+			tratan[atomize(d)] = append(tratan[atomize(d)], atomize(m.Name))
+		}
+	}
+
+	// enfermedades: tratamiento y alternativas por alergia
+	for _, d := range k.Diseases {
+		n := atomize(d.Name)
+		meds := tratan[n]
+		if len(meds) == 0 {
+			add("sin_tratamiento", sevAviso,
+				fmt.Sprintf("ningún medicamento trata %s", n),
+				fmt.Sprintf("añada %s a trata/2 de algún medicamento", n), n)
+			continue
+		}
+		for _, a := range alergias {
+			seguro := false
+			for _, m := range meds {
+				if !contraPor[m][a] {
+					seguro = true
+					break
+				}
+			}
+			if !seguro {
+				add("sin_alternativa_alergia", sevAviso,
+					fmt.Sprintf("con alergia a %s no queda ningún medicamento para %s (%s)", a, n, strings.Join(meds, ", ")),
+					fmt.Sprintf("añada para %s un medicamento que no esté contraindicado por %s", n, a), n, a)
+			}
+		}
+	}
+
+	// perfiles de síntomas
+	usados := map[string]bool{}
+	perfiles := map[string][]string{} // perfil canónico -> enfermedades
+	for _, d := range k.Diseases {
+		n := atomize(d.Name)
+		if len(d.Caracteristicas) == 0 {
+			add("enfermedad_sin_sintomas", sevError,
+				fmt.Sprintf("%s no tiene síntomas (caracteriza/3) y nunca puede sugerirse", n),
+				"añada sus síntomas con peso 1..3 o elimínela", n)
+			continue
+		}
+		var p []string
+		for _, c := range d.Caracteristicas {
+			s := atomize(c.Symptom)
+			usados[s] = true
+			p = append(p, fmt.Sprintf("%s:%d", s, c.Peso))
+		}
+		sort.Strings(p)
+		clave := strings.Join(p, ",")
+		perfiles[clave] = append(perfiles[clave], n)
+	}
+	for _, clave := range sortedKeys(perfiles) {
+		if ds := perfiles[clave]; len(ds) > 1 {
+			add("perfil_identico", sevError,
+				fmt.Sprintf("%s tienen el mismo perfil (%s) y siempre empatan", strings.Join(ds, ", "), clave),
+				"diferéncielas con algún síntoma propio o con otros pesos, o únalas", ds...)
+		}
+	}
+	for _, s := range k.Symptoms {
+		if n := atomize(s.Name); !usados[n] {
+			add("sintoma_sin_uso", sevAviso,
+				fmt.Sprintf("ninguna enfermedad usa el síntoma %s", n),
+				fmt.Sprintf("úselo en caracteriza/3 o elimínelo (DELETE /admin/symptoms/%s)", n), n)
+		}
+	}
+
+	// medicamentos
+	enfermedades := map[string]bool{}
+	for _, d := range k.Diseases {
+		enfermedades[atomize(d.Name)] = true
+	}
+	for _, m := range k.Meds {
+		n, trata := atomize(m.Name), false
+		for _, d := range m.Treats {
+			trata = trata || enfermedades[atomize(d)]
+		}
+		if !trata {
+			add("medicamento_sin_uso", sevAviso,
+				fmt.Sprintf("%s no trata ninguna enfermedad de la KB", n),
+				fmt.Sprintf("complete su lista trata o elimínelo (DELETE /admin/meds/%s?cascada=true)", n), n)
+		}
+	}
+
+	// contraindicaciones
+	vistas := map[Contraindicacion]int{}
+	var orden []Contraindicacion
+	for _, c := range contraindicaciones(&k) {
+		c = Contraindicacion{Med: atomize(c.Med), Tipo: c.Tipo, Valor: atomize(c.Valor)}
+		if vistas[c] == 0 {
+			orden = append(orden, c)
+		}
+		vistas[c]++
+	}
+	for _, c := range orden {
+		if n := vistas[c]; n > 1 {
+			add("contraindicacion_duplicada", sevAviso,
+				fmt.Sprintf("%s contraindicado por %s %s aparece %d veces", c.Med, c.Tipo, c.Valor, n),
+				fmt.Sprintf("deje una sola (PUT /admin/contraindications?med=%s)", c.Med), c.Med, c.Valor)
+		}
+		for _, m := range k.Meds {
+			if atomize(m.Name) != c.Med {
+				continue
+			}
+			for _, d := range m.Treats {
+				if atomize(d) == c.Valor {
+					add("contraindicacion_contradictoria", sevError,
+						fmt.Sprintf("%s trata %s pero está contraindicado por %s %s", c.Med, c.Valor, c.Tipo, c.Valor),
+						"revise cuál de las dos es correcta y quite la otra", c.Med, c.Valor)
+				}
+			}
+		}
+		if c.Tipo == contraAlergia && c.Valor == alergiaDesconocida {
+			add("contraindicacion_sin_valor", sevInfo,
+				fmt.Sprintf("%s está contraindicado por una alergia desconocida, que no coincide con ninguna declarada", c.Med),
+				"sustitúyala por la alergia real o quítela", c.Med)
+		}
+	}
+
+	sort.SliceStable(inf.Hallazgos, func(i, j int) bool {
+		a, b := inf.Hallazgos[i], inf.Hallazgos[j]
+		if ordenSeveridad[a.Severidad] != ordenSeveridad[b.Severidad] {
+			return ordenSeveridad[a.Severidad] < ordenSeveridad[b.Severidad]
+		}
+		return a.Regla < b.Regla
+	})
+	return inf
+}
+
+func formatInformeLint(inf InformeLint) string {
+	var b strings.Builder
+	titulo := "Lint de la KB"
+	if inf.Version != "" {
+		titulo += " (versión " + inf.Version + ")"
+	}
+	fmt.Fprintf(&b, "%s: %d errores, %d avisos, %d info\n", titulo, inf.Resumen[sevError], inf.Resumen[sevAviso], inf.Resumen[sevInfo])
+	if len(inf.Alergias) > 0 {
+		fmt.Fprintf(&b, "Alergias comprobadas: %s\n", strings.Join(inf.Alergias, ", "))
+	}
+	for _, h := range inf.Hallazgos {
+		fmt.Fprintf(&b, "\n[%s] %s: %s\n    → %s\n", h.Severidad, h.Regla, h.Mensaje, h.Sugerencia)
+	}
+	return b.String()
+}
+
+func splitAlergias(s string) []string {
+	var out []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+//
+// ======== GET /admin/kb/lint ========
+//
+
+func handleKBLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	k, version, err := kbDe(r)
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	inf := lintKB(k, splitAlergias(r.URL.Query().Get("alergias")))
+	inf.Version = version
+	if r.URL.Query().Get("formato") == "texto" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, formatInformeLint(inf))
+		return
+	}
+	writeJSON(w, http.StatusOK, inf)
+}
+
+//
+// ======== medi-logic lint ========
+//
+
+func runLintCmd(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	kbFile := fs.String("kb", filepath.Join("storage", "kb.json"), "KB en JSON")
+	alergias := fs.String("alergias", "", "alergias a comprobar, separadas por comas (por defecto las de la KB)")
+	estricto := fs.Bool("estricto", false, "terminar con error también si hay avisos")
+	asJSON := fs.Bool("json", false, "imprimir el informe en JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := os.ReadFile(*kbFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "uso: medi-logic lint [-kb kb.json] [-alergias a,b] [-estricto] [-json]")
+		return 2
+	}
+	var k Knowledge
+	if err := json.Unmarshal(b, &k); err != nil {
+		fmt.Fprintf(os.Stderr, "KB inválida: %v\n", err)
+		return 1
+	}
+
+	inf := lintKB(k, splitAlergias(*alergias))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(inf)
+	} else {
+		fmt.Print(formatInformeLint(inf))
+	}
+	if inf.Resumen[sevError] > 0 || *estricto && inf.Resumen[sevAviso] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/smtp"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,10 +32,22 @@ type AnalyzeReq struct {
 	Sintomas []SintomaInput `json:"sintomas"`
 	Alergias []string       `json:"alergias"`
 	Cronicos []string       `json:"cronicos"`
+	Paciente string         `json:"paciente,omitempty"` // sólo para el historial (se seudonimiza)
+	Notas    string         `json:"notas,omitempty"`    // texto libre, sólo para el historial
 }
 
 type AnalyzeResp struct {
+	ConsultaID string                   `json:"consultaId,omitempty"` // para POST /feedback
+	Borrador   string                   `json:"borrador,omitempty"`   // consulta de prueba contra un borrador
 	Resultados []map[string]interface{} `json:"resultados"`
+	Sintomas   []SintomaCodificado      `json:"sintomas,omitempty"` // los consultados que tienen código
+}
+
+// SintomaCodificado son los códigos clínicos de un síntoma consultado.
+type SintomaCodificado struct {
+	Nombre string `json:"nombre"`
+	SNOMED string `json:"snomed,omitempty"`
+	ICPC   string `json:"icpc,omitempty"`
 }
 
 //
@@ -41,7 +55,9 @@ type AnalyzeResp struct {
 //
 
 type Symptom struct {
-	Name string `json:"name"`
+	Name   string `json:"name"`
+	SNOMED string `json:"snomed,omitempty"` // concepto SNOMED CT
+	ICPC   string `json:"icpc,omitempty"`   // rúbrica ICPC-2
 }
 
 type Caract struct {
@@ -54,12 +70,15 @@ type Disease struct {
 	Tipo            string   `json:"tipo"`    // viral, cronico, etc.
 	Sistema         string   `json:"sistema"` // respiratorio, etc.
 	Descripcion     string   `json:"descripcion"`
+	Consejos        []string `json:"consejos,omitempty"` // recomendaciones de autocuidado
 	Caracteristicas []Caract `json:"caracteristicas"`
+	ICD10           string   `json:"icd10,omitempty"` // código CIE-10
 }
 
 type Medication struct {
 	Name   string   `json:"name"`
-	Treats []string `json:"treats"` // enfermedades
+	Treats []string `json:"treats"`        // enfermedades
+	ATC    string   `json:"atc,omitempty"` // principio activo, nivel 5 de la ATC
 }
 
 type ContraAlergia struct {
@@ -85,12 +104,9 @@ type Knowledge struct {
 //
 
 var (
-	adminToken = getenv("ADMIN_TOKEN", "admin123")
-	plPath     = filepath.Join("prolog", "medi_logic.pl")
+	plPath = filepath.Join("prolog", "medi_logic.pl") // .pl de la KB general
 
-	vm   *prolog.Interpreter
-	kb   Knowledge
-	mu   sync.Mutex
+	mu   sync.Mutex // protege las KB cargadas (bases.go) y sus borradores
 	logp = log.Printf
 )
 
@@ -99,33 +115,99 @@ var (
 //
 
 func main() {
+	// Subcomandos de línea de órdenes (medi-logic eval ...)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			os.Exit(runEvalCmd(os.Args[2:]))
+		case "fit":
+			os.Exit(runFitCmd(os.Args[2:]))
+		case "lint":
+			os.Exit(runLintCmd(os.Args[2:]))
+		}
+	}
+
 	ensureDirs()
+	loadFeedback()
+	initHistorial()
+	initVigilancia()
+	initOutbox()
+	initRedesPermitidas() // antes de los webhooks y los trabajos RPA
+	initWebhooks()
+	initReportes()
+	initCuentas()
+	initAuditoria()
+
+	// KB guardadas (o la KB por defecto) -> generar .pl -> cargar VM
+	initBases()
+	initInbox() // después de cargar la KB: aplica archivos pendientes
+	initRPAJobs()
+
+	registrarRutas()
 
-	// KB por defecto -> generar .pl -> cargar VM
-	kb = defaultKB()
-	code := buildPL(kb)
-	if err := os.WriteFile(plPath, []byte(code), 0644); err != nil {
-		log.Fatalf("No se pudo escribir %s: %v", plPath, err)
-	}
-	if err := reloadVM(code); err != nil {
-		log.Fatalf("Error cargando Prolog: %v", err)
-	}
+	log.Println("MediLogic backend en http://localhost:8080")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
 
-	// Rutas
+// registrarRutas registra los endpoints en http.DefaultServeMux.
+func registrarRutas() {
 	http.HandleFunc("/health", withCORS(func(w http.ResponseWriter, _ *http.Request) {
 		io.WriteString(w, "ok")
 	}))
 
-	http.HandleFunc("/analyze", withCORS(handleAnalyze))
-
-	// Admin
-	http.HandleFunc("/admin/export", withCORS(auth(handleExportPL)))
-	http.HandleFunc("/admin/kb", withCORS(auth(handleKB)))              // GET/POST
-	http.HandleFunc("/admin/upload-pl", withCORS(auth(handleUploadPL))) // POST multipart/simple
-	http.HandleFunc("/admin/rpa/ingest", withCORS(auth(handleRPAIngest)))
-
-	log.Println("MediLogic backend en http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Las rutas de rutaKB existen también bajo /kb/{kb} (ver bases.go)
+	rutaKB("/analyze", withCORS(handleAnalyze))
+	http.HandleFunc("/feedback", withCORS(authCuenta(rolEditor, handleFeedback))) // POST confirmación del médico (la KB es la de la consulta)
+
+	// Cuentas, sesión y auditoría (cuentas.go, auditoria.go)
+	http.HandleFunc("/auth/login", withCORS(auditado(false, handleLogin)))                         // POST {usuario, password}
+	http.HandleFunc("/auth/me", withCORS(authCuenta(rolViewer, handleYo)))                         // GET
+	http.HandleFunc("/auth/password", withCORS(authCuenta(rolViewer, handlePassword)))             // POST {actual, nueva}
+	http.HandleFunc("/admin/audit", withCORS(authCuenta(rolSuperadmin, handleAudit)))              // GET filtros, JSON o CSV
+	http.HandleFunc("/admin/audit/verify", withCORS(authCuenta(rolSuperadmin, handleAuditVerify))) // GET comprueba la cadena
+	http.HandleFunc("/admin/users", withCORS(authCuenta(rolSuperadmin, handleUsers)))              // GET/POST
+	http.HandleFunc("/admin/users/{usuario}", withCORS(authCuenta(rolSuperadmin, handleUser)))     // GET/PATCH/DELETE
+
+	// Admin de todas las KB
+	http.HandleFunc("/admin/kbs", withCORS(authCuenta(rolSuperadmin, handleKBs)))                          // GET/POST
+	http.HandleFunc("/admin/kbs/{nombre}", withCORS(authCuenta(rolSuperadmin, handleKBItem)))              // DELETE
+	http.HandleFunc("/admin/kbs/{nombre}/tokens", withCORS(authCuenta(rolSuperadmin, handleKBTokens)))     // POST token para la KB
+	http.HandleFunc("/admin/kbs/{nombre}/tokens/{id}", withCORS(authCuenta(rolSuperadmin, handleKBToken))) // DELETE
+	http.HandleFunc("/admin/outbox", withCORS(authCuenta(rolSuperadmin, handleOutbox)))                    // GET cola de correo
+	http.HandleFunc("/admin/outbox/resend", withCORS(authCuenta(rolSuperadmin, handleOutboxResend)))       // POST ?id= o ?estado=muerto
+
+	// Admin de una KB; el rol mínimo de cada ruta está en cuentas.go
+	rutaKB("/admin/export", withCORS(auth(rolViewer, handleExportPL)))
+	rutaKB("/admin/kb", withCORS(authSegun(rolEscritura, exigeIfMatch(handleKB))))                   // GET/POST
+	rutaKB("/admin/kb/lint", withCORS(auth(rolViewer, handleKBLint)))                                // GET hallazgos [?alergias=&formato=texto]
+	rutaKB("/admin/kb/csv", withCORS(authSegun(rolIngesta, handleKBCSV)))                            // GET .zip de CSV / POST lo importa [?dry_run=true]
+	rutaKB("/admin/upload-pl", withCORS(auth(rolSuperadmin, exigeIfMatch(handleUploadPL))))          // POST multipart/simple
+	rutaKB("/admin/symptoms", withCORS(authSegun(rolEscritura, exigeIfMatch(handleSymptoms))))       // GET/POST
+	rutaKB("/admin/symptoms/{name}", withCORS(authSegun(rolEscritura, exigeIfMatch(handleSymptom)))) // GET/PUT/PATCH/DELETE [?cascada=true]
+	rutaKB("/admin/diseases", withCORS(authSegun(rolEscritura, exigeIfMatch(handleDiseases))))       // GET/POST
+	rutaKB("/admin/diseases/{name}", withCORS(authSegun(rolEscritura, exigeIfMatch(handleDisease)))) // GET/PUT/PATCH/DELETE [?cascada=true]
+	rutaKB("/admin/meds", withCORS(authSegun(rolEscritura, exigeIfMatch(handleMeds))))               // GET/POST
+	rutaKB("/admin/meds/{name}", withCORS(authSegun(rolEscritura, exigeIfMatch(handleMed))))         // GET/PUT/PATCH/DELETE [?cascada=true]
+	rutaKB("/admin/contraindications", withCORS(authSegun(rolEscritura, exigeIfMatch(handleContraindicaciones))))
+	rutaKB("/admin/drafts", withCORS(authSegun(rolLectura(rolEditor), handleDrafts)))          // GET/POST
+	rutaKB("/admin/drafts/{nombre}", withCORS(authSegun(rolLectura(rolEditor), handleDraft)))  // GET/DELETE
+	rutaKB("/admin/drafts/{nombre}/diff", withCORS(auth(rolViewer, handleDraftDiff)))          // GET frente a la KB en vivo
+	rutaKB("/admin/drafts/{nombre}/approve", withCORS(auth(rolPublisher, handleDraftApprove))) // POST otra cuenta
+	rutaKB("/admin/drafts/{nombre}/publish", withCORS(auth(rolPublisher, handleDraftPublish))) // POST [?forzar=true]
+	rutaKB("/admin/rpa/ingest", withCORS(authSegun(rolIngesta, handleRPAIngest)))              // texto, JSON, YAML o CSV
+	rutaKB("/admin/rpa/schema", withCORS(auth(rolViewer, handleRPASchema)))
+	rutaKB("/admin/rpa/jobs", withCORS(authSegun(rolLectura(rolPublisher), handleRPAJobs))) // GET/POST/DELETE trabajos programados
+	rutaKB("/admin/rpa/jobs/run", withCORS(auth(rolPublisher, handleRPAJobRun)))            // POST ?id= ejecuta ahora
+	rutaKB("/admin/rpa/jobs/runs", withCORS(auth(rolViewer, handleRPAJobRuns)))             // GET ?id= historial
+	rutaKB("/admin/webhooks", withCORS(auth(rolSuperadmin, handleWebhooks)))                // GET/POST/DELETE
+	rutaKB("/admin/webhooks/entregas", withCORS(auth(rolSuperadmin, handleWebhookEntregas)))
+	rutaKB("/admin/reports", withCORS(auth(rolViewer, handleReports)))     // GET lista paginada
+	rutaKB("/admin/reports/{id}", withCORS(auth(rolViewer, handleReport))) // GET texto, HTML o JSON
+	rutaKB("/admin/eval", withCORS(auth(rolViewer, handleEval)))           // POST casos [+ kb candidata]
+	rutaKB("/admin/fit", withCORS(auth(rolEditor, handleFit)))             // POST casos -> KB candidata (no se aplica)
+	rutaKB("/admin/feedback/report", withCORS(auth(rolViewer, handleFeedbackReport)))
+	rutaKB("/admin/historial", withCORS(auth(rolViewer, handleHistorial)))   // GET filtros; ?descifrar=true sólo superadmin
+	rutaKB("/admin/vigilancia", withCORS(auth(rolViewer, handleVigilancia))) // GET conteos agregados (JSON/CSV)
 }
 
 //
@@ -137,12 +219,126 @@ func handleAnalyze(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
 		return
 	}
+	// Accept: application/fhir+json devuelve un Bundle FHIR R4 (ver fhir.go)
+	fhir, err := pideFHIR(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
 	var req AnalyzeReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "JSON inválido", http.StatusBadRequest)
 		return
 	}
 
+	// Con X-KB-Borrador (cualquier sesión con acceso a la KB) se consulta el
+	// borrador y la consulta no se registra en historial, vigilancia ni
+	// feedback.
+	kbNombre, borrador := nombreKB(r), r.Header.Get(cabeceraBorrador)
+	if borrador != "" {
+		if s, err := sesionDe(r); err != nil || !s.puedeKB(kbNombre) {
+			http.Error(w, "no autorizado", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	mu.Lock()
+	base, err := buscarBase(kbNombre)
+	if err != nil {
+		mu.Unlock()
+		writeKBError(w, err)
+		return
+	}
+	v, k, version := base.vm, &base.kb, base.version
+	if borrador != "" {
+		b, ok := base.borradores[borrador]
+		if !ok || b.vm == nil {
+			mu.Unlock()
+			http.Error(w, "borrador no encontrado o sin compilar", http.StatusNotFound)
+			return
+		}
+		v, k, version = b.vm, &b.KB, b.Version
+	}
+	res, err := consultar(v, req)
+	sistema := ""
+	var info map[string]infoEnf
+	var cods map[string]map[string]string
+	if err == nil {
+		cods = codigosDe(v)
+		if len(res) > 0 {
+			sistema = sistemaDe(*k, res[0].Enf)
+			info = infoEnfermedades(v, res)
+		}
+	}
+	mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var out []map[string]interface{}
+	for _, row := range res {
+		in := info[row.Enf]
+		consejos := in.Cs
+		if consejos == nil {
+			consejos = []string{}
+		}
+		item := map[string]interface{}{
+			"enfermedad":  row.Enf,
+			"afinidad":    row.Afin,
+			"medicamento": row.Med,
+			"urgencia":    row.Urg,
+			"descripcion": in.D,
+			"tipo":        in.T,
+			"sistema":     in.S,
+			"consejos":    consejos,
+		}
+		if c := cods[row.Enf][codICD10]; c != "" {
+			item["icd10"] = c
+		}
+		if c := cods[row.Med][codATC]; c != "" {
+			item["atc"] = c
+		}
+		out = append(out, item)
+	}
+	var sintomas []SintomaCodificado
+	for _, si := range req.Sintomas {
+		n := atomize(si.Nombre)
+		if c := cods[n]; c[codSNOMED] != "" || c[codICPC] != "" {
+			sintomas = append(sintomas, SintomaCodificado{Nombre: n, SNOMED: c[codSNOMED], ICPC: c[codICPC]})
+		}
+	}
+
+	resp := AnalyzeResp{Borrador: borrador, Resultados: out, Sintomas: sintomas}
+	if borrador == "" {
+		resp.ConsultaID = registrarConsulta(kbNombre, req, res)
+		registrarVigilancia(time.Now(), kbNombre, res, sistema)
+		if hist != nil {
+			if err := hist.guardar(resp.ConsultaID, kbNombre, req, res, version); err != nil {
+				logp("historial: no se pudo guardar %s: %v", resp.ConsultaID, err)
+			}
+		}
+	}
+
+	if fhir {
+		escribirFHIR(w, bundleFHIR(resp, req, res, info, cods, time.Now()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// resultado es una fila de consulta_item/7 ya leída desde Prolog.
+type resultado struct {
+	Enf  string `json:"enfermedad"`
+	Afin int64  `json:"afinidad"` // si prefieres afinidad real, cambia a float64 en PL y aquí
+	Med  string `json:"medicamento"`
+	Urg  string `json:"urgencia"`
+}
+
+// consultar ejecuta consulta_item/7 sobre el intérprete dado y devuelve las
+// filas ordenadas por afinidad. El llamador se encarga de sincronizar el acceso.
+func consultar(v *prolog.Interpreter, req AnalyzeReq) ([]resultado, error) {
 	// Construir términos Prolog [(s,sev),...], [a1,a2], [c1,c2]
 	sv := toPLTupleList(req.Sintomas)
 	als := toPLAtomList(req.Alergias)
@@ -150,55 +346,98 @@ func handleAnalyze(w http.ResponseWriter, r *http.Request) {
 
 	q := fmt.Sprintf(`consulta_item(%s,%s,%s, Enf, Afin, Med, Urg).`, sv, als, crs)
 
-	mu.Lock()
-	solutions, err := vm.Query(q)
-	mu.Unlock()
+	solutions, err := v.Query(q)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error al consultar: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error al consultar: %v", err)
 	}
 	defer solutions.Close()
 
-	var out []map[string]interface{}
-
+	var out []resultado
 	for solutions.Next() {
-		var row struct {
-			Enf  string
-			Afin int64 // si prefieres afinidad real, cambia a float64 en PL y aquí
-			Med  string
-			Urg  string
-		}
+		var row resultado
 		if err := solutions.Scan(&row); err != nil {
-			http.Error(w, fmt.Sprintf("error al leer solución: %v", err), http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("error al leer solución: %v", err)
 		}
-		out = append(out, map[string]interface{}{
-			"enfermedad":  row.Enf,
-			"afinidad":    row.Afin,
-			"medicamento": row.Med,
-			"urgencia":    row.Urg,
-		})
+		out = append(out, row)
 	}
 	if err := solutions.Err(); err != nil {
-		http.Error(w, fmt.Sprintf("error en soluciones: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error en soluciones: %v", err)
 	}
+	return out, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(AnalyzeResp{Resultados: out})
+// infoEnf son los datos descriptivos de una enfermedad (info_enfermedad/5).
+type infoEnf struct {
+	T, S, D string
+	Cs      []string
+}
+
+// infoEnfermedades consulta info_enfermedad/5 para cada enfermedad de los
+// resultados. Un .pl subido a mano puede no tener la regla: en ese caso se
+// devuelve lo que se haya podido leer. El llamador sincroniza el acceso.
+func infoEnfermedades(v *prolog.Interpreter, res []resultado) map[string]infoEnf {
+	out := map[string]infoEnf{}
+	for _, r := range res {
+		if _, ok := out[r.Enf]; ok {
+			continue
+		}
+		sol, err := v.Query(fmt.Sprintf("info_enfermedad(%s, T, S, D, Cs).", atomize(r.Enf)))
+		if err != nil {
+			continue
+		}
+		if sol.Next() {
+			var in infoEnf
+			if sol.Scan(&in) == nil {
+				out[r.Enf] = in
+			}
+		}
+		sol.Close()
+	}
+	return out
 }
 
 func handleExportPL(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, plPath)
+	mu.Lock()
+	base, err := buscarBase(nombreKB(r))
+	var ruta, pl string
+	if err == nil {
+		ruta = base.plPath
+		if n := r.Header.Get(cabeceraBorrador); n != "" {
+			if b, ok := base.borradores[n]; ok {
+				pl = b.PL
+			} else {
+				err = errBorradorNoExiste(n)
+			}
+		}
+	}
+	mu.Unlock()
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	if pl != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, pl)
+		return
+	}
+	http.ServeFile(w, r, ruta)
 }
 
 func handleKB(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		mu.Lock()
-		defer mu.Unlock()
+		k, version, err := kbDe(r)
+		if err != nil {
+			writeKBError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etagKB(version))
+		if coincideETag(r.Header.Get("If-None-Match"), version) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(kb)
+		_ = json.NewEncoder(w).Encode(k)
 
 	case http.MethodPost:
 		var in Knowledge
@@ -206,18 +445,15 @@ func handleKB(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "JSON inválido", http.StatusBadRequest)
 			return
 		}
-		code := buildPL(in)
-		if err := os.WriteFile(plPath, []byte(code), 0644); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if err := reloadVM(code); err != nil {
-			http.Error(w, "no se pudo recargar Prolog", http.StatusInternalServerError)
+		c, err := mutarKB(escrituraDe(r, "kb"), func(k *Knowledge) error {
+			*k = in
+			return nil
+		})
+		if err != nil {
+			writeKBError(w, err)
 			return
 		}
-		mu.Lock()
-		kb = in
-		mu.Unlock()
+		w.Header().Set("ETag", etagKB(c.Version))
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
@@ -231,6 +467,7 @@ func handleUploadPL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Soporta multipart/form-data y text/plain
+	var body []byte
 	if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
 		if err := r.ParseMultipartForm(10 << 20); err != nil {
 			http.Error(w, "multipart inválido", http.StatusBadRequest)
@@ -242,90 +479,410 @@ func handleUploadPL(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer f.Close()
-		b, _ := io.ReadAll(f)
-		if err := os.WriteFile(plPath, b, 0644); err != nil {
-			http.Error(w, "no se pudo escribir .pl", http.StatusInternalServerError)
-			return
-		}
-		if err := reloadVM(string(b)); err != nil {
-			http.Error(w, "no se pudo recargar Prolog", http.StatusInternalServerError)
+		body, _ = io.ReadAll(f)
+	} else {
+		body, _ = io.ReadAll(r.Body)
+	}
+	if len(body) == 0 {
+		http.Error(w, "body vacío", http.StatusBadRequest)
+		return
+	}
+
+	if n := r.Header.Get(cabeceraBorrador); n != "" {
+		version, err := subirPLBorrador(escrituraDe(r, "upload_pl"), body)
+		if err != nil {
+			writeKBError(w, err)
 			return
 		}
+		w.Header().Set("ETag", etagKB(version))
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	// Plano
-	body, _ := io.ReadAll(r.Body)
-	if len(body) == 0 {
-		http.Error(w, "body vacío", http.StatusBadRequest)
+
+	mu.Lock()
+	base, err := buscarBase(nombreKB(r))
+	if err != nil {
+		mu.Unlock()
+		writeKBError(w, err)
 		return
 	}
-	if err := os.WriteFile(plPath, body, 0644); err != nil {
-		http.Error(w, "no se pudo escribir .pl", http.StatusInternalServerError)
+	anterior := base.version
+	if !coincideETag(r.Header.Get("If-Match"), anterior) {
+		mu.Unlock()
+		writeKBError(w, errVersion(anterior))
 		return
 	}
-	if err := reloadVM(string(body)); err != nil {
-		http.Error(w, "no se pudo recargar Prolog", http.StatusInternalServerError)
+	// como en mutarKB: se compila y prueba antes de tocar el .pl o la VM
+	v, err := compilarPL(string(body))
+	if err != nil {
+		mu.Unlock()
+		writeKBError(w, kbErr(http.StatusUnprocessableEntity, "el .pl no es válido: %v", err))
 		return
 	}
+	if err := base.guardarPL(string(body)); err != nil {
+		mu.Unlock()
+		http.Error(w, "no se pudo escribir .pl", http.StatusInternalServerError)
+		return
+	}
+	version := versionOf(string(body))
+	base.vm, base.version = v, version
+	mu.Unlock()
+	notificarCambioKB(base.Nombre, "upload_pl", autorDe(r), anterior, version, nil)
+	w.Header().Set("ETag", etagKB(version))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func handleRPAIngest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "solo POST (text/plain)", http.StatusMethodNotAllowed)
+		http.Error(w, "solo POST (texto, JSON, YAML o CSV)", http.StatusMethodNotAllowed)
 		return
 	}
 	body, _ := io.ReadAll(r.Body)
-	txt := string(body)
 
-	parsed := parseRPAFile(txt)
+	formato := r.URL.Query().Get("formato")
+	if formato == "" {
+		formato = formatoDesdeContentType(r.Header.Get("Content-Type"))
+	}
+	parsed, formato, err := parseRPA(body, formato)
+	if err != nil {
+		http.Error(w, err.Error()+"\n"+formatDiagnosticos(parsed.Diagnosticos), http.StatusBadRequest)
+		return
+	}
+	// ?estricto=true no aplica nada si hay errores de validación
+	if r.URL.Query().Get("estricto") == "true" && parsed.errores() > 0 {
+		writeRPAResult(w, r, http.StatusUnprocessableEntity, formato, parsed, formatDiagnosticos(parsed.Diagnosticos))
+		return
+	}
 
-	// Actualiza KB y recarga
-	mu.Lock()
-	applyParsedToKB(&kb, parsed)
-	code := buildPL(kb)
-	_ = os.WriteFile(plPath, []byte(code), 0644)
-	mu.Unlock()
+	if r.URL.Query().Get("dry_run") == "true" {
+		handleRPADryRun(w, r, formato, parsed)
+		return
+	}
+
+	inf, err := aplicarRPA(formato, parsed, escrituraDe(r, "rpa"))
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	texto, html := inf.Texto(), inf.HTML()
 
-	if err := reloadVM(code); err != nil {
-		http.Error(w, "no se pudo recargar Prolog", http.StatusInternalServerError)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(html))
 		return
 	}
+	writeRPAResult(w, r, http.StatusOK, formato, parsed, texto)
+}
 
-	report := buildRPAReport(parsed)
-	if err := deliverReport(report); err != nil {
-		logp("SMTP no disponible, guardando informe local. Error: %v", err)
-		saveReportToDisk(report)
+// aplicarRPA actualiza la KB con lo parseado, regenera el .pl, recarga el
+// motor y emite el informe (cola de correo y copia en rpa_reports/). Lo usan el endpoint de
+// ingesta, la bandeja de entrada y los trabajos programados; origen y autor
+// se envían a los webhooks.
+func aplicarRPA(formato string, parsed rpaParsed, e escritura) (rpaInforme, error) {
+	c, err := mutarKB(e, func(k *Knowledge) error {
+		applyParsedToKB(k, parsed)
+		return nil
+	})
+	if err != nil {
+		return rpaInforme{}, err
 	}
 
+	inf := buildRPAReport(formato, parsed, c.Antes, c.Despues)
+	inf.Origen, inf.Autor, inf.KB, inf.Borrador = e.Origen, e.Autor, e.KB, e.Borrador
+	texto, html := inf.Texto(), inf.HTML()
+	outID, err := deliverReport(texto, html)
+	if err != nil {
+		logp("Informe no encolado para correo: %v", err)
+	}
+	if err := saveReportToDisk(inf, texto, html, outID); err != nil {
+		logp("No se pudo guardar el informe en rpa_reports/: %v", err)
+	}
+	return inf, nil
+}
+
+// rpaPreview es la respuesta de ?dry_run=true.
+type rpaPreview struct {
+	DryRun       bool      `json:"dryRun"`
+	Formato      string    `json:"formato"`
+	Diagnosticos []rpaDiag `json:"diagnosticos"`
+	Compila      bool      `json:"compila"`
+	Error        string    `json:"error,omitempty"`
+	Diff         KBDiff    `json:"diff"`
+}
+
+// handleRPADryRun responde con la vista previa en JSON o texto.
+func handleRPADryRun(w http.ResponseWriter, r *http.Request, formato string, parsed rpaParsed) {
+	antes, _, err := kbDe(r)
+	if err != nil {
+		writeKBError(w, err)
+		return
+	}
+	prev := previewRPA(formato, parsed, antes)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(prev)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(report))
+	w.Write([]byte(prev.Texto()))
+}
+
+// previewRPA aplica lo parseado sobre una copia de antes (la KB en vivo o un
+// borrador), la compila en un intérprete aparte y devuelve el diff. No se
+// toca nada.
+func previewRPA(formato string, parsed rpaParsed, antes Knowledge) rpaPreview {
+	despues := cloneKB(antes)
+	applyParsedToKB(&despues, parsed)
+
+	prev := rpaPreview{DryRun: true, Formato: formato, Diagnosticos: parsed.Diagnosticos, Diff: diffKB(antes, despues)}
+	if err := validarPL(buildPL(despues)); err != nil {
+		prev.Error = err.Error()
+	} else {
+		prev.Compila = true
+	}
+	return prev
+}
+
+func (prev rpaPreview) Texto() string {
+	var b strings.Builder
+	b.WriteString("MediLogic RPA – Vista previa (dry run, no se aplicó nada)\n\n")
+	b.WriteString(formatKBDiff(prev.Diff))
+	if prev.Compila {
+		b.WriteString("\nCompilación: OK\n")
+	} else {
+		b.WriteString("\nCompilación: ERROR " + prev.Error + "\n")
+	}
+	if len(prev.Diagnosticos) > 0 {
+		b.WriteString("\n" + formatDiagnosticos(prev.Diagnosticos))
+	}
+	return b.String()
+}
+
+// validarPL compila el código en un intérprete aparte y ejecuta una consulta
+// de prueba para comprobar que las reglas principales responden.
+func validarPL(code string) error {
+	_, err := compilarPL(code)
+	return err
+}
+
+// compilarPL es validarPL devolviendo el intérprete ya cargado.
+func compilarPL(code string) (*prolog.Interpreter, error) {
+	v, err := newVM(code)
+	if err != nil {
+		return nil, fmt.Errorf("no compila: %v", err)
+	}
+	if _, err := consultar(v, AnalyzeReq{}); err != nil {
+		return nil, fmt.Errorf("consulta de prueba: %v", err)
+	}
+	return v, nil
 }
 
 //
-// ======== Middleware / util ========
+// ======== Escritura de la KB ========
 //
+// Toda modificación de la KB estructurada (POST /admin/kb, ingestas RPA y los
+// recursos /admin/diseases, /admin/meds, ...) pasa por mutarKB: se aplica
+// sobre una copia, se compila y se prueba antes de tocar el .pl y la VM, y
+// después se avisa a los webhooks. /admin/upload-pl va aparte porque recibe
+// Prolog crudo.
+
+// errKB es un rechazo de una modificación con su código HTTP (404 no existe,
+// 409 conflicto con referencias, 412 versión distinta, 422 la KB resultante
+// no es válida).
+type errKB struct {
+	status  int
+	msg     string
+	version string // versión actual, para la ETag del 412
+}
+
+func (e *errKB) Error() string { return e.msg }
+
+func kbErr(status int, format string, args ...interface{}) error {
+	return &errKB{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func errVersion(actual string) error {
+	return &errKB{
+		status:  http.StatusPreconditionFailed,
+		msg:     fmt.Sprintf("la KB cambió desde que se leyó (versión actual %s); recárguela y repita el cambio", actual),
+		version: actual,
+	}
+}
 
-func auth(h http.HandlerFunc) http.HandlerFunc {
+// cambioKB es el resultado de una modificación aplicada.
+type cambioKB struct {
+	Antes, Despues Knowledge
+	Version        string
+}
+
+// escritura dice quién modifica la KB y dónde.
+type escritura struct {
+	Origen, Autor string
+	KB            string // nombre de la KB (ver bases.go)
+	IfMatch       string // cabecera If-Match; vacío no comprueba
+	Borrador      string // nombre del borrador; vacío es la KB en vivo
+}
+
+func escrituraDe(r *http.Request, origen string) escritura {
+	return escritura{
+		Origen:   origen,
+		Autor:    autorDe(r),
+		KB:       nombreKB(r),
+		IfMatch:  r.Header.Get("If-Match"),
+		Borrador: r.Header.Get(cabeceraBorrador),
+	}
+}
+
+// mutarKB aplica fn a una copia de la KB (la en vivo o la del borrador) y, si
+// el resultado compila, la publica. Con IfMatch sólo se aplica si la KB sigue
+// en esa versión. Los cambios de un borrador no avisan a los webhooks: lo
+// hace su publicación.
+func mutarKB(e escritura, fn func(k *Knowledge) error) (cambioKB, error) {
+	mu.Lock()
+	kb, err := buscarBase(e.KB)
+	if err != nil {
+		mu.Unlock()
+		return cambioKB{}, err
+	}
+	base, anterior := &kb.kb, kb.version
+	var b *Borrador
+	if e.Borrador != "" {
+		if b = kb.borradores[e.Borrador]; b == nil {
+			mu.Unlock()
+			return cambioKB{}, errBorradorNoExiste(e.Borrador)
+		}
+		base, anterior = &b.KB, b.Version
+	}
+	c := cambioKB{Antes: cloneKB(*base), Despues: cloneKB(*base)}
+	if e.IfMatch != "" && !coincideETag(e.IfMatch, anterior) {
+		mu.Unlock()
+		return c, errVersion(anterior)
+	}
+	if err := fn(&c.Despues); err != nil {
+		mu.Unlock()
+		return c, err
+	}
+	if err := validarCodigosKB(&c.Despues); err != nil {
+		mu.Unlock()
+		return c, err
+	}
+	code := buildPL(c.Despues)
+	v, err := compilarPL(code)
+	if err != nil {
+		mu.Unlock()
+		return c, kbErr(http.StatusUnprocessableEntity, "la KB resultante no es válida: %v", err)
+	}
+	c.Version = versionOf(code)
+	if b != nil {
+		b.actualizar(e.Autor, c.Despues, code, c.Version, v, false)
+		err := kb.guardarBorradores()
+		mu.Unlock()
+		return c, err
+	}
+	kb.kb = c.Despues
+	if err := kb.guardar(code); err != nil {
+		kb.kb = c.Antes
+		mu.Unlock()
+		return c, err
+	}
+	kb.vm, kb.version = v, c.Version
+	mu.Unlock()
+
+	d := diffKB(c.Antes, c.Despues)
+	notificarCambioKB(kb.Nombre, e.Origen, e.Autor, anterior, c.Version, &d)
+	return c, nil
+}
+
+// kbDe devuelve una copia de la KB que lee la petición (la del borrador de
+// X-KB-Borrador o la en vivo, de la KB elegida) y su versión.
+func kbDe(r *http.Request) (Knowledge, string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	kb, err := buscarBase(nombreKB(r))
+	if err != nil {
+		return Knowledge{}, "", err
+	}
+	if n := r.Header.Get(cabeceraBorrador); n != "" {
+		b, ok := kb.borradores[n]
+		if !ok {
+			return Knowledge{}, "", errBorradorNoExiste(n)
+		}
+		return cloneKB(b.KB), b.Version, nil
+	}
+	return cloneKB(kb.kb), kb.version, nil
+}
+
+// etagKB es la ETag de una versión de la KB (el hash del .pl, entre comillas).
+func etagKB(version string) string { return `"` + version + `"` }
+
+// coincideETag evalúa una cabecera If-Match / If-None-Match ("*" o lista de
+// ETags, fuertes o débiles) contra la versión actual.
+func coincideETag(h, version string) bool {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || strings.Trim(t, `"`) == version && t != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// exigeIfMatch rechaza con 428 las escrituras que no dicen sobre qué versión
+// de la KB se hicieron, para que una pestaña con datos viejos no deshaga
+// cambios de otro administrador. "If-Match: *" sobrescribe sin comprobar.
+func exigeIfMatch(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if tk := r.Header.Get("X-Admin-Token"); tk != "" && tk == adminToken {
-			h(w, r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get("If-Match") == "" {
+			http.Error(w, "falta If-Match con la ETag de GET /admin/kb (o * para sobrescribir sin comprobar)", http.StatusPreconditionRequired)
 			return
 		}
-		if r.URL.Query().Get("token") == adminToken {
-			h(w, r)
-			return
+		h(w, r)
+	}
+}
+
+// writeKBError responde con el código de un errKB o 500 si es otro error.
+func writeKBError(w http.ResponseWriter, err error) {
+	var e *errKB
+	if errors.As(err, &e) {
+		if e.version != "" {
+			w.Header().Set("ETag", etagKB(e.version))
 		}
-		http.Error(w, "no autorizado", http.StatusUnauthorized)
+		http.Error(w, e.msg, e.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeRPAResult responde con el informe en texto o, si el cliente acepta
+// JSON, con el informe y los diagnósticos estructurados.
+func writeRPAResult(w http.ResponseWriter, r *http.Request, status int, formato string, p rpaParsed, report string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"formato":      formato,
+			"enfermedades": len(p.Items),
+			"errores":      p.errores(),
+			"diagnosticos": p.Diagnosticos,
+			"informe":      report,
+		})
+		return
 	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(report))
 }
 
+//
+// ======== Middleware / util ========
+//
+
 func withCORS(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Token")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-KB, X-KB-Borrador, X-Paciente, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -334,10 +891,17 @@ func withCORS(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func reloadVM(code string) error {
-	vm = prolog.New(nil, nil)
+// versionOf identifica una KB compilada por el hash de su código Prolog.
+func versionOf(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// newVM crea un intérprete aislado con el código dado.
+func newVM(code string) (*prolog.Interpreter, error) {
+	v := prolog.New(nil, nil)
 	// Importante: Exec NO lleva segundo argumento
-	return vm.Exec(code)
+	return v, v.Exec(code)
 }
 
 //
@@ -366,6 +930,12 @@ func toPLTupleList(pares []SintomaInput) string {
 	return b.String()
 }
 
+// plQuote escribe un texto libre como átomo Prolog entre comillas simples.
+func plQuote(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\r", "", "\n", "\\n")
+	return "'" + r.Replace(s) + "'"
+}
+
 func toPLAtomList(xs []string) string {
 	if len(xs) == 0 {
 		return "[]"
@@ -419,6 +989,7 @@ func atomize(s string) string {
 func ensureDirs() {
 	_ = os.MkdirAll("prolog", 0755)
 	_ = os.MkdirAll("rpa_reports", 0755)
+	_ = os.MkdirAll("storage", 0755)
 }
 
 //
@@ -428,6 +999,11 @@ func ensureDirs() {
 func buildPL(k Knowledge) string {
 	var b strings.Builder
 
+	// Hechos declarados dinámicos para que una KB vacía (o sin medicamentos,
+	// contraindicaciones...) compile y responda sin resultados
+	b.WriteString(":- dynamic(sintoma/1).\n:- dynamic(enfermedad/3).\n:- dynamic(caracteriza/3).\n")
+	b.WriteString(":- dynamic(trata/2).\n:- dynamic(contraindicado_por_alergia/2).\n:- dynamic(contraindicado_por_cronico/2).\n\n")
+
 	// Síntomas
 	for _, s := range k.Symptoms {
 		b.WriteString(fmt.Sprintf("sintoma(%s).\n", atomize(s.Name)))
@@ -446,6 +1022,20 @@ func buildPL(k Knowledge) string {
 	}
 	b.WriteString("\n")
 
+	// Descripción y consejos de autocuidado (texto libre, como átomos entre comillas)
+	b.WriteString(":- dynamic(descripcion/2).\n:- dynamic(consejo/2).\n")
+	for _, d := range k.Diseases {
+		if d.Descripcion != "" {
+			b.WriteString(fmt.Sprintf("descripcion(%s, %s).\n", atomize(d.Name), plQuote(d.Descripcion)))
+		}
+	}
+	for _, d := range k.Diseases { // cada predicado contiguo
+		for _, c := range d.Consejos {
+			b.WriteString(fmt.Sprintf("consejo(%s, %s).\n", atomize(d.Name), plQuote(c)))
+		}
+	}
+	b.WriteString("\n")
+
 	// Características
 	for _, d := range k.Diseases {
 		for _, c := range d.Caracteristicas {
@@ -455,6 +1045,28 @@ func buildPL(k Knowledge) string {
 	}
 	b.WriteString("\n")
 
+	// Códigos clínicos (ver codigos.go)
+	b.WriteString(":- dynamic(codigo/3).\n")
+	for _, d := range k.Diseases {
+		if d.ICD10 != "" {
+			b.WriteString(fmt.Sprintf("codigo(%s, icd10, %s).\n", atomize(d.Name), plQuote(d.ICD10)))
+		}
+	}
+	for _, s := range k.Symptoms {
+		if s.SNOMED != "" {
+			b.WriteString(fmt.Sprintf("codigo(%s, snomed, %s).\n", atomize(s.Name), plQuote(s.SNOMED)))
+		}
+		if s.ICPC != "" {
+			b.WriteString(fmt.Sprintf("codigo(%s, icpc, %s).\n", atomize(s.Name), plQuote(s.ICPC)))
+		}
+	}
+	for _, m := range k.Meds {
+		if m.ATC != "" {
+			b.WriteString(fmt.Sprintf("codigo(%s, atc, %s).\n", atomize(m.Name), plQuote(m.ATC)))
+		}
+	}
+	b.WriteString("\n")
+
 	// Medicamentos que tratan
 	for _, m := range k.Meds {
 		var ts []string
@@ -523,6 +1135,12 @@ nivel_urgencia(Enf,Sv,U):-
   ; U='Posible automanejo'
   ).
 
+% ==== Información de la enfermedad (para /analyze) ====
+info_enfermedad(E,T,S,D,Cs):-
+  enfermedad(E,tipo(T),sistema(S)),
+  (descripcion(E,D0)->D=D0;D=''),
+  findall(C,consejo(E,C),Cs).
+
 % ==== Consulta principal y ordenamiento ====
 consulta(Sv,Als,Crs,Ordenado):-
   findall(res(Enf,A,Med,U),
@@ -554,6 +1172,14 @@ particionar_por_afinidad(P,[X|Xs],May,[X|Men]):-particionar_por_afinidad(P,Xs,Ma
 	return b.String()
 }
 
+// cloneKB devuelve una copia profunda de la KB (sin compartir slices).
+func cloneKB(k Knowledge) Knowledge {
+	var out Knowledge
+	b, _ := json.Marshal(k)
+	_ = json.Unmarshal(b, &out)
+	return out
+}
+
 func clamp(v, lo, hi int) int {
 	if v < lo {
 		return lo
@@ -571,48 +1197,57 @@ func clamp(v, lo, hi int) int {
 func defaultKB() Knowledge {
 	return Knowledge{
 		Symptoms: []Symptom{
-			{Name: "fiebre"},
-			{Name: "tos"},
-			{Name: "dolor_garganta"},
-			{Name: "dolor_cabeza"},
-			{Name: "fatiga"},
+			{Name: "fiebre", SNOMED: "386661006", ICPC: "A03"},
+			{Name: "tos", SNOMED: "49727002", ICPC: "R05"},
+			{Name: "dolor_garganta", SNOMED: "162397003", ICPC: "R21"},
+			{Name: "dolor_cabeza", SNOMED: "25064002", ICPC: "N01"},
+			{Name: "fatiga", SNOMED: "84229001", ICPC: "A04"},
 		},
 		Diseases: []Disease{
 			{
-				Name:    "resfriado_comun",
-				Tipo:    "viral",
-				Sistema: "respiratorio",
+				Name:        "resfriado_comun",
+				Tipo:        "viral",
+				Sistema:     "respiratorio",
+				Descripcion: "Infección viral leve de las vías respiratorias altas.",
+				Consejos:    []string{"Reposo relativo", "Hidratación abundante", "Lavado frecuente de manos"},
 				Caracteristicas: []Caract{
 					{Symptom: "tos", Peso: 2},
 					{Symptom: "dolor_garganta", Peso: 2},
 					{Symptom: "fiebre", Peso: 1},
 				},
+				ICD10: "J00",
 			},
 			{
-				Name:    "influenza",
-				Tipo:    "viral",
-				Sistema: "respiratorio",
+				Name:        "influenza",
+				Tipo:        "viral",
+				Sistema:     "respiratorio",
+				Descripcion: "Infección viral aguda con fiebre alta, tos y malestar general.",
+				Consejos:    []string{"Reposo en casa", "Hidratación abundante", "Consultar si la fiebre dura más de 3 días o hay dificultad para respirar"},
 				Caracteristicas: []Caract{
 					{Symptom: "fiebre", Peso: 3},
 					{Symptom: "tos", Peso: 2},
 					{Symptom: "fatiga", Peso: 2},
 				},
+				ICD10: "J11.1",
 			},
 			{
-				Name:    "migrana",
-				Tipo:    "neurologico",
-				Sistema: "nervioso",
+				Name:        "migrana",
+				Tipo:        "neurologico",
+				Sistema:     "nervioso",
+				Descripcion: "Cefalea recurrente, a menudo pulsátil y con sensibilidad a la luz.",
+				Consejos:    []string{"Descansar en un lugar oscuro y silencioso", "Evitar desencadenantes conocidos"},
 				Caracteristicas: []Caract{
 					{Symptom: "dolor_cabeza", Peso: 3},
 					{Symptom: "fatiga", Peso: 1},
 				},
+				ICD10: "G43.9",
 			},
 		},
 		Meds: []Medication{
-			{Name: "paracetamol", Treats: []string{"resfriado_comun", "influenza", "migrana"}},
-			{Name: "ibuprofeno", Treats: []string{"resfriado_comun", "migrana"}},
-			{Name: "oseltamivir", Treats: []string{"influenza"}},
-			{Name: "jarabe_dextrometorfano", Treats: []string{"resfriado_comun"}},
+			{Name: "paracetamol", Treats: []string{"resfriado_comun", "influenza", "migrana"}, ATC: "N02BE01"},
+			{Name: "ibuprofeno", Treats: []string{"resfriado_comun", "migrana"}, ATC: "M01AE01"},
+			{Name: "oseltamivir", Treats: []string{"influenza"}, ATC: "J05AH02"},
+			{Name: "jarabe_dextrometorfano", Treats: []string{"resfriado_comun"}, ATC: "R05DA09"},
 		},
 		ContraAlergias: []ContraAlergia{
 			{Med: "ibuprofeno", Alergia: "aines"},
@@ -630,35 +1265,184 @@ func defaultKB() Knowledge {
 
 type rpaDisease struct {
 	Name, Tipo, Sistema, Descripcion string
+	Consejos                         []string       // separados por ';' en texto y CSV
 	Sintomas                         map[string]int // fiebre:3
 	Contra                           []string       // medicamentos contraindicados (marcamos como alergia desconocida)
 	Trata                            []string
+	ICD10                            string
+	Codigos                          []rpaCodigo // snomed/icpc de síntomas y atc de medicamentos
+}
+
+// rpaCodigo es un código clínico para un síntoma o medicamento del bloque.
+// Se aplica si el elemento existe en la KB después de aplicar el bloque.
+type rpaCodigo struct {
+	Sistema, Nombre, Codigo string
+	Linea, Columna          int
 }
 
 type rpaParsed struct {
-	Items []rpaDisease
+	Items        []rpaDisease
+	Diagnosticos []rpaDiag
+}
+
+// rpaDiag es un problema encontrado al parsear. "error" significa que el dato
+// se descartó; "aviso" que se usó con una corrección o que no afecta a la KB.
+type rpaDiag struct {
+	Bloque    int    `json:"bloque"` // bloque de texto, registro o fila (desde 1)
+	Linea     int    `json:"linea"`  // 0 si no se conoce
+	Columna   int    `json:"columna"`
+	Severidad string `json:"severidad"`
+	Mensaje   string `json:"mensaje"`
+}
+
+const (
+	sevError = "error"
+	sevAviso = "aviso"
+)
+
+func (p *rpaParsed) diag(bloque, linea, col int, sev, format string, args ...interface{}) {
+	p.Diagnosticos = append(p.Diagnosticos, rpaDiag{
+		Bloque: bloque, Linea: linea, Columna: col, Severidad: sev,
+		Mensaje: fmt.Sprintf(format, args...),
+	})
+}
+
+// errores cuenta los diagnósticos de severidad error.
+func (p rpaParsed) errores() int {
+	n := 0
+	for _, d := range p.Diagnosticos {
+		if d.Severidad == sevError {
+			n++
+		}
+	}
+	return n
+}
+
+// addSintoma incorpora un par síntoma:peso validándolo; lo comparten todos los formatos.
+func (p *rpaParsed) addSintoma(d *rpaDisease, bloque, linea, col int, nombre, peso string) {
+	nombre = strings.TrimSpace(nombre)
+	if nombre == "" {
+		p.diag(bloque, linea, col, sevAviso, "síntoma vacío ignorado")
+		return
+	}
+	s := atomize(nombre)
+	w := 1
+	if peso = strings.TrimSpace(peso); peso != "" {
+		n, err := strconv.Atoi(peso)
+		if err != nil {
+			p.diag(bloque, linea, col, sevError, "el peso '%s' de '%s' no es un entero", peso, s)
+			return
+		}
+		w = n
+	}
+	if c := clamp(w, 1, 3); c != w {
+		p.diag(bloque, linea, col, sevAviso, "peso %d de '%s' fuera de 1..3, se usa %d", w, s, c)
+		w = c
+	}
+	if _, dup := d.Sintomas[s]; dup {
+		p.diag(bloque, linea, col, sevAviso, "síntoma duplicado '%s', se usa el último peso", s)
+	}
+	d.Sintomas[s] = w
+}
+
+// addICD10 valida el código de la enfermedad; si no es válido se descarta.
+func (p *rpaParsed) addICD10(d *rpaDisease, bloque, linea, col int, codigo string) {
+	c, err := normalizarCodigo(codICD10, codigo)
+	if err != nil {
+		p.diag(bloque, linea, col, sevError, "%v, se descarta", err)
+		return
+	}
+	d.ICD10 = c
+}
+
+// addCodigo incorpora un par elemento=código de snomed, icpc o atc.
+func (p *rpaParsed) addCodigo(d *rpaDisease, bloque, linea, col int, sistema, nombre, codigo string) {
+	nombre = strings.TrimSpace(nombre)
+	if nombre == "" {
+		p.diag(bloque, linea, col, sevError, "%s sin elemento (se espera nombre=código)", sistema)
+		return
+	}
+	c, err := normalizarCodigo(sistema, codigo)
+	if err != nil {
+		p.diag(bloque, linea, col, sevError, "%s: %v, se descarta", atomize(nombre), err)
+		return
+	}
+	if c == "" {
+		p.diag(bloque, linea, col, sevAviso, "%s de '%s' vacío ignorado", sistema, atomize(nombre))
+		return
+	}
+	d.Codigos = append(d.Codigos, rpaCodigo{Sistema: sistema, Nombre: atomize(nombre), Codigo: c, Linea: linea, Columna: col})
+}
+
+// addCodigosTexto lee "nombre=código, nombre=código" (texto y CSV).
+func (p *rpaParsed) addCodigosTexto(d *rpaDisease, bloque, linea, col int, sistema string, partes []string) {
+	for _, part := range partes {
+		n, c, ok := strings.Cut(part, "=")
+		if !ok {
+			p.diag(bloque, linea, col, sevError, "%s '%s' debe ser nombre=código", sistema, strings.TrimSpace(part))
+			continue
+		}
+		p.addCodigo(d, bloque, linea, col, sistema, n, c)
+	}
+}
+
+// revisarCodigos avisa de los códigos cuyo elemento no aparece en el bloque:
+// sólo se aplicarán si ya existe en la KB.
+func (p *rpaParsed) revisarCodigos(bloque int, d rpaDisease) {
+	for _, c := range d.Codigos {
+		_, enBloque := d.Sintomas[c.Nombre]
+		if c.Sistema == codATC {
+			enBloque = contains(d.Trata, c.Nombre) || contains(d.Contra, c.Nombre)
+		}
+		if !enBloque {
+			p.diag(bloque, c.Linea, c.Columna, sevAviso, "'%s' no aparece en el registro; su código %s sólo se aplica si ya está en la KB", c.Nombre, c.Sistema)
+		}
+	}
+}
+
+// rpaClaves son las claves válidas de un bloque (en todos los formatos).
+var rpaClaves = map[string]bool{
+	"nombre": true, "tipo": true, "sistema": true, "descripcion": true, "consejos": true,
+	"sintomas": true, "contraindicados": true, "trata": true,
+	codICD10: true, codSNOMED: true, codICPC: true, codATC: true,
 }
 
 func parseRPAFile(text string) rpaParsed {
-	blocks := splitRPA(text)
-	var items []rpaDisease
-	for _, bl := range blocks {
-		if strings.TrimSpace(bl) == "" {
+	var p rpaParsed
+	bloque := 0
+	for _, bl := range splitRPA(text) {
+		if strings.TrimSpace(strings.Join(bl.Lineas, "")) == "" {
 			continue
 		}
+		bloque++
 		d := rpaDisease{Sintomas: map[string]int{}}
-		lines := strings.Split(bl, "\n")
-		for _, ln := range lines {
-			ln = strings.TrimSpace(ln)
+		vistas := map[string]bool{}
+		for li, raw := range bl.Lineas {
+			linea := bl.Inicio + li
+			ln := strings.TrimSpace(raw)
 			if ln == "" {
 				continue
 			}
+			// desplazamientos en bytes dentro de raw; el diagnóstico lleva la columna en caracteres
+			ind := strings.Index(raw, ln)
+			colIni := columnaRunas(raw, ind)
 			col := strings.Index(ln, ":")
 			if col < 0 {
+				p.diag(bloque, linea, colIni, sevError, "línea sin 'clave: valor' ignorada")
 				continue
 			}
 			key := strings.TrimSpace(strings.ToLower(ln[:col]))
 			val := strings.TrimSpace(ln[col+1:])
+			valOff := ind + col + 1 + (len(ln[col+1:]) - len(strings.TrimLeft(ln[col+1:], " \t")))
+			valCol := columnaRunas(raw, valOff)
+			if !rpaClaves[key] {
+				p.diag(bloque, linea, colIni, sevError, "clave desconocida '%s'", key)
+				continue
+			}
+			if vistas[key] {
+				p.diag(bloque, linea, colIni, sevAviso, "clave '%s' repetida en el bloque, se usa la última", key)
+			}
+			vistas[key] = true
 			switch key {
 			case "nombre":
 				d.Name = atomize(val)
@@ -668,42 +1452,76 @@ func parseRPAFile(text string) rpaParsed {
 				d.Sistema = atomize(val)
 			case "descripcion":
 				d.Descripcion = val
+			case "consejos":
+				d.Consejos = splitConsejos(val)
 			case "sintomas":
-				for _, p := range strings.Split(val, ",") {
-					p = strings.TrimSpace(p)
-					if p == "" {
+				d.Sintomas = map[string]int{}
+				off := valOff
+				for _, part := range strings.Split(val, ",") {
+					pc := columnaRunas(raw, off+len(part)-len(strings.TrimLeft(part, " \t")))
+					off += len(part) + 1
+					if strings.TrimSpace(part) == "" {
 						continue
 					}
-					kv := strings.Split(p, ":")
-					s := atomize(strings.TrimSpace(kv[0]))
-					w := 1
+					kv := strings.SplitN(part, ":", 2)
+					w := ""
 					if len(kv) > 1 {
-						fmt.Sscanf(kv[1], "%d", &w)
-					}
-					if w < 1 {
-						w = 1
-					}
-					if w > 3 {
-						w = 3
+						w = kv[1]
 					}
-					d.Sintomas[s] = w
+					p.addSintoma(&d, bloque, linea, pc, kv[0], w)
 				}
 			case "contraindicados":
 				d.Contra = parseCSVAtoms(val)
 			case "trata":
 				d.Trata = parseCSVAtoms(val)
+			case codICD10:
+				p.addICD10(&d, bloque, linea, valCol, val)
+			case codSNOMED, codICPC, codATC:
+				p.addCodigosTexto(&d, bloque, linea, valCol, key, splitLista(val))
 			}
 		}
-		if d.Name != "" {
-			items = append(items, d)
+		if d.Name == "" {
+			p.diag(bloque, bl.Inicio, 1, sevError, "bloque sin 'nombre', se descarta")
+			continue
 		}
+		p.revisarCodigos(bloque, d)
+		p.Items = append(p.Items, d)
 	}
-	return rpaParsed{Items: items}
+	return p
+}
+
+// rpaBloque es un bloque de texto con el número de su primera línea (desde 1).
+type rpaBloque struct {
+	Inicio int
+	Lineas []string
 }
 
-func splitRPA(text string) []string {
+// splitRPA separa los bloques por líneas que sólo contienen "---", de modo
+// que una descripción con "---" en medio del texto no parte el bloque.
+func splitRPA(text string) []rpaBloque {
 	text = strings.ReplaceAll(text, "\r\n", "\n")
-	return strings.Split(text, "---")
+	var blocks []rpaBloque
+	cur := rpaBloque{Inicio: 1}
+	for i, ln := range strings.Split(text, "\n") {
+		if strings.TrimSpace(ln) == "---" {
+			blocks = append(blocks, cur)
+			cur = rpaBloque{Inicio: i + 2}
+			continue
+		}
+		cur.Lineas = append(cur.Lineas, ln)
+	}
+	return append(blocks, cur)
+}
+
+// splitConsejos separa por ';' (los consejos pueden llevar comas).
+func splitConsejos(s string) []string {
+	var out []string
+	for _, c := range strings.Split(s, ";") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
 }
 
 func parseCSVAtoms(s string) []string {
@@ -720,22 +1538,36 @@ func parseCSVAtoms(s string) []string {
 
 func applyParsedToKB(k *Knowledge, p rpaParsed) {
 	for _, it := range p.Items {
-		// sintomas nuevos
-		for s := range it.Sintomas {
+		// sintomas nuevos, en orden para que reimportar dé el mismo programa
+		sintomas := sortedKeys(it.Sintomas)
+		for _, s := range sintomas {
 			if !hasSym(k.Symptoms, s) {
 				k.Symptoms = append(k.Symptoms, Symptom{Name: s})
 			}
 		}
-		// enfermedad (actualiza o inserta)
+		// enfermedad (actualiza o inserta); lo que no venga en el bloque (icd10,
+		// tipo, sistema, descripción, consejos) conserva el valor que tenga
 		upd := false
 		for i := range k.Diseases {
 			if k.Diseases[i].Name == it.Name {
-				k.Diseases[i].Tipo = it.Tipo
-				k.Diseases[i].Sistema = it.Sistema
-				k.Diseases[i].Descripcion = it.Descripcion
+				if it.ICD10 != "" {
+					k.Diseases[i].ICD10 = it.ICD10
+				}
+				if it.Tipo != "" {
+					k.Diseases[i].Tipo = it.Tipo
+				}
+				if it.Sistema != "" {
+					k.Diseases[i].Sistema = it.Sistema
+				}
+				if it.Descripcion != "" {
+					k.Diseases[i].Descripcion = it.Descripcion
+				}
+				if len(it.Consejos) > 0 {
+					k.Diseases[i].Consejos = it.Consejos
+				}
 				k.Diseases[i].Caracteristicas = nil
-				for s, w := range it.Sintomas {
-					k.Diseases[i].Caracteristicas = append(k.Diseases[i].Caracteristicas, Caract{Symptom: s, Peso: w})
+				for _, s := range sintomas {
+					k.Diseases[i].Caracteristicas = append(k.Diseases[i].Caracteristicas, Caract{Symptom: s, Peso: it.Sintomas[s]})
 				}
 				upd = true
 				break
@@ -743,17 +1575,21 @@ func applyParsedToKB(k *Knowledge, p rpaParsed) {
 		}
 		if !upd {
 			var car []Caract
-			for s, w := range it.Sintomas {
-				car = append(car, Caract{Symptom: s, Peso: w})
+			for _, s := range sintomas {
+				car = append(car, Caract{Symptom: s, Peso: it.Sintomas[s]})
 			}
 			k.Diseases = append(k.Diseases, Disease{
 				Name: it.Name, Tipo: it.Tipo, Sistema: it.Sistema,
-				Descripcion: it.Descripcion, Caracteristicas: car,
+				Descripcion: it.Descripcion, Consejos: it.Consejos, Caracteristicas: car,
+				ICD10: it.ICD10,
 			})
 		}
 		// contraindicados -> marcamos como alergia "desconocida" para registrar el vínculo
 		for _, m := range it.Contra {
-			k.ContraAlergias = append(k.ContraAlergias, ContraAlergia{Med: m, Alergia: "desconocida"})
+			ca := ContraAlergia{Med: m, Alergia: alergiaDesconocida}
+			if !hasContra(k.ContraAlergias, ca) {
+				k.ContraAlergias = append(k.ContraAlergias, ca)
+			}
 		}
 		// trata
 		for _, m := range it.Trata {
@@ -771,6 +1607,23 @@ func applyParsedToKB(k *Knowledge, p rpaParsed) {
 				k.Meds = append(k.Meds, Medication{Name: m, Treats: []string{it.Name}})
 			}
 		}
+		// códigos de síntomas y medicamentos que ya estén en la KB
+		for _, c := range it.Codigos {
+			switch c.Sistema {
+			case codSNOMED:
+				if i := indiceSintoma(k, c.Nombre); i >= 0 {
+					k.Symptoms[i].SNOMED = c.Codigo
+				}
+			case codICPC:
+				if i := indiceSintoma(k, c.Nombre); i >= 0 {
+					k.Symptoms[i].ICPC = c.Codigo
+				}
+			case codATC:
+				if i := indiceMed(k, c.Nombre); i >= 0 {
+					k.Meds[i].ATC = c.Codigo
+				}
+			}
+		}
 	}
 }
 
@@ -783,6 +1636,15 @@ func hasSym(list []Symptom, x string) bool {
 	return false
 }
 
+func hasContra(list []ContraAlergia, x ContraAlergia) bool {
+	for _, c := range list {
+		if c == x {
+			return true
+		}
+	}
+	return false
+}
+
 func contains(list []string, x string) bool {
 	for _, s := range list {
 		if s == x {
@@ -792,62 +1654,28 @@ func contains(list []string, x string) bool {
 	return false
 }
 
-func buildRPAReport(p rpaParsed) string {
+// formatDiagnosticos lista los diagnósticos como "bloque N, línea L:C [sev] mensaje".
+func formatDiagnosticos(ds []rpaDiag) string {
+	if len(ds) == 0 {
+		return ""
+	}
 	var b strings.Builder
-	ts := time.Now().Format("2006-01-02 15:04:05")
-	b.WriteString("MediLogic RPA – Informe de carga\n")
-	b.WriteString("Fecha: " + ts + "\n\n")
-	for _, it := range p.Items {
-		b.WriteString(fmt.Sprintf("- Enfermedad: %s (tipo=%s, sistema=%s)\n", it.Name, it.Tipo, it.Sistema))
-		b.WriteString("  Síntomas: ")
-		var ss []string
-		for k, v := range it.Sintomas {
-			ss = append(ss, fmt.Sprintf("%s:%d", k, v))
-		}
-		b.WriteString(strings.Join(ss, ", "))
-		b.WriteString("\n")
-		if len(it.Trata) > 0 {
-			b.WriteString("  Trata: " + strings.Join(it.Trata, ", ") + "\n")
+	b.WriteString(fmt.Sprintf("Diagnósticos (%d)\n", len(ds)))
+	for _, d := range ds {
+		pos := ""
+		if d.Bloque > 0 {
+			pos = fmt.Sprintf("bloque %d, ", d.Bloque)
 		}
-		if len(it.Contra) > 0 {
-			b.WriteString("  Contraindicados: " + strings.Join(it.Contra, ", ") + "\n")
+		if d.Linea > 0 {
+			pos += fmt.Sprintf("línea %d:%d", d.Linea, d.Columna)
+		} else {
+			pos = strings.TrimSuffix(pos, ", ")
 		}
-		b.WriteString("\n")
+		b.WriteString(fmt.Sprintf("  %s [%s] %s\n", pos, d.Severidad, d.Mensaje))
 	}
 	return b.String()
 }
 
-func deliverReport(report string) error {
-	// SMTP opcional (variables de entorno):
-	// SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASS, SMTP_FROM, ADMIN_EMAILS
-	host := os.Getenv("SMTP_HOST")
-	port := getenv("SMTP_PORT", "587")
-	user := os.Getenv("SMTP_USER")
-	pass := os.Getenv("SMTP_PASS")
-	from := os.Getenv("SMTP_FROM")
-	rcpts := strings.Split(os.Getenv("ADMIN_EMAILS"), ",")
-	if host == "" || user == "" || pass == "" || from == "" || len(rcpts) == 0 || strings.TrimSpace(rcpts[0]) == "" {
-		return fmt.Errorf("SMTP no configurado")
-	}
-
-	addr := host + ":" + port
-	auth := smtp.PlainAuth("", user, pass, host)
-
-	msg := bytes.Buffer{}
-	msg.WriteString("To: " + strings.Join(rcpts, ",") + "\r\n")
-	msg.WriteString("Subject: MediLogic RPA – Informe de cambios\r\n")
-	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
-	msg.WriteString(report)
-
-	return smtp.SendMail(addr, auth, from, rcpts, msg.Bytes())
-}
-
-func saveReportToDisk(report string) {
-	fn := filepath.Join("rpa_reports", "rpa_"+time.Now().Format("20060102_150405")+".txt")
-	_ = os.WriteFile(fn, []byte(report), 0644)
-	logp("Informe RPA guardado en %s", fn)
-}
-
 func getenv(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Bandeja de salida (informes por correo) ========
+//
+// Los informes no se envían en línea: se encolan en storage/outbox.json y un
+// proceso en segundo plano los entrega con reintentos y espera exponencial
+// (outboxEsperaBase · 2^(intentos-1), hasta outboxEsperaMax). Tras
+// SMTP_MAX_INTENTOS fallos el mensaje queda como "muerto" y sólo se vuelve a
+// intentar con POST /admin/outbox/resend. Los entregados se conservan
+// outboxRetencion para consulta.
+//
+// SMTP (variables de entorno):
+//   SMTP_HOST, SMTP_PORT, SMTP_FROM, ADMIN_EMAILS   requeridas (puerto default 587)
+//   SMTP_USER, SMTP_PASS   sin usuario no se autentica
+//   SMTP_MODO              starttls | tls (TLS implícito) | plano (default: tls
+//                          en el puerto 465, starttls en los demás)
+//   SMTP_TLS_INSECURE      "true" no verifica el certificado (servidores de prueba)
+//   SMTP_MAX_INTENTOS      default 8
+
+var outboxPath = filepath.Join("storage", "outbox.json")
+
+const (
+	outboxEsperaBase = 30 * time.Second
+	outboxEsperaMax  = time.Hour
+	outboxRetencion  = 30 * 24 * time.Hour
+	outboxTimeout    = 30 * time.Second
+
+	outboxPendiente = "pendiente"
+	outboxEntregado = "entregado"
+	outboxMuerto    = "muerto"
+
+	smtpModoTLS      = "tls"
+	smtpModoStartTLS = "starttls"
+	smtpModoPlano    = "plano"
+)
+
+type OutboxMsg struct {
+	ID             string     `json:"id"`
+	Creado         time.Time  `json:"creado"`
+	Asunto         string     `json:"asunto"`
+	Texto          string     `json:"texto,omitempty"`
+	HTML           string     `json:"html,omitempty"`
+	Estado         string     `json:"estado"`
+	Intentos       int        `json:"intentos"`
+	ProximoIntento *time.Time `json:"proximoIntento,omitempty"`
+	UltimoError    string     `json:"ultimoError,omitempty"`
+	Entregado      *time.Time `json:"entregado,omitempty"`
+}
+
+type smtpConfig struct {
+	Host, Port, User, Pass, From string
+	Rcpts                        []string
+	Modo                         string
+	Insecure                     bool
+	MaxIntentos                  int
+}
+
+var (
+	outMu        sync.Mutex
+	outbox       = map[string]*OutboxMsg{}
+	outDespertar = make(chan struct{}, 1)
+)
+
+// smtpDesdeEnv lee la configuración en cada uso; error si no hay SMTP.
+func smtpDesdeEnv() (smtpConfig, error) {
+	c := smtpConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     getenv("SMTP_PORT", "587"),
+		User:     os.Getenv("SMTP_USER"),
+		Pass:     os.Getenv("SMTP_PASS"),
+		From:     os.Getenv("SMTP_FROM"),
+		Modo:     strings.ToLower(os.Getenv("SMTP_MODO")),
+		Insecure: os.Getenv("SMTP_TLS_INSECURE") == "true",
+	}
+	for _, r := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			c.Rcpts = append(c.Rcpts, r)
+		}
+	}
+	if c.Host == "" || c.From == "" || len(c.Rcpts) == 0 {
+		return c, fmt.Errorf("SMTP no configurado")
+	}
+	switch c.Modo {
+	case "":
+		c.Modo = smtpModoStartTLS
+		if c.Port == "465" {
+			c.Modo = smtpModoTLS
+		}
+	case smtpModoTLS, smtpModoStartTLS, smtpModoPlano:
+	default:
+		return c, fmt.Errorf("SMTP_MODO %q inválido (tls, starttls o plano)", c.Modo)
+	}
+	n, err := strconv.Atoi(getenv("SMTP_MAX_INTENTOS", "8"))
+	if err != nil || n < 1 {
+		n = 8
+	}
+	c.MaxIntentos = n
+	return c, nil
+}
+
+func loadOutbox() {
+	b, err := os.ReadFile(outboxPath)
+	if err != nil {
+		return
+	}
+	var ms []*OutboxMsg
+	if err := json.Unmarshal(b, &ms); err != nil {
+		logp("outbox.json inválido: %v", err)
+		return
+	}
+	for _, m := range ms {
+		outbox[m.ID] = m
+	}
+}
+
+// guardarOutbox debe llamarse con outMu tomado.
+func guardarOutbox() error {
+	ms := make([]*OutboxMsg, 0, len(outbox))
+	for _, m := range outbox {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Creado.Before(ms[j].Creado) })
+	b, _ := json.Marshal(ms)
+	tmp := outboxPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outboxPath)
+}
+
+// initOutbox carga la cola y arranca el proceso de entrega.
+func initOutbox() {
+	loadOutbox()
+	go func() {
+		t := time.NewTicker(10 * time.Second)
+		for {
+			procesarOutbox(time.Now())
+			select {
+			case <-t.C:
+			case <-outDespertar:
+			}
+		}
+	}()
+}
+
+func despertarOutbox() {
+	select {
+	case outDespertar <- struct{}{}:
+	default:
+	}
+}
+
+// deliverReport encola el informe y devuelve el id del mensaje; error si no
+// hay SMTP configurado o no se pudo persistir la cola.
+func deliverReport(texto, html string) (string, error) {
+	if _, err := smtpDesdeEnv(); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	m := &OutboxMsg{
+		ID:             nuevoID(),
+		Creado:         now,
+		Asunto:         "MediLogic RPA – Informe de cambios",
+		Texto:          texto,
+		HTML:           html,
+		Estado:         outboxPendiente,
+		ProximoIntento: &now,
+	}
+	outMu.Lock()
+	outbox[m.ID] = m
+	err := guardarOutbox()
+	outMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	despertarOutbox()
+	return m.ID, nil
+}
+
+// procesarOutbox intenta los mensajes pendientes vencidos y poda los
+// entregados antiguos. El envío se hace sin outMu tomado.
+func procesarOutbox(now time.Time) {
+	cfg, cfgErr := smtpDesdeEnv()
+
+	outMu.Lock()
+	var due []OutboxMsg
+	cambios := false
+	for id, m := range outbox {
+		if m.Estado == outboxEntregado && m.Entregado != nil && now.Sub(*m.Entregado) > outboxRetencion {
+			delete(outbox, id)
+			cambios = true
+			continue
+		}
+		if m.Estado == outboxPendiente && (m.ProximoIntento == nil || !now.Before(*m.ProximoIntento)) {
+			due = append(due, *m)
+		}
+	}
+	if cambios {
+		_ = guardarOutbox()
+	}
+	outMu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Creado.Before(due[j].Creado) })
+
+	for _, m := range due {
+		err := cfgErr
+		if err == nil {
+			err = enviarSMTP(cfg, m)
+		}
+		outMu.Lock()
+		cur, ok := outbox[m.ID]
+		if !ok || cur.Estado != outboxPendiente {
+			outMu.Unlock()
+			continue
+		}
+		cur.Intentos++
+		if err == nil {
+			t := time.Now().UTC()
+			cur.Estado, cur.Entregado, cur.UltimoError = outboxEntregado, &t, ""
+			cur.ProximoIntento = nil
+			logp("outbox: %s entregado (intento %d)", cur.ID, cur.Intentos)
+		} else {
+			cur.UltimoError = err.Error()
+			max := 8
+			if cfgErr == nil {
+				max = cfg.MaxIntentos
+			}
+			if cur.Intentos >= max {
+				cur.Estado = outboxMuerto
+				cur.ProximoIntento = nil
+				logp("outbox: %s sin entregar tras %d intentos: %v", cur.ID, cur.Intentos, err)
+			} else {
+				t := time.Now().UTC().Add(esperaExponencial(outboxEsperaBase, outboxEsperaMax, cur.Intentos))
+				cur.ProximoIntento = &t
+				logp("outbox: %s intento %d falló, reintento %s: %v", cur.ID, cur.Intentos, cur.ProximoIntento.Format(time.RFC3339), err)
+			}
+		}
+		if err := guardarOutbox(); err != nil {
+			logp("outbox: no se pudo guardar la cola: %v", err)
+		}
+		outMu.Unlock()
+	}
+}
+
+// esperaExponencial devuelve base·2^(intentos-1), acotado a max.
+func esperaExponencial(base, max time.Duration, intentos int) time.Duration {
+	d := base
+	for i := 1; i < intentos && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// enviarSMTP entrega un mensaje según el modo configurado.
+func enviarSMTP(cfg smtpConfig, m OutboxMsg) error {
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	tlsCfg := &tls.Config{ServerName: cfg.Host, InsecureSkipVerify: cfg.Insecure}
+
+	var conn net.Conn
+	var err error
+	d := net.Dialer{Timeout: outboxTimeout}
+	if cfg.Modo == smtpModoTLS {
+		conn, err = tls.DialWithDialer(&d, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * outboxTimeout))
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.Modo == smtpModoStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("el servidor no ofrece STARTTLS (use SMTP_MODO=tls o plano)")
+		}
+		if err := c.StartTLS(tlsCfg); err != nil {
+			return err
+		}
+	}
+	if cfg.User != "" {
+		// smtp.PlainAuth rechaza conexiones sin TLS salvo a localhost
+		if err := c.Auth(smtp.PlainAuth("", cfg.User, cfg.Pass, cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, r := range cfg.Rcpts {
+		if err := c.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mensajeMIME(cfg, m)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mensajeMIME arma el correo multipart/alternative: los clientes sin HTML
+// muestran el texto plano. El separador es aleatorio (multipart.Writer) y
+// las partes van en quoted-printable, porque el informe incluye texto de la
+// ingesta: una línea suya no puede cerrar la parte ni pasar de 998 bytes.
+func mensajeMIME(cfg smtpConfig, m OutboxMsg) []byte {
+	var cuerpo bytes.Buffer
+	mw := multipart.NewWriter(&cuerpo)
+	for _, p := range []struct{ tipo, texto string }{{"text/plain", m.Texto}, {"text/html", m.HTML}} {
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.tipo + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qp := quotedprintable.NewWriter(w)
+		_, _ = qp.Write([]byte(p.texto))
+		_ = qp.Close()
+	}
+	_ = mw.Close()
+
+	msg := bytes.Buffer{}
+	msg.WriteString("From: " + cfg.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(cfg.Rcpts, ",") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Asunto) + "\r\n")
+	msg.WriteString("Date: " + m.Creado.Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: <" + m.ID + "@medilogic>\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+	msg.Write(cuerpo.Bytes())
+	return msg.Bytes()
+}
+
+//
+// ======== Endpoints /admin/outbox ========
+//
+// GET  /admin/outbox?estado=pendiente|entregado|muerto   lista (sin cuerpos)
+// GET  /admin/outbox?id=...                               mensaje completo
+// POST /admin/outbox/resend?id=...  o  ?estado=muerto    vuelve a encolar
+
+func handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	outMu.Lock()
+	defer outMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if id := q.Get("id"); id != "" {
+		m, ok := outbox[id]
+		if !ok {
+			http.Error(w, "mensaje no encontrado", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(m)
+		return
+	}
+	out := []OutboxMsg{}
+	for _, m := range outbox {
+		if e := q.Get("estado"); e != "" && m.Estado != e {
+			continue
+		}
+		v := *m
+		v.Texto, v.HTML = "", ""
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Creado.After(out[j].Creado) })
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"total": len(out), "mensajes": out})
+}
+
+func handleOutboxResend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	id, estado := q.Get("id"), q.Get("estado")
+	if id == "" && estado == "" {
+		http.Error(w, "indique id o estado", http.StatusBadRequest)
+		return
+	}
+	outMu.Lock()
+	var ids []string
+	now := time.Now().UTC()
+	for _, m := range outbox {
+		if (id != "" && m.ID != id) || (estado != "" && m.Estado != estado) {
+			continue
+		}
+		m.Estado, m.Intentos, m.ProximoIntento, m.Entregado = outboxPendiente, 0, &now, nil
+		ids = append(ids, m.ID)
+	}
+	err := guardarOutbox()
+	outMu.Unlock()
+	if id != "" && len(ids) == 0 {
+		http.Error(w, "mensaje no encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	despertarOutbox()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"reencolados": len(ids), "ids": ids})
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// correoRecibido es lo que el servidor falso leyó tras DATA.
+type correoRecibido struct {
+	Datos string
+	TLS   bool // la conexión estaba cifrada al enviar DATA
+}
+
+// certPrueba toma el certificado autofirmado de httptest.
+func certPrueba(t *testing.T) []tls.Certificate {
+	t.Helper()
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	defer s.Close()
+	return s.TLS.Certificates
+}
+
+// smtpFalso levanta un servidor SMTP mínimo en 127.0.0.1 que acepta todo y
+// manda por el canal cada mensaje recibido.
+func smtpFalso(t *testing.T, modo string) (smtpConfig, <-chan correoRecibido) {
+	t.Helper()
+	cert := certPrueba(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modo == smtpModoTLS {
+		ln = tls.NewListener(ln, &tls.Config{Certificates: cert})
+	}
+	t.Cleanup(func() { ln.Close() })
+	recibidos := make(chan correoRecibido, 4)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go atenderSMTP(c, modo, cert, recibidos)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	cfg := smtpConfig{
+		Host: host, Port: port, From: "medilogic@example.org", Rcpts: []string{"admin@example.org"},
+		Modo: modo, Insecure: true, MaxIntentos: 8,
+	}
+	return cfg, recibidos
+}
+
+func atenderSMTP(c net.Conn, modo string, cert []tls.Certificate, recibidos chan<- correoRecibido) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	cifrada := modo == smtpModoTLS
+	fmt.Fprint(c, "220 falso ESMTP\r\n")
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(l))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			if modo == smtpModoStartTLS && !cifrada {
+				fmt.Fprint(c, "250-falso\r\n250 STARTTLS\r\n")
+			} else {
+				fmt.Fprint(c, "250 falso\r\n")
+			}
+		case cmd == "STARTTLS":
+			fmt.Fprint(c, "220 adelante\r\n")
+			tc := tls.Server(c, &tls.Config{Certificates: cert})
+			if tc.Handshake() != nil {
+				return
+			}
+			c, r, cifrada = tc, bufio.NewReader(tc), true
+		case cmd == "DATA":
+			fmt.Fprint(c, "354 termine con .\r\n")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			recibidos <- correoRecibido{Datos: b.String(), TLS: cifrada}
+			fmt.Fprint(c, "250 aceptado\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(c, "221 adiós\r\n")
+			return
+		default:
+			fmt.Fprint(c, "250 ok\r\n")
+		}
+	}
+}
+
+func esperarCorreo(t *testing.T, ch <-chan correoRecibido) correoRecibido {
+	t.Helper()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("el servidor SMTP falso no recibió ningún mensaje")
+		return correoRecibido{}
+	}
+}
+
+// partesCorreo devuelve el cuerpo de cada parte (ya decodificado) por tipo.
+func partesCorreo(t *testing.T, datos string) (map[string]string, string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(datos))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/alternative" {
+		t.Fatalf("Content-Type %q: %v", msg.Header.Get("Content-Type"), err)
+	}
+	partes := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tipo, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		b, _ := io.ReadAll(p)
+		partes[tipo] = string(b)
+	}
+	asunto, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	return partes, asunto
+}
+
+func TestEnviarSMTPModos(t *testing.T) {
+	// el texto del informe incluye lo que trajo la ingesta, también un
+	// separador adivinado y acentos
+	m := OutboxMsg{
+		ID: "abc", Creado: time.Now(), Asunto: "MediLogic RPA – Informe de cambios",
+		Texto: "gripe: síntomas nuevos\r\n--medilogic-rpa-informe--\r\nfin",
+		HTML:  "<p>gripe</p>",
+	}
+	for _, modo := range []string{smtpModoPlano, smtpModoStartTLS, smtpModoTLS} {
+		t.Run(modo, func(t *testing.T) {
+			cfg, recibidos := smtpFalso(t, modo)
+			if err := enviarSMTP(cfg, m); err != nil {
+				t.Fatal(err)
+			}
+			c := esperarCorreo(t, recibidos)
+			if c.TLS != (modo != smtpModoPlano) {
+				t.Errorf("DATA cifrado = %v", c.TLS)
+			}
+			partes, asunto := partesCorreo(t, c.Datos)
+			if asunto != m.Asunto {
+				t.Errorf("asunto %q", asunto)
+			}
+			if len(partes) != 2 || partes["text/plain"] != m.Texto || partes["text/html"] != m.HTML {
+				t.Errorf("partes: %q", partes)
+			}
+		})
+	}
+
+	// sin STARTTLS en el servidor no se manda en claro
+	cfg, _ := smtpFalso(t, smtpModoPlano)
+	cfg.Modo = smtpModoStartTLS
+	if err := enviarSMTP(cfg, m); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("servidor sin STARTTLS: err = %v", err)
+	}
+}
+
+func TestMensajeMIMESeparadorAleatorio(t *testing.T) {
+	cfg := smtpConfig{From: "a@example.org", Rcpts: []string{"b@example.org"}}
+	separador := func() string {
+		msg, err := mail.ReadMessage(strings.NewReader(string(mensajeMIME(cfg, OutboxMsg{ID: "x", Texto: "t", HTML: "h"}))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		return params["boundary"]
+	}
+	a, b := separador(), separador()
+	if a == "" || a == b {
+		t.Errorf("separadores %q y %q: deben ser aleatorios", a, b)
+	}
+}
+
+func TestEsperaExponencial(t *testing.T) {
+	casos := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour, // 64 min, acotado
+		20: time.Hour,
+	}
+	for n, quiere := range casos {
+		if got := esperaExponencial(outboxEsperaBase, outboxEsperaMax, n); got != quiere {
+			t.Errorf("intento %d: %v, se esperaba %v", n, got, quiere)
+		}
+	}
+}
+
+// usarOutbox aísla la cola del test en un directorio temporal.
+func usarOutbox(t *testing.T) {
+	t.Helper()
+	prevPath, prevCola := outboxPath, outbox
+	outboxPath = filepath.Join(t.TempDir(), "outbox.json")
+	outbox = map[string]*OutboxMsg{}
+	t.Cleanup(func() { outboxPath, outbox = prevPath, prevCola })
+}
+
+// reiniciarOutbox simula un reinicio: vacía la memoria y relee el archivo.
+func reiniciarOutbox() *OutboxMsg {
+	outbox = map[string]*OutboxMsg{}
+	loadOutbox()
+	for _, m := range outbox {
+		return m
+	}
+	return nil
+}
+
+func TestOutboxPersisteYReenvia(t *testing.T) {
+	usarOutbox(t)
+	cfg, recibidos := smtpFalso(t, smtpModoPlano)
+
+	// primero un puerto donde no escucha nadie
+	muerto, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, puertoMuerto, _ := net.SplitHostPort(muerto.Addr().String())
+	muerto.Close()
+	t.Setenv("SMTP_HOST", cfg.Host)
+	t.Setenv("SMTP_PORT", puertoMuerto)
+	t.Setenv("SMTP_FROM", cfg.From)
+	t.Setenv("ADMIN_EMAILS", strings.Join(cfg.Rcpts, ","))
+	t.Setenv("SMTP_MODO", smtpModoPlano)
+	t.Setenv("SMTP_MAX_INTENTOS", "2")
+
+	id, err := deliverReport("informe en texto", "<p>informe</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := reiniciarOutbox()
+	if m == nil || m.ID != id || m.Estado != outboxPendiente || m.Texto != "informe en texto" {
+		t.Fatalf("tras reiniciar: %+v", m)
+	}
+
+	antes := time.Now()
+	procesarOutbox(time.Now())
+	m = reiniciarOutbox()
+	if m.Intentos != 1 || m.Estado != outboxPendiente || m.UltimoError == "" || m.ProximoIntento == nil {
+		t.Fatalf("tras el primer fallo: %+v", m)
+	}
+	if espera := m.ProximoIntento.Sub(antes); espera < outboxEsperaBase-time.Second || espera > outboxEsperaBase+5*time.Second {
+		t.Errorf("primer reintento a %v, se esperaba %v", espera, outboxEsperaBase)
+	}
+
+	procesarOutbox(time.Now()) // aún no vence: no se intenta
+	if outbox[id].Intentos != 1 {
+		t.Fatalf("se reintentó antes de tiempo: %+v", outbox[id])
+	}
+	procesarOutbox(time.Now().Add(time.Hour))
+	if m = reiniciarOutbox(); m.Estado != outboxMuerto || m.Intentos != 2 {
+		t.Fatalf("tras SMTP_MAX_INTENTOS: %+v", m)
+	}
+	procesarOutbox(time.Now().Add(24 * time.Hour)) // un muerto no se reintenta solo
+	if outbox[id].Intentos != 2 {
+		t.Fatalf("se reintentó un mensaje muerto: %+v", outbox[id])
+	}
+
+	// reenviar desde el admin, ya con el servidor bueno
+	t.Setenv("SMTP_PORT", cfg.Port)
+	w := httptest.NewRecorder()
+	handleOutboxResend(w, httptest.NewRequest(http.MethodPost, "/admin/outbox/resend?estado=muerto", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), id) {
+		t.Fatalf("resend: %d %s", w.Code, w.Body)
+	}
+	if m = reiniciarOutbox(); m.Estado != outboxPendiente || m.Intentos != 0 {
+		t.Fatalf("tras resend: %+v", m)
+	}
+	procesarOutbox(time.Now())
+	partes, _ := partesCorreo(t, esperarCorreo(t, recibidos).Datos)
+	if partes["text/plain"] != "informe en texto" {
+		t.Errorf("texto recibido %q", partes["text/plain"])
+	}
+	if m = reiniciarOutbox(); m.Estado != outboxEntregado || m.Entregado == nil || m.UltimoError != "" {
+		t.Errorf("tras entregar: %+v", m)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ======== Informes RPA guardados ========
+//
+// Cada informe se guarda en rpa_reports/ como <id>.txt, <id>.html y <id>.json
+// (metadatos + informe estructurado), haya o no SMTP. El id conserva el
+// formato histórico rpa_AAAAMMDD_HHMMSS (hora local) con un sufijo aleatorio
+// para que dos ingestas en el mismo segundo no se pisen. Los informes
+// anteriores a este cambio (sólo .txt/.html) se listan con los datos que se
+// pueden deducir del nombre. Cada informe es de la KB en la que se aplicó la
+// ingesta (ver bases.go) y sólo se ve desde ella; los anteriores son de la
+// general.
+//
+//   RPA_REPORTES_RETENCION_DIAS  días que se conservan (default 180)
+
+var reportesDir = "rpa_reports"
+
+const (
+	reporteFechaFmt = "20060102_150405"
+
+	entregaSinSMTP      = "sin_smtp"
+	entregaDesconocida  = "desconocido"
+	reportesPorPagina   = 20
+	reportesPorPaginaMx = 100
+)
+
+var reporteIDRe = regexp.MustCompile(`^rpa_\d{8}_\d{6}(_[0-9a-f]+)?$`)
+
+type ReporteMeta struct {
+	ID          string    `json:"id"`
+	Fecha       time.Time `json:"fecha"`
+	Origen      string    `json:"origen,omitempty"`
+	Autor       string    `json:"autor,omitempty"`
+	KB          string    `json:"kb,omitempty"` // vacío: la general
+	Formato     string    `json:"formato,omitempty"`
+	Leidos      int       `json:"leidos"`
+	Creadas     int       `json:"creadas"`
+	Modificadas int       `json:"modificadas"`
+	Errores     int       `json:"errores"`
+	OutboxID    string    `json:"outboxId,omitempty"`
+	Entrega     string    `json:"entrega"` // sin_smtp | pendiente | entregado | muerto | desconocido
+	Legado      bool      `json:"-"`       // sólo .txt/.html
+}
+
+// reporteGuardado es el contenido de <id>.json.
+type reporteGuardado struct {
+	ReporteMeta
+	Informe *rpaInforme `json:"informe,omitempty"`
+}
+
+// saveReportToDisk guarda las tres variantes con el mismo nombre base.
+func saveReportToDisk(inf rpaInforme, texto, html, outboxID string) error {
+	id := "rpa_" + inf.Fecha.Format(reporteFechaFmt) + "_" + nuevoID()[:6]
+	base := filepath.Join(reportesDir, id)
+	rg := reporteGuardado{
+		ReporteMeta: ReporteMeta{
+			ID:          id,
+			Fecha:       inf.Fecha,
+			Origen:      inf.Origen,
+			Autor:       inf.Autor,
+			KB:          inf.KB,
+			Formato:     inf.Formato,
+			Leidos:      inf.Leidos,
+			Creadas:     len(inf.Creadas),
+			Modificadas: len(inf.Modificadas),
+			OutboxID:    outboxID,
+		},
+		Informe: &inf,
+	}
+	for _, d := range inf.Diagnosticos {
+		if d.Severidad == sevError {
+			rg.Errores++
+		}
+	}
+	b, _ := json.MarshalIndent(rg, "", "  ")
+	if err := os.WriteFile(base+".txt", []byte(texto), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".html", []byte(html), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".json", b, 0644); err != nil {
+		return err
+	}
+	logp("Informe RPA guardado en %s.txt", base)
+	return nil
+}
+
+func initReportes() {
+	dias, err := strconv.Atoi(getenv("RPA_REPORTES_RETENCION_DIAS", "180"))
+	if err != nil || dias < 1 {
+		logp("RPA_REPORTES_RETENCION_DIAS inválido, se usan 180 días")
+		dias = 180
+	}
+	ret := time.Duration(dias) * 24 * time.Hour
+	podar := func() {
+		if n, err := podarReportes(time.Now(), ret); err != nil {
+			logp("rpa_reports: no se pudo aplicar la retención: %v", err)
+		} else if n > 0 {
+			logp("rpa_reports: %d informes vencidos eliminados", n)
+		}
+	}
+	podar()
+	go func() {
+		for range time.Tick(time.Hour) {
+			podar()
+		}
+	}()
+}
+
+// fechaDeReporte lee la fecha del nombre (rpa_AAAAMMDD_HHMMSS...).
+func fechaDeReporte(id string) (time.Time, bool) {
+	if len(id) < 19 || !strings.HasPrefix(id, "rpa_") {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(reporteFechaFmt, id[4:19], time.Local)
+	return t, err == nil
+}
+
+// podarReportes borra todas las variantes de los informes más antiguos que ret.
+func podarReportes(now time.Time, ret time.Duration) (int, error) {
+	ents, err := os.ReadDir(reportesDir)
+	if err != nil {
+		return 0, err
+	}
+	borrados := map[string]bool{}
+	for _, e := range ents {
+		id := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		t, ok := fechaDeReporte(id)
+		if !ok || now.Sub(t) <= ret {
+			continue
+		}
+		if err := os.Remove(filepath.Join(reportesDir, e.Name())); err != nil {
+			return len(borrados), err
+		}
+		borrados[id] = true
+	}
+	return len(borrados), nil
+}
+
+// listarReportes devuelve los metadatos de todos los informes, el más
+// reciente primero, con el estado de entrega actual.
+func listarReportes() ([]ReporteMeta, error) {
+	ents, err := os.ReadDir(reportesDir)
+	if err != nil {
+		return nil, err
+	}
+	metas := map[string]*ReporteMeta{}
+	for _, e := range ents {
+		ext := filepath.Ext(e.Name())
+		id := strings.TrimSuffix(e.Name(), ext)
+		if !reporteIDRe.MatchString(id) {
+			continue
+		}
+		switch ext {
+		case ".json":
+			rg, err := leerReporte(id)
+			if err != nil {
+				continue
+			}
+			metas[id] = &rg.ReporteMeta
+		case ".txt", ".html":
+			if metas[id] == nil {
+				t, _ := fechaDeReporte(id)
+				metas[id] = &ReporteMeta{ID: id, Fecha: t, Legado: true}
+			}
+		}
+	}
+	out := make([]ReporteMeta, 0, len(metas))
+	for _, m := range metas {
+		m.Entrega = estadoEntrega(*m)
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Fecha.Equal(out[j].Fecha) {
+			return out[i].Fecha.After(out[j].Fecha)
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out, nil
+}
+
+func leerReporte(id string) (reporteGuardado, error) {
+	var rg reporteGuardado
+	b, err := os.ReadFile(filepath.Join(reportesDir, id+".json"))
+	if err != nil {
+		return rg, err
+	}
+	return rg, json.Unmarshal(b, &rg)
+}
+
+// estadoEntrega consulta la bandeja de salida. Los entregados se podan de la
+// cola tras outboxRetencion, así que un id ausente se da por entregado.
+func estadoEntrega(m ReporteMeta) string {
+	if m.Legado {
+		return entregaDesconocida
+	}
+	if m.OutboxID == "" {
+		return entregaSinSMTP
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	if msg, ok := outbox[m.OutboxID]; ok {
+		return msg.Estado
+	}
+	return outboxEntregado
+}
+
+//
+// ======== Endpoints /admin/reports ========
+//
+// GET /admin/reports?desde=&hasta=&entrega=&origen=&pagina=1&por_pagina=20
+// GET /admin/reports/{id}?formato=texto|html|json   (o por Accept)
+
+func handleReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	desde, err := parseFecha(q.Get("desde"))
+	if err != nil {
+		http.Error(w, "desde: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	hasta, err := parseHasta(q.Get("hasta"))
+	if err != nil {
+		http.Error(w, "hasta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pagina, porPagina := 1, reportesPorPagina
+	if v := q.Get("pagina"); v != "" {
+		if pagina, err = strconv.Atoi(v); err != nil || pagina < 1 {
+			http.Error(w, "pagina inválida", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("por_pagina"); v != "" {
+		if porPagina, err = strconv.Atoi(v); err != nil || porPagina < 1 || porPagina > reportesPorPaginaMx {
+			http.Error(w, fmt.Sprintf("por_pagina debe estar entre 1 y %d", reportesPorPaginaMx), http.StatusBadRequest)
+			return
+		}
+	}
+
+	todos, err := listarReportes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kbNombre := nombreKB(r)
+	var filtrados []ReporteMeta
+	for _, m := range todos {
+		if !mismaKB(m.KB, kbNombre) {
+			continue
+		}
+		if !desde.IsZero() && m.Fecha.Before(desde) {
+			continue
+		}
+		if !hasta.IsZero() && !m.Fecha.Before(hasta) {
+			continue
+		}
+		if v := q.Get("entrega"); v != "" && m.Entrega != v {
+			continue
+		}
+		if v := q.Get("origen"); v != "" && m.Origen != v {
+			continue
+		}
+		filtrados = append(filtrados, m)
+	}
+	ini := (pagina - 1) * porPagina
+	fin := ini + porPagina
+	if ini > len(filtrados) {
+		ini = len(filtrados)
+	}
+	if fin > len(filtrados) {
+		fin = len(filtrados)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":     len(filtrados),
+		"pagina":    pagina,
+		"porPagina": porPagina,
+		"informes":  append([]ReporteMeta{}, filtrados[ini:fin]...),
+	})
+}
+
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	if !reporteIDRe.MatchString(id) {
+		http.Error(w, "id inválido", http.StatusBadRequest)
+		return
+	}
+	formato := r.URL.Query().Get("formato")
+	if formato == "" {
+		accept := r.Header.Get("Accept")
+		switch {
+		case strings.Contains(accept, "application/json"):
+			formato = "json"
+		case strings.Contains(accept, "text/html"):
+			formato = "html"
+		default:
+			formato = "texto"
+		}
+	}
+	base := filepath.Join(reportesDir, id)
+	rg, err := leerReporte(id)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// sin .json es un informe anterior, de la KB general
+	if !mismaKB(rg.KB, nombreKB(r)) {
+		http.Error(w, "informe no encontrado", http.StatusNotFound)
+		return
+	}
+	switch formato {
+	case "texto", "txt":
+		servirReporte(w, base+".txt", "text/plain; charset=utf-8")
+	case "html":
+		servirReporte(w, base+".html", "text/html; charset=utf-8")
+	case "json":
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(base + ".txt"); err == nil {
+				http.Error(w, "informe anterior sin versión JSON (use formato=texto)", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "informe no encontrado", http.StatusNotFound)
+			return
+		}
+		rg.Entrega = estadoEntrega(rg.ReporteMeta)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rg)
+	default:
+		http.Error(w, "formato debe ser texto, html o json", http.StatusBadRequest)
+	}
+}
+
+func servirReporte(w http.ResponseWriter, path, ctype string) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "informe no encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write(b)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+//
+// ======== RPA: formatos estructurados (JSON, YAML, CSV) ========
+//
+// Todos los formatos describen los mismos registros y terminan en rpaParsed,
+// así que applyParsedToKB y el informe no distinguen el origen.
+//
+// JSON / YAML:
+//
+//	{"enfermedades":[{"nombre":"influenza","tipo":"viral","sistema":"respiratorio",
+//	  "descripcion":"...","consejos":["Reposo","Hidratación abundante"],
+//	  "sintomas":{"fiebre":3,"tos":2},
+//	  "contraindicados":["ibuprofeno"],"trata":["paracetamol","oseltamivir"],
+//	  "icd10":"J11.1","snomed":{"fiebre":"386661006"},"icpc":{"tos":"R05"},"atc":{"paracetamol":"N02BE01"}}]}
+//
+// CSV (una fila por enfermedad, cabecera obligatoria; listas separadas por ';'):
+//
+//	nombre,tipo,sistema,descripcion,consejos,sintomas,contraindicados,trata,icd10,snomed,icpc,atc
+//	influenza,viral,respiratorio,texto,Reposo;Hidratación,fiebre:3;tos:2,ibuprofeno,paracetamol;oseltamivir,J11.1,fiebre=386661006,tos=R05,paracetamol=N02BE01
+//
+// En texto, los códigos de síntomas y medicamentos van como en CSV
+// ("snomed: fiebre=386661006, tos=49727002"); ver codigos.go.
+//
+// Los esquemas publicados están en schemas/ y se sirven en /admin/rpa/schema.
+
+const (
+	rpaFmtTexto = "texto"
+	rpaFmtJSON  = "json"
+	rpaFmtYAML  = "yaml"
+	rpaFmtCSV   = "csv"
+)
+
+//go:embed schemas/rpa.schema.json schemas/rpa.csv.md
+var rpaSchemas embed.FS
+
+// rpaCSVColumnas son las columnas reconocidas; sólo "nombre" es obligatoria.
+var rpaCSVColumnas = []string{"nombre", "tipo", "sistema", "descripcion", "consejos", "sintomas", "contraindicados", "trata", codICD10, codSNOMED, codICPC, codATC}
+
+// parseRPA interpreta el cuerpo según formato ("" = detectar) y devuelve el
+// formato efectivo. El error sólo se devuelve cuando el documento entero es
+// ilegible; los problemas por registro van en Diagnosticos.
+func parseRPA(body []byte, formato string) (rpaParsed, string, error) {
+	if formato == "" {
+		formato = detectRPAFormat(body)
+	}
+	var (
+		p   rpaParsed
+		err error
+	)
+	switch formato {
+	case rpaFmtJSON:
+		p, err = parseRPAJSON(body)
+	case rpaFmtYAML:
+		p, err = parseRPAYAML(body)
+	case rpaFmtCSV:
+		p, err = parseRPACSV(body)
+	case rpaFmtTexto:
+		p = parseRPAFile(string(body))
+	default:
+		return p, formato, fmt.Errorf("formato RPA desconocido: %s", formato)
+	}
+	return p, formato, err
+}
+
+// formatoDesdeContentType traduce el Content-Type; "" si no determina formato.
+func formatoDesdeContentType(ct string) string {
+	mt, _, _ := mime.ParseMediaType(ct)
+	switch mt {
+	case "application/json":
+		return rpaFmtJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return rpaFmtYAML
+	case "text/csv":
+		return rpaFmtCSV
+	}
+	// text/plain se detecta: el panel admin lo usa también para el formato clásico
+	return ""
+}
+
+// detectRPAFormat adivina el formato mirando el contenido.
+func detectRPAFormat(body []byte) string {
+	t := strings.TrimSpace(strings.TrimPrefix(string(body), "\uFEFF"))
+	if strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[") {
+		return rpaFmtJSON
+	}
+	first := t
+	if i := strings.IndexByte(t, '\n'); i >= 0 {
+		first = strings.TrimSpace(t[:i])
+	}
+	// YAML: documento con la clave enfermedades o lista de registros
+	if strings.HasPrefix(first, "enfermedades:") || strings.HasPrefix(first, "- nombre:") ||
+		(first == "---" && strings.Contains(t, "\nenfermedades:")) {
+		return rpaFmtYAML
+	}
+	// CSV: la primera línea es una cabecera con la columna nombre
+	if !strings.Contains(first, ":") && strings.Contains(first, ",") {
+		for _, c := range strings.Split(first, ",") {
+			if strings.ToLower(strings.Trim(strings.TrimSpace(c), `"`)) == "nombre" {
+				return rpaFmtCSV
+			}
+		}
+	}
+	return rpaFmtTexto
+}
+
+// parseRPAJSON valida la sintaxis con encoding/json (para dar línea y columna
+// del fallo) y recorre el documento como YAML, que es un superconjunto de
+// JSON, para conservar la posición de cada clave en los diagnósticos.
+func parseRPAJSON(body []byte) (rpaParsed, error) {
+	var p rpaParsed
+	var probe interface{}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		linea, col := 0, 0
+		if se, ok := err.(*json.SyntaxError); ok {
+			linea, col = lineaColumna(body, int(se.Offset))
+		} else if te, ok := err.(*json.UnmarshalTypeError); ok {
+			linea, col = lineaColumna(body, int(te.Offset))
+		}
+		p.diag(0, linea, col, sevError, "JSON inválido: %v", err)
+		return p, fmt.Errorf("JSON inválido (línea %d, columna %d): %v", linea, col, err)
+	}
+	// fuera de cadenas un tabulador es sólo espacio en JSON, pero YAML no lo admite como sangría
+	return parseRPAYAML(bytes.ReplaceAll(body, []byte("\t"), []byte(" ")))
+}
+
+// lineaColumna convierte un desplazamiento en bytes a línea y columna (desde
+// 1). La columna cuenta caracteres, no bytes: "síntoma" ocupa 7 columnas.
+func lineaColumna(b []byte, off int) (int, int) {
+	if off > len(b) {
+		off = len(b)
+	}
+	linea, col := 1, 1
+	for _, c := range b[:off] {
+		if c == '\n' {
+			linea++
+			col = 1
+		} else if utf8.RuneStart(c) {
+			col++
+		}
+	}
+	return linea, col
+}
+
+// columnaRunas es la columna (desde 1, en caracteres) del byte off de linea.
+func columnaRunas(linea string, off int) int {
+	if off > len(linea) {
+		off = len(linea)
+	}
+	if off < 0 {
+		off = 0
+	}
+	return utf8.RuneCountInString(linea[:off]) + 1
+}
+
+func parseRPAYAML(body []byte) (rpaParsed, error) {
+	var p rpaParsed
+	dec := yaml.NewDecoder(bytes.NewReader(body))
+	bloque := 0
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.diag(0, 0, 0, sevError, "YAML inválido: %v", err)
+			return p, fmt.Errorf("YAML inválido: %v", err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		raiz := doc.Content[0]
+		lista := raiz
+		if raiz.Kind == yaml.MappingNode {
+			lista = nil
+			for i := 0; i+1 < len(raiz.Content); i += 2 {
+				k, v := raiz.Content[i], raiz.Content[i+1]
+				if strings.ToLower(k.Value) == "enfermedades" {
+					lista = v
+				} else {
+					p.diag(0, k.Line, k.Column, sevError, "clave desconocida '%s' (se esperaba 'enfermedades')", k.Value)
+				}
+			}
+			if lista == nil {
+				p.diag(0, raiz.Line, raiz.Column, sevError, "falta la lista 'enfermedades'")
+				continue
+			}
+		}
+		if lista.Kind != yaml.SequenceNode {
+			p.diag(0, lista.Line, lista.Column, sevError, "'enfermedades' debe ser una lista")
+			continue
+		}
+		for _, n := range lista.Content {
+			bloque++
+			p.nodoAEnfermedad(bloque, n)
+		}
+	}
+	return p, nil
+}
+
+// nodoAEnfermedad convierte un registro YAML/JSON en rpaDisease con diagnósticos.
+func (p *rpaParsed) nodoAEnfermedad(bloque int, n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		p.diag(bloque, n.Line, n.Column, sevError, "el registro debe ser un objeto, se descarta")
+		return
+	}
+	d := rpaDisease{Sintomas: map[string]int{}}
+	nombre := ""
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		key := strings.ToLower(strings.TrimSpace(k.Value))
+		if !rpaClaves[key] {
+			p.diag(bloque, k.Line, k.Column, sevError, "clave desconocida '%s'", k.Value)
+			continue
+		}
+		switch key {
+		case "nombre", "tipo", "sistema", "descripcion":
+			if v.Kind != yaml.ScalarNode {
+				p.diag(bloque, v.Line, v.Column, sevError, "'%s' debe ser texto", key)
+				continue
+			}
+			switch key {
+			case "nombre":
+				nombre = v.Value
+			case "tipo":
+				d.Tipo = atomizeOpt(v.Value)
+			case "sistema":
+				d.Sistema = atomizeOpt(v.Value)
+			case "descripcion":
+				d.Descripcion = strings.TrimSpace(v.Value)
+			}
+		case "sintomas":
+			if v.Kind != yaml.MappingNode {
+				p.diag(bloque, v.Line, v.Column, sevError, "'sintomas' debe ser un objeto sintoma: peso")
+				continue
+			}
+			for j := 0; j+1 < len(v.Content); j += 2 {
+				sk, sv := v.Content[j], v.Content[j+1]
+				p.addSintoma(&d, bloque, sk.Line, sk.Column, sk.Value, sv.Value)
+			}
+		case "consejos":
+			switch v.Kind {
+			case yaml.SequenceNode:
+				d.Consejos = nil
+				for _, c := range v.Content {
+					if c.Kind != yaml.ScalarNode || strings.TrimSpace(c.Value) == "" {
+						p.diag(bloque, c.Line, c.Column, sevAviso, "consejo vacío o no textual ignorado")
+						continue
+					}
+					d.Consejos = append(d.Consejos, strings.TrimSpace(c.Value))
+				}
+			case yaml.ScalarNode:
+				d.Consejos = splitConsejos(v.Value)
+			default:
+				p.diag(bloque, v.Line, v.Column, sevError, "'consejos' debe ser una lista de textos")
+			}
+		case "contraindicados", "trata":
+			var meds []string
+			switch v.Kind {
+			case yaml.SequenceNode:
+				for _, m := range v.Content {
+					if strings.TrimSpace(m.Value) == "" {
+						p.diag(bloque, m.Line, m.Column, sevAviso, "medicamento vacío ignorado")
+						continue
+					}
+					meds = append(meds, atomize(m.Value))
+				}
+			case yaml.ScalarNode:
+				meds = parseCSVAtoms(v.Value)
+			default:
+				p.diag(bloque, v.Line, v.Column, sevError, "'%s' debe ser una lista", key)
+				continue
+			}
+			if key == "trata" {
+				d.Trata = meds
+			} else {
+				d.Contra = meds
+			}
+		case codICD10:
+			if v.Kind != yaml.ScalarNode {
+				p.diag(bloque, v.Line, v.Column, sevError, "'icd10' debe ser texto")
+				continue
+			}
+			p.addICD10(&d, bloque, v.Line, v.Column, v.Value)
+		case codSNOMED, codICPC, codATC:
+			switch v.Kind {
+			case yaml.MappingNode:
+				for j := 0; j+1 < len(v.Content); j += 2 {
+					ek, ev := v.Content[j], v.Content[j+1]
+					p.addCodigo(&d, bloque, ek.Line, ek.Column, key, ek.Value, ev.Value)
+				}
+			case yaml.ScalarNode:
+				p.addCodigosTexto(&d, bloque, v.Line, v.Column, key, splitLista(v.Value))
+			default:
+				p.diag(bloque, v.Line, v.Column, sevError, "'%s' debe ser un objeto nombre: código", key)
+			}
+		}
+	}
+	if strings.TrimSpace(nombre) == "" {
+		p.diag(bloque, n.Line, n.Column, sevError, "registro sin 'nombre', se descarta")
+		return
+	}
+	d.Name = atomize(nombre)
+	p.revisarCodigos(bloque, d)
+	p.Items = append(p.Items, d)
+}
+
+func parseRPACSV(body []byte) (rpaParsed, error) {
+	var p rpaParsed
+	body = bytes.TrimPrefix(body, []byte("\uFEFF"))
+	cr := csv.NewReader(bytes.NewReader(body))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	// FieldPos da la columna en bytes; se pasa a caracteres con la línea original
+	lineas := strings.Split(string(body), "\n")
+	pos := func(i int) (int, int) {
+		l, c := cr.FieldPos(i)
+		if l < 1 || l > len(lineas) {
+			return l, c
+		}
+		return l, columnaRunas(lineas[l-1], c-1)
+	}
+
+	cab, err := cr.Read()
+	if err == io.EOF {
+		return p, nil
+	}
+	if err != nil {
+		p.diag(0, 1, 1, sevError, "CSV inválido: %v", err)
+		return p, fmt.Errorf("CSV inválido: %v", err)
+	}
+	idx := map[string]int{}
+	for i, h := range cab {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if !rpaClaves[h] {
+			_, col := pos(i)
+			p.diag(0, 1, col, sevAviso, "columna desconocida '%s' ignorada", h)
+			continue
+		}
+		idx[h] = i
+	}
+	if _, ok := idx["nombre"]; !ok {
+		p.diag(0, 1, 1, sevError, "falta la columna 'nombre'")
+		return p, fmt.Errorf("CSV sin columna 'nombre' (columnas: %s)", strings.Join(rpaCSVColumnas, ","))
+	}
+
+	for bloque := 1; ; bloque++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			linea := 0
+			if pe, ok := err.(*csv.ParseError); ok {
+				linea = pe.Line
+			}
+			p.diag(bloque, linea, 0, sevError, "CSV inválido: %v", err)
+			return p, fmt.Errorf("CSV inválido: %v", err)
+		}
+		// col devuelve la celda y su posición
+		col := func(name string) (string, int, int) {
+			i, ok := idx[name]
+			if !ok || i >= len(row) {
+				return "", 0, 0
+			}
+			l, c := pos(i)
+			return strings.TrimSpace(row[i]), l, c
+		}
+		nombre, linea, c := col("nombre")
+		if nombre == "" {
+			if linea == 0 {
+				linea, _ = cr.FieldPos(0)
+			}
+			p.diag(bloque, linea, c, sevError, "fila sin 'nombre', se descarta")
+			continue
+		}
+		d := rpaDisease{Name: atomize(nombre), Sintomas: map[string]int{}}
+		v, _, _ := col("tipo")
+		d.Tipo = atomizeOpt(v)
+		v, _, _ = col("sistema")
+		d.Sistema = atomizeOpt(v)
+		d.Descripcion, _, _ = col("descripcion")
+		v, _, _ = col("consejos")
+		d.Consejos = splitConsejos(v)
+
+		v, l, c := col("sintomas")
+		for _, part := range splitLista(v) {
+			s, w := part, ""
+			if i := strings.Index(part, ":"); i >= 0 {
+				s, w = part[:i], part[i+1:]
+			}
+			p.addSintoma(&d, bloque, l, c, s, w)
+		}
+		v, _, _ = col("contraindicados")
+		for _, m := range splitLista(v) {
+			d.Contra = append(d.Contra, atomize(m))
+		}
+		v, _, _ = col("trata")
+		for _, m := range splitLista(v) {
+			d.Trata = append(d.Trata, atomize(m))
+		}
+		if v, l, c := col(codICD10); v != "" {
+			p.addICD10(&d, bloque, l, c, v)
+		}
+		for _, sis := range []string{codSNOMED, codICPC, codATC} {
+			v, l, c := col(sis)
+			p.addCodigosTexto(&d, bloque, l, c, sis, splitLista(v))
+		}
+		p.revisarCodigos(bloque, d)
+		p.Items = append(p.Items, d)
+	}
+	return p, nil
+}
+
+// atomizeOpt es atomize salvo que un campo vacío sigue vacío (como en el formato texto).
+func atomizeOpt(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	return atomize(s)
+}
+
+// splitLista separa una celda por ';' (o ',' si la celda venía entrecomillada).
+func splitLista(s string) []string {
+	var out []string
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == ',' }) {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+//
+// ======== Endpoint /admin/rpa/schema ========
+//
+// GET /admin/rpa/schema?formato=json|yaml|csv
+
+func handleRPASchema(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("formato") {
+	case "", rpaFmtJSON, rpaFmtYAML:
+		// YAML usa el mismo esquema que JSON
+		b, _ := rpaSchemas.ReadFile("schemas/rpa.schema.json")
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(b)
+	case rpaFmtCSV:
+		b, _ := rpaSchemas.ReadFile("schemas/rpa.csv.md")
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write(b)
+	default:
+		http.Error(w, "formato debe ser json, yaml o csv", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnosticoNoCitaLineas(t *testing.T) {
+	p := parseRPAFile("nombre: gripe\nsecreto-de-firma-0123456789\n")
+	if len(p.Diagnosticos) != 1 {
+		t.Fatalf("diagnósticos: %+v", p.Diagnosticos)
+	}
+	if d := p.Diagnosticos[0]; strings.Contains(d.Mensaje, "secreto") {
+		t.Errorf("el diagnóstico repite la línea: %q", d.Mensaje)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+//
+// ======== RPA: informe de cambios ========
+//
+// El informe se construye comparando la KB antes y después de aplicar el
+// archivo, no a partir de lo parseado: así distingue una enfermedad nueva de
+// una reimportación idéntica y muestra los pesos que applyParsedToKB quitó al
+// reemplazar las características de una enfermedad existente.
+
+type rpaCreada struct {
+	Disease
+	Trata []string `json:"trata,omitempty"`
+}
+
+type rpaInforme struct {
+	Fecha        time.Time          `json:"fecha"`
+	Formato      string             `json:"formato"`
+	Origen       string             `json:"origen,omitempty"` // rpa | rpa_bandeja | rpa_job
+	Autor        string             `json:"autor,omitempty"`
+	KB           string             `json:"kb,omitempty"`
+	Borrador     string             `json:"borrador,omitempty"` // aplicado a un borrador, no en vivo
+	Leidos       int                `json:"leidos"`
+	Creadas      []rpaCreada        `json:"creadas"`
+	Modificadas  []EnfermedadCambio `json:"modificadas"`
+	SinCambios   []string           `json:"sinCambios"`
+	Diff         KBDiff             `json:"diff"`
+	Diagnosticos []rpaDiag          `json:"diagnosticos"`
+}
+
+func buildRPAReport(formato string, p rpaParsed, antes, despues Knowledge) rpaInforme {
+	d := diffKB(antes, despues)
+	inf := rpaInforme{
+		Fecha:        time.Now(),
+		Formato:      formato,
+		Leidos:       len(p.Items),
+		Modificadas:  d.EnfermedadesModificadas,
+		Diff:         d,
+		Diagnosticos: p.Diagnosticos,
+	}
+
+	idx := diseaseIndex(despues)
+	for _, name := range d.EnfermedadesNuevas {
+		c := rpaCreada{Disease: idx[name]}
+		for _, v := range d.TratamientosNuevos {
+			if v.Valor == name {
+				c.Trata = append(c.Trata, v.Med)
+			}
+		}
+		inf.Creadas = append(inf.Creadas, c)
+	}
+	// "sin cambios" sólo para lo que venía en el archivo, no para toda la KB
+	leidas := map[string]bool{}
+	for _, it := range p.Items {
+		leidas[it.Name] = true
+	}
+	for _, name := range d.EnfermedadesSinCambios {
+		if leidas[name] {
+			inf.SinCambios = append(inf.SinCambios, name)
+		}
+	}
+	return inf
+}
+
+// Texto es la variante en texto plano (respuesta, correo y copia .txt).
+func (inf rpaInforme) Texto() string {
+	var b strings.Builder
+	b.WriteString("MediLogic RPA – Informe de cambios\n")
+	b.WriteString("Fecha: " + inf.Fecha.Format("2006-01-02 15:04:05") + "\n")
+	b.WriteString(fmt.Sprintf("Formato: %s – registros leídos: %d\n", inf.Formato, inf.Leidos))
+	if inf.KB != "" && inf.KB != kbGeneral {
+		b.WriteString("KB: " + inf.KB + "\n")
+	}
+	if inf.Borrador != "" {
+		b.WriteString("Borrador: " + inf.Borrador + " (sin publicar)\n")
+	}
+	b.WriteString("\n")
+
+	b.WriteString(fmt.Sprintf("Creadas (%d)\n", len(inf.Creadas)))
+	for _, c := range inf.Creadas {
+		b.WriteString(fmt.Sprintf("- %s (tipo=%s, sistema=%s)\n", atomize(c.Name), c.Tipo, c.Sistema))
+		b.WriteString("    Síntomas: " + formatCaracts(c.Caracteristicas) + "\n")
+		if len(c.Trata) > 0 {
+			b.WriteString("    Trata: " + strings.Join(c.Trata, ", ") + "\n")
+		}
+	}
+	b.WriteString(fmt.Sprintf("\nModificadas (%d)\n", len(inf.Modificadas)))
+	for _, m := range inf.Modificadas {
+		b.WriteString("- " + m.Nombre + "\n")
+		for _, f := range m.Campos {
+			b.WriteString(fmt.Sprintf("    %s: %q → %q\n", f.Campo, f.Antes, f.Despues))
+		}
+		for _, p := range m.Pesos {
+			b.WriteString(fmt.Sprintf("    %s: %s → %s%s\n", p.Sintoma, formatPeso(p.Antes), formatPeso(p.Despues), notaPeso(p)))
+		}
+	}
+	b.WriteString(fmt.Sprintf("\nSin cambios (%d)\n", len(inf.SinCambios)))
+	for _, n := range inf.SinCambios {
+		b.WriteString("- " + n + "\n")
+	}
+
+	b.WriteString("\n")
+	b.WriteString("Síntomas nuevos: " + listaONinguno(inf.Diff.SintomasNuevos) + "\n")
+	b.WriteString("Medicamentos nuevos: " + listaONinguno(inf.Diff.MedicamentosNuevos) + "\n")
+	if len(inf.Diff.TratamientosNuevos) > 0 {
+		b.WriteString("Tratamientos nuevos: " + formatVinculos(inf.Diff.TratamientosNuevos) + "\n")
+	}
+	if len(inf.Diff.AlergiasNuevas) > 0 {
+		b.WriteString("Contraindicaciones nuevas: " + formatVinculos(inf.Diff.AlergiasNuevas) + "\n")
+	}
+	if len(inf.Diagnosticos) > 0 {
+		b.WriteString("\n" + formatDiagnosticos(inf.Diagnosticos))
+	}
+	return b.String()
+}
+
+func formatCaracts(cs []Caract) string {
+	var ss []string
+	for _, c := range cs {
+		ss = append(ss, fmt.Sprintf("%s:%d", atomize(c.Symptom), clamp(c.Peso, 1, 3)))
+	}
+	return listaONinguno(ss)
+}
+
+func notaPeso(p PesoCambio) string {
+	switch {
+	case p.Antes == 0:
+		return " (nuevo)"
+	case p.Despues == 0:
+		return " (eliminado)"
+	}
+	return ""
+}
+
+func listaONinguno(xs []string) string {
+	if len(xs) == 0 {
+		return "(ninguno)"
+	}
+	return strings.Join(xs, ", ")
+}
+
+var rpaInformeHTML = template.Must(template.New("informe").Funcs(template.FuncMap{
+	"atom":     atomize,
+	"caracts":  formatCaracts,
+	"peso":     formatPeso,
+	"nota":     notaPeso,
+	"lista":    listaONinguno,
+	"vinculos": formatVinculos,
+}).Parse(`<!doctype html>
+<html lang="es"><head><meta charset="utf-8"><title>MediLogic RPA – Informe de cambios</title>
+<style>
+body{font-family:system-ui,sans-serif;color:#111827;max-width:760px;margin:16px auto}
+table{border-collapse:collapse;width:100%;margin:6px 0 14px}
+th,td{border:1px solid #e5e7eb;padding:6px;text-align:left;font-size:14px}
+.muted{color:#6b7280}.add{color:#047857}.del{color:#b91c1c}
+</style></head><body>
+<h2>MediLogic RPA – Informe de cambios</h2>
+<p class="muted">Fecha: {{.Fecha.Format "2006-01-02 15:04:05"}} · Formato: {{.Formato}} · Registros leídos: {{.Leidos}}{{if and .KB (ne .KB "general")}} · KB: {{.KB}}{{end}}{{if .Borrador}} · Borrador: {{.Borrador}} (sin publicar){{end}}</p>
+
+<h3>Creadas ({{len .Creadas}})</h3>
+{{if .Creadas}}<table><tr><th>Enfermedad</th><th>Tipo</th><th>Sistema</th><th>Síntomas</th><th>Trata</th></tr>
+{{range .Creadas}}<tr><td>{{atom .Name}}</td><td>{{.Tipo}}</td><td>{{.Sistema}}</td><td>{{caracts .Caracteristicas}}</td><td>{{lista .Trata}}</td></tr>
+{{end}}</table>{{end}}
+
+<h3>Modificadas ({{len .Modificadas}})</h3>
+{{if .Modificadas}}<table><tr><th>Enfermedad</th><th>Cambio</th><th>Antes</th><th>Después</th></tr>
+{{range $m := .Modificadas}}{{range .Campos}}<tr><td>{{$m.Nombre}}</td><td>{{.Campo}}</td><td>{{.Antes}}</td><td>{{.Despues}}</td></tr>
+{{end}}{{range .Pesos}}<tr><td>{{$m.Nombre}}</td><td>{{.Sintoma}}{{nota .}}</td><td>{{peso .Antes}}</td><td>{{peso .Despues}}</td></tr>
+{{end}}{{end}}</table>{{end}}
+
+<h3>Sin cambios ({{len .SinCambios}})</h3>
+<p>{{lista .SinCambios}}</p>
+
+<h3>Nuevos elementos</h3>
+<ul>
+<li>Síntomas nuevos: <span class="add">{{lista .Diff.SintomasNuevos}}</span></li>
+<li>Medicamentos nuevos: <span class="add">{{lista .Diff.MedicamentosNuevos}}</span></li>
+{{if .Diff.TratamientosNuevos}}<li>Tratamientos nuevos: {{vinculos .Diff.TratamientosNuevos}}</li>{{end}}
+{{if .Diff.AlergiasNuevas}}<li>Contraindicaciones nuevas: {{vinculos .Diff.AlergiasNuevas}}</li>{{end}}
+</ul>
+
+{{if .Diagnosticos}}<h3>Diagnósticos ({{len .Diagnosticos}})</h3>
+<table><tr><th>Bloque</th><th>Línea</th><th>Severidad</th><th>Mensaje</th></tr>
+{{range .Diagnosticos}}<tr><td>{{.Bloque}}</td><td>{{.Linea}}:{{.Columna}}</td><td class="{{if eq .Severidad "error"}}del{{end}}">{{.Severidad}}</td><td>{{.Mensaje}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`))
+
+// HTML es la variante para correo y para el navegador.
+func (inf rpaInforme) HTML() string {
+	var b bytes.Buffer
+	if err := rpaInformeHTML.Execute(&b, inf); err != nil {
+		return "<pre>" + template.HTMLEscapeString(inf.Texto()) + "</pre>"
+	}
+	return b.String()
+}
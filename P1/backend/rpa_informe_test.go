@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+const rpaReimport = `nombre: gastritis
+tipo: cronica
+sistema: digestivo
+sintomas: dolor_abdominal:3, nausea:2, acidez:3, fatiga:1, fiebre:1
+contraindicados: ibuprofeno, aspirina
+trata: omeprazol
+`
+
+func TestReimportarMismaVersion(t *testing.T) {
+	p := parseRPAFile(rpaReimport)
+	if len(p.Items) != 1 {
+		t.Fatalf("items: %+v, diagnósticos: %+v", p.Items, p.Diagnosticos)
+	}
+
+	k := defaultKB()
+	applyParsedToKB(&k, p)
+	primera := versionOf(buildPL(k))
+	contras := len(k.ContraAlergias)
+
+	antes := cloneKB(k)
+	applyParsedToKB(&k, p)
+	if v := versionOf(buildPL(k)); v != primera {
+		t.Errorf("la segunda importación cambia la versión: %s -> %s", primera, v)
+	}
+	if len(k.ContraAlergias) != contras {
+		t.Errorf("contraindicaciones duplicadas: %d -> %d", contras, len(k.ContraAlergias))
+	}
+	inf := buildRPAReport(rpaFmtTexto, p, antes, k)
+	if len(inf.Creadas) != 0 || len(inf.Modificadas) != 0 || len(inf.SinCambios) != 1 {
+		t.Errorf("informe de la reimportación: creadas %v, modificadas %v, sin cambios %v", inf.Creadas, inf.Modificadas, inf.SinCambios)
+	}
+
+	// el orden del mapa de síntomas no debe influir en el programa
+	for i := 0; i < 10; i++ {
+		k := defaultKB()
+		applyParsedToKB(&k, p)
+		if v := versionOf(buildPL(k)); v != primera {
+			t.Fatalf("importación %d sobre la KB por defecto: versión %s, se esperaba %s", i, v, primera)
+		}
+	}
+}
+
+func TestReimportarConservaMetadatos(t *testing.T) {
+	k := defaultKB()
+	applyParsedToKB(&k, parseRPAFile(rpaReimport+"descripcion: Inflamación del estómago\nconsejos: Comidas pequeñas; Evitar el alcohol\nicd10: K29.7\n"))
+	// el segundo bloque sólo trae los síntomas
+	applyParsedToKB(&k, parseRPAFile("nombre: gastritis\nsintomas: acidez:3\n"))
+
+	d := k.Diseases[indiceEnfermedad(&k, "gastritis")]
+	if d.Tipo != "cronica" || d.Sistema != "digestivo" || d.Descripcion != "Inflamación del estómago" || d.ICD10 != "K29.7" {
+		t.Errorf("se perdieron datos de la enfermedad: %+v", d)
+	}
+	if len(d.Consejos) != 2 || d.Consejos[1] != "Evitar el alcohol" {
+		t.Errorf("consejos: %q", d.Consejos)
+	}
+	if len(d.Caracteristicas) != 1 || d.Caracteristicas[0] != (Caract{Symptom: "acidez", Peso: 3}) {
+		t.Errorf("las características no se reemplazaron: %+v", d.Caracteristicas)
+	}
+
+	applyParsedToKB(&k, parseRPAFile("nombre: gastritis\ntipo: viral\nconsejos: Dieta blanda\n"))
+	d = k.Diseases[indiceEnfermedad(&k, "gastritis")]
+	if d.Tipo != "viral" || d.Sistema != "digestivo" || len(d.Consejos) != 1 || d.Consejos[0] != "Dieta blanda" {
+		t.Errorf("los campos presentes no reemplazaron a los anteriores: %+v", d)
+	}
+}
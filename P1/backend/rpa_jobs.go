@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// ======== RPA: trabajos programados ========
+//
+// Un trabajo descarga un archivo RPA de una URL http(s) o lo lee de una ruta
+// local según una expresión cron y lo pasa por el mismo pipeline que
+// POST /admin/rpa/ingest, aplicándolo o sólo como vista previa (dry run).
+// Los trabajos se guardan en storage/rpa_jobs.json y cada ejecución en
+// storage/rpa_runs.jsonl con su estado e informe.
+//
+//   GET    /admin/rpa/jobs             lista (con próxima ejecución y la última)
+//   POST   /admin/rpa/jobs             crea o reemplaza un trabajo (por id)
+//   DELETE /admin/rpa/jobs?id=...      elimina un trabajo
+//   POST   /admin/rpa/jobs/run?id=...  ejecuta ahora
+//   GET    /admin/rpa/jobs/runs?id=...&limite=50  historial (más reciente primero)
+//
+// Cada trabajo aplica sobre la KB desde la que se creó (ver bases.go) y sólo
+// se ve desde ella; los ids son únicos entre todas las KB.
+//
+// Orígenes permitidos (variables de entorno):
+//   RPA_JOBS_DIR               carpeta de los orígenes locales; el origen es una
+//                              ruta relativa a ella. Vacío: sólo URLs
+//   RPA_JOBS_REDES_PERMITIDAS  redes (CIDR o IP, separadas por comas) a las que
+//                              se puede conectar aunque sean locales o privadas
+//
+// Un origen local no puede salir de RPA_JOBS_DIR (ni con .. ni con enlaces
+// simbólicos) ni caer dentro de storage/, donde están los secretos. Una URL
+// no puede llevar a loopback, enlace local, redes privadas o compartidas ni
+// a direcciones sin especificar, salvo que estén en RPA_JOBS_REDES_PERMITIDAS.
+// La IP se comprueba al conectar, así que vale también para redirecciones y
+// para nombres que resuelven a una red interna.
+// Los webhooks (webhooks.go) usan la misma comprobación.
+
+var (
+	rpaJobsPath = filepath.Join("storage", "rpa_jobs.json")
+	rpaRunsPath = filepath.Join("storage", "rpa_runs.jsonl")
+)
+
+const (
+	rpaModoAplicar = "aplicar"
+	rpaModoDryRun  = "dry_run"
+
+	rpaFuenteTimeout = 30 * time.Second
+	rpaFuenteMax     = 10 << 20
+)
+
+var (
+	rpaJobsDir         string         // RPA_JOBS_DIR; vacío: sin orígenes locales
+	rpaRedesPermitidas []netip.Prefix // RPA_JOBS_REDES_PERMITIDAS
+
+	// redes que, además de las de netip (loopback, privadas...), no se alcanzan
+	rpaRedesVetadas = []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/10"), // NAT de operador
+		netip.MustParsePrefix("0.0.0.0/8"),
+	}
+
+	clienteOrigen = &http.Client{
+		Timeout: rpaFuenteTimeout,
+		Transport: &http.Transport{
+			// sin proxy: la comprobación de destino tiene que ver la IP real;
+			// sin keep-alive: las descargas son esporádicas y cada una conecta de nuevo
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: controlDestino}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   true,
+		},
+	}
+)
+
+type RPAJob struct {
+	ID       string `json:"id"`
+	KB       string `json:"kb,omitempty"` // vacío: la general
+	Cron     string `json:"cron"`
+	Origen   string `json:"origen"`            // URL http(s) o ruta de archivo
+	Formato  string `json:"formato,omitempty"` // vacío = Content-Type/extensión/contenido
+	Modo     string `json:"modo"`              // aplicar | dry_run
+	Estricto bool   `json:"estricto,omitempty"`
+	Activo   bool   `json:"activo"`
+}
+
+type RPARun struct {
+	ID           string    `json:"id"`
+	Job          string    `json:"job"`
+	KB           string    `json:"kb,omitempty"`
+	Disparo      string    `json:"disparo"` // cron | manual
+	Inicio       time.Time `json:"inicio"`
+	Fin          time.Time `json:"fin"`
+	Estado       string    `json:"estado"` // aplicado | dry_run | fallido
+	Modo         string    `json:"modo"`
+	Formato      string    `json:"formato,omitempty"`
+	Enfermedades int       `json:"enfermedades"`
+	Errores      int       `json:"errores"`
+	Diagnosticos []rpaDiag `json:"diagnosticos,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Informe      string    `json:"informe,omitempty"`
+	Diff         *KBDiff   `json:"diff,omitempty"` // sólo dry_run
+}
+
+// rpaJobVista es un trabajo en GET /admin/rpa/jobs.
+type rpaJobVista struct {
+	RPAJob
+	Proxima *time.Time `json:"proxima,omitempty"`
+	Ultima  *RPARun    `json:"ultima,omitempty"`
+}
+
+var (
+	jobsMu      sync.Mutex
+	rpaJobs     = map[string]RPAJob{}
+	jobsEnCurso = map[string]bool{}
+	runsMu      sync.Mutex
+)
+
+func (j *RPAJob) validar() error {
+	j.ID = strings.TrimSpace(j.ID)
+	if j.ID == "" {
+		return fmt.Errorf("id requerido")
+	}
+	if strings.ContainsAny(j.ID, "/?&# ") {
+		return fmt.Errorf("id %q: no use espacios ni /?&#", j.ID)
+	}
+	if _, err := parseCron(j.Cron); err != nil {
+		return err
+	}
+	if strings.TrimSpace(j.Origen) == "" {
+		return fmt.Errorf("origen requerido (URL o ruta)")
+	}
+	if esURL(j.Origen) {
+		u, err := url.Parse(j.Origen)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("origen: URL inválida")
+		}
+	} else if err := origenLocalValido(j.Origen); err != nil {
+		return err
+	}
+	switch j.Formato {
+	case "", rpaFmtTexto, rpaFmtJSON, rpaFmtYAML, rpaFmtCSV:
+	default:
+		return fmt.Errorf("formato desconocido %q", j.Formato)
+	}
+	switch j.Modo {
+	case "":
+		j.Modo = rpaModoDryRun
+	case rpaModoAplicar, rpaModoDryRun:
+	default:
+		return fmt.Errorf("modo debe ser %q o %q", rpaModoAplicar, rpaModoDryRun)
+	}
+	return nil
+}
+
+func loadRPAJobs() {
+	b, err := os.ReadFile(rpaJobsPath)
+	if err != nil {
+		return
+	}
+	var js []RPAJob
+	if err := json.Unmarshal(b, &js); err != nil {
+		logp("rpa_jobs.json inválido: %v", err)
+		return
+	}
+	for _, j := range js {
+		if err := j.validar(); err != nil {
+			logp("trabajo RPA %q ignorado: %v", j.ID, err)
+			continue
+		}
+		rpaJobs[j.ID] = j
+	}
+}
+
+// guardarRPAJobs debe llamarse con jobsMu tomado.
+func guardarRPAJobs() error {
+	js := make([]RPAJob, 0, len(rpaJobs))
+	for _, id := range sortedKeys(rpaJobs) {
+		js = append(js, rpaJobs[id])
+	}
+	b, _ := json.MarshalIndent(js, "", "  ")
+	tmp := rpaJobsPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rpaJobsPath)
+}
+
+// initRedesPermitidas lee RPA_JOBS_REDES_PERMITIDAS, que valen para los
+// trabajos RPA y para los webhooks; va antes de initWebhooks.
+func initRedesPermitidas() {
+	redes, err := parseRedes(os.Getenv("RPA_JOBS_REDES_PERMITIDAS"))
+	if err != nil {
+		log.Fatalf("RPA_JOBS_REDES_PERMITIDAS: %v", err)
+	}
+	rpaRedesPermitidas = redes
+}
+
+// initRPAJobs carga los trabajos y revisa las expresiones al inicio de cada minuto.
+func initRPAJobs() {
+	rpaJobsDir = os.Getenv("RPA_JOBS_DIR")
+	loadRPAJobs()
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			tick := time.Now()
+			jobsMu.Lock()
+			var due []RPAJob
+			for _, j := range rpaJobs {
+				if c, err := parseCron(j.Cron); err == nil && j.Activo && c.coincide(tick) {
+					due = append(due, j)
+				}
+			}
+			jobsMu.Unlock()
+			for _, j := range due {
+				go ejecutarJob(j, "cron")
+			}
+		}
+	}()
+	if len(rpaJobs) > 0 {
+		logp("Trabajos RPA programados: %d", len(rpaJobs))
+	}
+}
+
+// ejecutarJob corre el trabajo y guarda la ejecución. Si el mismo trabajo ya
+// está en curso no se lanza otra vez y se devuelve un error.
+func ejecutarJob(j RPAJob, disparo string) (RPARun, error) {
+	jobsMu.Lock()
+	if jobsEnCurso[j.ID] {
+		jobsMu.Unlock()
+		return RPARun{}, fmt.Errorf("el trabajo %q ya está en ejecución", j.ID)
+	}
+	jobsEnCurso[j.ID] = true
+	jobsMu.Unlock()
+	defer func() {
+		jobsMu.Lock()
+		delete(jobsEnCurso, j.ID)
+		jobsMu.Unlock()
+	}()
+
+	run := RPARun{ID: nuevoID(), Job: j.ID, KB: j.KB, Disparo: disparo, Inicio: time.Now().UTC(), Modo: j.Modo}
+	run.Error = correrJob(j, &run)
+	run.Fin = time.Now().UTC()
+	switch {
+	case run.Error != "":
+		run.Estado = "fallido"
+		logp("trabajo RPA %s fallido: %s", j.ID, run.Error)
+	case j.Modo == rpaModoDryRun:
+		run.Estado = rpaModoDryRun
+	default:
+		run.Estado = "aplicado"
+	}
+	if err := appendRPARun(run); err != nil {
+		logp("trabajo RPA %s: no se pudo guardar la ejecución: %v", j.ID, err)
+	}
+	return run, nil
+}
+
+// correrJob completa run y devuelve el error como texto (vacío si fue bien).
+func correrJob(j RPAJob, run *RPARun) string {
+	body, ctype, err := leerOrigen(j.Origen)
+	if err != nil {
+		return err.Error()
+	}
+	formato := j.Formato
+	if formato == "" {
+		formato = formatoDesdeContentType(ctype)
+	}
+	if formato == "" {
+		formato = inboxExts[strings.ToLower(filepath.Ext(strings.SplitN(j.Origen, "?", 2)[0]))]
+	}
+	parsed, formato, err := parseRPA(body, formato)
+	run.Formato = formato
+	run.Enfermedades = len(parsed.Items)
+	run.Errores = parsed.errores()
+	run.Diagnosticos = parsed.Diagnosticos
+	if err != nil {
+		return err.Error()
+	}
+	if j.Estricto && parsed.errores() > 0 {
+		return fmt.Sprintf("%d errores de validación, no se aplicó nada", parsed.errores())
+	}
+
+	kbNombre := j.KB
+	if kbNombre == "" {
+		kbNombre = kbGeneral
+	}
+	if j.Modo == rpaModoDryRun {
+		mu.Lock()
+		base, err := buscarBase(kbNombre)
+		var antes Knowledge
+		if err == nil {
+			antes = cloneKB(base.kb)
+		}
+		mu.Unlock()
+		if err != nil {
+			return err.Error()
+		}
+		prev := previewRPA(formato, parsed, antes)
+		run.Diff = &prev.Diff
+		run.Informe = prev.Texto()
+		if !prev.Compila {
+			return prev.Error
+		}
+		return ""
+	}
+	inf, err := aplicarRPA(formato, parsed, escritura{Origen: "rpa_job", Autor: "job:" + j.ID, KB: kbNombre})
+	if err != nil {
+		return err.Error()
+	}
+	run.Informe = inf.Texto()
+	return ""
+}
+
+// leerOrigen devuelve el contenido y, para URLs, el Content-Type.
+func leerOrigen(origen string) ([]byte, string, error) {
+	if !esURL(origen) {
+		ruta, err := rutaLocal(origen)
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := os.Open(ruta)
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		b, err := leerLimitado(f)
+		return b, "", err
+	}
+	resp, err := clienteOrigen.Get(origen)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, "", fmt.Errorf("origen respondió %s", resp.Status)
+	}
+	b, err := leerLimitado(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+func leerLimitado(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, rpaFuenteMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > rpaFuenteMax {
+		return nil, fmt.Errorf("origen excede %d bytes", rpaFuenteMax)
+	}
+	return b, nil
+}
+
+func esURL(origen string) bool {
+	return strings.HasPrefix(origen, "http://") || strings.HasPrefix(origen, "https://")
+}
+
+// origenLocalValido comprueba la forma de una ruta local al crear el trabajo;
+// rutaLocal la resuelve (enlaces incluidos) en cada ejecución.
+func origenLocalValido(origen string) error {
+	if rpaJobsDir == "" {
+		return fmt.Errorf("origen: sólo se admiten URLs http(s); para archivos locales defina RPA_JOBS_DIR")
+	}
+	if filepath.IsAbs(origen) {
+		return fmt.Errorf("origen: la ruta debe ser relativa a RPA_JOBS_DIR")
+	}
+	for _, p := range strings.Split(filepath.ToSlash(origen), "/") {
+		if p == ".." {
+			return fmt.Errorf("origen: la ruta no puede contener '..'")
+		}
+	}
+	return nil
+}
+
+// rutaLocal resuelve el origen dentro de RPA_JOBS_DIR y rechaza lo que, tras
+// seguir los enlaces, quede fuera de la carpeta o dentro de storage/.
+func rutaLocal(origen string) (string, error) {
+	if err := origenLocalValido(origen); err != nil {
+		return "", err
+	}
+	base, err := resolverRuta(rpaJobsDir)
+	if err != nil {
+		return "", fmt.Errorf("RPA_JOBS_DIR: %v", err)
+	}
+	ruta, err := resolverRuta(filepath.Join(base, origen))
+	if err != nil {
+		return "", fmt.Errorf("origen: %v", err)
+	}
+	if !dentroDe(base, ruta) {
+		return "", fmt.Errorf("origen: la ruta sale de RPA_JOBS_DIR")
+	}
+	if st, err := resolverRuta("storage"); err == nil && (dentroDe(st, ruta) || ruta == st) {
+		return "", fmt.Errorf("origen: no se puede leer de storage/")
+	}
+	return ruta, nil
+}
+
+func resolverRuta(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// dentroDe indica si p está bajo dir (ambas rutas absolutas y resueltas).
+func dentroDe(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// parseRedes lee una lista de CIDR o IP sueltas separadas por comas.
+func parseRedes(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			a, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// destinoPermitido dice si un trabajo o un webhook puede conectarse a la IP a.
+func destinoPermitido(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range rpaRedesPermitidas {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	if a.IsLoopback() || a.IsPrivate() || a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() ||
+		a.IsInterfaceLocalMulticast() || a.IsMulticast() || a.IsUnspecified() {
+		return false
+	}
+	for _, p := range rpaRedesVetadas {
+		if p.Contains(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// controlDestino corre con la IP ya resuelta, antes de cada conexión.
+func controlDestino(_, direccion string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(direccion)
+	if err != nil {
+		return err
+	}
+	if !destinoPermitido(ap.Addr()) {
+		return fmt.Errorf("destino %s no permitido (red local o privada; ver RPA_JOBS_REDES_PERMITIDAS)", ap.Addr())
+	}
+	return nil
+}
+
+func appendRPARun(run RPARun) error {
+	b, _ := json.Marshal(run)
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	f, err := os.OpenFile(rpaRunsPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// leerRPARuns devuelve las ejecuciones del trabajo (todas las de la KB si job
+// es ""), la más reciente primero.
+func leerRPARuns(kbNombre, job string, limite int) ([]RPARun, error) {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	f, err := os.Open(rpaRunsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []RPARun
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var run RPARun
+		if err := json.Unmarshal(sc.Bytes(), &run); err != nil {
+			continue
+		}
+		if mismaKB(run.KB, kbNombre) && (job == "" || run.Job == job) {
+			out = append(out, run)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Inicio.After(out[j].Inicio) })
+	if limite > 0 && len(out) > limite {
+		out = out[:limite]
+	}
+	return out, sc.Err()
+}
+
+//
+// ======== Endpoints /admin/rpa/jobs ========
+//
+
+func handleRPAJobs(w http.ResponseWriter, r *http.Request) {
+	kbNombre := nombreKB(r)
+	switch r.Method {
+	case http.MethodGet:
+		runs, err := leerRPARuns(kbNombre, "", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ultima := map[string]*RPARun{}
+		for i := range runs {
+			if ultima[runs[i].Job] == nil {
+				ultima[runs[i].Job] = &runs[i]
+			}
+		}
+		jobsMu.Lock()
+		out := []rpaJobVista{}
+		for _, id := range sortedKeys(rpaJobs) {
+			if !mismaKB(rpaJobs[id].KB, kbNombre) {
+				continue
+			}
+			v := rpaJobVista{RPAJob: rpaJobs[id], Ultima: ultima[id]}
+			if c, err := parseCron(v.Cron); err == nil && v.Activo {
+				if t := c.siguiente(time.Now()); !t.IsZero() {
+					v.Proxima = &t
+				}
+			}
+			out = append(out, v)
+		}
+		jobsMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var j RPAJob
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		if err := j.validar(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j.KB = kbNombre
+		jobsMu.Lock()
+		prev, existia := rpaJobs[j.ID]
+		if existia && !mismaKB(prev.KB, kbNombre) {
+			jobsMu.Unlock()
+			http.Error(w, "ya existe un trabajo con ese id en otra KB", http.StatusConflict)
+			return
+		}
+		rpaJobs[j.ID] = j
+		err := guardarRPAJobs()
+		jobsMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !existia {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(j)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		jobsMu.Lock()
+		j, ok := rpaJobs[id]
+		ok = ok && mismaKB(j.KB, kbNombre)
+		var err error
+		if ok {
+			delete(rpaJobs, id)
+			err = guardarRPAJobs()
+		}
+		jobsMu.Unlock()
+		if !ok {
+			http.Error(w, "trabajo no encontrado", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /admin/rpa/jobs/run?id=... ejecuta el trabajo y espera el resultado.
+func handleRPAJobRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+	jobsMu.Lock()
+	j, ok := rpaJobs[r.URL.Query().Get("id")]
+	jobsMu.Unlock()
+	if !ok || !mismaKB(j.KB, nombreKB(r)) {
+		http.Error(w, "trabajo no encontrado", http.StatusNotFound)
+		return
+	}
+	run, err := ejecutarJob(j, "manual")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(run)
+}
+
+// GET /admin/rpa/jobs/runs?id=...&limite=50
+func handleRPAJobRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	limite := 50
+	if v := r.URL.Query().Get("limite"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "limite inválido", http.StatusBadRequest)
+			return
+		}
+		limite = n
+	}
+	runs, err := leerRPARuns(nombreKB(r), r.URL.Query().Get("id"), limite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []RPARun{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"total": len(runs), "ejecuciones": runs})
+}
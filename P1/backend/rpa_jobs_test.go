@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conRedes permite conectar a las redes dadas durante el test.
+func conRedes(t *testing.T, redes string) {
+	t.Helper()
+	prev := rpaRedesPermitidas
+	r, err := parseRedes(redes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpaRedesPermitidas = r
+	t.Cleanup(func() { rpaRedesPermitidas = prev })
+}
+
+func TestLeerOrigenHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hoja.yaml":
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write([]byte("enfermedades:\n  - nombre: gripe\n"))
+		case "/grande":
+			w.Write(make([]byte, rpaFuenteMax+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// sin permiso, el servidor local (loopback) no se alcanza
+	conRedes(t, "")
+	if _, _, err := leerOrigen(srv.URL + "/hoja.yaml"); err == nil || !strings.Contains(err.Error(), "no permitido") {
+		t.Fatalf("loopback sin RPA_JOBS_REDES_PERMITIDAS: err = %v", err)
+	}
+
+	conRedes(t, "127.0.0.1, ::1")
+	body, ctype, err := leerOrigen(srv.URL + "/hoja.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatoDesdeContentType(ctype) != rpaFmtYAML {
+		t.Errorf("Content-Type %q no se reconoce como YAML", ctype)
+	}
+	p, formato, err := parseRPA(body, "")
+	if err != nil || formato != rpaFmtYAML || len(p.Items) != 1 || p.Items[0].Name != "gripe" {
+		t.Errorf("parseRPA = %+v, %q, %v", p.Items, formato, err)
+	}
+
+	if _, _, err := leerOrigen(srv.URL + "/no-existe"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("404: err = %v", err)
+	}
+	if _, _, err := leerOrigen(srv.URL + "/grande"); err == nil || !strings.Contains(err.Error(), "excede") {
+		t.Errorf("origen demasiado grande: err = %v", err)
+	}
+}
+
+func TestLeerOrigenRedireccionInterna(t *testing.T) {
+	// el servidor permitido redirige a los metadatos de la nube: el destino se
+	// comprueba otra vez al conectar, antes de enviar nada
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	conRedes(t, "127.0.0.1")
+	if _, _, err := leerOrigen(srv.URL); err == nil || !strings.Contains(err.Error(), "no permitido") {
+		t.Fatalf("redirección a un destino vetado: err = %v", err)
+	}
+}
+
+func TestDestinoPermitido(t *testing.T) {
+	conRedes(t, "10.1.0.0/16")
+	casos := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"169.254.169.254":  false, // metadatos de la nube
+		"fe80::1":          false,
+		"192.168.1.10":     false,
+		"172.16.0.1":       false,
+		"10.2.0.1":         false,
+		"10.1.2.3":         true, // en RPA_JOBS_REDES_PERMITIDAS
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"224.0.0.1":        false,
+	}
+	for ip, quiere := range casos {
+		if got := destinoPermitido(netip.MustParseAddr(ip)); got != quiere {
+			t.Errorf("%s: %v, se esperaba %v", ip, got, quiere)
+		}
+	}
+	if _, err := parseRedes("10.0.0.0/8, nada"); err == nil {
+		t.Error("parseRedes aceptó una red inválida")
+	}
+}
+
+func TestRutaLocal(t *testing.T) {
+	raiz := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(raiz); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	prev := rpaJobsDir
+	t.Cleanup(func() { rpaJobsDir = prev })
+
+	fuera := t.TempDir()
+	for _, d := range []string{"storage", "datos/sub", filepath.Join(fuera, "otro")} {
+		os.MkdirAll(d, 0755)
+	}
+	os.WriteFile("storage/auth_secret", []byte("no-debe-salir"), 0600)
+	os.WriteFile("datos/sub/hoja.txt", []byte("nombre: gripe\n"), 0644)
+	os.WriteFile(filepath.Join(fuera, "otro", "x.txt"), []byte("x"), 0644)
+	os.Symlink(filepath.Join(fuera, "otro", "x.txt"), "datos/enlace_fuera.txt")
+	os.Symlink(filepath.Join(raiz, "storage", "auth_secret"), "datos/enlace_secreto")
+
+	rpaJobsDir = ""
+	if _, err := rutaLocal("datos/sub/hoja.txt"); err == nil {
+		t.Error("sin RPA_JOBS_DIR se aceptó un origen local")
+	}
+
+	rpaJobsDir = "datos"
+	if _, err := rutaLocal("sub/hoja.txt"); err != nil {
+		t.Errorf("origen válido rechazado: %v", err)
+	}
+	for _, origen := range []string{
+		"../storage/auth_secret",
+		"sub/../../storage/auth_secret",
+		filepath.Join(raiz, "storage", "auth_secret"),
+		"enlace_fuera.txt",
+		"enlace_secreto",
+		"no_existe.txt",
+	} {
+		if _, err := rutaLocal(origen); err == nil {
+			t.Errorf("%q: se esperaba error", origen)
+		}
+	}
+
+	// aunque RPA_JOBS_DIR incluya storage/, no se lee de ahí
+	rpaJobsDir = "."
+	if _, err := rutaLocal("storage/auth_secret"); err == nil || !strings.Contains(err.Error(), "storage") {
+		t.Errorf("storage/auth_secret: err = %v", err)
+	}
+	j := RPAJob{ID: "x", Cron: "@daily", Origen: "../storage/auth_secret"}
+	if err := j.validar(); err == nil {
+		t.Error("validar aceptó un origen con ..")
+	}
+}
+
+func TestEjecutarJobHistorial(t *testing.T) {
+	b := usarBases(t)
+	t.Setenv("SMTP_HOST", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hoja.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("nombre: gastritis\nsintomas: nausea:2, dolor_abdominal:3\ntrata: omeprazol\n"))
+	}))
+	defer srv.Close()
+	conRedes(t, "127.0.0.1")
+
+	version := b.version
+	prev, err := ejecutarJob(RPAJob{ID: "diario", Origen: srv.URL + "/hoja.txt", Modo: rpaModoDryRun}, "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.Estado != rpaModoDryRun || prev.Formato != rpaFmtTexto || prev.Diff == nil || len(prev.Diff.EnfermedadesNuevas) != 1 {
+		t.Errorf("dry run: %+v", prev)
+	}
+	if b.version != version {
+		t.Error("el dry run cambió la KB")
+	}
+
+	aplicado, err := ejecutarJob(RPAJob{ID: "diario", Origen: srv.URL + "/hoja.txt", Modo: rpaModoAplicar}, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aplicado.Estado != "aplicado" || aplicado.Enfermedades != 1 || !strings.Contains(aplicado.Informe, "gastritis") {
+		t.Errorf("aplicar: %+v", aplicado)
+	}
+	if indiceEnfermedad(&b.kb, "gastritis") < 0 || b.version == version {
+		t.Error("el trabajo no aplicó la enfermedad a la KB")
+	}
+
+	fallido, err := ejecutarJob(RPAJob{ID: "diario", Origen: srv.URL + "/no-existe", Modo: rpaModoAplicar}, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallido.Estado != "fallido" || !strings.Contains(fallido.Error, "404") {
+		t.Errorf("origen inexistente: %+v", fallido)
+	}
+	if _, err := ejecutarJob(RPAJob{ID: "otro", KB: "pediatria", Origen: srv.URL + "/hoja.txt", Modo: rpaModoAplicar}, "manual"); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := leerRPARuns(kbGeneral, "diario", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("historial: %d ejecuciones, se esperaban 3", len(runs))
+	}
+	for i, quiere := range []RPARun{fallido, aplicado, prev} {
+		if runs[i].ID != quiere.ID || runs[i].Estado != quiere.Estado || runs[i].Disparo != quiere.Disparo {
+			t.Errorf("ejecución %d: %s %s %s, se esperaba %s %s %s", i, runs[i].ID, runs[i].Estado, runs[i].Disparo, quiere.ID, quiere.Estado, quiere.Disparo)
+		}
+	}
+	if runs, _ := leerRPARuns("pediatria", "", 0); len(runs) != 1 || runs[0].Estado != "fallido" {
+		t.Errorf("historial de pediatria: %+v", runs)
+	}
+
+	// un trabajo en curso no se lanza otra vez
+	jobsMu.Lock()
+	jobsEnCurso["diario"] = true
+	jobsMu.Unlock()
+	_, err = ejecutarJob(RPAJob{ID: "diario", Origen: srv.URL + "/hoja.txt", Modo: rpaModoDryRun}, "cron")
+	jobsMu.Lock()
+	delete(jobsEnCurso, "diario")
+	jobsMu.Unlock()
+	if err == nil {
+		t.Error("se lanzó un trabajo que ya estaba en ejecución")
+	}
+	if runs, _ := leerRPARuns(kbGeneral, "diario", 0); len(runs) != 3 {
+		t.Errorf("el intento rechazado quedó en el historial: %d ejecuciones", len(runs))
+	}
+}
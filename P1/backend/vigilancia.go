@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Vigilancia epidemiológica ========
+//
+// Cada /analyze suma 1 al contador (hora, enfermedad, sistema, urgencia) de su
+// primer resultado. Sólo se guardan conteos: ni síntomas, ni IDs, ni datos del
+// paciente. Los días y semanas se obtienen agregando horas. Se conservan
+// vigilanciaRetencion de datos en storage/vigilancia.json.
+//
+// Los conteos viven en memoria y se vuelcan cada vigilanciaVolcado (archivo
+// temporal y rename), no en cada consulta: /analyze no espera al disco y una
+// caída sólo pierde el último intervalo. Si el archivo no se puede leer al
+// arrancar se aparta como .corrupto-<fecha> en lugar de sobrescribirlo.
+
+const (
+	vigilanciaRetencion = 400 * 24 * time.Hour
+	vigilanciaVolcado   = time.Minute
+)
+
+var vigilanciaPath = filepath.Join("storage", "vigilancia.json")
+
+// vigClave es una celda de conteo; se serializa como "enf|sistema|urgencia"
+// y, si la consulta no fue contra la KB general, "enf|sistema|urgencia|kb".
+type vigClave struct {
+	Enfermedad, Sistema, Urgencia string
+	KB                            string // vacío: la general
+}
+
+func (c vigClave) String() string {
+	s := c.Enfermedad + "|" + c.Sistema + "|" + c.Urgencia
+	if c.KB != "" && c.KB != kbGeneral {
+		s += "|" + c.KB
+	}
+	return s
+}
+
+func parseVigClave(s string) vigClave {
+	p := strings.SplitN(s, "|", 4)
+	for len(p) < 4 {
+		p = append(p, "")
+	}
+	return vigClave{p[0], p[1], p[2], p[3]}
+}
+
+var (
+	vigMu sync.Mutex
+	// hora UTC (formato vigHora) -> celda -> n
+	vigConteos = map[string]map[string]int{}
+	vigSucio   bool // hay conteos sin volcar
+)
+
+const vigHora = "2006-01-02T15"
+
+func initVigilancia() {
+	b, err := os.ReadFile(vigilanciaPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Fatalf("vigilancia: %v", err)
+	default:
+		if err := json.Unmarshal(b, &vigConteos); err != nil {
+			aparte := vigilanciaPath + ".corrupto-" + time.Now().UTC().Format("20060102T150405")
+			if rerr := os.Rename(vigilanciaPath, aparte); rerr != nil {
+				log.Fatalf("vigilancia: %s ilegible (%v) y no se pudo apartar: %v", vigilanciaPath, err, rerr)
+			}
+			logp("vigilancia: %s ilegible (%v); apartado como %s, se empieza de cero", vigilanciaPath, err, aparte)
+			vigConteos = map[string]map[string]int{}
+		}
+	}
+	go func() {
+		for range time.Tick(vigilanciaVolcado) {
+			if err := volcarVigilancia(time.Now()); err != nil {
+				logp("vigilancia: no se pudo guardar: %v", err)
+			}
+		}
+	}()
+}
+
+// volcarVigilancia poda lo que sale de la retención y escribe los conteos si
+// cambiaron desde el último volcado.
+func volcarVigilancia(ahora time.Time) error {
+	vigMu.Lock()
+	if !vigSucio {
+		vigMu.Unlock()
+		return nil
+	}
+	limite := ahora.Add(-vigilanciaRetencion).UTC().Format(vigHora)
+	for k := range vigConteos {
+		if k < limite {
+			delete(vigConteos, k)
+		}
+	}
+	b, _ := json.Marshal(vigConteos)
+	vigSucio = false
+	vigMu.Unlock()
+
+	tmp := vigilanciaPath + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, vigilanciaPath)
+	}
+	if err != nil {
+		vigMu.Lock()
+		vigSucio = true // se reintenta en el próximo volcado
+		vigMu.Unlock()
+	}
+	return err
+}
+
+// registrarVigilancia suma el resultado principal de una consulta contra la
+// KB kbNombre; sistema es el de su primera enfermedad.
+func registrarVigilancia(t time.Time, kbNombre string, res []resultado, sistema string) {
+	c := vigClave{Enfermedad: sinResultado, Sistema: "-", Urgencia: "-", KB: kbNombre}
+	if len(res) > 0 {
+		c = vigClave{Enfermedad: res[0].Enf, Sistema: sistema, Urgencia: res[0].Urg, KB: kbNombre}
+	}
+	h := t.UTC().Format(vigHora)
+
+	vigMu.Lock()
+	defer vigMu.Unlock()
+	if vigConteos[h] == nil {
+		vigConteos[h] = map[string]int{}
+	}
+	vigConteos[h][c.String()]++
+	vigSucio = true
+}
+
+// sistemaDe busca el sistema de una enfermedad en la KB. Si el .pl se subió a
+// mano puede no estar en la KB en JSON.
+func sistemaDe(k Knowledge, enf string) string {
+	for _, d := range k.Diseases {
+		if atomize(d.Name) == enf {
+			return atomize(d.Sistema)
+		}
+	}
+	return "desconocido"
+}
+
+//
+// ======== Agregación y anomalías ========
+//
+
+type VigConteo struct {
+	Periodo    string `json:"periodo"`
+	Enfermedad string `json:"enfermedad"`
+	Sistema    string `json:"sistema"`
+	Urgencia   string `json:"urgencia"`
+	N          int    `json:"n"`
+}
+
+type VigSerie struct {
+	Periodo    string  `json:"periodo"`
+	Enfermedad string  `json:"enfermedad"`
+	N          int     `json:"n"`
+	Total      int     `json:"total"` // consultas del periodo
+	Cuota      float64 `json:"cuota"` // N/Total
+	Base       float64 `json:"base"`  // media de la cuota en la ventana anterior
+	Desv       float64 `json:"desv"`
+	Anomalia   bool    `json:"anomalia"`
+}
+
+type VigReport struct {
+	Bucket       string      `json:"bucket"`
+	Ventana      int         `json:"ventana"`
+	Umbral       float64     `json:"umbral"`
+	MinCasos     int         `json:"minCasos"`
+	Conteos      []VigConteo `json:"conteos"`
+	Enfermedades []VigSerie  `json:"enfermedades"`
+}
+
+type vigOpciones struct {
+	KB           string // sólo las consultas contra esta KB
+	Bucket       string // hour | day | week
+	Desde, Hasta time.Time
+	Ventana      int     // periodos previos para la línea base
+	Umbral       float64 // nº de desviaciones sobre la base
+	MinCasos     int     // mínimo de casos de la enfermedad para marcar anomalía
+}
+
+// inicioBucket trunca t (UTC) al inicio de su periodo.
+func inicioBucket(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "week":
+		d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		wd := (int(d.Weekday()) + 6) % 7 // lunes = 0
+		return d.AddDate(0, 0, -wd)
+	default:
+		return t.Truncate(time.Hour)
+	}
+}
+
+func siguienteBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.Add(time.Hour)
+	}
+}
+
+func etiquetaBucket(t time.Time, bucket string) string {
+	switch bucket {
+	case "day":
+		return t.Format("2006-01-02")
+	case "week":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	default:
+		return t.Format("2006-01-02T15:00Z")
+	}
+}
+
+func agregarVigilancia(horas map[string]map[string]int, o vigOpciones) VigReport {
+	rep := VigReport{Bucket: o.Bucket, Ventana: o.Ventana, Umbral: o.Umbral, MinCasos: o.MinCasos}
+
+	// periodo -> celda -> n
+	porPeriodo := map[time.Time]map[vigClave]int{}
+	var primero, ultimo time.Time
+	for h, celdas := range horas {
+		t, err := time.Parse(vigHora, h)
+		if err != nil {
+			continue
+		}
+		if !o.Desde.IsZero() && t.Before(o.Desde) {
+			continue
+		}
+		if !o.Hasta.IsZero() && !t.Before(o.Hasta) {
+			continue
+		}
+		p := inicioBucket(t, o.Bucket)
+		if porPeriodo[p] == nil {
+			porPeriodo[p] = map[vigClave]int{}
+		}
+		for k, n := range celdas {
+			c := parseVigClave(k)
+			if !mismaKB(c.KB, o.KB) {
+				continue
+			}
+			porPeriodo[p][c] += n
+		}
+		if primero.IsZero() || p.Before(primero) {
+			primero = p
+		}
+		if p.After(ultimo) {
+			ultimo = p
+		}
+	}
+	if primero.IsZero() {
+		return rep
+	}
+
+	// enfermedades presentes en el rango, para que las series tengan ceros
+	enfSet := map[string]bool{}
+	for _, celdas := range porPeriodo {
+		for c := range celdas {
+			enfSet[c.Enfermedad] = true
+		}
+	}
+	var enfs []string
+	for e := range enfSet {
+		enfs = append(enfs, e)
+	}
+	sort.Strings(enfs)
+
+	historia := map[string][]float64{} // cuotas previas por enfermedad
+	for p := primero; !p.After(ultimo); p = siguienteBucket(p, o.Bucket) {
+		etq := etiquetaBucket(p, o.Bucket)
+		celdas := porPeriodo[p]
+
+		var claves []vigClave
+		total := 0
+		porEnf := map[string]int{}
+		for c, n := range celdas {
+			claves = append(claves, c)
+			total += n
+			porEnf[c.Enfermedad] += n
+		}
+		sort.Slice(claves, func(i, j int) bool { return claves[i].String() < claves[j].String() })
+		for _, c := range claves {
+			rep.Conteos = append(rep.Conteos, VigConteo{Periodo: etq, Enfermedad: c.Enfermedad, Sistema: c.Sistema, Urgencia: c.Urgencia, N: celdas[c]})
+		}
+
+		for _, e := range enfs {
+			s := VigSerie{Periodo: etq, Enfermedad: e, N: porEnf[e], Total: total, Cuota: ratio(porEnf[e], total)}
+			prev := historia[e]
+			if len(prev) > o.Ventana {
+				prev = prev[len(prev)-o.Ventana:]
+			}
+			s.Base, s.Desv = mediaDesv(prev)
+			// se exige un mínimo de historia para no marcar el arranque como brote
+			s.Anomalia = len(prev) >= 3 && s.N >= o.MinCasos && s.Cuota > s.Base+o.Umbral*s.Desv && s.Cuota > s.Base
+			if total > 0 {
+				historia[e] = append(historia[e], s.Cuota)
+			}
+			if s.N > 0 || s.Anomalia {
+				rep.Enfermedades = append(rep.Enfermedades, s)
+			}
+		}
+	}
+	return rep
+}
+
+func mediaDesv(xs []float64) (float64, float64) {
+	if len(xs) == 0 {
+		return 0, 0
+	}
+	var m float64
+	for _, x := range xs {
+		m += x
+	}
+	m /= float64(len(xs))
+	var v float64
+	for _, x := range xs {
+		v += (x - m) * (x - m)
+	}
+	return m, math.Sqrt(v / float64(len(xs)))
+}
+
+//
+// ======== Endpoint /admin/vigilancia ========
+//
+// GET /admin/vigilancia?bucket=hour|day|week&desde=&hasta=&ventana=7&umbral=2&min=5&formato=json|csv
+
+func handleVigilancia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	o := vigOpciones{KB: nombreKB(r), Bucket: q.Get("bucket"), Ventana: 7, Umbral: 2, MinCasos: 5}
+	switch o.Bucket {
+	case "":
+		o.Bucket = "day"
+	case "hour", "day", "week":
+	default:
+		http.Error(w, "bucket debe ser hour, day o week", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if o.Desde, err = parseFecha(q.Get("desde")); err != nil {
+		http.Error(w, "desde: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if o.Hasta, err = parseHasta(q.Get("hasta")); err != nil {
+		http.Error(w, "hasta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v, err := strconv.Atoi(q.Get("ventana")); err == nil && v > 0 {
+		o.Ventana = v
+	}
+	if v, err := strconv.ParseFloat(q.Get("umbral"), 64); err == nil && v >= 0 {
+		o.Umbral = v
+	}
+	if v, err := strconv.Atoi(q.Get("min")); err == nil && v >= 0 {
+		o.MinCasos = v
+	}
+
+	vigMu.Lock()
+	rep := agregarVigilancia(vigConteos, o)
+	vigMu.Unlock()
+
+	formato := q.Get("formato")
+	if formato == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		formato = "csv"
+	}
+	if formato == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="vigilancia_`+o.Bucket+`.csv"`)
+		writeVigilanciaCSV(w, rep)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// writeVigilanciaCSV escribe una tabla plana: cada conteo lleva los datos de
+// la serie de su enfermedad en ese periodo.
+func writeVigilanciaCSV(w http.ResponseWriter, rep VigReport) {
+	series := map[string]VigSerie{}
+	for _, s := range rep.Enfermedades {
+		series[s.Periodo+"|"+s.Enfermedad] = s
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"periodo", "enfermedad", "sistema", "urgencia", "n", "total_periodo", "cuota_enfermedad", "base_enfermedad", "anomalia"})
+	for _, c := range rep.Conteos {
+		s := series[c.Periodo+"|"+c.Enfermedad]
+		_ = cw.Write([]string{
+			c.Periodo, c.Enfermedad, c.Sistema, c.Urgencia,
+			strconv.Itoa(c.N), strconv.Itoa(s.Total),
+			strconv.FormatFloat(s.Cuota, 'f', 4, 64),
+			strconv.FormatFloat(s.Base, 'f', 4, 64),
+			strconv.FormatBool(s.Anomalia),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======== Webhooks de cambios en la KB ========
+//
+// Cada cambio de la KB (POST /admin/kb, /admin/upload-pl, RPA por endpoint,
+// bandeja o trabajo programado) envía un POST JSON a los webhooks activos:
+//
+//   {"evento":"kb.cambio","id":...,"kb":"general","fecha":...,"version":...,"versionAnterior":...,
+//    "origen":"kb|upload_pl|rpa|rpa_bandeja|rpa_job","autor":...,"resumen":{...},"diff":{...}}
+//
+// Cada webhook pertenece a la KB desde la que se creó (ver bases.go) y sólo
+// recibe los cambios de esa KB.
+//
+// Cabeceras: X-MediLogic-Evento, X-MediLogic-Entrega (id),
+// X-MediLogic-Timestamp (segundos Unix del intento) y
+// X-MediLogic-Firma: sha256=<HMAC-SHA256 de "<timestamp>.<cuerpo>" con el
+// secreto del webhook>; con el timestamp firmado el receptor puede rechazar
+// reenvíos de una entrega vieja. Todo webhook tiene secreto: si no se envía al
+// crearlo se genera uno y se devuelve sólo en esa respuesta. Una respuesta 2xx
+// es entrega correcta; lo demás se reintenta con espera exponencial hasta
+// webhookMaxIntentos. Los webhooks se guardan en storage/webhooks.json y las
+// últimas webhookMaxEntregas entregas en storage/webhook_entregas.json.
+//
+// Como los trabajos RPA (ver rpa_jobs.go), un webhook no puede apuntar a
+// loopback, enlace local ni redes privadas salvo las de
+// RPA_JOBS_REDES_PERMITIDAS: se comprueba al registrarlo y otra vez con la IP
+// resuelta en cada conexión. Las redirecciones no se siguen.
+
+var (
+	webhooksPath = filepath.Join("storage", "webhooks.json")
+	entregasPath = filepath.Join("storage", "webhook_entregas.json")
+)
+
+const (
+	webhookMaxIntentos  = 6
+	webhookMaxEntregas  = 500
+	webhookEsperaBase   = 10 * time.Second
+	webhookEsperaMax    = 30 * time.Minute
+	webhookTimeout      = 10 * time.Second
+	webhookMaxRespuesta = 2 << 10
+
+	eventoKBCambio = "kb.cambio"
+)
+
+// clienteWebhook conecta sólo a destinos permitidos (ver controlDestino); una
+// redirección cuenta como respuesta no 2xx.
+var clienteWebhook = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: webhookTimeout, Control: controlDestino}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+type Webhook struct {
+	ID      string `json:"id"`
+	KB      string `json:"kb,omitempty"` // vacío: la general
+	URL     string `json:"url"`
+	Secreto string `json:"secreto,omitempty"`
+	Activo  bool   `json:"activo"`
+}
+
+// KBCambio es el cuerpo del evento kb.cambio.
+type KBCambio struct {
+	Evento          string         `json:"evento"`
+	ID              string         `json:"id"`
+	KB              string         `json:"kb"`
+	Fecha           time.Time      `json:"fecha"`
+	Version         string         `json:"version"`
+	VersionAnterior string         `json:"versionAnterior"`
+	Origen          string         `json:"origen"`
+	Autor           string         `json:"autor"`
+	Resumen         map[string]int `json:"resumen,omitempty"`
+	Diff            *KBDiff        `json:"diff,omitempty"` // nulo si se subió un .pl directamente
+}
+
+type WebhookIntento struct {
+	Fecha    time.Time `json:"fecha"`
+	Codigo   int       `json:"codigo,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duracion int64     `json:"duracionMs"`
+}
+
+type WebhookEntrega struct {
+	ID             string           `json:"id"`
+	Webhook        string           `json:"webhook"`
+	KB             string           `json:"kb,omitempty"`
+	URL            string           `json:"url"`
+	Evento         string           `json:"evento"`
+	Creado         time.Time        `json:"creado"`
+	Payload        json.RawMessage  `json:"payload"`
+	Estado         string           `json:"estado"` // pendiente | entregado | muerto
+	Intentos       []WebhookIntento `json:"intentos"`
+	ProximoIntento *time.Time       `json:"proximoIntento,omitempty"`
+	Respuesta      string           `json:"respuesta,omitempty"` // cuerpo de la última respuesta (truncado)
+}
+
+var (
+	whMu        sync.Mutex
+	webhooks    = map[string]Webhook{}
+	entregas    = map[string]*WebhookEntrega{}
+	whDespertar = make(chan struct{}, 1)
+)
+
+func initWebhooks() {
+	if b, err := os.ReadFile(webhooksPath); err == nil {
+		var ws []Webhook
+		if err := json.Unmarshal(b, &ws); err != nil {
+			logp("webhooks.json inválido: %v", err)
+		}
+		for _, w := range ws {
+			if w.Secreto == "" && w.Activo {
+				// de antes de exigir secreto: no se firma con clave vacía
+				logp("webhook %s sin secreto: desactivado hasta que se le asigne uno", w.ID)
+				w.Activo = false
+			}
+			webhooks[w.ID] = w
+		}
+	}
+	if b, err := os.ReadFile(entregasPath); err == nil {
+		var es []*WebhookEntrega
+		if err := json.Unmarshal(b, &es); err != nil {
+			logp("webhook_entregas.json inválido: %v", err)
+		}
+		for _, e := range es {
+			entregas[e.ID] = e
+		}
+	}
+	go func() {
+		t := time.NewTicker(5 * time.Second)
+		for {
+			procesarEntregas(time.Now())
+			select {
+			case <-t.C:
+			case <-whDespertar:
+			}
+		}
+	}()
+}
+
+// guardarWebhooks y guardarEntregas deben llamarse con whMu tomado.
+func guardarWebhooks() error {
+	ws := make([]Webhook, 0, len(webhooks))
+	for _, id := range sortedKeys(webhooks) {
+		ws = append(ws, webhooks[id])
+	}
+	b, _ := json.MarshalIndent(ws, "", "  ")
+	tmp := webhooksPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, webhooksPath)
+}
+
+func guardarEntregas() error {
+	es := entregasOrdenadas()
+	// se conservan las más recientes, pero nunca se descarta una pendiente
+	if len(es) > webhookMaxEntregas {
+		var keep []*WebhookEntrega
+		for i, e := range es {
+			if i < webhookMaxEntregas || e.Estado == outboxPendiente {
+				keep = append(keep, e)
+			} else {
+				delete(entregas, e.ID)
+			}
+		}
+		es = keep
+	}
+	b, _ := json.Marshal(es)
+	tmp := entregasPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, entregasPath)
+}
+
+// entregasOrdenadas devuelve las entregas, la más reciente primero.
+func entregasOrdenadas() []*WebhookEntrega {
+	es := make([]*WebhookEntrega, 0, len(entregas))
+	for _, e := range entregas {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Creado.After(es[j].Creado) })
+	return es
+}
+
+// notificarCambioKB encola el evento para cada webhook activo de la KB. No
+// hace nada si la versión compilada no cambió (p. ej. una reimportación
+// idéntica).
+func notificarCambioKB(kbNombre, origen, autor, anterior, version string, diff *KBDiff) {
+	if version == anterior {
+		return
+	}
+	ev := KBCambio{
+		Evento:          eventoKBCambio,
+		ID:              nuevoID(),
+		KB:              kbNombre,
+		Fecha:           time.Now().UTC(),
+		Version:         version,
+		VersionAnterior: anterior,
+		Origen:          origen,
+		Autor:           autor,
+	}
+	if diff != nil {
+		d := *diff
+		d.EnfermedadesSinCambios = nil
+		ev.Diff = &d
+		ev.Resumen = resumenDiff(d)
+	}
+	payload, _ := json.Marshal(ev)
+
+	whMu.Lock()
+	defer whMu.Unlock()
+	n := 0
+	for _, id := range sortedKeys(webhooks) {
+		w := webhooks[id]
+		if !w.Activo || !mismaKB(w.KB, kbNombre) {
+			continue
+		}
+		e := &WebhookEntrega{
+			ID:             nuevoID(),
+			Webhook:        w.ID,
+			KB:             kbNombre,
+			URL:            w.URL,
+			Evento:         ev.Evento,
+			Creado:         ev.Fecha,
+			Payload:        payload,
+			Estado:         outboxPendiente,
+			Intentos:       []WebhookIntento{},
+			ProximoIntento: &ev.Fecha,
+		}
+		entregas[e.ID] = e
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	if err := guardarEntregas(); err != nil {
+		logp("webhooks: no se pudieron guardar las entregas: %v", err)
+	}
+	select {
+	case whDespertar <- struct{}{}:
+	default:
+	}
+}
+
+func resumenDiff(d KBDiff) map[string]int {
+	m := map[string]int{
+		"enfermedadesNuevas":           len(d.EnfermedadesNuevas),
+		"enfermedadesModificadas":      len(d.EnfermedadesModificadas),
+		"enfermedadesEliminadas":       len(d.EnfermedadesEliminadas),
+		"sintomasNuevos":               len(d.SintomasNuevos),
+		"sintomasEliminados":           len(d.SintomasEliminados),
+		"medicamentosNuevos":           len(d.MedicamentosNuevos),
+		"medicamentosEliminados":       len(d.MedicamentosEliminados),
+		"tratamientosNuevos":           len(d.TratamientosNuevos),
+		"tratamientosEliminados":       len(d.TratamientosEliminados),
+		"contraindicacionesNuevas":     len(d.AlergiasNuevas) + len(d.CronicosNuevos),
+		"contraindicacionesEliminadas": len(d.AlergiasEliminadas) + len(d.CronicosEliminados),
+		"codigos":                      len(d.Codigos),
+	}
+	for k, v := range m {
+		if v == 0 {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+func nuevoSecretoWebhook() string {
+	return hex.EncodeToString(aleatorio(32))
+}
+
+// firmaWebhook firma "<ts>.<cuerpo>".
+func firmaWebhook(secreto string, ts int64, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secreto))
+	m.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// hostPermitido comprueba al registrar un webhook que su host (IP o nombre,
+// con todas sus direcciones) no lleve a una red vetada. La conexión vuelve a
+// comprobarlo, porque el DNS puede cambiar después.
+func hostPermitido(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("no se pudo resolver %s", host)
+	}
+	for _, a := range ips {
+		if !destinoPermitido(a) {
+			return fmt.Errorf("destino %s no permitido (red local o privada; ver RPA_JOBS_REDES_PERMITIDAS)", a.Unmap())
+		}
+	}
+	return nil
+}
+
+// procesarEntregas intenta las entregas vencidas; el POST se hace sin whMu.
+func procesarEntregas(now time.Time) {
+	whMu.Lock()
+	var due []WebhookEntrega
+	for _, e := range entregas {
+		if e.Estado == outboxPendiente && (e.ProximoIntento == nil || !now.Before(*e.ProximoIntento)) {
+			due = append(due, *e)
+		}
+	}
+	whMu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Creado.Before(due[j].Creado) })
+
+	for _, e := range due {
+		whMu.Lock()
+		wh, ok := webhooks[e.Webhook]
+		if !ok || wh.Secreto == "" {
+			// el webhook se borró (o no tiene secreto): la entrega se descarta
+			if cur, ok := entregas[e.ID]; ok && cur.Estado == outboxPendiente {
+				cancelarEntrega(cur, "webhook eliminado o sin secreto")
+				if err := guardarEntregas(); err != nil {
+					logp("webhooks: no se pudieron guardar las entregas: %v", err)
+				}
+			}
+			whMu.Unlock()
+			continue
+		}
+		whMu.Unlock()
+
+		it := WebhookIntento{Fecha: time.Now().UTC()}
+		var respuesta string
+		req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(e.Payload))
+		if err == nil {
+			ts := it.Fecha.Unix()
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "MediLogic-Webhook/1")
+			req.Header.Set("X-MediLogic-Evento", e.Evento)
+			req.Header.Set("X-MediLogic-Entrega", e.ID)
+			req.Header.Set("X-MediLogic-Timestamp", strconv.FormatInt(ts, 10))
+			req.Header.Set("X-MediLogic-Firma", firmaWebhook(wh.Secreto, ts, e.Payload))
+			var resp *http.Response
+			if resp, err = clienteWebhook.Do(req); err == nil {
+				b, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxRespuesta))
+				resp.Body.Close()
+				it.Codigo, respuesta = resp.StatusCode, string(b)
+				if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("respuesta %s", resp.Status)
+				}
+			}
+		}
+		it.Duracion = time.Since(it.Fecha).Milliseconds()
+		if err != nil {
+			it.Error = err.Error()
+		}
+
+		whMu.Lock()
+		cur, ok := entregas[e.ID]
+		if ok && cur.Estado == outboxPendiente {
+			cur.Intentos = append(cur.Intentos, it)
+			cur.Respuesta = respuesta
+			switch {
+			case err == nil:
+				cur.Estado, cur.ProximoIntento = outboxEntregado, nil
+			case len(cur.Intentos) >= webhookMaxIntentos:
+				cur.Estado, cur.ProximoIntento = outboxMuerto, nil
+				logp("webhook %s: entrega %s abandonada tras %d intentos: %v", cur.Webhook, cur.ID, len(cur.Intentos), err)
+			default:
+				t := time.Now().UTC().Add(esperaExponencial(webhookEsperaBase, webhookEsperaMax, len(cur.Intentos)))
+				cur.ProximoIntento = &t
+			}
+			if err := guardarEntregas(); err != nil {
+				logp("webhooks: no se pudieron guardar las entregas: %v", err)
+			}
+		}
+		whMu.Unlock()
+	}
+}
+
+// cancelarEntrega da por muerta una entrega pendiente sin intentarla. Debe
+// llamarse con whMu tomado.
+func cancelarEntrega(e *WebhookEntrega, motivo string) {
+	e.Estado, e.ProximoIntento = outboxMuerto, nil
+	e.Intentos = append(e.Intentos, WebhookIntento{Fecha: time.Now().UTC(), Error: motivo})
+}
+
+//
+// ======== Endpoints /admin/webhooks ========
+//
+// GET    /admin/webhooks                lista (el secreto no se devuelve)
+// POST   /admin/webhooks                crea o reemplaza por id; devuelve el
+//                                       webhook, con el secreto sólo si se generó
+// DELETE /admin/webhooks?id=...
+// GET    /admin/webhooks/entregas?webhook=&estado=&limite=50
+//
+// Sólo se ven y se tocan los webhooks de la KB de la petición; los ids son
+// únicos entre todas las KB.
+
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	kbNombre := nombreKB(r)
+	switch r.Method {
+	case http.MethodGet:
+		whMu.Lock()
+		out := []Webhook{}
+		for _, id := range sortedKeys(webhooks) {
+			wh := webhooks[id]
+			if !mismaKB(wh.KB, kbNombre) {
+				continue
+			}
+			if wh.Secreto != "" {
+				wh.Secreto = "***"
+			}
+			out = append(out, wh)
+		}
+		whMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var in Webhook
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		in.ID = strings.TrimSpace(in.ID)
+		if in.ID == "" {
+			http.Error(w, "id requerido", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(in.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			http.Error(w, "url debe ser http(s) absoluta", http.StatusBadRequest)
+			return
+		}
+		if err := hostPermitido(r.Context(), u.Hostname()); err != nil {
+			http.Error(w, "url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		in.KB = kbNombre
+		whMu.Lock()
+		prev, existia := webhooks[in.ID]
+		if existia && !mismaKB(prev.KB, kbNombre) {
+			whMu.Unlock()
+			http.Error(w, "ya existe un webhook con ese id en otra KB", http.StatusConflict)
+			return
+		}
+		if existia && in.Secreto == "" {
+			in.Secreto = prev.Secreto // se conserva si no se envía
+		}
+		generado := in.Secreto == ""
+		if generado {
+			in.Secreto = nuevoSecretoWebhook()
+		}
+		webhooks[in.ID] = in
+		err = guardarWebhooks()
+		whMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !generado {
+			in.Secreto = "***"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !existia {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(in)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		whMu.Lock()
+		wh, ok := webhooks[id]
+		ok = ok && mismaKB(wh.KB, kbNombre)
+		var err error
+		if ok {
+			delete(webhooks, id)
+			err = guardarWebhooks()
+			n := 0
+			for _, e := range entregas {
+				if e.Webhook == id && e.Estado == outboxPendiente {
+					cancelarEntrega(e, "webhook eliminado")
+					n++
+				}
+			}
+			if n > 0 {
+				if err := guardarEntregas(); err != nil {
+					logp("webhooks: no se pudieron guardar las entregas: %v", err)
+				}
+			}
+		}
+		whMu.Unlock()
+		if !ok {
+			http.Error(w, "webhook no encontrado", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleWebhookEntregas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limite := 50
+	if v := q.Get("limite"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "limite inválido", http.StatusBadRequest)
+			return
+		}
+		limite = n
+	}
+	whMu.Lock()
+	out := []WebhookEntrega{}
+	kbNombre := nombreKB(r)
+	for _, e := range entregasOrdenadas() {
+		if !mismaKB(e.KB, kbNombre) {
+			continue
+		}
+		if (q.Get("webhook") != "" && e.Webhook != q.Get("webhook")) || (q.Get("estado") != "" && e.Estado != q.Get("estado")) {
+			continue
+		}
+		out = append(out, *e)
+		if limite > 0 && len(out) >= limite {
+			break
+		}
+	}
+	whMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"total": len(out), "entregas": out})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// usarWebhooks aísla los webhooks y las entregas del test en un directorio temporal.
+func usarWebhooks(t *testing.T) {
+	t.Helper()
+	prevW, prevE, prevWP, prevEP := webhooks, entregas, webhooksPath, entregasPath
+	dir := t.TempDir()
+	webhooks, entregas = map[string]Webhook{}, map[string]*WebhookEntrega{}
+	webhooksPath, entregasPath = filepath.Join(dir, "webhooks.json"), filepath.Join(dir, "webhook_entregas.json")
+	t.Cleanup(func() { webhooks, entregas, webhooksPath, entregasPath = prevW, prevE, prevWP, prevEP })
+}
+
+func registrarWebhook(url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleWebhooks(w, httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(`{"id":"wh","url":"`+url+`","activo":true}`)))
+	return w
+}
+
+// entregar encola un cambio y procesa las entregas; devuelve la única entrega.
+func entregar(t *testing.T) *WebhookEntrega {
+	t.Helper()
+	entregas = map[string]*WebhookEntrega{}
+	notificarCambioKB(kbGeneral, "kb", "admin", "v1", "v2", nil)
+	procesarEntregas(time.Now().Add(time.Second))
+	if len(entregas) != 1 {
+		t.Fatalf("%d entregas, se esperaba 1", len(entregas))
+	}
+	for _, e := range entregas {
+		return e
+	}
+	return nil
+}
+
+func TestWebhookDestinoVetado(t *testing.T) {
+	usarWebhooks(t)
+	var recibidas atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recibidas.Add(1)
+		if r.URL.Path == "/redirige" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("X-MediLogic-Firma"), "sha256=") {
+			http.Error(w, "sin firma", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	// sin permiso no se registran destinos internos
+	conRedes(t, "")
+	for _, u := range []string{srv.URL, "http://localhost:9/", "http://169.254.169.254/latest/meta-data/", "http://[::1]/", "http://10.0.0.1/"} {
+		if w := registrarWebhook(u); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no permitido") {
+			t.Errorf("%s: %d %s", u, w.Code, w.Body)
+		}
+	}
+	if len(webhooks) != 0 {
+		t.Fatalf("se guardaron webhooks vetados: %v", webhooks)
+	}
+
+	// uno guardado antes (o cuyo DNS cambió) tampoco conecta
+	webhooks["wh"] = Webhook{ID: "wh", URL: srv.URL, Secreto: "s", Activo: true}
+	if e := entregar(t); e.Estado != outboxPendiente || !strings.Contains(e.Intentos[0].Error, "no permitido") {
+		t.Errorf("entrega a loopback: %+v", e)
+	}
+	if n := recibidas.Load(); n != 0 {
+		t.Fatalf("el servidor recibió %d peticiones", n)
+	}
+
+	conRedes(t, "127.0.0.1")
+	webhooks = map[string]Webhook{}
+	if w := registrarWebhook(srv.URL); w.Code != http.StatusCreated {
+		t.Fatalf("registro con RPA_JOBS_REDES_PERMITIDAS: %d %s", w.Code, w.Body)
+	}
+	if e := entregar(t); e.Estado != outboxEntregado || e.Intentos[0].Codigo != http.StatusOK {
+		t.Errorf("entrega permitida: %+v", e)
+	}
+
+	// la redirección no se sigue: cuenta como fallo
+	if w := registrarWebhook(srv.URL + "/redirige"); w.Code != http.StatusOK {
+		t.Fatalf("actualizar: %d %s", w.Code, w.Body)
+	}
+	if e := entregar(t); e.Estado != outboxPendiente || e.Intentos[0].Codigo != http.StatusFound {
+		t.Errorf("entrega con redirección: %+v", e)
+	}
+}